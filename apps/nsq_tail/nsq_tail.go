@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -22,6 +23,9 @@ var (
 	maxInFlight   = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
 	totalMessages = flag.Int("n", 0, "total messages to show (will wait if starved)")
 	printTopic    = flag.Bool("print-topic", false, "print topic name where message was received")
+	printID       = flag.Bool("print-id", false, "print message ID")
+	printTime     = flag.Bool("print-timestamp", false, "print message timestamp (RFC3339)")
+	printAttempts = flag.Bool("print-attempts", false, "print message attempts")
 
 	nsqdTCPAddrs     = app.StringArray{}
 	lookupdHTTPAddrs = app.StringArray{}
@@ -43,12 +47,21 @@ type TailHandler struct {
 func (th *TailHandler) HandleMessage(m *nsq.Message) error {
 	th.messagesShown++
 
+	var fields []string
 	if *printTopic {
-		_, err := os.Stdout.WriteString(th.topicName)
-		if err != nil {
-			log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
-		}
-		_, err = os.Stdout.WriteString(" | ")
+		fields = append(fields, th.topicName)
+	}
+	if *printID {
+		fields = append(fields, string(m.ID[:]))
+	}
+	if *printTime {
+		fields = append(fields, time.Unix(0, m.Timestamp).Format(time.RFC3339Nano))
+	}
+	if *printAttempts {
+		fields = append(fields, strconv.Itoa(int(m.Attempts)))
+	}
+	for _, field := range fields {
+		_, err := os.Stdout.WriteString(field + " | ")
 		if err != nil {
 			log.Fatalf("ERROR: failed to write to os.Stdout - %s", err)
 		}
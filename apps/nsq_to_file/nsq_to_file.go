@@ -46,7 +46,7 @@ func flagSet() *flag.FlagSet {
 	fs.Int("gzip-level", 6, "gzip compression level (1-9, 1=BestSpeed, 9=BestCompression)")
 	fs.Bool("gzip", false, "gzip output files.")
 	fs.Bool("skip-empty-files", false, "skip writing empty files")
-	fs.Duration("topic-refresh", time.Minute, "how frequently the topic list should be refreshed")
+	fs.Duration("topic-refresh", time.Minute, "how frequently the topic list should be refreshed (topics no longer listed stop being logged)")
 	fs.String("topic-pattern", "", "only log topics matching the following pattern")
 
 	fs.Int64("rotate-size", 0, "rotate the file when it grows bigger than `rotate-size` bytes")
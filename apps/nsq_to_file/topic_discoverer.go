@@ -37,6 +37,22 @@ func newTopicDiscoverer(logf lg.AppLogFunc, opts *Options, cfg *nsq.Config, hupC
 }
 
 func (t *TopicDiscoverer) updateTopics(topics []string) {
+	// when following nsqlookupd, stop logging topics that are gone
+	if len(t.opts.Topics) == 0 {
+		current := make(map[string]bool, len(topics))
+		for _, topic := range topics {
+			current[topic] = true
+		}
+		for topic, fl := range t.topics {
+			if current[topic] {
+				continue
+			}
+			t.logf(lg.INFO, "topic %s is gone, stopping", topic)
+			close(fl.termChan)
+			delete(t.topics, topic)
+		}
+	}
+
 	for _, topic := range topics {
 		if _, ok := t.topics[topic]; ok {
 			continue
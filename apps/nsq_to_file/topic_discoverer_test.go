@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTopicDiscovererUpdateTopics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq_to_file")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.OutputDir = tmpDir
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+	discoverer := newTopicDiscoverer(logf, opts, nsq.NewConfig(), nil, nil)
+
+	discoverer.updateTopics([]string{"a", "b"})
+	test.Equal(t, 2, len(discoverer.topics))
+	a := discoverer.topics["a"]
+
+	// a topic nsqlookupd no longer lists is stopped
+	discoverer.updateTopics([]string{"b"})
+	test.Equal(t, 1, len(discoverer.topics))
+	test.NotNil(t, discoverer.topics["b"])
+	select {
+	case <-a.consumer.StopChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logger of topic a wasn't stopped")
+	}
+
+	// and picked up again if it comes back
+	discoverer.updateTopics([]string{"a", "b"})
+	test.Equal(t, 2, len(discoverer.topics))
+	test.NotNil(t, discoverer.topics["a"])
+	test.Equal(t, true, discoverer.topics["a"] != a)
+
+	// topics given with --topic are never stopped
+	opts.Topics = []string{"a", "b"}
+	discoverer.updateTopics(nil)
+	test.Equal(t, 2, len(discoverer.topics))
+
+	for _, fl := range discoverer.topics {
+		close(fl.termChan)
+	}
+	discoverer.wg.Wait()
+}
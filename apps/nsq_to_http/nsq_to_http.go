@@ -15,6 +15,8 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -52,6 +54,7 @@ var (
 	getAddrs           = app.StringArray{}
 	postAddrs          = app.StringArray{}
 	customHeaders      = app.StringArray{}
+	finishStatuses     = app.StringArray{}
 	nsqdTCPAddrs       = app.StringArray{}
 	lookupdHTTPAddrs   = app.StringArray{}
 	validCustomHeaders map[string]string
@@ -60,6 +63,7 @@ var (
 func init() {
 	flag.Var(&postAddrs, "post", "HTTP address to make a POST request to.  data will be in the body (may be given multiple times)")
 	flag.Var(&customHeaders, "header", "Custom header for HTTP requests (may be given multiple times)")
+	flag.Var(&finishStatuses, "finish-status", "HTTP status code (e.g. 404) or class (e.g. 4xx) of responses after which a message is finished rather than requeued (may be given multiple times)")
 	flag.Var(&getAddrs, "get", "HTTP address to make a GET request to. '%s' will be printf replaced with data (may be given multiple times)")
 	flag.Var(&nsqdTCPAddrs, "nsqd-tcp-address", "nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
@@ -69,6 +73,27 @@ type Publisher interface {
 	Publish(string, []byte) error
 }
 
+// statusError is returned by a Publisher for an unsuccessful response
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("got status code %d", int(e))
+}
+
+var finishStatusRegex = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// isFinishStatus returns whether code matches one of statuses, codes like
+// 404 or classes like 4xx
+func isFinishStatus(statuses []string, code int) bool {
+	s := strconv.Itoa(code)
+	for _, status := range statuses {
+		if status == s || (strings.HasSuffix(status, "xx") && status[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
+
 type PublishHandler struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	counter uint64
@@ -82,6 +107,17 @@ type PublishHandler struct {
 	timermetrics     *timer_metrics.TimerMetrics
 }
 
+// publish publishes msg to addr, a response with a --finish-status is logged
+// and treated as a success so the message isn't requeued
+func (ph *PublishHandler) publish(addr string, msg []byte) error {
+	err := ph.Publish(addr, msg)
+	if code, ok := err.(statusError); ok && isFinishStatus(finishStatuses, int(code)) {
+		log.Printf("finishing message after %s from %s", err, addr)
+		return nil
+	}
+	return err
+}
+
 func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 	if *sample < 1.0 && rand.Float64() > *sample {
 		return nil
@@ -92,7 +128,7 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 	case ModeAll:
 		for _, addr := range ph.addresses {
 			st := time.Now()
-			err := ph.Publish(addr, m.Body)
+			err := ph.publish(addr, m.Body)
 			if err != nil {
 				return err
 			}
@@ -102,7 +138,7 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 		counter := atomic.AddUint64(&ph.counter, 1)
 		idx := counter % uint64(len(ph.addresses))
 		addr := ph.addresses[idx]
-		err := ph.Publish(addr, m.Body)
+		err := ph.publish(addr, m.Body)
 		if err != nil {
 			return err
 		}
@@ -110,7 +146,7 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message) error {
 	case ModeHostPool:
 		hostPoolResponse := ph.hostPool.Get()
 		addr := hostPoolResponse.Host()
-		err := ph.Publish(addr, m.Body)
+		err := ph.publish(addr, m.Body)
 		hostPoolResponse.Mark(err)
 		if err != nil {
 			return err
@@ -134,7 +170,7 @@ func (p *PostPublisher) Publish(addr string, msg []byte) error {
 	resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("got status code %d", resp.StatusCode)
+		return statusError(resp.StatusCode)
 	}
 	return nil
 }
@@ -151,7 +187,7 @@ func (p *GetPublisher) Publish(addr string, msg []byte) error {
 	resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("got status code %d", resp.StatusCode)
+		return statusError(resp.StatusCode)
 	}
 	return nil
 }
@@ -225,6 +261,12 @@ func main() {
 		}
 	}
 
+	for _, status := range finishStatuses {
+		if !finishStatusRegex.MatchString(status) {
+			log.Fatalf("invalid --finish-status %q - must be a status code or class, e.g. 404 or 4xx", status)
+		}
+	}
+
 	switch *mode {
 	case "round-robin":
 		selectedMode = ModeRoundRobin
@@ -56,3 +56,22 @@ func TestParseCustomHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestIsFinishStatus(t *testing.T) {
+	statuses := []string{"404", "5xx"}
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{404, true},
+		{400, false},
+		{500, true},
+		{503, true},
+		{200, false},
+	}
+	for _, tt := range tests {
+		if got := isFinishStatus(statuses, tt.code); got != tt.want {
+			t.Errorf("isFinishStatus(%v, %d) = %v, want %v", statuses, tt.code, got, tt.want)
+		}
+	}
+}
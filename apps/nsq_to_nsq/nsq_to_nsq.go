@@ -11,7 +11,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -43,9 +45,13 @@ var (
 	destNsqdTCPAddrs    = app.StringArray{}
 	whitelistJSONFields = app.StringArray{}
 	topics              = app.StringArray{}
+	topicMappings       = app.StringArray{}
 
 	requireJSONField = flag.String("require-json-field", "", "for JSON messages: only pass messages that contain this field")
 	requireJSONValue = flag.String("require-json-value", "", "for JSON messages: only pass messages in which the required field has this value")
+	requireBodyRegex = flag.String("require-body-regex", "", "only pass messages whose body matches this regular expression")
+
+	bodyRegex *regexp.Regexp
 )
 
 func init() {
@@ -53,6 +59,7 @@ func init() {
 	flag.Var(&destNsqdTCPAddrs, "destination-nsqd-tcp-address", "destination nsqd TCP address (may be given multiple times)")
 	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 	flag.Var(&topics, "topic", "nsq topic (may be given multiple times)")
+	flag.Var(&topicMappings, "topic-map", "<topic>:<destination topic> to publish messages of a consumed topic to, instead of --destination-topic (may be given multiple times)")
 	flag.Var(&whitelistJSONFields, "whitelist-json-field", "for JSON messages: pass this field (may be given multiple times)")
 }
 
@@ -206,6 +213,10 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message, destinationTopic string)
 	var err error
 	msgBody := m.Body
 
+	if bodyRegex != nil && !bodyRegex.Match(msgBody) {
+		return nil
+	}
+
 	if *requireJSONField != "" || len(whitelistJSONFields) > 0 {
 		var js map[string]interface{}
 		err = json.Unmarshal(msgBody, &js)
@@ -254,6 +265,20 @@ func (ph *PublishHandler) HandleMessage(m *nsq.Message, destinationTopic string)
 	return nil
 }
 
+// parseTopicMappings returns the destination topics by consumed topic of
+// --topic-map values
+func parseTopicMappings(mappings []string) (map[string]string, error) {
+	destTopics := make(map[string]string, len(mappings))
+	for _, m := range mappings {
+		parts := strings.Split(m, ":")
+		if len(parts) != 2 || !protocol.IsValidTopicName(parts[0]) || !protocol.IsValidTopicName(parts[1]) {
+			return nil, fmt.Errorf("invalid --topic-map %q - must be <topic>:<destination topic>", m)
+		}
+		destTopics[parts[0]] = parts[1]
+	}
+	return destTopics, nil
+}
+
 func hasArg(s string) bool {
 	argExist := false
 	flag.Visit(func(f *flag.Flag) {
@@ -294,6 +319,18 @@ func main() {
 		log.Fatal("--destination-topic is invalid")
 	}
 
+	destTopics, err := parseTopicMappings(topicMappings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *requireBodyRegex != "" {
+		bodyRegex, err = regexp.Compile(*requireBodyRegex)
+		if err != nil {
+			log.Fatalf("--require-body-regex is invalid - %s", err)
+		}
+	}
+
 	if !protocol.IsValidChannelName(*channel) {
 		log.Fatal("--channel is invalid")
 	}
@@ -370,7 +407,9 @@ func main() {
 		}
 
 		publishTopic := topic
-		if *destTopic != "" {
+		if t, ok := destTopics[topic]; ok {
+			publishTopic = t
+		} else if *destTopic != "" {
 			publishTopic = *destTopic
 		}
 		topicHandler := &TopicHandler{
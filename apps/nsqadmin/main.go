@@ -39,6 +39,9 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement, must match nsqd)")
 	flagSet.Duration("statsd-interval", opts.StatsdInterval, "time interval nsqd is configured to push to statsd (must match nsqd)")
 
+	flagSet.Duration("counter-poll-interval", opts.CounterPollInterval, "how often to poll the message counts of all nodes for the cluster totals of the counter page (0 to disable)")
+	flagSet.String("counter-file", "", "path to a file in which to keep the cluster totals of the counter page across restarts")
+
 	flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent")
 
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
@@ -49,6 +52,8 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("http-client-tls-cert", "", "path to certificate file for the HTTP client")
 	flagSet.String("http-client-tls-key", "", "path to key file for the HTTP client")
 
+	flagSet.String("nsqd-http-auth-secret", "", "secret sent as a bearer token with HTTP requests, for nsqd's --http-auth-secret")
+
 	flagSet.String("allow-config-from-cidr", opts.AllowConfigFromCIDR, "A CIDR from which to allow HTTP requests to the /config endpoint")
 	flagSet.String("acl-http-header", opts.AclHttpHeader, "HTTP header to check for authenticated admin users")
 
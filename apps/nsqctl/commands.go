@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// partial logs err if only some of the nodes failed to respond, returning
+// it otherwise
+func partial(err error) error {
+	if _, ok := err.(clusterinfo.PartialErr); ok {
+		log.Printf("WARNING: %s", err)
+		return nil
+	}
+	return err
+}
+
+// print writes v as JSON, with --json, otherwise a table of rows
+func (c *ctl) print(v interface{}, header []string, rows [][]string) error {
+	if c.json {
+		return json.NewEncoder(c.out).Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) printNames(header string, names []string) error {
+	sort.Strings(names)
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, []string{name})
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return c.print(names, []string{header}, rows)
+}
+
+func (c *ctl) topics(args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		var topics []string
+		var err error
+		if len(c.lookupdHTTPAddrs) != 0 {
+			topics, err = c.ci.GetLookupdTopics(c.lookupdHTTPAddrs)
+		} else {
+			topics, err = c.ci.GetNSQDTopics(c.nsqdHTTPAddrs)
+		}
+		if err = partial(err); err != nil {
+			return err
+		}
+		return c.printNames("TOPIC", topics)
+	}
+
+	if len(args) != 2 {
+		return errUsage
+	}
+	topic := args[1]
+	if !protocol.IsValidTopicName(topic) {
+		return fmt.Errorf("invalid topic name %q", topic)
+	}
+	switch args[0] {
+	case "create":
+		return c.create(topic, "")
+	case "delete":
+		return c.ci.DeleteTopic(topic, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "empty":
+		return c.ci.EmptyTopic(topic, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "pause":
+		return c.ci.PauseTopic(topic, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "unpause":
+		return c.ci.UnPauseTopic(topic, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	}
+	return errUsage
+}
+
+func (c *ctl) channels(args []string) error {
+	if len(args) == 2 && args[0] == "list" {
+		topic := args[1]
+		var channels []string
+		if len(c.lookupdHTTPAddrs) != 0 {
+			var err error
+			channels, err = c.ci.GetLookupdTopicChannels(topic, c.lookupdHTTPAddrs)
+			if err = partial(err); err != nil {
+				return err
+			}
+		} else {
+			producers, err := c.ci.GetNSQDTopicProducers(topic, c.nsqdHTTPAddrs)
+			if err = partial(err); err != nil {
+				return err
+			}
+			_, channelStats, err := c.ci.GetNSQDStats(producers, topic, "", false)
+			if err = partial(err); err != nil {
+				return err
+			}
+			for name := range channelStats {
+				channels = append(channels, name)
+			}
+		}
+		return c.printNames("CHANNEL", channels)
+	}
+
+	if len(args) != 3 {
+		return errUsage
+	}
+	topic, channel := args[1], args[2]
+	if !protocol.IsValidTopicName(topic) {
+		return fmt.Errorf("invalid topic name %q", topic)
+	}
+	if !protocol.IsValidChannelName(channel) {
+		return fmt.Errorf("invalid channel name %q", channel)
+	}
+	switch args[0] {
+	case "create":
+		return c.create(topic, channel)
+	case "delete":
+		return c.ci.DeleteChannel(topic, channel, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "empty":
+		return c.ci.EmptyChannel(topic, channel, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "pause":
+		return c.ci.PauseChannel(topic, channel, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	case "unpause":
+		return c.ci.UnPauseChannel(topic, channel, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	}
+	return errUsage
+}
+
+// create creates the topic (and channel, if not empty) on the nsqlookupd,
+// or else on each nsqd
+func (c *ctl) create(topic string, channel string) error {
+	if len(c.lookupdHTTPAddrs) != 0 {
+		return c.ci.CreateTopicChannel(topic, channel, c.lookupdHTTPAddrs)
+	}
+
+	var errs []error
+	for _, addr := range c.nsqdHTTPAddrs {
+		endpoint := fmt.Sprintf("http://%s/topic/create?topic=%s", addr, url.QueryEscape(topic))
+		if channel != "" {
+			endpoint = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=%s",
+				addr, url.QueryEscape(topic), url.QueryEscape(channel))
+		}
+		err := c.client.POSTV1(endpoint)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return clusterinfo.ErrList(errs)
+	}
+	return nil
+}
+
+// statsRow is a topic's (Channel is empty) or a channel's stats, summed
+// over the nodes
+type statsRow struct {
+	Topic         string `json:"topic"`
+	Channel       string `json:"channel,omitempty"`
+	Depth         int64  `json:"depth"`
+	MemoryDepth   int64  `json:"memory_depth"`
+	BackendDepth  int64  `json:"backend_depth"`
+	InFlightCount int64  `json:"in_flight_count"`
+	DeferredCount int64  `json:"deferred_count"`
+	RequeueCount  int64  `json:"requeue_count"`
+	TimeoutCount  int64  `json:"timeout_count"`
+	MessageCount  int64  `json:"message_count"`
+	ClientCount   int    `json:"client_count"`
+	Paused        bool   `json:"paused"`
+}
+
+// stats shows the stats of every topic and channel, or only those of topic
+// (or of its channel)
+func (c *ctl) stats(topic string, channel string) error {
+	var producers clusterinfo.Producers
+	var err error
+	if topic == "" {
+		producers, err = c.ci.GetProducers(c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	} else {
+		producers, err = c.ci.GetTopicProducers(topic, c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	}
+	if err = partial(err); err != nil {
+		return err
+	}
+	topicStats, channelStats, err := c.ci.GetNSQDStats(producers, topic, channel, false)
+	if err = partial(err); err != nil {
+		return err
+	}
+
+	stats := []*statsRow{}
+	if channel == "" {
+		topics := make(map[string]*statsRow)
+		for _, t := range topicStats {
+			row, ok := topics[t.TopicName]
+			if !ok {
+				row = &statsRow{Topic: t.TopicName}
+				topics[t.TopicName] = row
+				stats = append(stats, row)
+			}
+			row.Depth += t.Depth
+			row.MemoryDepth += t.MemoryDepth
+			row.BackendDepth += t.BackendDepth
+			row.MessageCount += t.MessageCount
+			row.Paused = row.Paused || t.Paused
+		}
+	}
+	for _, ch := range channelStats {
+		stats = append(stats, &statsRow{
+			Topic:         ch.TopicName,
+			Channel:       ch.ChannelName,
+			Depth:         ch.Depth,
+			MemoryDepth:   ch.MemoryDepth,
+			BackendDepth:  ch.BackendDepth,
+			InFlightCount: ch.InFlightCount,
+			DeferredCount: ch.DeferredCount,
+			RequeueCount:  ch.RequeueCount,
+			TimeoutCount:  ch.TimeoutCount,
+			MessageCount:  ch.MessageCount,
+			ClientCount:   ch.ClientCount,
+			Paused:        ch.Paused,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Channel < stats[j].Channel
+	})
+
+	n := func(v int64) string { return strconv.FormatInt(v, 10) }
+	rows := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		row := []string{s.Topic, s.Channel, n(s.Depth), n(s.MemoryDepth), n(s.BackendDepth)}
+		if s.Channel == "" {
+			// the channel columns are blank for topics
+			row = append(row, "", "", "", "", n(s.MessageCount), "")
+		} else {
+			row = append(row, n(s.InFlightCount), n(s.DeferredCount), n(s.RequeueCount),
+				n(s.TimeoutCount), n(s.MessageCount), strconv.Itoa(s.ClientCount))
+		}
+		row = append(row, strconv.FormatBool(s.Paused))
+		rows = append(rows, row)
+	}
+	return c.print(stats, []string{"TOPIC", "CHANNEL", "DEPTH", "MEM", "DISK",
+		"IN-FLIGHT", "DEFERRED", "REQUEUED", "TIMED-OUT", "MESSAGES", "CLIENTS", "PAUSED"}, rows)
+}
+
+// nodeRow is an nsqd, as shown by nodes
+type nodeRow struct {
+	Hostname         string   `json:"hostname"`
+	BroadcastAddress string   `json:"broadcast_address"`
+	TCPPort          int      `json:"tcp_port"`
+	HTTPPort         int      `json:"http_port"`
+	Version          string   `json:"version"`
+	Topics           []string `json:"topics"`
+}
+
+// nodes shows the nsqd of the cluster
+func (c *ctl) nodes() error {
+	producers, err := c.ci.GetProducers(c.lookupdHTTPAddrs, c.nsqdHTTPAddrs)
+	if err = partial(err); err != nil {
+		return err
+	}
+
+	nodes := make([]nodeRow, 0, len(producers))
+	rows := make([][]string, 0, len(producers))
+	for _, p := range producers {
+		node := nodeRow{
+			Hostname:         p.Hostname,
+			BroadcastAddress: p.BroadcastAddress,
+			TCPPort:          p.TCPPort,
+			HTTPPort:         p.HTTPPort,
+			Version:          p.Version,
+			Topics:           []string{},
+		}
+		for _, t := range p.Topics {
+			node.Topics = append(node.Topics, t.Topic)
+		}
+		nodes = append(nodes, node)
+		rows = append(rows, []string{node.Hostname, node.BroadcastAddress,
+			strconv.Itoa(node.TCPPort), strconv.Itoa(node.HTTPPort), node.Version,
+			strconv.Itoa(len(node.Topics))})
+	}
+	return c.print(nodes, []string{"HOSTNAME", "BROADCAST ADDRESS", "TCP PORT", "HTTP PORT", "VERSION", "TOPICS"}, rows)
+}
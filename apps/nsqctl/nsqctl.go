@@ -0,0 +1,157 @@
+// This is a utility application to administer an NSQ cluster from the
+// command line: list, create, delete, empty and (un)pause topics and
+// channels and show stats and nodes, through the nsqd and nsqlookupd
+// HTTP APIs
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsqio/nsq/internal/app"
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+var (
+	showVersion        = flag.Bool("version", false, "print version")
+	jsonOutput         = flag.Bool("json", false, "print output as JSON rather than tables, for scripting")
+	httpConnectTimeout = flag.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
+	httpRequestTimeout = flag.Duration("http-client-request-timeout", 5*time.Second, "timeout for HTTP request")
+	httpAuthSecret     = flag.String("http-auth-secret", "", "secret sent as a bearer token with HTTP requests, for nsqd's --http-auth-secret")
+	nsqdHTTPAddrs      = app.StringArray{}
+	lookupdHTTPAddrs   = app.StringArray{}
+)
+
+const commands = `commands:
+  topics list
+  topics create|delete|empty|pause|unpause <topic>
+  channels list <topic>
+  channels create|delete|empty|pause|unpause <topic> <channel>
+  stats [<topic> [<channel>]]
+  nodes
+`
+
+func init() {
+	flag.Var(&nsqdHTTPAddrs, "nsqd-http-address", "nsqd HTTP address (may be given multiple times)")
+	flag.Var(&lookupdHTTPAddrs, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
+}
+
+func checkAddrs(addrs []string) error {
+	for _, a := range addrs {
+		if strings.HasPrefix(a, "http") {
+			return errors.New("address should not contain scheme")
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\n%s\nflags:\n", os.Args[0], commands)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsqctl v%s\n", version.Binary)
+		return
+	}
+
+	connectTimeout := *httpConnectTimeout
+	if int64(connectTimeout) <= 0 {
+		log.Fatal("--http-client-connect-timeout should be positive")
+	}
+
+	requestTimeout := *httpRequestTimeout
+	if int64(requestTimeout) <= 0 {
+		log.Fatal("--http-client-request-timeout should be positive")
+	}
+
+	if len(nsqdHTTPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--nsqd-http-address or --lookupd-http-address required")
+	}
+	if len(nsqdHTTPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
+		log.Fatal("use --nsqd-http-address or --lookupd-http-address not both")
+	}
+
+	if err := checkAddrs(nsqdHTTPAddrs); err != nil {
+		log.Fatalf("--nsqd-http-address error - %s", err)
+	}
+
+	if err := checkAddrs(lookupdHTTPAddrs); err != nil {
+		log.Fatalf("--lookupd-http-address error - %s", err)
+	}
+
+	client := http_api.NewClient(nil, connectTimeout, requestTimeout)
+	client.SetAuthSecret(*httpAuthSecret)
+	c := &ctl{
+		ci:               clusterinfo.New(nil, client),
+		client:           client,
+		nsqdHTTPAddrs:    nsqdHTTPAddrs,
+		lookupdHTTPAddrs: lookupdHTTPAddrs,
+		json:             *jsonOutput,
+		out:              os.Stdout,
+	}
+	err := c.run(flag.Args())
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+// ctl runs commands against the cluster of its nsqd or nsqlookupd, writing
+// their output to out
+type ctl struct {
+	ci               *clusterinfo.ClusterInfo
+	client           *http_api.Client
+	nsqdHTTPAddrs    []string
+	lookupdHTTPAddrs []string
+	json             bool
+	out              io.Writer
+}
+
+var errUsage = errors.New("invalid command")
+
+func (c *ctl) run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "topics":
+		return c.topics(args[1:])
+	case "channels":
+		return c.channels(args[1:])
+	case "stats":
+		if len(args) > 3 {
+			return errUsage
+		}
+		var topic, channel string
+		if len(args) > 1 {
+			topic = args[1]
+		}
+		if len(args) > 2 {
+			channel = args[2]
+		}
+		return c.stats(topic, channel)
+	case "nodes":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return c.nodes()
+	}
+	return errUsage
+}
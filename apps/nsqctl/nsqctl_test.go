@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/test"
+	"github.com/nsqio/nsq/nsqd"
+)
+
+func mustStartNSQD(opts *nsqd.Options) *nsqd.NSQD {
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.HTTPSAddress = "127.0.0.1:0"
+	if opts.DataPath == "" {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-")
+		if err != nil {
+			panic(err)
+		}
+		opts.DataPath = tmpDir
+	}
+	nsqd, err := nsqd.New(opts)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		err := nsqd.Main()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	return nsqd
+}
+
+func TestCommands(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var out bytes.Buffer
+	client := http_api.NewClient(nil, time.Second, time.Second)
+	c := &ctl{
+		ci:            clusterinfo.New(nil, client),
+		client:        client,
+		nsqdHTTPAddrs: []string{nsqd.RealHTTPAddr().String()},
+		out:           &out,
+	}
+	run := func(args ...string) string {
+		out.Reset()
+		test.Nil(t, c.run(args))
+		return out.String()
+	}
+
+	run("topics", "create", "orders")
+	run("channels", "create", "orders", "archive")
+	run("channels", "pause", "orders", "archive")
+	test.Equal(t, "TOPIC\norders\n", run("topics", "list"))
+	test.Equal(t, "CHANNEL\narchive\n", run("channels", "list", "orders"))
+
+	lines := strings.Split(strings.TrimSpace(run("stats")), "\n")
+	test.Equal(t, 3, len(lines))
+	test.Equal(t, []string{"TOPIC", "CHANNEL", "DEPTH"}, strings.Fields(lines[0])[:3])
+	test.Equal(t, []string{"orders", "0", "0", "0", "0", "false"}, strings.Fields(lines[1]))
+	test.Equal(t, []string{"orders", "archive", "0", "0", "0", "0", "0", "0", "0", "0", "0", "true"},
+		strings.Fields(lines[2]))
+
+	c.json = true
+	var stats []statsRow
+	test.Nil(t, json.Unmarshal([]byte(run("stats", "orders", "archive")), &stats))
+	test.Equal(t, []statsRow{{Topic: "orders", Channel: "archive", Paused: true}}, stats)
+	var nodes []nodeRow
+	test.Nil(t, json.Unmarshal([]byte(run("nodes")), &nodes))
+	test.Equal(t, 1, len(nodes))
+	test.Equal(t, []string{"orders"}, nodes[0].Topics)
+
+	run("topics", "delete", "orders")
+	test.Equal(t, "[]\n", run("topics", "list"))
+
+	test.Equal(t, errUsage, c.run([]string{"topics", "rename", "orders"}))
+	test.NotNil(t, c.run([]string{"topics", "create", "not valid"}))
+}
+
+func TestCommandsAuthSecret(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPAuthSecret = "s3cret"
+	nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	var out bytes.Buffer
+	client := http_api.NewClient(nil, time.Second, time.Second)
+	c := &ctl{
+		ci:            clusterinfo.New(nil, client),
+		client:        client,
+		nsqdHTTPAddrs: []string{nsqd.RealHTTPAddr().String()},
+		out:           &out,
+	}
+
+	test.NotNil(t, c.run([]string{"topics", "create", "orders"}))
+	client.SetAuthSecret("s3cret")
+	test.Nil(t, c.run([]string{"topics", "create", "orders"}))
+	_, err := nsqd.GetExistingTopic("orders")
+	test.Nil(t, err)
+}
@@ -3,14 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
 	"github.com/nsqio/nsq/internal/lg"
@@ -51,22 +52,15 @@ func (p *program) Start() error {
 		os.Exit(0)
 	}
 
-	var cfg config
-	configFile := flagSet.Lookup("config").Value.String()
-	if configFile != "" {
-		_, err := toml.DecodeFile(configFile, &cfg)
-		if err != nil {
-			logFatal("failed to load config file %s - %s", configFile, err)
-		}
+	err := resolveOptions(opts, flagSet)
+	if err != nil {
+		logFatal("%s", err)
 	}
-	cfg.Validate()
-
-	options.Resolve(opts, flagSet, cfg)
-	nsqd, err := nsqd.New(opts)
+	n, err := nsqd.New(opts)
 	if err != nil {
 		logFatal("failed to instantiate nsqd - %s", err)
 	}
-	p.nsqd = nsqd
+	p.nsqd = n
 
 	err = p.nsqd.LoadMetadata()
 	if err != nil {
@@ -79,15 +73,62 @@ func (p *program) Start() error {
 
 	go func() {
 		err := p.nsqd.Main()
+		if err == nsqd.ErrDrained {
+			// POST /drain?exit=true
+			p.Stop()
+			os.Exit(0)
+		}
 		if err != nil {
 			p.Stop()
 			os.Exit(1)
 		}
 	}()
 
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			p.reload()
+		}
+	}()
+
 	return nil
 }
 
+// resolveOptions sets opts from the config file, if any, and the flags
+func resolveOptions(opts *nsqd.Options, flagSet *flag.FlagSet) error {
+	var cfg config
+	configFile := flagSet.Lookup("config").Value.String()
+	if configFile != "" {
+		var err error
+		cfg, err = loadConfig(configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config file %s - %s", configFile, err)
+		}
+	}
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	options.Resolve(opts, flagSet, cfg)
+	return nil
+}
+
+// reload re-reads the config file (on SIGHUP) and applies the options that
+// can change while nsqd runs, see nsqd.ReloadOptions
+func (p *program) reload() {
+	opts := nsqd.NewOptions()
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse(os.Args[1:])
+	err := resolveOptions(opts, flagSet)
+	if err == nil {
+		_, _, err = p.nsqd.ReloadOptions(opts)
+	}
+	if err != nil {
+		logError("failed to reload options - %s", err)
+	}
+}
+
 func (p *program) Stop() error {
 	p.once.Do(func() {
 		p.nsqd.Exit()
@@ -98,3 +139,8 @@ func (p *program) Stop() error {
 func logFatal(f string, args ...interface{}) {
 	lg.LogFatal("[nsqd] ", f, args...)
 }
+
+func logError(f string, args ...interface{}) {
+	logger := log.New(os.Stderr, "[nsqd] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	lg.Logf(logger, lg.ERROR, lg.ERROR, f, args...)
+}
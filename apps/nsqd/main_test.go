@@ -2,8 +2,11 @@ package main
 
 import (
 	"crypto/tls"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/mreiferson/go-options"
@@ -34,3 +37,106 @@ func TestConfigFlagParsing(t *testing.T) {
 		t.Errorf("min %#v not expected %#v", opts.TLSMinVersion, tls.VersionTLS10)
 	}
 }
+
+func TestJSONConfig(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse([]string{"--mem-queue-size=200"})
+
+	dir, err := ioutil.TempDir("", "nsqd-config-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "nsqd.json")
+	err = ioutil.WriteFile(configFile, []byte(`{
+		"mem_queue_size": 100,
+		"max_msg_attempts": 5,
+		"msg_timeout": "30s",
+		"nsqlookupd_tcp_addresses": ["127.0.0.1:4160"]
+	}`), 0600)
+	test.Nil(t, err)
+
+	cfg, err := loadConfig(configFile)
+	test.Nil(t, err)
+	cfg.Validate()
+	options.Resolve(opts, flagSet, cfg)
+
+	test.Equal(t, int64(200), opts.MemQueueSize)
+	test.Equal(t, 5, opts.MaxMsgAttempts)
+	test.Equal(t, 30*time.Second, opts.MsgTimeout)
+	test.Equal(t, []string{"127.0.0.1:4160"}, opts.NSQLookupdTCPAddresses)
+}
+
+func TestTLSClientAuthorizationConfig(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse([]string{})
+
+	dir, err := ioutil.TempDir("", "nsqd-config-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "nsqd.cfg")
+	err = ioutil.WriteFile(configFile, []byte(`
+tls_client_auth_policy = "require-verify"
+
+[[tls_client_authorization]]
+identity = "orders.example.com"
+topic = "^orders$"
+permissions = ["publish"]
+
+[[tls_client_authorization]]
+identity = "archiver.example.com"
+topic = ".*"
+channels = ["^archive$"]
+permissions = ["subscribe"]
+`), 0600)
+	test.Nil(t, err)
+
+	cfg, err := loadConfig(configFile)
+	test.Nil(t, err)
+	test.Nil(t, cfg.Validate())
+	options.Resolve(opts, flagSet, cfg)
+
+	test.Equal(t, []string{
+		`{"identity":"orders.example.com","permissions":["publish"],"topic":"^orders$"}`,
+		`{"channels":["^archive$"],"identity":"archiver.example.com","permissions":["subscribe"],"topic":".*"}`,
+	}, opts.TLSClientAuthorizations)
+}
+
+func TestNamespaceConfig(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+
+	flagSet := nsqdFlagSet(opts)
+	flagSet.Parse([]string{})
+
+	dir, err := ioutil.TempDir("", "nsqd-config-test")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "nsqd.cfg")
+	err = ioutil.WriteFile(configFile, []byte(`
+[[namespace]]
+name = "orders"
+max_topics = 100
+max_publish_rate = 5000
+identities = ["orders.example.com"]
+
+[[namespace]]
+name = "billing"
+max_disk_bytes = 10737418240
+`), 0600)
+	test.Nil(t, err)
+
+	cfg, err := loadConfig(configFile)
+	test.Nil(t, err)
+	test.Nil(t, cfg.Validate())
+	options.Resolve(opts, flagSet, cfg)
+
+	test.Equal(t, []string{
+		`{"identities":["orders.example.com"],"max_publish_rate":5000,"max_topics":100,"name":"orders"}`,
+		`{"max_disk_bytes":10737418240,"name":"billing"}`,
+	}, opts.Namespaces)
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/nsqio/nsq/internal/app"
 	"github.com/nsqio/nsq/nsqd"
 )
@@ -63,10 +67,67 @@ func (t *tlsMinVersionOption) String() string {
 	return strconv.FormatInt(int64(*t), 10)
 }
 
+// addressesOption is a listen address flag that may be given multiple times,
+// the first replacing the default, as nsqd's comma separated addresses
+type addressesOption struct {
+	addrs []string
+	set   bool
+}
+
+func (a *addressesOption) Set(s string) error {
+	if !a.set {
+		a.addrs = nil
+		a.set = true
+	}
+	a.addrs = append(a.addrs, s)
+	return nil
+}
+
+func (a *addressesOption) Get() interface{} { return a.String() }
+
+func (a *addressesOption) String() string {
+	return strings.Join(a.addrs, ",")
+}
+
 type config map[string]interface{}
 
-// Validate settings in the config file, and fatal on errors
-func (cfg config) Validate() {
+// loadConfig reads a TOML config file, or a JSON one if its name ends in
+// .json, flags set on the command line take precedence over it
+func loadConfig(configFile string) (config, error) {
+	var cfg config
+	if filepath.Ext(configFile) != ".json" {
+		_, err := toml.DecodeFile(configFile, &cfg)
+		return cfg, err
+	}
+
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	// JSON numbers decode as float64, integer options need ints
+	for k, v := range cfg {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			cfg[k] = i
+		} else {
+			cfg[k], _ = n.Float64()
+		}
+	}
+	return cfg, nil
+}
+
+// Validate settings in the config file
+func (cfg config) Validate() error {
 	// special validation/translation
 	if v, exists := cfg["tls_required"]; exists {
 		var t tlsRequiredOption
@@ -74,7 +135,7 @@ func (cfg config) Validate() {
 		if err == nil {
 			cfg["tls_required"] = t.String()
 		} else {
-			logFatal("failed parsing tls_required %+v", v)
+			return fmt.Errorf("failed parsing tls_required %+v", v)
 		}
 	}
 	if v, exists := cfg["tls_min_version"]; exists {
@@ -88,9 +149,61 @@ func (cfg config) Validate() {
 				delete(cfg, "tls_min_version")
 			}
 		} else {
-			logFatal("failed parsing tls_min_version %+v", v)
+			return fmt.Errorf("failed parsing tls_min_version %+v", v)
 		}
 	}
+	for _, k := range []string{"tcp_address", "http_address", "https_address"} {
+		// a list of addresses, as nsqd's comma separated addresses
+		if v, ok := cfg[k].([]interface{}); ok {
+			addrs := make([]string, len(v))
+			for i, addr := range v {
+				addrs[i] = fmt.Sprintf("%v", addr)
+			}
+			cfg[k] = strings.Join(addrs, ",")
+		}
+	}
+	// [[tls_client_authorization]] and [[namespace]] sections, as
+	// --tls-client-authorization and --namespace values
+	if err := cfg.sectionsToJSON("tls_client_authorization", "tls_client_authorizations"); err != nil {
+		return err
+	}
+	return cfg.sectionsToJSON("namespace", "namespaces")
+}
+
+// sectionsToJSON replaces the [[section]] tables of the config file with
+// their JSON encodings, appended to the list of key
+func (cfg config) sectionsToJSON(section string, key string) error {
+	v, exists := cfg[section]
+	if !exists {
+		return nil
+	}
+	var sections []interface{}
+	switch v := v.(type) {
+	case []map[string]interface{}:
+		for _, s := range v {
+			sections = append(sections, s)
+		}
+	case []interface{}:
+		sections = v
+	default:
+		return fmt.Errorf("failed parsing %s %+v", section, v)
+	}
+	var values []string
+	if existing, ok := cfg[key].([]interface{}); ok {
+		for _, e := range existing {
+			values = append(values, fmt.Sprintf("%v", e))
+		}
+	}
+	for _, s := range sections {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed parsing %s %+v", section, s)
+		}
+		values = append(values, string(b))
+	}
+	cfg[key] = values
+	delete(cfg, section)
+	return nil
 }
 
 func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
@@ -98,21 +211,29 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 
 	// basic options
 	flagSet.Bool("version", false, "print version string")
-	flagSet.String("config", "", "path to config file")
+	flagSet.String("config", "", "path to config file (TOML, or JSON if named *.json), command-line flags take precedence")
 
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
 	flagSet.String("log-prefix", "[nsqd] ", "log message prefix")
+	flagSet.String("log-format", opts.LogFormat, "log message format: text, or json (one object per line with ts, level and msg, no prefix)")
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
 	flagSet.Int64("node-id", opts.ID, "unique part for message IDs, (int) in range [0,1024) (default is hash of hostname)")
 	flagSet.Bool("worker-id", false, "[deprecated] use --node-id")
 
-	flagSet.String("https-address", opts.HTTPSAddress, "<addr>:<port> to listen on for HTTPS clients")
-	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
-	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
+	httpsAddresses := addressesOption{addrs: []string{opts.HTTPSAddress}}
+	flagSet.Var(&httpsAddresses, "https-address", "<addr>:<port> (or [<ipv6>]:<port>, or unix:///path/to.sock) to listen on for HTTPS clients (may be given multiple times)")
+	httpAddresses := addressesOption{addrs: []string{opts.HTTPAddress}}
+	flagSet.Var(&httpAddresses, "http-address", "<addr>:<port> (or [<ipv6>]:<port>, or unix:///path/to.sock) to listen on for HTTP clients (may be given multiple times)")
+	tcpAddresses := addressesOption{addrs: []string{opts.TCPAddress}}
+	flagSet.Var(&tcpAddresses, "tcp-address", "<addr>:<port> (or [<ipv6>]:<port>, or unix:///path/to.sock) to listen on for TCP clients (may be given multiple times)")
+	flagSet.Int("listen-backlog", opts.ListenBacklog, "accept backlog of the TCP/HTTP/HTTPS listeners (defaults to the OS maximum)")
+	flagSet.String("unix-socket-perm", opts.UnixSocketPerm, "permissions (octal) of the unix sockets listened on")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.String("http-auth-secret", opts.HTTPAuthSecret, "secret required (as a bearer token or basic auth password) by HTTP endpoints that create, change, empty or delete topics and channels, set options, consume (/message, /fin, /req, /ws) or export messages, or profile (/debug/pprof), others are rejected with a 403")
+	flagSet.Bool("http-auth-read", opts.HTTPAuthRead, "also require --http-auth-secret for /info, /stats, /metrics and GET /config (/ping stays open)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.Int("broadcast-tcp-port", opts.BroadcastTCPPort, "TCP port that will be registered with lookupd (defaults to the TCP port that this nsqd is listening on)")
 	flagSet.Int("broadcast-http-port", opts.BroadcastHTTPPort, "HTTP port that will be registered with lookupd (defaults to the HTTP port that this nsqd is listening on)")
@@ -120,16 +241,43 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
+	replicaHTTPAddrs := app.StringArray{}
+	flagSet.Var(&replicaHTTPAddrs, "replica-http-address", "<addr>:<port> of an nsqd to replicate publishes to non-ephemeral topics to (may be given multiple times)")
+	flagSet.String("replication-mode", opts.ReplicationMode, "sync (publishes are acked once every replica has accepted them) or async (publishes are queued for the replicas)")
+	flagSet.Bool("pprof", opts.PprofEnabled, "serve the /debug/pprof profiling endpoints on the HTTP/HTTPS listeners")
 
 	// diskqueue options
+	flagSet.String("backend", opts.Backend, "storage for messages beyond --mem-queue-size: diskqueue, memory (up to --memory-backend-size more, lost on exit), or one registered by an embedding program")
+	flagSet.Int64("memory-backend-size", opts.MemoryBackendSize, "number of messages beyond --mem-queue-size to keep with --backend=memory (per topic/channel), publishes beyond it fail with E_TOPIC_FULL")
 	flagSet.String("data-path", opts.DataPath, "path to store disk-backed messages")
 	flagSet.Int64("mem-queue-size", opts.MemQueueSize, "number of messages to keep in memory (per topic/channel)")
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Int("read-buffer-size", opts.ReadBufferSize, "number of bytes to read from a diskqueue file at a time (raise for topics with large messages, or for one topic or channel with read_buffer_size in /topic/config or /channel/config)")
+	flagSet.Int64("max-disk-write-rate", opts.MaxDiskWriteRate, "bytes of messages per second each topic's and channel's diskqueue may write, writes beyond it wait (default 0, i.e., unlimited)")
+	flagSet.Bool("verify-on-start", opts.VerifyOnStart, "scan all diskqueue files for corrupt messages on startup (I/O heavy)")
+	flagSet.Bool("recover-orphaned-queues", opts.RecoverOrphanedQueues, "re-create the topics and channels whose intact diskqueue files are found on startup but aren't in the metadata file (those that can't be are reported in /stats either way)")
+	flagSet.String("diskqueue-format", opts.DiskQueueFormat, "record format of new diskqueue files: length-prefixed or framed (with a version, flags and CRC-32 checksum). Records are only checksummed with framed, so by default corruption within a record goes undetected. Existing queues keep their format until empty")
+	flagSet.String("diskqueue-compression", opts.DiskQueueCompression, "compression of the data of each diskqueue record written: none, gzip or snappy, requires --diskqueue-format=framed (records that don't get smaller are kept uncompressed, and all are read however they were written)")
+	flagSet.Bool("diskqueue-mmap", opts.DiskQueueMmap, "memory-map diskqueue files that are behind the one being written to read them, rather than reading a read-buffer-size at a time (ignored where mmap isn't available)")
+	topicDataPaths := app.StringArray{}
+	flagSet.Var(&topicDataPaths, "topic-data-path", "path to store disk-backed messages of topics (and their channels) on, picked by a hash of the topic name, rather than --data-path (may be given multiple times, see /topic/migrate to move a topic)")
+	dataEncryptionKeys := app.StringArray{}
+	flagSet.Var(&dataEncryptionKeys, "data-encryption-key", "<id>:<hex AES-128/192/256 key> to encrypt (AES-GCM) diskqueue records with, requires --diskqueue-format=framed (may be given multiple times, the first encrypts and the others only decrypt records written before a rotation)")
+	flagSet.Bool("message-pool", opts.MessagePool, "reuse message structs and small (<= 4KB) message bodies to reduce GC pressure")
+	flagSet.Bool("persist-deferred", opts.PersistDeferred, "keep deferred publishes (DPUB) on disk until they are due, rather than in memory in each channel")
 
 	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for checking in-flight and deferred message timeouts")
 	flagSet.Int("queue-scan-selection-count", opts.QueueScanSelectionCount, "number of channels to check per cycle (every 100ms) for in-flight and deferred timeouts")
+	flagSet.Duration("topic-hibernate-timeout", opts.TopicHibernateTimeout, "duration a topic without messages or clients stays idle before its goroutines are stopped until the next publish or subscribe (0 to disable)")
+	flagSet.Duration("idle-expiry", opts.IdleExpiry, "duration a topic or channel without clients or publishes stays idle before it is deleted, with its messages and disk files (0 to disable)")
+	flagSet.String("fan-out-mode", opts.FanOutMode, "default for how topics hand a message to their channels: copy (each channel gets its own copy of the body) or shared (channels share one body, which must not be modified)")
+	flagSet.Int64("max-depth", opts.MaxDepth, "number of messages a topic (or any of its channels) may hold before --overflow-policy applies to publishes (default 0, i.e., unlimited)")
+	flagSet.String("overflow-policy", opts.OverflowPolicy, "what a publish to a topic at --max-depth does: error (the producer gets E_TOPIC_FULL), block (for up to --overflow-timeout, then error) or drop-oldest (messages at the head of the full queues are dropped)")
+	flagSet.Duration("overflow-timeout", opts.OverflowTimeout, "maximum duration a publish waits for room with --overflow-policy=block")
+	namespaces := app.StringArray{}
+	flagSet.Var(&namespaces, "namespace", "JSON {\"name\":...,\"max_topics\":...,\"max_disk_bytes\":...,\"max_publish_rate\":...,\"identities\":[...]} declaring a namespace, the topics named <name>.<topic> that share its quotas (0 for no limit) and that only clients with one of the identities (TLS client certificate CN or SAN, or auth server identity) may publish or subscribe to, if any are given (may be given multiple times, or as [[namespace]] config file sections)")
 
 	// msg and command options
 	flagSet.Duration("msg-timeout", opts.MsgTimeout, "default duration to wait before auto-requeing a message")
@@ -137,6 +285,13 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.String("requeue-policy", opts.RequeuePolicy, "order in which requeued and new messages are delivered: fifo, requeue-first or ratio")
+	flagSet.Int("requeue-ratio", opts.RequeueRatio, "number of new messages delivered per requeued message (with --requeue-policy=ratio)")
+	flagSet.String("queue-scheduling", opts.QueueScheduling, "order in which messages of the in-memory and disk queues of a topic or channel are delivered: random, fifo (by timestamp) or weighted")
+	flagSet.Int("queue-scheduling-weight", opts.QueueSchedulingWeight, "number of in-memory messages delivered per message from disk, while both have some (with --queue-scheduling=weighted)")
+	flagSet.Int("priority-weight", opts.PriorityWeight, "number of high priority messages (see PPUB) delivered per other message of a topic or channel, while both have some")
+	flagSet.Int("max-msg-attempts", opts.MaxMsgAttempts, "number of deliveries after which a message that comes back is discarded (or republished to its channel's dead-letter topic) instead of delivered again (default 0, i.e., unlimited)")
+	flagSet.Duration("msg-ttl", opts.MsgTTL, "duration after its publish a message is discarded (or republished to its channel's dead-letter topic) instead of delivered (default 0, i.e., never)")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -146,6 +301,10 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("min-output-buffer-timeout", opts.MinOutputBufferTimeout, "minimum client configurable duration of time between flushing to a client")
 	flagSet.Duration("output-buffer-timeout", opts.OutputBufferTimeout, "default duration of time between flushing data to clients")
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
+	flagSet.Duration("slow-consumer-ack-latency", opts.SlowConsumerAckLatency, "average time from delivery to FIN or REQ above which a consumer is slow (0 to disable)")
+	flagSet.Int("slow-consumer-timeouts", opts.SlowConsumerTimeouts, "number of messages timed out in a row after which a consumer is slow (0 to disable)")
+	flagSet.String("slow-consumer-policy", opts.SlowConsumerPolicy, "what happens to slow consumers: flag (in stats) or evict (disconnect them, requeueing their messages in flight)")
+	flagSet.String("delivery-preference", opts.DeliveryPreference, "which consumers of a channel get messages first: none, local (forwarders, i.e. clients that IDENTIFY with forwarder, only get messages while all local consumers are saturated) or forwarder (vice versa)")
 
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
@@ -154,6 +313,14 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
 	flagSet.Int("statsd-udp-packet-size", opts.StatsdUDPPacketSize, "the size in bytes of statsd UDP packets")
 
+	// depth alert options
+	flagSet.String("alert-webhook-url", opts.AlertWebhookURL, "URL to POST a JSON alert to when a channel's depth reaches its depth_alert (set with /channel/config), and when it's back under it")
+	flagSet.Duration("alert-interval", opts.AlertInterval, "duration between checks of channel depths against their depth_alert")
+	flagSet.Duration("alert-renotify-interval", opts.AlertRenotifyInterval, "duration between repeated alerts for a channel that stays at or above its depth_alert (0 to alert only once)")
+
+	// tracing options
+	flagSet.String("trace-endpoint", opts.TraceEndpoint, "URL to POST span events (publish, enqueue_disk, deliver, finish, requeue, timeout) of messages with a trace-id header to, as JSON one per line")
+
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
@@ -164,6 +331,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("tls-key", opts.TLSKey, "path to key file")
 	flagSet.String("tls-client-auth-policy", opts.TLSClientAuthPolicy, "client certificate auth policy ('require' or 'require-verify')")
 	flagSet.String("tls-root-ca-file", opts.TLSRootCAFile, "path to certificate authority file")
+	tlsClientAuthorizations := app.StringArray{}
+	flagSet.Var(&tlsClientAuthorizations, "tls-client-authorization", "JSON {\"identity\":...,\"topic\":...,\"channels\":[...],\"permissions\":[\"subscribe\",\"publish\"]} granting clients whose certificate has identity as its CN or a SAN the permissions on matching topics and channels (regexps), once given only authorized clients may PUB or SUB, requires --tls-client-auth-policy=require-verify (may be given multiple times, or as [[tls_client_authorization]] config file sections)")
 	tlsRequired := tlsRequiredOption(opts.TLSRequired)
 	tlsMinVersion := tlsMinVersionOption(opts.TLSMinVersion)
 	flagSet.Var(&tlsRequired, "tls-required", "require TLS for client connections (true, false, tcp-https)")
@@ -80,7 +80,7 @@ func (p *program) Start() error {
 	options.Resolve(opts, flagSet, cfg)
 	nsqlookupd, err := nsqlookupd.New(opts)
 	if err != nil {
-		logFatal("failed to instantiate nsqlookupd", err)
+		logFatal("failed to instantiate nsqlookupd - %s", err)
 	}
 	p.nsqlookupd = nsqlookupd
 
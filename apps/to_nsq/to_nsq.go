@@ -5,6 +5,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -23,6 +24,8 @@ import (
 var (
 	topic     = flag.String("topic", "", "NSQ topic to publish to")
 	delimiter = flag.String("delimiter", "\n", "character to split input from stdin")
+	batchSize = flag.Int("batch-size", 1, "number of messages to publish together with MPUB, the last batch is published at the end of stdin")
+	format    = flag.String("format", "raw", "format of the input from stdin: raw (each is a message body) or json (each is a message as exported by nsqd's /channel/export, its body is published)")
 
 	destNsqdTCPAddrs = app.StringArray{}
 )
@@ -46,6 +49,14 @@ func main() {
 		log.Fatal("--delimiter must be a single byte")
 	}
 
+	if *batchSize < 1 {
+		log.Fatal("--batch-size must be >= 1")
+	}
+
+	if *format != "raw" && *format != "json" {
+		log.Fatal("--format must be one of raw or json")
+	}
+
 	stopChan := make(chan bool)
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
@@ -65,6 +76,7 @@ func main() {
 	if len(producers) == 0 {
 		log.Fatal("--nsqd-tcp-address required")
 	}
+	p := &publisher{producers: producers, batchSize: *batchSize}
 
 	throttleEnabled := *rate >= 1
 	balance := int64(1)
@@ -98,10 +110,10 @@ func main() {
 				if currentBalance <= 0 {
 					time.Sleep(interval)
 				}
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(r, delim, p)
 				atomic.AddInt64(&balance, -1)
 			} else {
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(r, delim, p)
 			}
 			if err != nil {
 				if err != io.EOF {
@@ -123,26 +135,79 @@ func main() {
 	}
 }
 
+// publisher publishes messages to all of its producers, in batches of
+// batchSize
+type publisher struct {
+	producers map[string]*nsq.Producer
+	batchSize int
+	batch     [][]byte
+}
+
+func (p *publisher) add(msg []byte) error {
+	p.batch = append(p.batch, msg)
+	if len(p.batch) < p.batchSize {
+		return nil
+	}
+	return p.flush()
+}
+
+// flush publishes the messages added since the last batch
+func (p *publisher) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	for _, producer := range p.producers {
+		var err error
+		if len(p.batch) == 1 {
+			err = producer.Publish(*topic, p.batch[0])
+		} else {
+			err = producer.MultiPublish(*topic, p.batch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.batch = nil
+	return nil
+}
+
+// exportedMessage is a message as exported by nsqd's /channel/export (its
+// headers aren't republished, go-nsq can't publish them)
+type exportedMessage struct {
+	Body string `json:"body"`
+}
+
 // readAndPublish reads to the delim from r and publishes the bytes
-// to the map of producers.
-func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Producer) error {
+// with p, flushing it at the end of r.
+func readAndPublish(r *bufio.Reader, delim byte, p *publisher) error {
 	line, readErr := r.ReadBytes(delim)
 
-	if len(line) > 0 {
+	if len(line) > 0 && line[len(line)-1] == delim {
 		// trim the delimiter
 		line = line[:len(line)-1]
 	}
 
-	if len(line) == 0 {
-		return readErr
+	if len(line) > 0 && *format == "json" {
+		var msg exportedMessage
+		err := json.Unmarshal(line, &msg)
+		if err != nil {
+			return fmt.Errorf("failed to decode message %q - %s", line, err)
+		}
+		line = []byte(msg.Body)
 	}
 
-	for _, producer := range producers {
-		err := producer.Publish(*topic, line)
+	if len(line) > 0 {
+		err := p.add(line)
 		if err != nil {
 			return err
 		}
 	}
 
+	if readErr == io.EOF {
+		err := p.flush()
+		if err != nil {
+			return err
+		}
+	}
 	return readErr
 }
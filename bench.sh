@@ -11,7 +11,7 @@ echo "# compiling/running nsqd"
 pushd apps/nsqd >/dev/null
 go build
 rm -f *.dat
-./nsqd --mem-queue-size=$memQueueSize --data-path=$dataPath >/dev/null 2>&1 &
+./nsqd --mem-queue-size=$memQueueSize --data-path=$dataPath --pprof >/dev/null 2>&1 &
 nsqd_pid=$!
 popd >/dev/null
 
@@ -23,8 +23,8 @@ trap cleanup INT TERM EXIT
 
 sleep 0.3
 echo "# creating topic/channel"
-curl --silent 'http://127.0.0.1:4151/create_topic?topic=sub_bench' >/dev/null 2>&1
-curl --silent 'http://127.0.0.1:4151/create_channel?topic=sub_bench&channel=ch' >/dev/null 2>&1
+curl --silent -X POST 'http://127.0.0.1:4151/topic/create?topic=sub_bench' >/dev/null 2>&1
+curl --silent -X POST 'http://127.0.0.1:4151/channel/create?topic=sub_bench&channel=ch' >/dev/null 2>&1
 
 echo "# compiling bench_reader/bench_writer"
 pushd bench >/dev/null
@@ -22,6 +22,7 @@ var (
 	channel    = flag.String("channel", "ch", "channel to receive messages on")
 	deadline   = flag.String("deadline", "", "deadline to start the benchmark run")
 	rdy        = flag.Int("rdy", 2500, "RDY count to use")
+	conns      = flag.Int("connections", runtime.GOMAXPROCS(0), "number of connections to subscribe on")
 )
 
 var totalMsgCount int64
@@ -34,7 +35,7 @@ func main() {
 
 	goChan := make(chan int)
 	rdyChan := make(chan int)
-	workers := runtime.GOMAXPROCS(0)
+	workers := *conns
 	for j := 0; j < workers; j++ {
 		wg.Add(1)
 		go func(id int) {
@@ -20,6 +20,7 @@ var (
 	size       = flag.Int("size", 200, "size of messages")
 	batchSize  = flag.Int("batch-size", 200, "batch size of messages")
 	deadline   = flag.String("deadline", "", "deadline to start the benchmark run")
+	conns      = flag.Int("connections", runtime.GOMAXPROCS(0), "number of connections to publish on")
 )
 
 var totalMsgCount int64
@@ -38,7 +39,7 @@ func main() {
 
 	goChan := make(chan int)
 	rdyChan := make(chan int)
-	for j := 0; j < runtime.GOMAXPROCS(0); j++ {
+	for j := 0; j < *conns; j++ {
 		wg.Add(1)
 		go func() {
 			pubWorker(*runfor, *tcpAddress, *batchSize, batch, *topic, rdyChan, goChan)
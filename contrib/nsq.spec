@@ -46,3 +46,4 @@ make PREFIX=/${path} DESTDIR=$RPM_BUILD_ROOT install
 /%{path}/bin/nsq_tail
 /%{path}/bin/nsq_stat
 /%{path}/bin/to_nsq
+/%{path}/bin/nsqctl
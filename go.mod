@@ -11,7 +11,6 @@ require (
 	github.com/judwhite/go-svc v1.1.2
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mreiferson/go-options v1.0.0
-	github.com/nsqio/go-diskqueue v1.0.0
 	github.com/nsqio/go-nsq v1.0.8
 	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76 // indirect
 )
@@ -91,6 +91,32 @@ func (p *Producer) IsInconsistent(numLookupd int) bool {
 	return len(p.RemoteAddresses) != numLookupd
 }
 
+// RateWindows are per second rates over the last 1m and 5m
+type RateWindows struct {
+	M1 float64 `json:"1m"`
+	M5 float64 `json:"5m"`
+}
+
+func (w *RateWindows) Add(a RateWindows) {
+	w.M1 += a.M1
+	w.M5 += a.M5
+}
+
+// MessageRates are the rates nsqd reports for a topic or channel
+type MessageRates struct {
+	Published RateWindows `json:"published"`
+	Delivered RateWindows `json:"delivered"`
+	Finished  RateWindows `json:"finished"`
+	Requeued  RateWindows `json:"requeued"`
+}
+
+func (r *MessageRates) Add(a MessageRates) {
+	r.Published.Add(a.Published)
+	r.Delivered.Add(a.Delivered)
+	r.Finished.Add(a.Finished)
+	r.Requeued.Add(a.Requeued)
+}
+
 type TopicStats struct {
 	Node         string          `json:"node"`
 	Hostname     string          `json:"hostname"`
@@ -102,6 +128,7 @@ type TopicStats struct {
 	NodeStats    []*TopicStats   `json:"nodes"`
 	Channels     []*ChannelStats `json:"channels"`
 	Paused       bool            `json:"paused"`
+	Rates        MessageRates    `json:"rates"`
 
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
@@ -112,6 +139,7 @@ func (t *TopicStats) Add(a *TopicStats) {
 	t.MemoryDepth += a.MemoryDepth
 	t.BackendDepth += a.BackendDepth
 	t.MessageCount += a.MessageCount
+	t.Rates.Add(a.Rates)
 	if a.Paused {
 		t.Paused = a.Paused
 	}
@@ -156,6 +184,7 @@ type ChannelStats struct {
 	NodeStats     []*ChannelStats `json:"nodes"`
 	Clients       []*ClientStats  `json:"clients"`
 	Paused        bool            `json:"paused"`
+	Rates         MessageRates    `json:"rates"`
 
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
@@ -171,6 +200,7 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.TimeoutCount += a.TimeoutCount
 	c.MessageCount += a.MessageCount
 	c.ClientCount += a.ClientCount
+	c.Rates.Add(a.Rates)
 	if a.Paused {
 		c.Paused = a.Paused
 	}
@@ -197,6 +227,7 @@ type ClientStats struct {
 	UserAgent         string        `json:"user_agent"`
 	ConnectTs         int64         `json:"connect_ts"`
 	ConnectedDuration time.Duration `json:"connected"`
+	LastHeartbeatTs   int64         `json:"last_heartbeat_ts"`
 	InFlightCount     int           `json:"in_flight_count"`
 	ReadyCount        int           `json:"ready_count"`
 	FinishCount       int64         `json:"finish_count"`
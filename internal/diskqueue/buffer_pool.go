@@ -0,0 +1,47 @@
+package diskqueue
+
+import (
+	"sync"
+)
+
+// records of up to maxPooledReadSize bytes are read into buffers from
+// readPools, which a reader hands back with Recycle once it's done with
+// what it got from ReadChan
+
+const (
+	minPooledReadSize = 64
+	maxPooledReadSize = 64 * 1024
+)
+
+// readPools[i] holds buffers of minPooledReadSize<<i bytes
+var readPools [11]sync.Pool
+
+func readPoolIndex(size int) int {
+	i := 0
+	for n := minPooledReadSize; n < size; n <<= 1 {
+		i++
+	}
+	return i
+}
+
+// getReadBuf returns a buffer of size bytes, from readPools if it's small
+// enough
+func getReadBuf(size int) []byte {
+	if size > maxPooledReadSize {
+		return make([]byte, size)
+	}
+	i := readPoolIndex(size)
+	if b, ok := readPools[i].Get().([]byte); ok {
+		return b[:size]
+	}
+	return make([]byte, size, minPooledReadSize<<uint(i))
+}
+
+// putReadBuf returns b to readPools, if it came from there
+func putReadBuf(b []byte) {
+	c := cap(b)
+	if c < minPooledReadSize || c > maxPooledReadSize || c != minPooledReadSize<<uint(readPoolIndex(c)) {
+		return
+	}
+	readPools[readPoolIndex(c)].Put(b[:0])
+}
@@ -0,0 +1,112 @@
+package diskqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is how the data of FormatFramed records is compressed, each
+// record on its own (see SetCompression)
+type Compression int
+
+const (
+	CompressionNone   Compression = 0
+	CompressionGzip   Compression = 1
+	CompressionSnappy Compression = 2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression returns the Compression named s (see Compression.String)
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	}
+	return 0, fmt.Errorf("unknown diskqueue compression %q", s)
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compress returns data compressed with c and the record flag saying so,
+// or data itself and no flag if compressing it doesn't make it smaller
+// (which keeps compressed records within the size limits)
+func (c Compression) compress(data []byte) ([]byte, byte, error) {
+	var out []byte
+	var flag byte
+	switch c {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzipWriterPool.Get().(*gzip.Writer)
+		w.Reset(&buf)
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		gzipWriterPool.Put(w)
+		if err != nil {
+			return nil, 0, err
+		}
+		out, flag = buf.Bytes(), flagGzip
+	case CompressionSnappy:
+		out, flag = snappy.Encode(nil, data), flagSnappy
+	default:
+		return data, 0, nil
+	}
+	if len(out) >= len(data) {
+		return data, 0, nil
+	}
+	return out, flag, nil
+}
+
+// decompress returns the data of a record compressed as flags say, an error
+// if it's more than maxSize bytes
+func decompress(data []byte, flags byte, maxSize int32) ([]byte, error) {
+	switch {
+	case flags&flagGzip != 0:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(r, int64(maxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if n > int64(maxSize) {
+			return nil, fmt.Errorf("invalid message read size (>%d)", maxSize)
+		}
+		return buf.Bytes(), nil
+	case flags&flagSnappy != 0:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > int(maxSize) {
+			return nil, fmt.Errorf("invalid message read size (%d)", n)
+		}
+		return snappy.Decode(getReadBuf(n), data)
+	}
+	return data, nil
+}
@@ -0,0 +1,1337 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logging stuff copied from github.com/nsqio/nsq/internal/lg
+
+type LogLevel int
+
+const (
+	DEBUG = LogLevel(1)
+	INFO  = LogLevel(2)
+	WARN  = LogLevel(3)
+	ERROR = LogLevel(4)
+	FATAL = LogLevel(5)
+)
+
+type AppLogFunc func(lvl LogLevel, f string, args ...interface{})
+
+func (l LogLevel) String() string {
+	switch l {
+	case 1:
+		return "DEBUG"
+	case 2:
+		return "INFO"
+	case 3:
+		return "WARNING"
+	case 4:
+		return "ERROR"
+	case 5:
+		return "FATAL"
+	}
+	panic("invalid LogLevel")
+}
+
+// Format is the layout of the records in a queue's data files
+type Format int
+
+const (
+	// FormatLengthPrefixed records are a 4-byte big endian length followed by the data
+	FormatLengthPrefixed Format = 0
+	// FormatFramed records are a 4-byte big endian length, a 1-byte version,
+	// a 1-byte flags field, a 4-byte big endian CRC-32 (Castagnoli) of the
+	// data, followed by the data (compressed if flagGzip or flagSnappy is
+	// set, see Compression, and then encrypted if flagEncrypted is set, see
+	// Keyring)
+	FormatFramed Format = 1
+)
+
+const framedVersion = 1
+
+// FormatFramed record flags
+const (
+	flagEncrypted = 0x01
+	flagGzip      = 0x02
+	flagSnappy    = 0x04
+)
+
+const validFlags = flagEncrypted | flagGzip | flagSnappy
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func (f Format) String() string {
+	switch f {
+	case FormatLengthPrefixed:
+		return "length-prefixed"
+	case FormatFramed:
+		return "framed"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the Format named s (see Format.String)
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "length-prefixed":
+		return FormatLengthPrefixed, nil
+	case "framed":
+		return FormatFramed, nil
+	}
+	return 0, fmt.Errorf("unknown diskqueue format %q", s)
+}
+
+// headerSize returns the number of bytes preceding the data of a record
+func (f Format) headerSize() int64 {
+	if f == FormatFramed {
+		return 10
+	}
+	return 4
+}
+
+// writeRecord appends a record holding data to buf, FormatFramed records are
+// compressed with compression and encrypted if keys isn't nil
+func (f Format) writeRecord(buf *bytes.Buffer, data []byte, keys *Keyring, compression Compression) error {
+	var flags byte
+	if f == FormatFramed && compression != CompressionNone {
+		var err error
+		data, flags, err = compression.compress(data)
+		if err != nil {
+			return err
+		}
+	}
+	if f == FormatFramed && keys != nil {
+		var err error
+		data, err = keys.seal(data)
+		if err != nil {
+			return err
+		}
+		flags |= flagEncrypted
+	}
+	err := binary.Write(buf, binary.BigEndian, int32(len(data)))
+	if err != nil {
+		return err
+	}
+	if f == FormatFramed {
+		buf.WriteByte(framedVersion)
+		buf.WriteByte(flags)
+		err = binary.Write(buf, binary.BigEndian, crc32.Checksum(data, crc32c))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = buf.Write(data)
+	return err
+}
+
+// readRecord reads a record from r, returning its data (decrypted with keys
+// if it's encrypted, and decompressed if it's compressed) and total size.
+// An error other than from reading r means that the record is corrupt, or
+// can't be decrypted.
+func (f Format) readRecord(r io.Reader, minMsgSize int32, maxMsgSize int32, keys *Keyring) ([]byte, int64, error) {
+	var msgSize int32
+	err := binary.Read(r, binary.BigEndian, &msgSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	maxSize := maxMsgSize
+	if f == FormatFramed {
+		maxSize += encryptedOverhead
+	}
+	if msgSize < 0 || msgSize > maxSize {
+		return nil, 0, fmt.Errorf("invalid message read size (%d)", msgSize)
+	}
+
+	var header [6]byte
+	if f == FormatFramed {
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if header[0] != framedVersion {
+			return nil, 0, fmt.Errorf("invalid record version (%d)", header[0])
+		}
+		if header[1]&^validFlags != 0 || header[1]&flagGzip != 0 && header[1]&flagSnappy != 0 {
+			return nil, 0, fmt.Errorf("invalid record flags (%d)", header[1])
+		}
+	}
+	// compressed data may be smaller than any message
+	if msgSize < minMsgSize && header[1]&(flagGzip|flagSnappy) == 0 {
+		return nil, 0, fmt.Errorf("invalid message read size (%d)", msgSize)
+	}
+
+	readBuf := getReadBuf(int(msgSize))
+	_, err = io.ReadFull(r, readBuf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if f == FormatFramed {
+		checksum := binary.BigEndian.Uint32(header[2:])
+		if crc32.Checksum(readBuf, crc32c) != checksum {
+			return nil, 0, ErrChecksumMismatch
+		}
+	}
+
+	if header[1]&flagEncrypted != 0 {
+		if keys == nil {
+			return nil, 0, errors.New("record is encrypted and there are no keys")
+		}
+		ciphertext := readBuf
+		readBuf, err = keys.open(ciphertext)
+		if err != nil {
+			return nil, 0, err
+		}
+		putReadBuf(ciphertext)
+	}
+
+	if header[1]&(flagGzip|flagSnappy) != 0 {
+		compressed := readBuf
+		readBuf, err = decompress(compressed, header[1], maxMsgSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		putReadBuf(compressed)
+	}
+
+	if header[1] != 0 && (int32(len(readBuf)) < minMsgSize || int32(len(readBuf)) > maxMsgSize) {
+		return nil, 0, fmt.Errorf("invalid message read size (%d)", len(readBuf))
+	}
+
+	return readBuf, f.headerSize() + int64(msgSize), nil
+}
+
+// ErrChecksumMismatch is returned reading a FormatFramed record whose data
+// doesn't match its CRC-32, i.e. bit rot or a partial write
+var ErrChecksumMismatch = errors.New("record checksum mismatch")
+
+type Interface interface {
+	Put([]byte) error
+	PutBatch([][]byte) error
+	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	Recycle([]byte)
+	Close() error
+	Delete() error
+	Depth() int64
+	SkippedCount() int64
+	ChecksumErrorCount() int64
+	DiskBytes() int64
+	CompressionStats() (int64, int64)
+	Peek(func([]byte) error) error
+	SetMaxBytesPerFile(int64)
+	SetReadBufferSize(int)
+	SetMaxWriteRate(int64)
+	WriteThrottle() (bool, int64)
+	SetMmapReads(bool)
+	SetCompression(Compression)
+	Empty() error
+	Sync() error
+	Positions() (int64, int64, int64, int64, error)
+}
+
+// diskQueue implements a filesystem backed FIFO queue
+type diskQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+
+	// run-time state (also persisted to disk)
+	readPos      int64
+	writePos     int64
+	readFileNum  int64
+	writeFileNum int64
+	depth        int64
+
+	// messages lost to corruption, and records that failed their checksum
+	// (not persisted)
+	skipped        int64
+	checksumErrors int64
+
+	// the size of the queue's data files
+	diskBytes int64
+
+	// the size of the data of the records written, before and after
+	// compression (not persisted)
+	uncompressedBytes int64
+	compressedBytes   int64
+
+	// the size the next file is rolled at, see SetMaxBytesPerFile
+	nextMaxBytesPerFile int64
+
+	sync.RWMutex
+
+	// instantiation time metadata
+	name            string
+	dataPath        string
+	maxBytesPerFile int64 // of the file being written, changes when it's rolled
+	minMsgSize      int32
+	maxMsgSize      int32
+	syncEvery       int64         // number of writes per fsync
+	syncTimeout     time.Duration // duration of time per fsync
+	readBufferSize  int32         // size of the buffered reader over each data file, see SetReadBufferSize
+	format          Format        // persisted, queues are always read in the format they were written in
+	keys            *Keyring      // FormatFramed records are encrypted with, if not nil
+	throttle        *writeThrottle
+	exitFlag        int32
+	mmapReads       int32 // see SetMmapReads
+	compression     int32 // see SetCompression
+	needSync        bool
+
+	// keeps track of the position where we have read
+	// (but not yet sent over readChan)
+	nextReadPos     int64
+	nextReadFileNum int64
+
+	readFile  *os.File
+	readMap   []byte // the mapping of readFile, if it's mmap'd
+	writeFile *os.File
+	reader    io.Reader
+	writeBuf  bytes.Buffer
+
+	// exposed via ReadChan()
+	readChan chan []byte
+
+	// internal channels
+	writeChan         chan []byte
+	writeBatchChan    chan [][]byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	syncChan          chan int
+	syncResponseChan  chan error
+	peekChan          chan position
+	exitChan          chan int
+	exitSyncChan      chan int
+
+	logf AppLogFunc
+}
+
+// position is where a queue's unread records start and end
+type position struct {
+	readFileNum  int64
+	readPos      int64
+	writeFileNum int64
+	writePos     int64
+}
+
+// DefaultReadBufferSize is the size of the buffered reader used when
+// a non-positive readBufferSize is passed to New
+const DefaultReadBufferSize = 4096
+
+// New instantiates an instance of diskQueue, retrieving metadata
+// from the filesystem and starting the read ahead goroutine
+//
+// readBufferSize controls how many bytes are read from a data file per
+// syscall, queues holding large messages benefit from larger values
+//
+// format is the record format of a new queue, an existing queue keeps
+// the format it was created with until it is empty
+//
+// keys, if not nil, encrypt the records written in FormatFramed (and
+// decrypt those read)
+func New(name string, dataPath string, maxBytesPerFile int64,
+	minMsgSize int32, maxMsgSize int32,
+	syncEvery int64, syncTimeout time.Duration, readBufferSize int,
+	format Format, keys *Keyring, logf AppLogFunc) Interface {
+	if readBufferSize <= 0 {
+		readBufferSize = DefaultReadBufferSize
+	}
+	d := diskQueue{
+		name:                name,
+		dataPath:            dataPath,
+		maxBytesPerFile:     maxBytesPerFile,
+		nextMaxBytesPerFile: maxBytesPerFile,
+		minMsgSize:          minMsgSize,
+		maxMsgSize:          maxMsgSize,
+		readChan:            make(chan []byte),
+		writeChan:           make(chan []byte),
+		writeBatchChan:      make(chan [][]byte),
+		writeResponseChan:   make(chan error),
+		emptyChan:           make(chan int),
+		peekChan:            make(chan position),
+		emptyResponseChan:   make(chan error),
+		syncChan:            make(chan int),
+		syncResponseChan:    make(chan error),
+		exitChan:            make(chan int),
+		exitSyncChan:        make(chan int),
+		syncEvery:           syncEvery,
+		syncTimeout:         syncTimeout,
+		readBufferSize:      int32(readBufferSize),
+		keys:                keys,
+		throttle:            &writeThrottle{},
+		logf:                logf,
+	}
+
+	// no need to lock here, nothing else could possibly be touching this instance
+	err := d.retrieveMetaData()
+	if err != nil && !os.IsNotExist(err) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
+	}
+
+	if d.format != format {
+		if d.readFileNum == d.writeFileNum && d.readPos == d.writePos {
+			d.format = format
+		} else {
+			d.logf(INFO, "DISKQUEUE(%s): keeping %s format until empty",
+				d.name, d.format)
+		}
+	}
+
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		if fi, err := os.Stat(d.fileName(i)); err == nil {
+			d.diskBytes += fi.Size()
+		}
+	}
+
+	go d.ioLoop()
+	return &d
+}
+
+// Depth returns the depth of the queue
+func (d *diskQueue) Depth() int64 {
+	return atomic.LoadInt64(&d.depth)
+}
+
+// SkippedCount returns the number of messages lost to corrupt data files
+// since the queue was opened. They are only known to be missing (and are
+// counted) once the reader has caught up with the writer.
+func (d *diskQueue) SkippedCount() int64 {
+	return atomic.LoadInt64(&d.skipped)
+}
+
+// ChecksumErrorCount returns the number of records that failed their
+// checksum since the queue was opened (the rest of each of their files is
+// skipped, like any other corruption)
+func (d *diskQueue) ChecksumErrorCount() int64 {
+	return atomic.LoadInt64(&d.checksumErrors)
+}
+
+// DiskBytes returns the size of the queue's data files (not counting those
+// set aside as .bad)
+func (d *diskQueue) DiskBytes() int64 {
+	return atomic.LoadInt64(&d.diskBytes)
+}
+
+// Peek calls fn with each unread record, oldest first, without reading
+// them from the queue. It stops at the first error, from fn or reading a
+// record.
+//
+// Peek reads the records that were unread when it was called, those read
+// from the queue since may be skipped.
+func (d *diskQueue) Peek(fn func([]byte) error) error {
+	var p position
+	select {
+	case p = <-d.peekChan:
+	case <-d.exitChan:
+		return errors.New("exiting")
+	}
+
+	for fileNum := p.readFileNum; fileNum <= p.writeFileNum; fileNum++ {
+		var pos int64
+		if fileNum == p.readFileNum {
+			pos = p.readPos
+		}
+		end := int64(-1) // until EOF
+		if fileNum == p.writeFileNum {
+			end = p.writePos
+		}
+		if pos == end {
+			break
+		}
+
+		f, err := openReadOnly(d.fileName(fileNum))
+		if os.IsNotExist(err) {
+			// read to the end (and removed) since
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		reader := bufio.NewReaderSize(f, int(atomic.LoadInt32(&d.readBufferSize)))
+
+		for end < 0 || pos < end {
+			buf, totalBytes, err := d.format.readRecord(reader, d.minMsgSize, d.maxMsgSize, d.keys)
+			if err == io.EOF && end < 0 {
+				break
+			}
+			if err == nil {
+				err = fn(buf)
+			}
+			if err != nil {
+				f.Close()
+				return err
+			}
+			pos += totalBytes
+		}
+		f.Close()
+	}
+
+	return nil
+}
+
+// SetMaxBytesPerFile changes the size files are rolled at, from the next
+// file written on (files are read whatever size they were written with)
+func (d *diskQueue) SetMaxBytesPerFile(maxBytesPerFile int64) {
+	atomic.StoreInt64(&d.nextMaxBytesPerFile, maxBytesPerFile)
+}
+
+// SetReadBufferSize changes the size of the buffered reader over each data
+// file (DefaultReadBufferSize if it's not positive), from the next file
+// opened for reading on
+func (d *diskQueue) SetReadBufferSize(readBufferSize int) {
+	if readBufferSize <= 0 {
+		readBufferSize = DefaultReadBufferSize
+	}
+	atomic.StoreInt32(&d.readBufferSize, int32(readBufferSize))
+}
+
+// SetMaxWriteRate limits Put and PutBatch to bytesPerSec bytes of data per
+// second (0 for no limit), they wait (without holding up reads) until a
+// write is within it
+func (d *diskQueue) SetMaxWriteRate(bytesPerSec int64) {
+	d.throttle.setRate(bytesPerSec)
+}
+
+// SetMmapReads sets whether files behind the one being written (which
+// won't grow any more) are memory-mapped to be read, rather than read
+// through a buffered reader. Records are still copied out of the mapping,
+// as what's returned by ReadChan outlives it. It is ignored (with a
+// warning) on platforms without mmap.
+func (d *diskQueue) SetMmapReads(enabled bool) {
+	if enabled && !mmapSupported {
+		d.logf(WARN, "DISKQUEUE(%s): mmap reads are not supported on this platform", d.name)
+		enabled = false
+	}
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&d.mmapReads, v)
+}
+
+// SetCompression sets how the data of the records written from now on is
+// compressed, FormatFramed queues' only (records are read however they were
+// written)
+func (d *diskQueue) SetCompression(compression Compression) {
+	atomic.StoreInt32(&d.compression, int32(compression))
+}
+
+// CompressionStats returns the size of the data of the records written
+// since the queue was opened, before and after compression (and encryption)
+func (d *diskQueue) CompressionStats() (int64, int64) {
+	return atomic.LoadInt64(&d.uncompressedBytes), atomic.LoadInt64(&d.compressedBytes)
+}
+
+// WriteThrottle returns whether a write is waiting on the max write rate,
+// and how many writes have had to
+func (d *diskQueue) WriteThrottle() (bool, int64) {
+	return atomic.LoadInt64(&d.throttle.waiting) > 0, atomic.LoadInt64(&d.throttle.throttledCount)
+}
+
+// ReadChan returns the receive-only []byte channel for reading data
+func (d *diskQueue) ReadChan() <-chan []byte {
+	return d.readChan
+}
+
+// Recycle hands back a buffer received from ReadChan, for a later read to
+// reuse. b must not be used afterwards.
+func (d *diskQueue) Recycle(b []byte) {
+	putReadBuf(b)
+}
+
+// Put writes a []byte to the queue
+func (d *diskQueue) Put(data []byte) error {
+	d.throttle.wait(len(data), d.exitChan)
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeChan <- data
+	return <-d.writeResponseChan
+}
+
+// PutBatch writes a batch of []byte to the queue, either all of them are
+// added or (on error) none are
+func (d *diskQueue) PutBatch(data [][]byte) error {
+	var n int
+	for _, b := range data {
+		n += len(b)
+	}
+	d.throttle.wait(n, d.exitChan)
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeBatchChan <- data
+	return <-d.writeResponseChan
+}
+
+// Close cleans up the queue and persists metadata
+func (d *diskQueue) Close() error {
+	err := d.exit(false)
+	if err != nil {
+		return err
+	}
+	return d.sync()
+}
+
+func (d *diskQueue) Delete() error {
+	return d.exit(true)
+}
+
+func (d *diskQueue) exit(deleted bool) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.exitFlag = 1
+
+	if deleted {
+		d.logf(INFO, "DISKQUEUE(%s): deleting", d.name)
+	} else {
+		d.logf(INFO, "DISKQUEUE(%s): closing", d.name)
+	}
+
+	close(d.exitChan)
+	// ensure that ioLoop has exited
+	<-d.exitSyncChan
+
+	d.closeReadFile()
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	return nil
+}
+
+// Empty destructively clears out any pending data in the queue
+// by fast forwarding read positions and removing intermediate files
+func (d *diskQueue) Empty() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): emptying", d.name)
+
+	d.emptyChan <- 1
+	return <-d.emptyResponseChan
+}
+
+// Sync fsyncs the data written to the queue so far, and persists metadata,
+// rather than waiting for syncEvery writes or syncTimeout
+func (d *diskQueue) Sync() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.syncChan <- 1
+	return <-d.syncResponseChan
+}
+
+// Positions returns the file number and offset of the next read, and of the
+// next write
+func (d *diskQueue) Positions() (int64, int64, int64, int64, error) {
+	select {
+	case p := <-d.peekChan:
+		return p.readFileNum, p.readPos, p.writeFileNum, p.writePos, nil
+	case <-d.exitChan:
+		return 0, 0, 0, 0, errors.New("exiting")
+	}
+}
+
+func (d *diskQueue) deleteAllFiles() error {
+	err := d.skipToNextRWFile()
+
+	innerErr := os.Remove(d.metaDataFileName())
+	if innerErr != nil && !os.IsNotExist(innerErr) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to remove metadata file - %s", d.name, innerErr)
+		return innerErr
+	}
+
+	return err
+}
+
+func (d *diskQueue) skipToNextRWFile() error {
+	var err error
+
+	d.closeReadFile()
+
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	for i := d.readFileNum; i <= d.writeFileNum; i++ {
+		fn := d.fileName(i)
+		innerErr := os.Remove(fn)
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
+			err = innerErr
+		}
+	}
+
+	d.writeFileNum++
+	d.writePos = 0
+	d.readFileNum = d.writeFileNum
+	d.readPos = 0
+	d.nextReadFileNum = d.writeFileNum
+	d.nextReadPos = 0
+	atomic.StoreInt64(&d.depth, 0)
+	atomic.StoreInt64(&d.diskBytes, 0)
+
+	return err
+}
+
+// readOne performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (d *diskQueue) readOne() ([]byte, error) {
+	var err error
+
+	if d.readFile == nil {
+		curFileName := d.fileName(d.readFileNum)
+		d.readFile, err = openReadOnly(curFileName)
+		if err != nil {
+			return nil, err
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
+
+		if atomic.LoadInt32(&d.mmapReads) == 1 && d.readFileNum < d.writeFileNum {
+			d.mapReadFile()
+		}
+		if d.readMap != nil {
+			d.reader = bytes.NewReader(d.readMap[d.readPos:])
+		} else {
+			if d.readPos > 0 {
+				_, err = d.readFile.Seek(d.readPos, 0)
+				if err != nil {
+					d.closeReadFile()
+					return nil, err
+				}
+			}
+
+			d.reader = bufio.NewReaderSize(d.readFile, int(atomic.LoadInt32(&d.readBufferSize)))
+		}
+	}
+
+	// on a corrupt record we have no reasonable guarantee on
+	// where a new message should begin
+	readBuf, totalBytes, err := d.format.readRecord(d.reader, d.minMsgSize, d.maxMsgSize, d.keys)
+	if err != nil {
+		if err == ErrChecksumMismatch {
+			atomic.AddInt64(&d.checksumErrors, 1)
+		}
+		d.closeReadFile()
+		return nil, err
+	}
+
+	// we only advance next* because we have not yet sent this to consumers
+	// (where readFileNum, readPos will actually be advanced)
+	d.nextReadPos = d.readPos + totalBytes
+	d.nextReadFileNum = d.readFileNum
+
+	// files behind the one being written are complete, whatever
+	// maxBytesPerFile was when they were written
+	if (d.nextReadPos >= d.maxBytesPerFile || d.readFileNum < d.writeFileNum) &&
+		d.readFileDone() {
+		d.closeReadFile()
+
+		d.nextReadFileNum++
+		d.nextReadPos = 0
+	}
+
+	return readBuf, nil
+}
+
+// mapReadFile maps the (complete) read file into readMap, leaving readMap nil
+// (so the file is read instead) if it can't be mapped
+func (d *diskQueue) mapReadFile() {
+	fi, err := d.readFile.Stat()
+	if err != nil || fi.Size() == 0 || fi.Size() < d.readPos {
+		return
+	}
+	d.readMap, err = mmapFile(d.readFile, fi.Size())
+	if err != nil {
+		d.logf(WARN, "DISKQUEUE(%s): failed to mmap %s, reading it instead - %s",
+			d.name, d.readFile.Name(), err)
+		d.readMap = nil
+	}
+}
+
+func (d *diskQueue) closeReadFile() {
+	if d.readMap != nil {
+		munmapFile(d.readMap)
+		d.readMap = nil
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+}
+
+// readFileDone returns whether everything in the (full) read file has been
+// read, a batch (see PutBatch) can take a file beyond maxBytesPerFile
+func (d *diskQueue) readFileDone() bool {
+	if d.readFileNum == d.writeFileNum {
+		return d.nextReadPos >= d.writePos
+	}
+	if d.readFile == nil {
+		return true
+	}
+	fi, err := d.readFile.Stat()
+	if err != nil {
+		return true
+	}
+	return d.nextReadPos >= fi.Size()
+}
+
+// writeOne performs a low level filesystem write for one or more []byte
+// (all in one write, so that either all or none of them are added)
+// while advancing write positions and rolling files, if necessary
+func (d *diskQueue) writeOne(data ...[]byte) error {
+	var err error
+
+	if d.writeFile == nil {
+		curFileName := d.fileName(d.writeFileNum)
+		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+
+		if d.writePos > 0 {
+			_, err = d.writeFile.Seek(d.writePos, 0)
+			if err != nil {
+				d.writeFile.Close()
+				d.writeFile = nil
+				return err
+			}
+		}
+	}
+
+	d.writeBuf.Reset()
+	compression := Compression(atomic.LoadInt32(&d.compression))
+	var dataBytes int64
+	for _, b := range data {
+		dataLen := int32(len(b))
+
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+		}
+
+		err = d.format.writeRecord(&d.writeBuf, b, d.keys, compression)
+		if err != nil {
+			return err
+		}
+		dataBytes += int64(dataLen)
+	}
+
+	// only write to the file once
+	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	if err != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+		return err
+	}
+
+	totalBytes := int64(d.writeBuf.Len())
+	d.writePos += totalBytes
+	atomic.AddInt64(&d.diskBytes, totalBytes)
+	atomic.AddInt64(&d.uncompressedBytes, dataBytes)
+	atomic.AddInt64(&d.compressedBytes, totalBytes-int64(len(data))*d.format.headerSize())
+	atomic.AddInt64(&d.depth, int64(len(data)))
+
+	if d.writePos >= d.maxBytesPerFile {
+		d.writeFileNum++
+		d.writePos = 0
+		d.maxBytesPerFile = atomic.LoadInt64(&d.nextMaxBytesPerFile)
+
+		// sync every time we start writing to a new file
+		err = d.sync()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+		}
+
+		if d.writeFile != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+		}
+	}
+
+	return err
+}
+
+// sync fsyncs the current writeFile and persists metadata
+func (d *diskQueue) sync() error {
+	if d.writeFile != nil {
+		err := d.writeFile.Sync()
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+	}
+
+	err := d.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	d.needSync = false
+	return nil
+}
+
+// retrieveMetaData initializes state from the filesystem
+func (d *diskQueue) retrieveMetaData() error {
+	var f *os.File
+	var err error
+
+	fileName := d.metaDataFileName()
+	f, err = openReadOnly(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var depth int64
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&depth,
+		&d.readFileNum, &d.readPos,
+		&d.writeFileNum, &d.writePos)
+	if err != nil {
+		return err
+	}
+	// the format line is omitted for FormatLengthPrefixed (predating it)
+	_, err = fmt.Fscanf(f, "%d\n", &d.format)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	atomic.StoreInt64(&d.depth, depth)
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
+
+	return nil
+}
+
+// persistMetaData atomically writes state to the filesystem
+func (d *diskQueue) persistMetaData() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n%d,%d\n%d,%d\n",
+		atomic.LoadInt64(&d.depth),
+		d.readFileNum, d.readPos,
+		d.writeFileNum, d.writePos)
+	if d.format != FormatLengthPrefixed {
+		fmt.Fprintf(&buf, "%d\n", d.format)
+	}
+	return writeFileAtomic(d.metaDataFileName(), buf.Bytes())
+}
+
+// writeFileAtomic replaces fileName with data, written and fsynced to a
+// tmp file that's renamed over it, so that after a crash it has either its
+// old or its new contents. The directory is synced last (see syncDir),
+// which also makes the data files created in it since durable.
+func writeFileAtomic(fileName string, data []byte) error {
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tmpFileName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	return syncDir(filepath.Dir(fileName))
+}
+
+func (d *diskQueue) metaDataFileName() string {
+	return filepath.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.meta.dat", d.name))
+}
+
+// Exists returns whether the named queue has a metadata file in dataPath,
+// i.e. whether it has been opened (and closed or synced) there
+func Exists(name string, dataPath string) bool {
+	d := diskQueue{name: name, dataPath: dataPath}
+	_, err := os.Stat(d.metaDataFileName())
+	return err == nil
+}
+
+func (d *diskQueue) fileName(fileNum int64) string {
+	return filepath.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", d.name, fileNum))
+}
+
+func (d *diskQueue) checkTailCorruption(depth int64) {
+	if d.readFileNum < d.writeFileNum || d.readPos < d.writePos {
+		return
+	}
+
+	// we've reached the end of the diskqueue
+	// if depth isn't 0 something went wrong
+	if depth != 0 {
+		if depth < 0 {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) negative depth at tail (%d), metadata corruption, resetting 0...",
+				d.name, depth)
+		} else if depth > 0 {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) positive depth at tail (%d), data loss, resetting 0...",
+				d.name, depth)
+			atomic.AddInt64(&d.skipped, depth)
+		}
+		// force set depth 0
+		atomic.StoreInt64(&d.depth, 0)
+		d.needSync = true
+	}
+
+	if d.readFileNum != d.writeFileNum || d.readPos != d.writePos {
+		if d.readFileNum > d.writeFileNum {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) readFileNum > writeFileNum (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
+				d.name, d.readFileNum, d.writeFileNum)
+		}
+
+		if d.readPos > d.writePos {
+			d.logf(ERROR,
+				"DISKQUEUE(%s) readPos > writePos (%d > %d), corruption, skipping to next writeFileNum and resetting 0...",
+				d.name, d.readPos, d.writePos)
+		}
+
+		d.skipToNextRWFile()
+		d.needSync = true
+	}
+}
+
+func (d *diskQueue) moveForward() {
+	oldReadFileNum := d.readFileNum
+	d.readFileNum = d.nextReadFileNum
+	d.readPos = d.nextReadPos
+
+	// see if we need to clean up the old file
+	if oldReadFileNum != d.nextReadFileNum {
+		// sync every time we start reading from a new file
+		d.needSync = true
+
+		fn := d.fileName(oldReadFileNum)
+		d.forgetFile(fn)
+		err := os.Remove(fn)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+		}
+	}
+
+	if d.writePos >= reclaimWriteFileSize {
+		d.maybeReclaimWriteFile()
+	}
+
+	// depth is only changed by ioLoop, decrementing it last publishes the
+	// positions above to whoever sees the new depth
+	depth := atomic.AddInt64(&d.depth, -1)
+	d.checkTailCorruption(depth)
+}
+
+// reclaimWriteFileSize is the size from which the write file is reclaimed
+// as soon as it has been read to the end, smaller ones wait for the next
+// syncTimeout, so that a reader keeping up with the writer doesn't cost a
+// sync per message
+const reclaimWriteFileSize = 1 << 20
+
+// maybeReclaimWriteFile removes the write file if it has been read to the
+// end, rather than leaving it to grow to maxBytesPerFile, starting the next
+// one
+func (d *diskQueue) maybeReclaimWriteFile() {
+	if d.readFileNum != d.writeFileNum || d.readPos != d.writePos || d.writePos == 0 {
+		return
+	}
+
+	d.closeReadFile()
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	fn := d.fileName(d.writeFileNum)
+	d.forgetFile(fn)
+	err := os.Remove(fn)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+	}
+
+	d.writeFileNum++
+	d.writePos = 0
+	d.maxBytesPerFile = atomic.LoadInt64(&d.nextMaxBytesPerFile)
+	d.readFileNum = d.writeFileNum
+	d.readPos = 0
+	d.nextReadFileNum = d.writeFileNum
+	d.nextReadPos = 0
+	d.needSync = true
+}
+
+// forgetFile stops counting the size of a data file that's about to be
+// removed (or set aside) in DiskBytes
+func (d *diskQueue) forgetFile(fn string) {
+	if fi, err := os.Stat(fn); err == nil {
+		atomic.AddInt64(&d.diskBytes, -fi.Size())
+	}
+}
+
+func (d *diskQueue) handleReadError() {
+	// jump to the next read file and rename the current (bad) file
+	if d.readFileNum == d.writeFileNum {
+		// if you can't properly read from the current write file it's safe to
+		// assume that something is fucked and we should skip the current file too
+		if d.writeFile != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+		}
+		d.writeFileNum++
+		d.writePos = 0
+	}
+
+	badFn := d.fileName(d.readFileNum)
+	badRenameFn := badFn + ".bad"
+
+	d.logf(WARN,
+		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
+		d.name, badRenameFn)
+
+	d.forgetFile(badFn)
+	err := renameFile(badFn, badRenameFn)
+	if err != nil {
+		d.logf(ERROR,
+			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
+			d.name, badFn, badRenameFn)
+	}
+
+	d.readFileNum++
+	d.readPos = 0
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = 0
+
+	// significant state change, schedule a sync on the next iteration
+	d.needSync = true
+
+	// having skipped the write file, too, the reader is at the tail
+	d.checkTailCorruption(atomic.LoadInt64(&d.depth))
+}
+
+// ioLoop provides the backend for exposing a go channel (via ReadChan())
+// in support of multiple concurrent queue consumers
+//
+// it works by looping and branching based on whether or not the queue has data
+// to read and blocking until data is either read or written over the appropriate
+// go channels
+//
+// conveniently this also means that we're asynchronously reading from the filesystem
+func (d *diskQueue) ioLoop() {
+	var dataRead []byte
+	var err error
+	var count int64
+	var r chan []byte
+
+	syncTicker := time.NewTicker(d.syncTimeout)
+
+	for {
+		// dont sync all the time :)
+		if count >= d.syncEvery {
+			d.needSync = true
+		}
+
+		if d.needSync {
+			err = d.sync()
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+			}
+			count = 0
+		}
+
+		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+			if d.nextReadPos == d.readPos {
+				dataRead, err = d.readOne()
+				if err != nil {
+					d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+						d.name, d.readPos, d.fileName(d.readFileNum), err)
+					d.handleReadError()
+					continue
+				}
+			}
+			r = d.readChan
+		} else {
+			r = nil
+		}
+
+		select {
+		// the Go channel spec dictates that nil channel operations (read or write)
+		// in a select are skipped, we set r to d.readChan only when there is data to read
+		case r <- dataRead:
+			count++
+			// moveForward sets needSync flag if a file is removed
+			d.moveForward()
+		case <-d.emptyChan:
+			d.emptyResponseChan <- d.deleteAllFiles()
+			count = 0
+		case <-d.syncChan:
+			err = d.sync()
+			if err == nil {
+				count = 0
+			}
+			d.syncResponseChan <- err
+		case d.peekChan <- position{d.readFileNum, d.readPos, d.writeFileNum, d.writePos}:
+		case dataWrite := <-d.writeChan:
+			count++
+			d.writeResponseChan <- d.writeOne(dataWrite)
+		case batch := <-d.writeBatchChan:
+			count += int64(len(batch))
+			d.writeResponseChan <- d.writeOne(batch...)
+		case <-syncTicker.C:
+			d.maybeReclaimWriteFile()
+			if count == 0 {
+				// avoid sync when there's no activity
+				continue
+			}
+			d.needSync = true
+		case <-d.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	d.logf(INFO, "DISKQUEUE(%s): closing ... ioLoop", d.name)
+	syncTicker.Stop()
+	d.exitSyncChan <- 1
+}
+
+// ScanResult summarizes a Scan of a queue's unread data
+type ScanResult struct {
+	Depth   int64 // as recorded in the metadata file
+	Files   int
+	Records int64 // valid records before the first corrupt one
+	Bytes   int64
+
+	// location of the first corrupt record (CorruptFile is empty if none was found)
+	CorruptFile string
+	CorruptPos  int64
+	CorruptErr  error
+}
+
+// Scan reads every record between the read and write positions recorded
+// in the named queue's metadata file, verifying that each length prefix is
+// within [minMsgSize, maxMsgSize] (and checksums, for FormatFramed) and, if
+// validate is not nil, that validate accepts the record (decrypted with
+// keys, if it's encrypted). It stops at the first corrupt record.
+//
+// Scan only reads files, it is meant to be run before the queue is opened.
+func Scan(name string, dataPath string, minMsgSize int32, maxMsgSize int32,
+	keys *Keyring, validate func([]byte) error) (ScanResult, error) {
+	var result ScanResult
+
+	d := diskQueue{
+		name:     name,
+		dataPath: dataPath,
+	}
+	err := d.retrieveMetaData()
+	if err != nil {
+		return result, err
+	}
+	result.Depth = atomic.LoadInt64(&d.depth)
+
+	corrupt := func(fileNum int64, pos int64, err error) (ScanResult, error) {
+		result.CorruptFile = d.fileName(fileNum)
+		result.CorruptPos = pos
+		result.CorruptErr = err
+		return result, nil
+	}
+
+	for fileNum := d.readFileNum; fileNum <= d.writeFileNum; fileNum++ {
+		var pos int64
+		if fileNum == d.readFileNum {
+			pos = d.readPos
+		}
+		end := int64(-1) // until EOF
+		if fileNum == d.writeFileNum {
+			end = d.writePos
+		}
+		if pos == end {
+			break
+		}
+
+		f, err := openReadOnly(d.fileName(fileNum))
+		if err != nil {
+			return corrupt(fileNum, pos, err)
+		}
+		result.Files++
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			f.Close()
+			return result, err
+		}
+		reader := bufio.NewReaderSize(f, DefaultReadBufferSize)
+
+		for end < 0 || pos < end {
+			buf, totalBytes, err := d.format.readRecord(reader, minMsgSize, maxMsgSize, keys)
+			if err == io.EOF && end < 0 {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return corrupt(fileNum, pos, err)
+			}
+			if validate != nil {
+				err = validate(buf)
+				if err != nil {
+					f.Close()
+					return corrupt(fileNum, pos, err)
+				}
+			}
+			pos += totalBytes
+			result.Records++
+			result.Bytes += totalBytes
+		}
+		f.Close()
+	}
+
+	return result, nil
+}
@@ -0,0 +1,1547 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Equal(t *testing.T, expected, actual interface{}) {
+	if !reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\t   %#v (expected)\n\n\t!= %#v (actual)\033[39m\n\n",
+			filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+}
+
+func NotEqual(t *testing.T, expected, actual interface{}) {
+	if reflect.DeepEqual(expected, actual) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\tnexp: %#v\n\n\tgot:  %#v\033[39m\n\n",
+			filepath.Base(file), line, expected, actual)
+		t.FailNow()
+	}
+}
+
+func Nil(t *testing.T, object interface{}) {
+	if !isNil(object) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\t   <nil> (expected)\n\n\t!= %#v (actual)\033[39m\n\n",
+			filepath.Base(file), line, object)
+		t.FailNow()
+	}
+}
+
+func NotNil(t *testing.T, object interface{}) {
+	if isNil(object) {
+		_, file, line, _ := runtime.Caller(1)
+		t.Logf("\033[31m%s:%d:\n\n\tExpected value not to be <nil>\033[39m\n\n",
+			filepath.Base(file), line)
+		t.FailNow()
+	}
+}
+
+func isNil(object interface{}) bool {
+	if object == nil {
+		return true
+	}
+
+	value := reflect.ValueOf(object)
+	kind := value.Kind()
+	if kind >= reflect.Chan && kind <= reflect.Slice && value.IsNil() {
+		return true
+	}
+
+	return false
+}
+
+type tbLog interface {
+	Log(...interface{})
+}
+
+func NewTestLogger(tbl tbLog) AppLogFunc {
+	return func(lvl LogLevel, f string, args ...interface{}) {
+		tbl.Log(fmt.Sprintf(lvl.String()+": "+f, args...))
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	l := NewTestLogger(t)
+
+	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	msg := []byte("test")
+	err = dq.Put(msg)
+	Nil(t, err)
+	Equal(t, int64(1), dq.Depth())
+
+	msgOut := <-dq.ReadChan()
+	Equal(t, msg, msgOut)
+}
+
+func TestDiskQueueRoll(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := bytes.Repeat([]byte{0}, 10)
+	ml := int64(len(msg))
+	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	for i := 0; i < 10; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(0), dq.(*diskQueue).writePos)
+}
+
+func TestDiskQueueWriteThrottle(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_write_throttle" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<20, 4, 1<<12, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	// a burst of 1000 bytes, then 1000 bytes every 100ms
+	dq.SetMaxWriteRate(10000)
+	msg := make([]byte, 1000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	Equal(t, true, time.Since(start) >= 250*time.Millisecond)
+	throttled, count := dq.WriteThrottle()
+	Equal(t, false, throttled)
+	Equal(t, int64(3), count)
+
+	dq.SetMaxWriteRate(0)
+	start = time.Now()
+	Nil(t, dq.PutBatch([][]byte{msg, msg, msg}))
+	Nil(t, dq.Put(msg))
+	Equal(t, true, time.Since(start) < 100*time.Millisecond)
+	_, count = dq.WriteThrottle()
+	Equal(t, int64(3), count)
+}
+
+func TestDiskQueueRecycle(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_recycle" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<20, 4, 1<<20, 2500, 2*time.Second, 0, FormatFramed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	sizes := []int{10, 100, 100, 5000, maxPooledReadSize + 1, 100}
+	for i, size := range sizes {
+		Nil(t, dq.Put(bytes.Repeat([]byte{byte('a' + i)}, size)))
+	}
+	for i, size := range sizes {
+		b := <-dq.ReadChan()
+		Equal(t, bytes.Repeat([]byte{byte('a' + i)}, size), b)
+		if size <= maxPooledReadSize {
+			Equal(t, minPooledReadSize<<uint(readPoolIndex(size)), cap(b))
+		}
+		// the next read may reuse b
+		dq.Recycle(b)
+	}
+
+	// buffers of other sizes are left alone
+	putReadBuf(make([]byte, 100))
+	Equal(t, 128, cap(getReadBuf(100)))
+}
+
+func TestDiskQueueMmapReads(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_mmap_reads" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1000, 4, 1<<10, 2500, 2*time.Second, 0, FormatFramed, nil, l)
+	NotNil(t, dq)
+	dq.SetMmapReads(true)
+
+	msg := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 10+i)
+	}
+	for i := 0; i < 100; i++ {
+		Nil(t, dq.Put(msg(i)))
+	}
+	for i := 0; i < 50; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+	dq.Close()
+
+	// picks up mid-file
+	dq = New(dqName, tmpDir, 1000, 4, 1<<10, 2500, 2*time.Second, 0, FormatFramed, nil, l)
+	defer dq.Close()
+	dq.SetMmapReads(true)
+	for i := 50; i < 100; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+	// the last read is only counted once ioLoop moves forward
+	for i := 0; i < 100 && dq.Depth() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), dq.ChecksumErrorCount())
+
+	// and the file being written is read as before
+	Nil(t, dq.Put(msg(0)))
+	Equal(t, msg(0), <-dq.ReadChan())
+}
+
+func TestDiskQueueSetReadBufferSize(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_set_read_buffer_size" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<20, 0, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	Equal(t, int32(DefaultReadBufferSize), atomic.LoadInt32(&dq.(*diskQueue).readBufferSize))
+
+	// records larger than the buffer are still read whole
+	dq.SetReadBufferSize(16)
+	Equal(t, int32(16), atomic.LoadInt32(&dq.(*diskQueue).readBufferSize))
+	msg := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 3; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
+	dq.SetReadBufferSize(0)
+	Equal(t, int32(DefaultReadBufferSize), atomic.LoadInt32(&dq.(*diskQueue).readBufferSize))
+}
+
+func TestDiskQueueSetMaxBytesPerFile(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_set_max_bytes_per_file" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ml := int64(10)
+	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	n := 0
+	put := func(count int) {
+		for i := 0; i < count; i++ {
+			err := dq.Put([]byte(fmt.Sprintf("%010d", n)))
+			Nil(t, err)
+			n++
+		}
+	}
+	read := func(from int, count int) {
+		for i := from; i < from+count; i++ {
+			Equal(t, []byte(fmt.Sprintf("%010d", i)), <-dq.ReadChan())
+		}
+	}
+
+	// from the next file on
+	put(5)
+	dq.SetMaxBytesPerFile(3 * (ml + 4))
+	read(0, 4)
+	put(5)
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	put(3)
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+
+	// raised, files written with the smaller size are still read to their end
+	dq.SetMaxBytesPerFile(100 * (ml + 4))
+	put(10)
+	Equal(t, int64(3), dq.(*diskQueue).writeFileNum)
+	read(4, 19)
+	for i := 0; i < 100 && dq.Depth() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), dq.SkippedCount())
+}
+
+func TestDiskQueuePutBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ml := int64(10)
+	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := func(i int) []byte {
+		return []byte(fmt.Sprintf("message %02d", i))[:ml]
+	}
+
+	// a batch with an invalid message is not written at all
+	err = dq.PutBatch([][]byte{msg(0), []byte("short"), msg(1)})
+	NotNil(t, err)
+	Equal(t, int64(0), dq.Depth())
+
+	// a batch is written to one file, even beyond maxBytesPerFile
+	dq.Put(msg(0))
+	var batch [][]byte
+	for i := 1; i < 25; i++ {
+		batch = append(batch, msg(i))
+	}
+	Nil(t, dq.PutBatch(batch))
+	Nil(t, dq.Put(msg(25)))
+	Equal(t, int64(26), dq.Depth())
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(ml+4), dq.(*diskQueue).writePos)
+
+	for i := 0; i < 26; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+	// depth is decremented once the last message has been handed over
+	for i := 0; i < 100 && dq.Depth() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueReclaimOnEmpty(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_reclaim_on_empty" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ml := int64(10)
+	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 1, 50*time.Millisecond, 0, FormatLengthPrefixed, nil, l)
+
+	msg := []byte("0123456789")
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	Equal(t, 5*(ml+4), dq.DiskBytes())
+
+	// the write file is removed on the next syncTimeout once it's read to
+	// the end
+	for i := 0; i < 5; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	for i := 0; i < 100 && dq.DiskBytes() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.DiskBytes())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	Nil(t, dq.Put(msg))
+	Equal(t, ml+4, dq.DiskBytes())
+	_, err = os.Stat(dq.(*diskQueue).fileName(1))
+	Nil(t, err)
+	Equal(t, msg, <-dq.ReadChan())
+	for i := 0; i < 100 && dq.DiskBytes() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.DiskBytes())
+
+	// and the queue restarts from the next file
+	dq.Close()
+	dq = New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 1, 50*time.Millisecond, 0, FormatLengthPrefixed, nil, l)
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), dq.DiskBytes())
+	Nil(t, dq.Put(msg))
+	Equal(t, msg, <-dq.ReadChan())
+	dq.Close()
+}
+
+func TestDiskQueueReclaimBySize(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_reclaim_by_size" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := make([]byte, 1<<10)
+	n := reclaimWriteFileSize/(int64(len(msg))+4) + 1
+	dq := New(dqName, tmpDir, 4*reclaimWriteFileSize, int32(len(msg)), int32(len(msg)), 1<<20, time.Hour, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	// a small write file read to the end is kept until the next syncTimeout
+	Nil(t, dq.Put(msg))
+	Equal(t, msg, <-dq.ReadChan())
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	// a large one as soon as it's read to the end
+	for i := int64(1); i < n; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	for i := int64(1); i < n; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	for i := 0; i < 100 && dq.DiskBytes() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(0), dq.DiskBytes())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+}
+
+func TestDiskQueuePeek(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_peek" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ml := int64(10)
+	dq := New(dqName, tmpDir, 10*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, 0, FormatFramed, nil, l)
+	defer dq.Close()
+
+	msg := func(i int) []byte {
+		return []byte(fmt.Sprintf("message %02d", i))[:ml]
+	}
+	for i := 0; i < 25; i++ {
+		Nil(t, dq.Put(msg(i)))
+	}
+	for i := 0; i < 3; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+
+	// unread records, across files, are peeked without being read
+	var peeked [][]byte
+	Nil(t, dq.Peek(func(b []byte) error {
+		peeked = append(peeked, b)
+		return nil
+	}))
+	Equal(t, 22, len(peeked))
+	for i, b := range peeked {
+		Equal(t, msg(i+3), b)
+	}
+	Equal(t, msg(3), <-dq.ReadChan())
+
+	stop := errors.New("stop")
+	n := 0
+	Equal(t, stop, dq.Peek(func(b []byte) error {
+		n++
+		return stop
+	}))
+	Equal(t, 1, n)
+}
+
+func assertFileNotExist(t *testing.T, fn string) {
+	f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
+	Equal(t, (*os.File)(nil), f)
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueEmpty(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := bytes.Repeat([]byte{0}, 10)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	for i := 0; i < 100; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+
+	for {
+		if dq.Depth() == 97 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	Equal(t, int64(97), dq.Depth())
+
+	numFiles := dq.(*diskQueue).writeFileNum
+	dq.Empty()
+
+	assertFileNotExist(t, dq.(*diskQueue).metaDataFileName())
+	for i := int64(0); i <= numFiles; i++ {
+		assertFileNotExist(t, dq.(*diskQueue).fileName(i))
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, dq.(*diskQueue).writeFileNum, dq.(*diskQueue).readFileNum)
+	Equal(t, dq.(*diskQueue).writePos, dq.(*diskQueue).readPos)
+	Equal(t, dq.(*diskQueue).readPos, dq.(*diskQueue).nextReadPos)
+	Equal(t, dq.(*diskQueue).readFileNum, dq.(*diskQueue).nextReadFileNum)
+
+	for i := 0; i < 100; i++ {
+		err := dq.Put(msg)
+		Nil(t, err)
+		Equal(t, int64(i+1), dq.Depth())
+	}
+
+	for i := 0; i < 100; i++ {
+		<-dq.ReadChan()
+	}
+
+	for {
+		if dq.Depth() == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, dq.(*diskQueue).writeFileNum, dq.(*diskQueue).readFileNum)
+	Equal(t, dq.(*diskQueue).writePos, dq.(*diskQueue).readPos)
+	Equal(t, dq.(*diskQueue).readPos, dq.(*diskQueue).nextReadPos)
+}
+
+func TestDiskQueueCorruption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_corruption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// require a non-zero message length for the corrupt (len 0) test below
+	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 123) // 127 bytes per message, 8 (1016 bytes) messages per file
+	for i := 0; i < 25; i++ {
+		dq.Put(msg)
+	}
+
+	Equal(t, int64(25), dq.Depth())
+
+	// corrupt the 2nd file
+	dqFn := dq.(*diskQueue).fileName(1)
+	os.Truncate(dqFn, 500) // 3 valid messages, 5 corrupted
+
+	for i := 0; i < 19; i++ { // 1 message leftover in 4th file
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
+	// corrupt the 4th (current) file
+	dqFn = dq.(*diskQueue).fileName(3)
+	os.Truncate(dqFn, 100)
+
+	dq.Put(msg) // in 5th file
+	dq.Put(msg)
+
+	// one left unread, so that the 5th file isn't reclaimed
+	Equal(t, msg, <-dq.ReadChan())
+
+	// write a corrupt (len 0) message at the 5th (current) file
+	dq.(*diskQueue).writeFile.Write([]byte{0, 0, 0, 0})
+
+	Equal(t, msg, <-dq.ReadChan())
+
+	// force a new 6th file - put into 5th, then readOne errors, then put into 6th
+	dq.Put(msg)
+	dq.Put(msg)
+
+	Equal(t, msg, <-dq.ReadChan())
+}
+
+func TestDiskQueueCorruptionSkippedCount(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_corruption_skipped" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 123) // 127 bytes per message, 8 (1016 bytes) messages per file
+	for i := 0; i < 25; i++ {
+		dq.Put(msg)
+	}
+
+	// corrupt the 2nd file
+	os.Truncate(dq.(*diskQueue).fileName(1), 500) // 3 valid messages, 5 corrupted
+
+	for i := 0; i < 20; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+
+	// the loss is known once the reader reaches the writer
+	for i := 0; i < 100 && dq.SkippedCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(5), dq.SkippedCount())
+	Equal(t, int64(0), dq.Depth())
+
+	// corrupting the current file skips the write file, too
+	dq.Put(msg)
+	dq.(*diskQueue).writeFile.Write([]byte{0, 0, 0, 0})
+	dq.Put(msg)
+	Equal(t, msg, <-dq.ReadChan())
+	for i := 0; i < 100 && dq.SkippedCount() == 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(6), dq.SkippedCount())
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueChecksumError(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_checksum_error" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, 0, FormatFramed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 117) // 127 bytes per record, 8 (1016 bytes) records per file
+	for i := 0; i < 20; i++ {
+		dq.Put(msg)
+	}
+
+	// flip a bit in the data of the 4th record of the 2nd file
+	fileName := dq.(*diskQueue).fileName(1)
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{1}, 3*127+10+5)
+	Nil(t, err)
+	f.Close()
+
+	for i := 0; i < 11; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	// the rest of the file is skipped
+	for i := 0; i < 4; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), dq.ChecksumErrorCount())
+	_, err = os.Stat(fileName + ".bad")
+	Nil(t, err)
+
+	for i := 0; i < 100 && dq.SkippedCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, int64(5), dq.SkippedCount())
+}
+
+func TestDiskQueueScan(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_scan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1000, 10, 1<<10, 5, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+
+	msg := make([]byte, 123) // 127 bytes per message, 8 (1016 bytes) messages per file
+	for i := 0; i < 25; i++ {
+		dq.Put(msg)
+	}
+	for i := 0; i < 2; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	dq.Close()
+
+	validate := func(b []byte) error {
+		if b[0] != 0 {
+			return errors.New("invalid first byte")
+		}
+		return nil
+	}
+
+	result, err := Scan(dqName, tmpDir, 10, 1<<10, nil, validate)
+	Nil(t, err)
+	Equal(t, int64(23), result.Depth)
+	Equal(t, 4, result.Files)
+	Equal(t, int64(23), result.Records)
+	Equal(t, int64(23*127), result.Bytes)
+	Equal(t, "", result.CorruptFile)
+
+	// corrupt the body of the 4th message in the 2nd file
+	fn := dq.(*diskQueue).fileName(1)
+	f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{1}, 3*127+4)
+	Nil(t, err)
+	f.Close()
+
+	result, err = Scan(dqName, tmpDir, 10, 1<<10, nil, validate)
+	Nil(t, err)
+	Equal(t, int64(6+3), result.Records)
+	Equal(t, fn, result.CorruptFile)
+	Equal(t, int64(3*127), result.CorruptPos)
+	NotNil(t, result.CorruptErr)
+
+	// and the length prefix of the 2nd message
+	f, err = os.OpenFile(fn, os.O_RDWR, 0600)
+	Nil(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, 127)
+	Nil(t, err)
+	f.Close()
+
+	result, err = Scan(dqName, tmpDir, 10, 1<<10, nil, nil)
+	Nil(t, err)
+	Equal(t, int64(6+1), result.Records)
+	Equal(t, fn, result.CorruptFile)
+	Equal(t, int64(127), result.CorruptPos)
+
+	_, err = Scan("does_not_exist", tmpDir, 10, 1<<10, nil, nil)
+	Equal(t, true, os.IsNotExist(err))
+}
+
+type md struct {
+	depth        int64
+	readFileNum  int64
+	writeFileNum int64
+	readPos      int64
+	writePos     int64
+}
+
+func readMetaDataFile(fileName string, retried int) md {
+	f, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
+	if err != nil {
+		// provide a simple retry that results in up to
+		// another 500ms for the file to be written.
+		if retried < 9 {
+			retried++
+			time.Sleep(50 * time.Millisecond)
+			return readMetaDataFile(fileName, retried)
+		}
+		panic(err)
+	}
+	defer f.Close()
+
+	var ret md
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&ret.depth,
+		&ret.readFileNum, &ret.readPos,
+		&ret.writeFileNum, &ret.writePos)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func TestDiskQueueSyncAfterRead(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_after_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<11, 0, 1<<10, 2500, 50*time.Millisecond, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 1000)
+	dq.Put(msg)
+
+	for i := 0; i < 10; i++ {
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		if d.depth == 1 &&
+			d.readFileNum == 0 &&
+			d.writeFileNum == 0 &&
+			d.readPos == 0 &&
+			d.writePos == 1004 {
+			// success
+			goto next
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("fail")
+
+next:
+	dq.Put(msg)
+	<-dq.ReadChan()
+
+	for i := 0; i < 10; i++ {
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		if d.depth == 1 &&
+			d.readFileNum == 0 &&
+			d.writeFileNum == 0 &&
+			d.readPos == 1004 &&
+			d.writePos == 2008 {
+			// success
+			goto done
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("fail")
+
+done:
+}
+
+func TestDiskQueueSync(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// neither syncEvery nor syncTimeout come around during the test
+	dq := New(dqName, tmpDir, 1<<11, 0, 1<<10, 2500, time.Hour, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 1000)
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Sync())
+
+	d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+	Equal(t, int64(1), d.depth)
+	Equal(t, int64(1004), d.writePos)
+}
+
+func TestDiskQueuePositions(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_positions" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<11, 0, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	msg := make([]byte, 1000)
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Put(msg))
+	<-dq.ReadChan()
+
+	readFileNum, readPos, writeFileNum, writePos, err := dq.Positions()
+	Nil(t, err)
+	Equal(t, []int64{0, 1004, 0, 2008}, []int64{readFileNum, readPos, writeFileNum, writePos})
+
+	// the write that fills a file moves the next one to the next file
+	Nil(t, dq.Put(msg))
+	readFileNum, readPos, writeFileNum, writePos, err = dq.Positions()
+	Nil(t, err)
+	Equal(t, []int64{0, 1004, 1, 0}, []int64{readFileNum, readPos, writeFileNum, writePos})
+}
+
+func TestDiskQueueDataPath(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_data_path" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// not a format string
+	dataPath := filepath.Join(tmpDir, "100%d")
+	Nil(t, os.Mkdir(dataPath, 0755))
+
+	dq := New(dqName, dataPath, 1024, 4, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	Nil(t, dq.Put([]byte("test")))
+	Nil(t, dq.Close())
+
+	_, err = os.Stat(filepath.Join(dataPath, dqName+".diskqueue.meta.dat"))
+	Nil(t, err)
+	_, err = os.Stat(filepath.Join(dataPath, dqName+".diskqueue.000000.dat"))
+	Nil(t, err)
+	Equal(t, true, Exists(dqName, dataPath))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "test.dat")
+	Nil(t, writeFileAtomic(fileName, []byte("old")))
+	Nil(t, writeFileAtomic(fileName, []byte("new")))
+	data, err := ioutil.ReadFile(fileName)
+	Nil(t, err)
+	Equal(t, "new", string(data))
+
+	// a failed write leaves neither the tmp file nor a change behind
+	dirName := filepath.Join(tmpDir, "test.dir")
+	Nil(t, os.Mkdir(dirName, 0755))
+	NotNil(t, writeFileAtomic(dirName, []byte("new")))
+	fi, err := os.Stat(dirName)
+	Nil(t, err)
+	Equal(t, true, fi.IsDir())
+
+	tmpFiles, err := filepath.Glob(filepath.Join(tmpDir, "*.tmp"))
+	Nil(t, err)
+	Equal(t, 0, len(tmpFiles))
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = openReadOnly(filepath.Join(tmpDir, "missing.dat"))
+	Equal(t, true, os.IsNotExist(err))
+
+	// files being read (as by Peek) can be set aside and removed by ioLoop
+	for _, name := range []string{"renamed.dat", "removed.dat"} {
+		fileName := filepath.Join(tmpDir, name)
+		Nil(t, ioutil.WriteFile(fileName, []byte("test"), 0600))
+		f, err := openReadOnly(fileName)
+		Nil(t, err)
+		if name == "renamed.dat" {
+			Nil(t, renameFile(fileName, fileName+".bad"))
+		} else {
+			Nil(t, os.Remove(fileName))
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		Nil(t, err)
+		Equal(t, "test", string(data))
+	}
+
+	Nil(t, syncDir(tmpDir))
+}
+
+func TestDiskQueueReadBufferSize(t *testing.T) {
+	l := NewTestLogger(t)
+	msgSize := 1000
+	// spans multiple files and exercises buffers both smaller and larger than a message
+	for _, bufSize := range []int{16, 512, 4096, 1 << 16} {
+		dqName := "test_disk_queue_read_buffer_size" + strconv.Itoa(bufSize) + strconv.Itoa(int(time.Now().Unix()))
+		tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+		Nil(t, err)
+		dq := New(dqName, tmpDir, int64(10*(msgSize+4)), 0, 1<<10, 2500, 2*time.Second, bufSize, FormatLengthPrefixed, nil, l)
+		NotNil(t, dq)
+
+		for i := 0; i < 25; i++ {
+			msg := bytes.Repeat([]byte{byte(i)}, msgSize)
+			Nil(t, dq.Put(msg))
+		}
+		for i := 0; i < 15; i++ {
+			msgOut := <-dq.ReadChan()
+			Equal(t, bytes.Repeat([]byte{byte(i)}, msgSize), msgOut)
+		}
+		dq.Close()
+
+		// read position accounting must not depend on how much was buffered
+		d := readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		Equal(t, int64(10), d.depth)
+		Equal(t, int64(1), d.readFileNum)
+		Equal(t, int64(5*(msgSize+4)), d.readPos)
+
+		dq = New(dqName, tmpDir, int64(10*(msgSize+4)), 0, 1<<10, 2500, 2*time.Second, bufSize, FormatLengthPrefixed, nil, l)
+		for i := 15; i < 25; i++ {
+			msgOut := <-dq.ReadChan()
+			Equal(t, bytes.Repeat([]byte{byte(i)}, msgSize), msgOut)
+		}
+		dq.Close()
+
+		d = readMetaDataFile(dq.(*diskQueue).metaDataFileName(), 0)
+		Equal(t, int64(0), d.depth)
+		Equal(t, d.writeFileNum, d.readFileNum)
+		Equal(t, d.writePos, d.readPos)
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestDiskQueueFormatRecord(t *testing.T) {
+	for _, format := range []Format{FormatLengthPrefixed, FormatFramed} {
+		var buf bytes.Buffer
+		msgs := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 100), []byte("ccc")}
+		for _, msg := range msgs {
+			Nil(t, format.writeRecord(&buf, msg, nil, CompressionNone))
+		}
+		Equal(t, int64(3)*format.headerSize()+104, int64(buf.Len()))
+
+		for _, msg := range msgs {
+			msgOut, totalBytes, err := format.readRecord(&buf, 1, 1<<10, nil)
+			Nil(t, err)
+			Equal(t, msg, msgOut)
+			Equal(t, format.headerSize()+int64(len(msg)), totalBytes)
+		}
+		Equal(t, 0, buf.Len())
+	}
+
+	// framed records are versioned and checksummed
+	var buf bytes.Buffer
+	Nil(t, FormatFramed.writeRecord(&buf, []byte("test"), nil, CompressionNone))
+	b := buf.Bytes()
+	b[len(b)-1] = 'x'
+	_, _, err := FormatFramed.readRecord(bytes.NewReader(b), 1, 1<<10, nil)
+	Equal(t, ErrChecksumMismatch, err)
+	b[4] = 2
+	_, _, err = FormatFramed.readRecord(bytes.NewReader(b), 1, 1<<10, nil)
+	Equal(t, errors.New("invalid record version (2)"), err)
+}
+
+func TestDiskQueueFormat(t *testing.T) {
+	l := NewTestLogger(t)
+	for _, format := range []Format{FormatLengthPrefixed, FormatFramed} {
+		other := FormatFramed
+		if format == FormatFramed {
+			other = FormatLengthPrefixed
+		}
+
+		dqName := "test_disk_queue_format" + format.String() + strconv.Itoa(int(time.Now().Unix()))
+		tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+		Nil(t, err)
+		dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, format, nil, l)
+		NotNil(t, dq)
+		for i := 0; i < 100; i++ {
+			Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		}
+		dq.Close()
+
+		// the format is only recorded if it isn't the original one
+		data, err := ioutil.ReadFile(dq.(*diskQueue).metaDataFileName())
+		Nil(t, err)
+		Equal(t, format == FormatFramed, bytes.HasSuffix(data, []byte("\n1\n")))
+
+		result, err := Scan(dqName, tmpDir, 1, 1<<10, nil, nil)
+		Nil(t, err)
+		Equal(t, int64(100), result.Records)
+		Equal(t, "", result.CorruptFile)
+
+		// a non-empty queue is read in the format it was written in
+		dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, other, nil, l)
+		Equal(t, format, dq.(*diskQueue).format)
+		for i := 0; i < 100; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		dq.Close()
+
+		// an empty one switches
+		dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, other, nil, l)
+		Equal(t, other, dq.(*diskQueue).format)
+		Nil(t, dq.Put([]byte("test")))
+		dq.Close()
+		dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, format, nil, l)
+		Equal(t, []byte("test"), <-dq.ReadChan())
+		dq.Close()
+
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestDiskQueueEncryption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_encryption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	_, err = NewKeyring(map[uint32][]byte{1: []byte("short")}, 1)
+	NotNil(t, err)
+	_, err = NewKeyring(map[uint32][]byte{1: key1}, 2)
+	NotNil(t, err)
+	keys1, err := NewKeyring(map[uint32][]byte{1: key1}, 1)
+	Nil(t, err)
+
+	dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, FormatFramed, keys1, l)
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte("secret"+strconv.Itoa(i))))
+	}
+	dq.Close()
+	data, err := ioutil.ReadFile(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, false, bytes.Contains(data, []byte("secret")))
+
+	// after rotating to key 2, records written with key 1 can still be read
+	keys2, err := NewKeyring(map[uint32][]byte{1: key1, 2: key2}, 2)
+	Nil(t, err)
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, FormatFramed, keys2, l)
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte("secret"+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	Nil(t, dq.Put([]byte("secret10")))
+	dq.Close()
+
+	result, err := Scan(dqName, tmpDir, 1, 1<<10, keys2, nil)
+	Nil(t, err)
+	Equal(t, int64(6), result.Records)
+	Equal(t, "", result.CorruptFile)
+	result, err = Scan(dqName, tmpDir, 1, 1<<10, nil, nil)
+	Nil(t, err)
+	Equal(t, errors.New("record is encrypted and there are no keys"), result.CorruptErr)
+	result, err = Scan(dqName, tmpDir, 1, 1<<10, keys1, nil)
+	Nil(t, err)
+	Equal(t, int64(5), result.Records)
+	Equal(t, errors.New("record encrypted with unknown key 2"), result.CorruptErr)
+
+	dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, FormatFramed, keys2, l)
+	for i := 5; i < 11; i++ {
+		Equal(t, []byte("secret"+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	dq.Close()
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	l := NewTestLogger(t)
+	keys, err := NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)}, 1)
+	Nil(t, err)
+	msg := bytes.Repeat([]byte(`{"compress":"me"}`), 20)
+
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+		for _, keys := range []*Keyring{nil, keys} {
+			dqName := "test_disk_queue_compression" + strconv.Itoa(int(time.Now().Unix()))
+			tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+			Nil(t, err)
+
+			dq := New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, FormatFramed, keys, l)
+			dq.SetCompression(compression)
+			for i := 0; i < 10; i++ {
+				Nil(t, dq.Put(msg))
+			}
+			// stored uncompressed, it doesn't get any smaller
+			Nil(t, dq.Put([]byte("x")))
+			uncompressed, compressed := dq.CompressionStats()
+			Equal(t, int64(10*len(msg)+1), uncompressed)
+			Equal(t, true, compressed < uncompressed/4)
+			dq.Close()
+
+			result, err := Scan(dqName, tmpDir, 1, 1<<10, keys, nil)
+			Nil(t, err)
+			Equal(t, int64(11), result.Records)
+			Equal(t, "", result.CorruptFile)
+
+			// records are read however they were written
+			dq = New(dqName, tmpDir, 1024, 1, 1<<10, 2500, 2*time.Second, 0, FormatFramed, keys, l)
+			for i := 0; i < 10; i++ {
+				Equal(t, msg, <-dq.ReadChan())
+			}
+			Equal(t, []byte("x"), <-dq.ReadChan())
+			dq.Close()
+			os.RemoveAll(tmpDir)
+		}
+	}
+
+	// nor do they decompress beyond maxMsgSize
+	var buf bytes.Buffer
+	Nil(t, FormatFramed.writeRecord(&buf, bytes.Repeat([]byte("a"), 1<<10), nil, CompressionGzip))
+	_, _, err = FormatFramed.readRecord(bytes.NewReader(buf.Bytes()), 1, 1<<9, nil)
+	Equal(t, errors.New("invalid message read size (>512)"), err)
+}
+
+func TestDiskQueueTorture(t *testing.T) {
+	var wg sync.WaitGroup
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_torture" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 262144, 0, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	NotNil(t, dq)
+	Equal(t, int64(0), dq.Depth())
+
+	msg := []byte("aaaaaaaaaabbbbbbbbbbccccccccccddddddddddeeeeeeeeeeffffffffff")
+
+	numWriters := 4
+	numReaders := 4
+	readExitChan := make(chan int)
+	writeExitChan := make(chan int)
+
+	var depth int64
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case <-writeExitChan:
+					return
+				default:
+					err := dq.Put(msg)
+					if err == nil {
+						atomic.AddInt64(&depth, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	time.Sleep(1 * time.Second)
+
+	dq.Close()
+
+	t.Logf("closing writeExitChan")
+	close(writeExitChan)
+	wg.Wait()
+
+	t.Logf("restarting diskqueue")
+
+	dq = New(dqName, tmpDir, 262144, 0, 1<<10, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	NotNil(t, dq)
+	Equal(t, depth, dq.Depth())
+
+	var read int64
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				time.Sleep(100000 * time.Nanosecond)
+				select {
+				case m := <-dq.ReadChan():
+					Equal(t, m, msg)
+					atomic.AddInt64(&read, 1)
+				case <-readExitChan:
+					return
+				}
+			}
+		}()
+	}
+
+	t.Logf("waiting for depth 0")
+	for {
+		if dq.Depth() == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Logf("closing readExitChan")
+	close(readExitChan)
+	wg.Wait()
+
+	Equal(t, depth, read)
+}
+
+func BenchmarkDiskQueuePut16(b *testing.B) {
+	benchmarkDiskQueuePut(16, b)
+}
+func BenchmarkDiskQueuePut64(b *testing.B) {
+	benchmarkDiskQueuePut(64, b)
+}
+func BenchmarkDiskQueuePut256(b *testing.B) {
+	benchmarkDiskQueuePut(256, b)
+}
+func BenchmarkDiskQueuePut1024(b *testing.B) {
+	benchmarkDiskQueuePut(1024, b)
+}
+func BenchmarkDiskQueuePut4096(b *testing.B) {
+	benchmarkDiskQueuePut(4096, b)
+}
+func BenchmarkDiskQueuePut16384(b *testing.B) {
+	benchmarkDiskQueuePut(16384, b)
+}
+func BenchmarkDiskQueuePut65536(b *testing.B) {
+	benchmarkDiskQueuePut(65536, b)
+}
+func BenchmarkDiskQueuePut262144(b *testing.B) {
+	benchmarkDiskQueuePut(262144, b)
+}
+func BenchmarkDiskQueuePut1048576(b *testing.B) {
+	benchmarkDiskQueuePut(1048576, b)
+}
+func benchmarkDiskQueuePut(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768*100, 0, 1<<20, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := dq.Put(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkDiskWrite16(b *testing.B) {
+	benchmarkDiskWrite(16, b)
+}
+func BenchmarkDiskWrite64(b *testing.B) {
+	benchmarkDiskWrite(64, b)
+}
+func BenchmarkDiskWrite256(b *testing.B) {
+	benchmarkDiskWrite(256, b)
+}
+func BenchmarkDiskWrite1024(b *testing.B) {
+	benchmarkDiskWrite(1024, b)
+}
+func BenchmarkDiskWrite4096(b *testing.B) {
+	benchmarkDiskWrite(4096, b)
+}
+func BenchmarkDiskWrite16384(b *testing.B) {
+	benchmarkDiskWrite(16384, b)
+}
+func BenchmarkDiskWrite65536(b *testing.B) {
+	benchmarkDiskWrite(65536, b)
+}
+func BenchmarkDiskWrite262144(b *testing.B) {
+	benchmarkDiskWrite(262144, b)
+}
+func BenchmarkDiskWrite1048576(b *testing.B) {
+	benchmarkDiskWrite(1048576, b)
+}
+func benchmarkDiskWrite(size int64, b *testing.B) {
+	b.StopTimer()
+	fileName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	f, _ := os.OpenFile(path.Join(tmpDir, fileName), os.O_RDWR|os.O_CREATE, 0600)
+	b.SetBytes(size)
+	data := make([]byte, size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		f.Write(data)
+	}
+	f.Sync()
+}
+
+func BenchmarkDiskWriteBuffered16(b *testing.B) {
+	benchmarkDiskWriteBuffered(16, b)
+}
+func BenchmarkDiskWriteBuffered64(b *testing.B) {
+	benchmarkDiskWriteBuffered(64, b)
+}
+func BenchmarkDiskWriteBuffered256(b *testing.B) {
+	benchmarkDiskWriteBuffered(256, b)
+}
+func BenchmarkDiskWriteBuffered1024(b *testing.B) {
+	benchmarkDiskWriteBuffered(1024, b)
+}
+func BenchmarkDiskWriteBuffered4096(b *testing.B) {
+	benchmarkDiskWriteBuffered(4096, b)
+}
+func BenchmarkDiskWriteBuffered16384(b *testing.B) {
+	benchmarkDiskWriteBuffered(16384, b)
+}
+func BenchmarkDiskWriteBuffered65536(b *testing.B) {
+	benchmarkDiskWriteBuffered(65536, b)
+}
+func BenchmarkDiskWriteBuffered262144(b *testing.B) {
+	benchmarkDiskWriteBuffered(262144, b)
+}
+func BenchmarkDiskWriteBuffered1048576(b *testing.B) {
+	benchmarkDiskWriteBuffered(1048576, b)
+}
+func benchmarkDiskWriteBuffered(size int64, b *testing.B) {
+	b.StopTimer()
+	fileName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	f, _ := os.OpenFile(path.Join(tmpDir, fileName), os.O_RDWR|os.O_CREATE, 0600)
+	b.SetBytes(size)
+	data := make([]byte, size)
+	w := bufio.NewWriterSize(f, 1024*4)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		w.Write(data)
+		if i%1024 == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	f.Sync()
+}
+
+// you might want to run this like
+// $ go test -bench=DiskQueueGet -benchtime 0.1s
+// too avoid doing too many iterations.
+func BenchmarkDiskQueueGet16(b *testing.B) {
+	benchmarkDiskQueueGet(16, b)
+}
+func BenchmarkDiskQueueGet64(b *testing.B) {
+	benchmarkDiskQueueGet(64, b)
+}
+func BenchmarkDiskQueueGet256(b *testing.B) {
+	benchmarkDiskQueueGet(256, b)
+}
+func BenchmarkDiskQueueGet1024(b *testing.B) {
+	benchmarkDiskQueueGet(1024, b)
+}
+func BenchmarkDiskQueueGet4096(b *testing.B) {
+	benchmarkDiskQueueGet(4096, b)
+}
+func BenchmarkDiskQueueGet16384(b *testing.B) {
+	benchmarkDiskQueueGet(16384, b)
+}
+func BenchmarkDiskQueueGet65536(b *testing.B) {
+	benchmarkDiskQueueGet(65536, b)
+}
+func BenchmarkDiskQueueGet262144(b *testing.B) {
+	benchmarkDiskQueueGet(262144, b)
+}
+func BenchmarkDiskQueueGet1048576(b *testing.B) {
+	benchmarkDiskQueueGet(1048576, b)
+}
+
+func benchmarkDiskQueueGet(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768, 0, 1<<30, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		<-dq.ReadChan()
+	}
+}
+
+// compare allocations with those of BenchmarkDiskQueueGet
+func BenchmarkDiskQueueGetRecycle256(b *testing.B) {
+	benchmarkDiskQueueGetRecycle(256, b)
+}
+func BenchmarkDiskQueueGetRecycle4096(b *testing.B) {
+	benchmarkDiskQueueGetRecycle(4096, b)
+}
+func BenchmarkDiskQueueGetRecycle65536(b *testing.B) {
+	benchmarkDiskQueueGetRecycle(65536, b)
+}
+func benchmarkDiskQueueGetRecycle(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get_recycle" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768, 0, 1<<30, 2500, 2*time.Second, 0, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		dq.Recycle(<-dq.ReadChan())
+	}
+}
+
+// you might want to run this like
+// $ go test -bench=DiskQueueDrainReadBuffer -benchtime 0.1s
+// to compare read buffer sizes for large messages.
+func BenchmarkDiskQueueDrainReadBuffer4k(b *testing.B) {
+	benchmarkDiskQueueDrainReadBuffer(256*1024, 4096, b)
+}
+func BenchmarkDiskQueueDrainReadBuffer64k(b *testing.B) {
+	benchmarkDiskQueueDrainReadBuffer(256*1024, 65536, b)
+}
+func BenchmarkDiskQueueDrainReadBuffer256k(b *testing.B) {
+	benchmarkDiskQueueDrainReadBuffer(256*1024, 262144, b)
+}
+func BenchmarkDiskQueueDrainReadBuffer1m(b *testing.B) {
+	benchmarkDiskQueueDrainReadBuffer(256*1024, 1048576, b)
+}
+
+func benchmarkDiskQueueDrainReadBuffer(size int64, readBufferSize int, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_drain" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100*1024*1024, 0, 1<<30, 2500, 2*time.Second, readBufferSize, FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		<-dq.ReadChan()
+	}
+}
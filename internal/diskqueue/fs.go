@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package diskqueue
+
+import (
+	"os"
+)
+
+// openReadOnly opens name for reading, it can be removed or renamed while
+// it's open
+func openReadOnly(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDONLY, 0600)
+}
+
+// renameFile atomically replaces newpath with oldpath
+func renameFile(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// syncDir fsyncs dir, making the files created, renamed and removed in it
+// durable (File.Sync is F_FULLFSYNC on darwin, fsync elsewhere)
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	return err
+}
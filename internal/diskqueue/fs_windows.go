@@ -0,0 +1,60 @@
+//go:build windows
+// +build windows
+
+package diskqueue
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// not in package syscall
+const errSharingViolation syscall.Errno = 32
+
+// openReadOnly opens name for reading. Unlike os.Open it shares the file for
+// deletion, as files are on other platforms, so the ioLoop can remove or
+// rename a data file while Peek or Scan is reading it.
+func openReadOnly(name string) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	h, err := syscall.CreateFile(p,
+		syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
+
+// renameFile atomically replaces newpath with oldpath (os.Rename is
+// MoveFileEx with MOVEFILE_REPLACE_EXISTING). It retries for a while when
+// newpath is briefly held open elsewhere, as by virus scanners and the
+// search indexer.
+func renameFile(oldpath string, newpath string) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		err = os.Rename(oldpath, newpath)
+		if err == nil || !isTransientRenameErr(err) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	return err
+}
+
+func isTransientRenameErr(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		err = linkErr.Err
+	}
+	return err == syscall.ERROR_ACCESS_DENIED || err == errSharingViolation
+}
+
+// syncDir is a no-op, Windows can't fsync a directory (NTFS journals
+// renames and file creation itself)
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package diskqueue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// encryptedOverhead is how much bigger than its data an encrypted record's
+// is: a 4-byte big endian key ID, a 12-byte nonce and the 16-byte GCM tag
+const encryptedOverhead = 4 + 12 + 16
+
+// Keyring holds the AES keys that FormatFramed records are encrypted with
+// (AES-GCM), by ID. Records are written with the current key, the others
+// are kept to read those written before it was rotated.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring of keys (each 16, 24 or 32 bytes, for
+// AES-128, AES-192 or AES-256) by ID, current being the one to write with
+func NewKeyring(keys map[uint32][]byte, current uint32) (*Keyring, error) {
+	k := &Keyring{
+		current: current,
+		aeads:   make(map[uint32]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d - %s", id, err)
+		}
+		k.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d - %s", id, err)
+		}
+	}
+	if _, ok := k.aeads[current]; !ok {
+		return nil, fmt.Errorf("no key %d", current)
+	}
+	return k, nil
+}
+
+// seal returns data encrypted with the current key, prefixed by its ID and
+// the nonce
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	aead := k.aeads[k.current]
+	out := make([]byte, 4+aead.NonceSize(), encryptedOverhead+len(data))
+	binary.BigEndian.PutUint32(out, k.current)
+	_, err := rand.Read(out[4:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[4:], data, out[:4]), nil
+}
+
+// open returns the data of a record sealed with any of the keys
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	if len(data) < encryptedOverhead {
+		return nil, errors.New("encrypted record too short")
+	}
+	id := binary.BigEndian.Uint32(data)
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("record encrypted with unknown key %d", id)
+	}
+	nonce := data[4 : 4+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[4+aead.NonceSize():], data[:4])
+}
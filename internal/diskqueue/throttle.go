@@ -0,0 +1,77 @@
+package diskqueue
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeThrottle is a token bucket of bytes that Put and PutBatch wait on,
+// see SetMaxWriteRate
+type writeThrottle struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	throttledCount int64
+	waiting        int64
+	enabled        int32
+
+	sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate sets the rate, 0 for no limit
+func (t *writeThrottle) setRate(rate int64) {
+	t.Lock()
+	t.rate = float64(rate)
+	t.burst = math.Max(1, t.rate/10)
+	t.tokens = t.burst
+	t.last = time.Now()
+	t.Unlock()
+	var enabled int32
+	if rate > 0 {
+		enabled = 1
+	}
+	atomic.StoreInt32(&t.enabled, enabled)
+}
+
+// wait blocks until there are tokens to take (or exitChan is closed), then
+// takes n of them, possibly leaving a debt (so a write bigger than the
+// burst gets through) that later writes wait to be paid off
+func (t *writeThrottle) wait(n int, exitChan chan int) {
+	if atomic.LoadInt32(&t.enabled) == 0 {
+		return
+	}
+	throttled := false
+	for {
+		t.Lock()
+		if t.rate == 0 {
+			t.Unlock()
+			return
+		}
+		now := time.Now()
+		t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+		t.last = now
+		if t.tokens >= 0 {
+			t.tokens -= float64(n)
+			t.Unlock()
+			return
+		}
+		d := time.Duration(-t.tokens / t.rate * float64(time.Second))
+		t.Unlock()
+
+		if !throttled {
+			throttled = true
+			atomic.AddInt64(&t.throttledCount, 1)
+			atomic.AddInt64(&t.waiting, 1)
+			defer atomic.AddInt64(&t.waiting, -1)
+		}
+		select {
+		case <-time.After(d):
+		case <-exitChan:
+			return
+		}
+	}
+}
@@ -31,7 +31,8 @@ func NewDeadlineTransport(connectTimeout time.Duration, requestTimeout time.Dura
 }
 
 type Client struct {
-	c *http.Client
+	c          *http.Client
+	authSecret string
 }
 
 func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeout time.Duration) *Client {
@@ -45,17 +46,34 @@ func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeo
 	}
 }
 
+// SetAuthSecret sets the secret sent as a bearer token with every request,
+// for nsqd's --http-auth-secret
+func (c *Client) SetAuthSecret(secret string) {
+	c.authSecret = secret
+}
+
+func (c *Client) newRequest(method string, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	if c.authSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authSecret)
+	}
+	return req, nil
+}
+
 // GETV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) GETV1(endpoint string, v interface{}) error {
 retry:
-	req, err := http.NewRequest("GET", endpoint, nil)
+	req, err := c.newRequest("GET", endpoint)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
-
 	resp, err := c.c.Do(req)
 	if err != nil {
 		return err
@@ -68,11 +86,14 @@ retry:
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
-			endpoint, err = httpsEndpoint(endpoint, body)
+			httpsURL, err := httpsEndpoint(endpoint, body)
 			if err != nil {
 				return err
 			}
-			goto retry
+			if httpsURL != "" {
+				endpoint = httpsURL
+				goto retry
+			}
 		}
 		return fmt.Errorf("got response %s %q", resp.Status, body)
 	}
@@ -88,13 +109,11 @@ retry:
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) POSTV1(endpoint string) error {
 retry:
-	req, err := http.NewRequest("POST", endpoint, nil)
+	req, err := c.newRequest("POST", endpoint)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
-
 	resp, err := c.c.Do(req)
 	if err != nil {
 		return err
@@ -107,11 +126,14 @@ retry:
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
-			endpoint, err = httpsEndpoint(endpoint, body)
+			httpsURL, err := httpsEndpoint(endpoint, body)
 			if err != nil {
 				return err
 			}
-			goto retry
+			if httpsURL != "" {
+				endpoint = httpsURL
+				goto retry
+			}
 		}
 		return fmt.Errorf("got response %s %q", resp.Status, body)
 	}
@@ -127,6 +149,10 @@ func httpsEndpoint(endpoint string, body []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if forbiddenResp.HTTPSPort == 0 {
+		// a 403 for a missing or wrong --http-auth-secret
+		return "", nil
+	}
 
 	u, err := url.Parse(endpoint)
 	if err != nil {
@@ -2,10 +2,14 @@
 package lg
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -22,6 +26,13 @@ type Logger interface {
 	Output(maxdepth int, s string) error
 }
 
+// LevelLogger is a Logger that is given the level of each message apart from
+// its text
+type LevelLogger interface {
+	Logger
+	OutputLevel(maxdepth int, lvl LogLevel, s string) error
+}
+
 type NilLogger struct{}
 
 func (l NilLogger) Output(maxdepth int, s string) error {
@@ -77,9 +88,47 @@ func Logf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, f string, args ..
 	if cfgLevel > msgLevel {
 		return
 	}
+	if l, ok := logger.(LevelLogger); ok {
+		l.OutputLevel(3, msgLevel, fmt.Sprintf(f, args...))
+		return
+	}
 	logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
 }
 
+// JSONLogger writes each message as a line of JSON with its time, level and
+// text
+type JSONLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (l *JSONLogger) Output(maxdepth int, s string) error {
+	return l.write("", s)
+}
+
+func (l *JSONLogger) OutputLevel(maxdepth int, lvl LogLevel, s string) error {
+	return l.write(lvl.String(), s)
+}
+
+func (l *JSONLogger) write(level string, s string) error {
+	b, err := json.Marshal(struct {
+		Time  string `json:"ts"`
+		Level string `json:"level,omitempty"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), level, s})
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
 func LogFatal(prefix string, f string, args ...interface{}) {
 	logger := log.New(os.Stderr, prefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	Logf(logger, FATAL, FATAL, f, args...)
@@ -1,6 +1,8 @@
 package lg
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/nsqio/nsq/internal/test"
@@ -39,3 +41,22 @@ func TestLogging(t *testing.T) {
 	}
 	test.Equal(t, 5, logger.Count)
 }
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	Logf(logger, INFO, DEBUG, "Test")
+	test.Equal(t, 0, buf.Len())
+
+	Logf(logger, INFO, WARN, "Test %d", 1)
+	var line struct {
+		Time  string `json:"ts"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}
+	test.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	test.Equal(t, "WARNING", line.Level)
+	test.Equal(t, "Test 1", line.Msg)
+	test.NotNil(t, line.Time)
+}
@@ -2,16 +2,26 @@ package util
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 type WaitGroupWrapper struct {
 	sync.WaitGroup
+	running int64
 }
 
 func (w *WaitGroupWrapper) Wrap(cb func()) {
 	w.Add(1)
+	atomic.AddInt64(&w.running, 1)
 	go func() {
 		cb()
+		atomic.AddInt64(&w.running, -1)
 		w.Done()
 	}()
 }
+
+// Running returns the number of goroutines started by Wrap that have not
+// yet returned
+func (w *WaitGroupWrapper) Running() int64 {
+	return atomic.LoadInt64(&w.running)
+}
@@ -0,0 +1,68 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(op, msg)
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(srv.URL, "http") + "/echo")
+	test.Nil(t, err)
+	defer conn.Close()
+
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 200), bytes.Repeat([]byte("y"), 70000)} {
+		err = conn.WriteMessage(OpText, msg)
+		test.Nil(t, err)
+		op, out, err := conn.ReadMessage()
+		test.Nil(t, err)
+		test.Equal(t, OpText, op)
+		test.Equal(t, msg, out)
+	}
+
+	// pings are answered, and skipped by ReadMessage
+	err = conn.writeFrame(opPing, []byte("ping"))
+	test.Nil(t, err)
+	_, op, payload, err := conn.readFrame()
+	test.Nil(t, err)
+	test.Equal(t, opPong, op)
+	test.Equal(t, []byte("ping"), payload)
+
+	err = conn.writeFrame(opClose, nil)
+	test.Nil(t, err)
+	_, _, err = conn.ReadMessage()
+	test.Equal(t, io.EOF, err)
+}
+
+func TestUpgradeNotWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		Upgrade(w, req)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
@@ -0,0 +1,207 @@
+package nsqadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// counterTotals are the message counts of the cluster's topics and channels
+// accumulated by counterLoop, every --counter-poll-interval, from those of
+// each nsqd. They don't go down when an nsqd restarts (or its stats are
+// reset), and with --counter-file they're kept across restarts of nsqadmin.
+type counterTotals struct {
+	sync.RWMutex `json:"-"`
+
+	// by topic, and by "topic:channel"
+	Topics   map[string]int64 `json:"topics"`
+	Channels map[string]int64 `json:"channels"`
+
+	// the count last polled from each node, by "node/topic" and
+	// "node/topic:channel"
+	Last map[string]int64 `json:"last"`
+
+	Updated int64 `json:"updated"` // unix seconds
+}
+
+func newCounterTotals() *counterTotals {
+	return &counterTotals{
+		Topics:   make(map[string]int64),
+		Channels: make(map[string]int64),
+		Last:     make(map[string]int64),
+	}
+}
+
+// loadCounterTotals returns the totals saved to fileName, or none if it
+// isn't set or doesn't exist
+func loadCounterTotals(fileName string) (*counterTotals, error) {
+	t := newCounterTotals()
+	if fileName == "" {
+		return t, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %s", fileName, err)
+	}
+	return t, nil
+}
+
+// save writes the totals to fileName, through a temporary file so that
+// a crash never leaves it half written
+func (t *counterTotals) save(fileName string) error {
+	t.RLock()
+	data, err := json.Marshal(t)
+	t.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	err = ioutil.WriteFile(tmpFileName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// add counts the increase of the count of key (of node) since it was last
+// polled, or all of it if it went down (or it's the first poll), towards
+// totals[total]
+func (t *counterTotals) add(totals map[string]int64, total string, key string, count int64) {
+	last, ok := t.Last[key]
+	if !ok || count < last {
+		last = 0
+	}
+	totals[total] += count - last
+	t.Last[key] = count
+}
+
+// update adds the counts of topicStats, the stats of each topic of each
+// node
+func (t *counterTotals) update(topicStats []*clusterinfo.TopicStats) {
+	t.Lock()
+	defer t.Unlock()
+	for _, ts := range topicStats {
+		t.add(t.Topics, ts.TopicName, ts.Node+"/"+ts.TopicName, ts.MessageCount)
+		for _, cs := range ts.Channels {
+			name := ts.TopicName + ":" + cs.ChannelName
+			t.add(t.Channels, name, ts.Node+"/"+name, cs.MessageCount)
+		}
+	}
+	t.Updated = time.Now().Unix()
+}
+
+type counterTopic struct {
+	TopicName    string           `json:"topic_name"`
+	MessageCount int64            `json:"message_count"`
+	Channels     []counterChannel `json:"channels"`
+}
+
+type counterChannel struct {
+	ChannelName  string `json:"channel_name"`
+	MessageCount int64  `json:"message_count"`
+}
+
+// counterSummary is what /api/counter returns of the counterTotals
+type counterSummary struct {
+	// of all the channels, what the counter page shows
+	MessageCount int64          `json:"message_count"`
+	Topics       []counterTopic `json:"topics"`
+	Updated      int64          `json:"updated"`
+}
+
+func (t *counterTotals) summary() *counterSummary {
+	t.RLock()
+	defer t.RUnlock()
+	s := &counterSummary{Updated: t.Updated}
+	byName := make(map[string]*counterTopic)
+	for name, count := range t.Topics {
+		s.Topics = append(s.Topics, counterTopic{TopicName: name, MessageCount: count})
+	}
+	sort.Slice(s.Topics, func(i, j int) bool { return s.Topics[i].TopicName < s.Topics[j].TopicName })
+	for i := range s.Topics {
+		byName[s.Topics[i].TopicName] = &s.Topics[i]
+	}
+	var names []string
+	for name := range t.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		count := t.Channels[name]
+		s.MessageCount += count
+		parts := strings.SplitN(name, ":", 2)
+		if topic, ok := byName[parts[0]]; ok && len(parts) == 2 {
+			topic.Channels = append(topic.Channels, counterChannel{parts[1], count})
+		}
+	}
+	return s
+}
+
+// counterLoop polls the stats of every nsqd for counterTotals
+func (n *NSQAdmin) counterLoop() {
+	opts := n.getOpts()
+	client := http_api.NewClient(n.httpClientTLSConfig, opts.HTTPClientConnectTimeout,
+		opts.HTTPClientRequestTimeout)
+	client.SetAuthSecret(opts.NSQDHTTPAuthSecret)
+	ci := clusterinfo.New(n.logf, client)
+
+	n.pollCounters(ci)
+	ticker := time.NewTicker(opts.CounterPollInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.pollCounters(ci)
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "COUNTER: closing")
+	ticker.Stop()
+}
+
+func (n *NSQAdmin) pollCounters(ci *clusterinfo.ClusterInfo) {
+	opts := n.getOpts()
+	producers, err := ci.GetProducers(opts.NSQLookupdHTTPAddresses, opts.NSQDHTTPAddresses)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			n.logf(LOG_ERROR, "COUNTER: failed to get producers - %s", err)
+			return
+		}
+		n.logf(LOG_WARN, "COUNTER: %s", err)
+	}
+	// the counts of nodes that couldn't be queried are picked up next time
+	topicStats, _, err := ci.GetNSQDStats(producers, "", "", false)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			n.logf(LOG_ERROR, "COUNTER: failed to get nsqd stats - %s", err)
+			return
+		}
+		n.logf(LOG_WARN, "COUNTER: %s", err)
+	}
+
+	n.counterTotals.update(topicStats)
+	if opts.CounterFile != "" {
+		err := n.counterTotals.save(opts.CounterFile)
+		if err != nil {
+			n.logf(LOG_ERROR, "COUNTER: failed to save %s - %s", opts.CounterFile, err)
+		}
+	}
+}
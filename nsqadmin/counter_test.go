@@ -0,0 +1,58 @@
+package nsqadmin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func counterTopicStats(node string, topicCount int64, channelCounts map[string]int64) *clusterinfo.TopicStats {
+	ts := &clusterinfo.TopicStats{Node: node, TopicName: "t", MessageCount: topicCount}
+	for name, count := range channelCounts {
+		ts.Channels = append(ts.Channels, &clusterinfo.ChannelStats{ChannelName: name, MessageCount: count})
+	}
+	return ts
+}
+
+func TestCounterTotals(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsqadmin-counter-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	fileName := filepath.Join(dataPath, "counter.json")
+
+	totals, err := loadCounterTotals(fileName)
+	test.Nil(t, err)
+	totals.update([]*clusterinfo.TopicStats{
+		counterTopicStats("a:4151", 10, map[string]int64{"ch1": 8, "ch2": 10}),
+		counterTopicStats("b:4151", 5, map[string]int64{"ch1": 5}),
+	})
+	// b restarted, its counts start over
+	totals.update([]*clusterinfo.TopicStats{
+		counterTopicStats("a:4151", 12, map[string]int64{"ch1": 12, "ch2": 12}),
+		counterTopicStats("b:4151", 2, map[string]int64{"ch1": 1}),
+	})
+	test.Nil(t, totals.save(fileName))
+
+	// as does nsqadmin, which picks up where it left off
+	totals, err = loadCounterTotals(fileName)
+	test.Nil(t, err)
+	totals.update([]*clusterinfo.TopicStats{
+		counterTopicStats("a:4151", 13, map[string]int64{"ch1": 13, "ch2": 13}),
+		counterTopicStats("b:4151", 2, map[string]int64{"ch1": 2}),
+	})
+
+	s := totals.summary()
+	test.Equal(t, int64(20+13), s.MessageCount)
+	test.Equal(t, []counterTopic{{
+		TopicName:    "t",
+		MessageCount: 13 + 7,
+		Channels: []counterChannel{
+			{ChannelName: "ch1", MessageCount: 13 + 7},
+			{ChannelName: "ch2", MessageCount: 13},
+		},
+	}}, s.Topics)
+}
@@ -60,6 +60,7 @@ func NewHTTPServer(nsqadmin *NSQAdmin) *httpServer {
 
 	client := http_api.NewClient(nsqadmin.httpClientTLSConfig, nsqadmin.getOpts().HTTPClientConnectTimeout,
 		nsqadmin.getOpts().HTTPClientRequestTimeout)
+	client.SetAuthSecret(nsqadmin.getOpts().NSQDHTTPAuthSecret)
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
@@ -218,6 +219,18 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		messages = append(messages, pe.Error())
 	}
 
+	// filter by namespace (if specified), the topics named <namespace>.<topic>
+	namespace, _ := reqParams.Get("namespace")
+	if namespace != "" {
+		filtered := make([]string, 0)
+		for _, topicName := range topics {
+			if strings.HasPrefix(topicName, namespace+".") {
+				filtered = append(filtered, topicName)
+			}
+		}
+		topics = filtered
+	}
+
 	inactive, _ := reqParams.Get("inactive")
 	if inactive == "true" {
 		topicChannelMap := make(map[string][]string)
@@ -670,10 +683,17 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 		}
 	}
 
+	// the cluster totals, with --counter-poll-interval
+	var totals *counterSummary
+	if s.nsqadmin.counterTotals != nil {
+		totals = s.nsqadmin.counterTotals.summary()
+	}
+
 	return struct {
 		Stats   map[string]*counterStats `json:"stats"`
+		Totals  *counterSummary          `json:"totals,omitempty"`
 		Message string                   `json:"message"`
-	}{stats, maybeWarnMsg(messages)}, nil
+	}{stats, totals, maybeWarnMsg(messages)}, nil
 }
 
 func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -179,6 +179,35 @@ func TestHTTPTopicsGET(t *testing.T) {
 	test.Equal(t, topicName, tr.Topics[0])
 }
 
+func TestHTTPTopicsGETNamespace(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	nsqds[0].GetTopic("orders.test_topics_get" + suffix)
+	nsqds[0].GetTopic("billing.test_topics_get" + suffix)
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics?namespace=orders", nsqadmin1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	tr := TopicsDoc{}
+	err = json.Unmarshal(body, &tr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(tr.Topics))
+	test.Equal(t, "orders.test_topics_get"+suffix, tr.Topics[0])
+}
+
 func TestHTTPTopicGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -368,6 +397,55 @@ func TestHTTPCreateTopicChannelPOST(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestHTTPNSQDAuthSecret(t *testing.T) {
+	lgr := test.NewTestLogger(t)
+
+	nsqdOpts := nsqd.NewOptions()
+	nsqdOpts.TCPAddress = "127.0.0.1:0"
+	nsqdOpts.HTTPAddress = "127.0.0.1:0"
+	nsqdOpts.HTTPAuthSecret = "s3cret"
+	nsqdOpts.Logger = lgr
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	nsqdOpts.DataPath = tmpDir
+	nsqd1, err := nsqd.New(nsqdOpts)
+	test.Nil(t, err)
+	go nsqd1.Main()
+	defer nsqd1.Exit()
+
+	topicName := "test_nsqd_auth_secret" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopic(topicName)
+
+	pauseTopic := func(secret string) int {
+		nsqadminOpts := NewOptions()
+		nsqadminOpts.HTTPAddress = "127.0.0.1:0"
+		nsqadminOpts.NSQDHTTPAddresses = []string{nsqd1.RealHTTPAddr().String()}
+		nsqadminOpts.NSQDHTTPAuthSecret = secret
+		nsqadminOpts.Logger = lgr
+		nsqadmin1, err := New(nsqadminOpts)
+		test.Nil(t, err)
+		go nsqadmin1.Main()
+		defer nsqadmin1.Exit()
+
+		url := fmt.Sprintf("http://%s/api/topics/%s", nsqadmin1.RealHTTPAddr(), topicName)
+		body, _ := json.Marshal(map[string]interface{}{
+			"action": "pause",
+		})
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a failed nsqd is only logged, as a partial error
+	pauseTopic("")
+	test.Equal(t, false, topic.IsPaused())
+
+	test.Equal(t, 200, pauseTopic("s3cret"))
+	test.Equal(t, true, topic.IsPaused())
+}
+
 func TestHTTPTombstoneTopicNodePOST(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
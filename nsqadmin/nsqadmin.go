@@ -30,6 +30,8 @@ type NSQAdmin struct {
 	notifications       chan *AdminAction
 	graphiteURL         *url.URL
 	httpClientTLSConfig *tls.Config
+	counterTotals       *counterTotals
+	exitChan            chan int
 }
 
 func New(opts *Options) (*NSQAdmin, error) {
@@ -39,6 +41,7 @@ func New(opts *Options) (*NSQAdmin, error) {
 
 	n := &NSQAdmin{
 		notifications: make(chan *AdminAction),
+		exitChan:      make(chan int),
 	}
 	n.swapOpts(opts)
 
@@ -112,6 +115,17 @@ func New(opts *Options) (*NSQAdmin, error) {
 		}
 	}
 
+	if opts.CounterPollInterval < 0 {
+		return nil, errors.New("--counter-poll-interval must be >= 0")
+	}
+	if opts.CounterPollInterval > 0 {
+		var err error
+		n.counterTotals, err = loadCounterTotals(opts.CounterFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --counter-file (%s) - %s", opts.CounterFile, err)
+		}
+	}
+
 	opts.BasePath = normalizeBasePath(opts.BasePath)
 
 	n.logf(LOG_INFO, version.String("nsqadmin"))
@@ -184,6 +198,9 @@ func (n *NSQAdmin) Main() error {
 		exitFunc(http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.logf))
 	})
 	n.waitGroup.Wrap(n.handleAdminActions)
+	if n.counterTotals != nil {
+		n.waitGroup.Wrap(n.counterLoop)
+	}
 
 	err := <-exitCh
 	return err
@@ -194,5 +211,6 @@ func (n *NSQAdmin) Exit() {
 		n.httpListener.Close()
 	}
 	close(n.notifications)
+	close(n.exitChan)
 	n.waitGroup.Wait()
 }
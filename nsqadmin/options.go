@@ -23,6 +23,9 @@ type Options struct {
 
 	StatsdInterval time.Duration `flag:"statsd-interval"`
 
+	CounterPollInterval time.Duration `flag:"counter-poll-interval"`
+	CounterFile         string        `flag:"counter-file"`
+
 	NSQLookupdHTTPAddresses []string `flag:"lookupd-http-address" cfg:"nsqlookupd_http_addresses"`
 	NSQDHTTPAddresses       []string `flag:"nsqd-http-address" cfg:"nsqd_http_addresses"`
 
@@ -34,6 +37,8 @@ type Options struct {
 	HTTPClientTLSCert               string `flag:"http-client-tls-cert"`
 	HTTPClientTLSKey                string `flag:"http-client-tls-key"`
 
+	NSQDHTTPAuthSecret string `flag:"nsqd-http-auth-secret"`
+
 	AllowConfigFromCIDR string `flag:"allow-config-from-cidr"`
 
 	NotificationHTTPEndpoint string `flag:"notification-http-endpoint"`
@@ -14,7 +14,14 @@ var Topics = Backbone.Collection.extend({
         Backbone.Collection.prototype.constructor.apply(this, arguments);
     },
 
+    initialize: function(models, options) {
+        this.namespace = options && options['namespace'];
+    },
+
     url: function() {
+        if (this.namespace) {
+            return AppState.apiPath('/topics?namespace=' + encodeURIComponent(this.namespace));
+        }
         return AppState.apiPath('/topics');
     },
 
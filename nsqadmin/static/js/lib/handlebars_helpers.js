@@ -224,6 +224,12 @@ Handlebars.registerHelper('nanotohuman', function(n) {
     return s;
 });
 
+// rates are per second over the last 1m and 5m, see nsqd's MessageRates
+Handlebars.registerHelper('ratetohuman', function(rates) {
+    rates = rates || {};
+    return round(rates['1m'] || 0, 2) + ' / ' + round(rates['5m'] || 0, 2);
+});
+
 Handlebars.registerHelper('sparkline', function(typ, node, ns1, ns2, key) {
     var q = {
         'colorList': genColorList(typ, key),
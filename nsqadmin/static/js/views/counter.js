@@ -48,6 +48,11 @@ var CounterView = BaseView.extend({
             var num = _.reduce(data['stats'], function(n, v) {
                 return n + v['message_count'];
             }, 0);
+            if (data['totals']) {
+                // cluster totals, which don't go down when nodes restart
+                num = data['totals']['message_count'];
+                this.writeTotals(data['totals']);
+            }
 
             if (this.currentNum === -1) {
                 // seed the display
@@ -102,6 +107,23 @@ var CounterView = BaseView.extend({
         this.animator = setTimeout(this.displayFrame.bind(this), 1000 / 60);
     },
 
+    writeTotals: function(totals) {
+        var tbody = $('#totals tbody').empty();
+        _.each(totals['topics'], function(topic) {
+            tbody.append($('<tr>')
+                .append($('<th>').text(topic['topic_name']))
+                .append($('<th>'))
+                .append($('<th class="count">').text(topic['message_count'])));
+            _.each(topic['channels'], function(channel) {
+                tbody.append($('<tr>')
+                    .append($('<td>'))
+                    .append($('<td>').text(channel['channel_name']))
+                    .append($('<td class="count">').text(channel['message_count'])));
+            });
+        });
+        $('#totals').show();
+    },
+
     writeCounts: function(c) {
         var text = parseInt(c, 10).toString();
         var node = $('.numbers')[0];
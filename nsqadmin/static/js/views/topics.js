@@ -1,3 +1,5 @@
+var $ = require('jquery');
+
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
 
@@ -9,17 +11,30 @@ var TopicsView = BaseView.extend({
 
     template: require('./spinner.hbs'),
 
+    events: {
+        'submit .namespace-filter': 'onFilterNamespace'
+    },
+
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
-        this.collection = new Topics();
+        var match = /[?&]namespace=([^&]*)/.exec(window.location.search);
+        this.namespace = match ? decodeURIComponent(match[1]) : '';
+        this.collection = new Topics([], {'namespace': this.namespace});
         this.collection.fetch()
             .done(function(data) {
                 this.template = require('./topics.hbs');
-                this.render({'message': data['message']});
+                this.render({'message': data['message'], 'namespace': this.namespace});
             }.bind(this))
             .fail(this.handleViewError.bind(this))
             .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+    },
+
+    onFilterNamespace: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var namespace = $(e.target.elements['namespace']).val();
+        window.location.search = namespace ? 'namespace=' + encodeURIComponent(namespace) : '';
     }
 });
 
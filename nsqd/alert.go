@@ -0,0 +1,133 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// alert statuses
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// depthAlert is POSTed to --alert-webhook-url when a channel's depth reaches
+// its depth_alert (and every --alert-renotify-interval while it stays
+// there), and once it's back under it
+type depthAlert struct {
+	Status           string `json:"status"`
+	Topic            string `json:"topic"`
+	Channel          string `json:"channel"`
+	Depth            int64  `json:"depth"`
+	DepthAlert       int64  `json:"depth_alert"`
+	BroadcastAddress string `json:"broadcast_address"`
+	Timestamp        int64  `json:"timestamp"`
+}
+
+// alertLoop checks the depth of channels with a depth_alert every
+// --alert-interval, and POSTs a depthAlert when one crosses it
+func (n *NSQD) alertLoop() {
+	type firingChannel struct {
+		lastNotified time.Time
+	}
+	firing := make(map[*Channel]firingChannel)
+
+	opts := n.getOpts()
+	client := &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+		Timeout:   opts.HTTPClientRequestTimeout,
+	}
+	ticker := time.NewTicker(opts.AlertInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+
+		var channels []*Channel
+		n.RLock()
+		for _, t := range n.topicMap {
+			t.RLock()
+			for _, c := range t.channelMap {
+				channels = append(channels, c)
+			}
+			t.RUnlock()
+		}
+		n.RUnlock()
+
+		opts := n.getOpts()
+		now := time.Now()
+		prevFiring := firing
+		firing = make(map[*Channel]firingChannel)
+		for _, c := range channels {
+			threshold := c.limits.alertDepth()
+			depth := c.Depth()
+			fc, ok := prevFiring[c]
+
+			status := ""
+			switch {
+			case threshold > 0 && depth >= threshold:
+				if !ok || (opts.AlertRenotifyInterval > 0 && now.Sub(fc.lastNotified) >= opts.AlertRenotifyInterval) {
+					status = alertFiring
+				}
+			case ok:
+				status = alertResolved
+			}
+			if status != "" {
+				err := n.postAlert(client, opts.AlertWebhookURL, depthAlert{
+					Status:           status,
+					Topic:            c.topicName,
+					Channel:          c.name,
+					Depth:            depth,
+					DepthAlert:       threshold,
+					BroadcastAddress: opts.BroadcastAddress,
+					Timestamp:        now.Unix(),
+				})
+				if err != nil {
+					// tried again at the next check
+					n.logf(LOG_ERROR, "ALERT: failed to post %s alert for channel %s/%s - %s",
+						status, c.topicName, c.name, err)
+				} else if status == alertFiring {
+					fc.lastNotified = now
+					ok = true
+				} else {
+					ok = false
+				}
+			}
+			if ok {
+				firing[c] = fc
+			}
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "ALERT: closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) postAlert(client *http.Client, url string, alert depthAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got response %s %q", resp.Status, respBody)
+	}
+	n.logf(LOG_INFO, "ALERT: channel %s/%s %s at depth %d (depth_alert %d)",
+		alert.Topic, alert.Channel, alert.Status, alert.Depth, alert.DepthAlert)
+	return nil
+}
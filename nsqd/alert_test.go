@@ -0,0 +1,69 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDepthAlert(t *testing.T) {
+	alerts := make(chan depthAlert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alert depthAlert
+		err := json.NewDecoder(req.Body).Decode(&alert)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		alerts <- alert
+	}))
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AlertWebhookURL = srv.URL
+	opts.AlertInterval = 10 * time.Millisecond
+	opts.AlertRenotifyInterval = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_depth_alert" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+	depthAlert := int64(2)
+	channel.SetQueueOptions(QueueOptions{DepthAlert: &depthAlert})
+
+	var id MessageID
+	test.Nil(t, channel.PutMessage(NewMessage(id, []byte("one"))))
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	test.Nil(t, channel.PutMessage(NewMessage(id, []byte("two"))))
+	alert := <-alerts
+	test.Equal(t, alertFiring, alert.Status)
+	test.Equal(t, topicName, alert.Topic)
+	test.Equal(t, "ch", alert.Channel)
+	test.Equal(t, int64(2), alert.Depth)
+	test.Equal(t, int64(2), alert.DepthAlert)
+
+	// without --alert-renotify-interval it's only notified once
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-channel.memoryMsgChan
+	alert = <-alerts
+	test.Equal(t, alertResolved, alert.Status)
+	test.Equal(t, int64(1), alert.Depth)
+}
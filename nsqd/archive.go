@@ -0,0 +1,130 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// archiveBufferSize is the number of copies of delivered messages waiting
+// to be archived, those that don't fit are dropped (and counted) rather than
+// slowing delivery down
+const archiveBufferSize = 8192
+
+// ChannelArchive is where copies of the messages delivered on a channel are
+// archived (see /channel/archive): published to Topic, and/or passed to
+// Options.ArchiveSink
+type ChannelArchive struct {
+	Topic string `json:"topic,omitempty"`
+	Sink  bool   `json:"sink,omitempty"`
+}
+
+func (a ChannelArchive) isEmpty() bool {
+	return a.Topic == "" && !a.Sink
+}
+
+// ArchivedMessage is a copy of a message delivered on a channel with an
+// archive
+type ArchivedMessage struct {
+	Topic     string            `json:"topic"`
+	Channel   string            `json:"channel"`
+	ID        MessageID         `json:"id"`
+	Timestamp int64             `json:"timestamp"` // of the publish, unix ns
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      []byte            `json:"body"`
+
+	archive ChannelArchive
+	channel *Channel
+}
+
+// ArchiveSink receives the messages delivered on the channels archived with
+// sink=true, one at a time from a single goroutine
+type ArchiveSink interface {
+	Archive(ArchivedMessage)
+}
+
+// SetArchive sets where the channel's delivered messages are archived
+func (c *Channel) SetArchive(archive ChannelArchive) {
+	c.Lock()
+	c.archive = archive
+	c.Unlock()
+}
+
+func (c *Channel) Archive() ChannelArchive {
+	c.RLock()
+	defer c.RUnlock()
+	return c.archive
+}
+
+// archiveDelivery queues a copy of msg, about to be delivered, for
+// archiveLoop if the channel has an archive. It must be called while msg is
+// still the caller's.
+func (c *Channel) archiveDelivery(msg *Message) {
+	archive := c.Archive()
+	if archive.isEmpty() {
+		return
+	}
+	// msg's body may be pooled, and released once it's FIN'd
+	body := make([]byte, len(msg.Body))
+	copy(body, msg.Body)
+	am := &ArchivedMessage{
+		Topic:     c.topicName,
+		Channel:   c.name,
+		ID:        msg.ID,
+		Timestamp: msg.Timestamp,
+		Attempts:  msg.Attempts,
+		Headers:   msg.Headers,
+		Body:      body,
+		archive:   archive,
+		channel:   c,
+	}
+	select {
+	case c.nsqd.archiveChan <- am:
+	default:
+		atomic.AddUint64(&c.archiveDroppedCount, 1)
+	}
+}
+
+// archiveLoop publishes the copies of delivered messages queued by
+// archiveDelivery to their archive topic, and passes them to ArchiveSink
+func (n *NSQD) archiveLoop() {
+	for {
+		select {
+		case am := <-n.archiveChan:
+			n.archiveMessage(am)
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "ARCHIVE: closing")
+}
+
+func (n *NSQD) archiveMessage(am *ArchivedMessage) {
+	c := am.channel
+	if sink := n.getOpts().ArchiveSink; am.archive.Sink && sink != nil {
+		sink.Archive(*am)
+	}
+	if am.archive.Topic != "" {
+		body := am.Body
+		if am.archive.Sink {
+			// the sink may hold on to its copy
+			body = make([]byte, len(am.Body))
+			copy(body, am.Body)
+		}
+		topic, err := n.GetExistingTopic(am.archive.Topic)
+		if err == nil {
+			m := NewMessage(am.ID, body)
+			m.Attempts = am.Attempts
+			m.Headers = am.Headers
+			err = topic.PutMessage(m)
+		}
+		if err != nil {
+			n.logf(LOG_ERROR, "CHANNEL(%s): failed to archive msg(%s) to topic %s - %s",
+				c.name, am.ID, am.archive.Topic, err)
+			atomic.AddUint64(&c.archiveDroppedCount, 1)
+			return
+		}
+	}
+	atomic.AddUint64(&c.archivedCount, 1)
+}
@@ -0,0 +1,98 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type chanArchiveSink chan ArchivedMessage
+
+func (s chanArchiveSink) Archive(am ArchivedMessage) {
+	s <- am
+}
+
+func TestChannelArchive(t *testing.T) {
+	sink := make(chanArchiveSink, 10)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ArchiveSink = sink
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_archive" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	archive := func(params string) int {
+		url := fmt.Sprintf("http://%s/channel/archive?topic=%s&channel=ch&%s", httpAddr, topicName, params)
+		resp, err := http.Post(url, "application/octet-stream", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	test.Equal(t, 400, archive("archive_topic="+topicName))
+	test.Equal(t, 400, archive("archive_topic=invalid!"))
+	test.Equal(t, 400, archive("sink=maybe"))
+	test.Equal(t, 200, archive("archive_topic="+topicName+"_audit&sink=true"))
+	test.Equal(t, ChannelArchive{Topic: topicName + "_audit", Sink: true}, channel.Archive())
+	auditChannel := nsqd.GetTopic(topicName + "_audit").GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Headers = map[string]string{"a": "b"}
+	test.Nil(t, topic.PutMessage(msg))
+	msg = <-channel.memoryMsgChan
+	msg.Attempts++
+	test.Nil(t, channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout))
+
+	am := <-sink
+	test.Equal(t, topicName, am.Topic)
+	test.Equal(t, "ch", am.Channel)
+	test.Equal(t, msg.ID, am.ID)
+	test.Equal(t, uint16(1), am.Attempts)
+	test.Equal(t, []byte("test"), am.Body)
+	test.Equal(t, "b", am.Headers["a"])
+
+	archived := <-auditChannel.memoryMsgChan
+	test.Equal(t, msg.ID, archived.ID)
+	test.Equal(t, []byte("test"), archived.Body)
+	test.Equal(t, "b", archived.Headers["a"])
+
+	// archiving is turned off with neither
+	test.Equal(t, 200, archive(""))
+	test.Equal(t, ChannelArchive{}, channel.Archive())
+	test.Nil(t, channel.RequeueMessage(1, msg.ID, 0, RequeueReasonOther))
+	msg = <-channel.memoryMsgChan
+	msg.Attempts++
+	test.Nil(t, channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout))
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, 0, len(sink))
+	test.Equal(t, 0, len(auditChannel.memoryMsgChan))
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, uint64(1), stats[0].Channels[0].ArchivedCount)
+	test.Equal(t, uint64(0), stats[0].Channels[0].ArchiveDroppedCount)
+}
+
+func TestChannelArchiveNoSink(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_archive_no_sink" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/channel/archive?topic=%s&channel=ch&sink=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
@@ -1,5 +1,17 @@
 package nsqd
 
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+	"github.com/nsqio/nsq/internal/lg"
+)
+
 // BackendQueue represents the behavior for the secondary message
 // storage system
 type BackendQueue interface {
@@ -10,3 +22,219 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// diskQueueFormat returns the record format of new diskqueues
+// (opts.DiskQueueFormat is validated in New)
+func diskQueueFormat(opts *Options) diskqueue.Format {
+	format, _ := diskqueue.ParseFormat(opts.DiskQueueFormat)
+	return format
+}
+
+// parseDataEncryptionKeys returns the keyring of --data-encryption-key
+// values (<id>:<hex AES key>), the first being the key to encrypt with, or
+// nil if there are none
+func parseDataEncryptionKeys(values []string) (*diskqueue.Keyring, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	keys := make(map[uint32][]byte, len(values))
+	var current uint32
+	for i, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("must be <id>:<hex key>")
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key id %q", parts[0])
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("key %d given twice", id)
+		}
+		// the error would include part of the key
+		keys[uint32(id)], err = hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not hex", id)
+		}
+		if i == 0 {
+			current = uint32(id)
+		}
+	}
+	return diskqueue.NewKeyring(keys, current)
+}
+
+// diskQueueCompression returns the compression of the records of new
+// diskqueues (opts.DiskQueueCompression is validated in New)
+func diskQueueCompression(opts *Options) diskqueue.Compression {
+	compression, _ := diskqueue.ParseCompression(opts.DiskQueueCompression)
+	return compression
+}
+
+// dataEncryptionKeyring returns the keyring new diskqueues are encrypted
+// with, nil for none (opts.DataEncryptionKeys are validated in New)
+func dataEncryptionKeyring(opts *Options) *diskqueue.Keyring {
+	keys, _ := parseDataEncryptionKeys(opts.DataEncryptionKeys)
+	return keys
+}
+
+// backendSkippedCount returns the number of messages of backend lost to
+// corruption since it was opened (see diskqueue's SkippedCount), 0 for
+// backends that can't be corrupted
+func backendSkippedCount(backend BackendQueue) int64 {
+	b, ok := backend.(interface {
+		SkippedCount() int64
+	})
+	if !ok {
+		return 0
+	}
+	return b.SkippedCount()
+}
+
+// backendChecksumErrorCount returns the number of records of backend that
+// failed their checksum since it was opened (see diskqueue's
+// ChecksumErrorCount), 0 for backends without checksums
+func backendChecksumErrorCount(backend BackendQueue) int64 {
+	b, ok := backend.(interface {
+		ChecksumErrorCount() int64
+	})
+	if !ok {
+		return 0
+	}
+	return b.ChecksumErrorCount()
+}
+
+// backendDiskBytes returns the size of backend's files (see diskqueue's
+// DiskBytes), 0 for backends without files
+func backendDiskBytes(backend BackendQueue) int64 {
+	b, ok := backend.(interface {
+		DiskBytes() int64
+	})
+	if !ok {
+		return 0
+	}
+	return b.DiskBytes()
+}
+
+// backendWriteThrottle returns whether a write to backend is waiting on its
+// max write rate, and how many have had to (see diskqueue's WriteThrottle),
+// false and 0 for backends that don't throttle writes
+func backendWriteThrottle(backend BackendQueue) (bool, int64) {
+	b, ok := backend.(interface {
+		WriteThrottle() (bool, int64)
+	})
+	if !ok {
+		return false, 0
+	}
+	return b.WriteThrottle()
+}
+
+// backendCompressionStats returns the size of the data of the messages
+// written to backend since it was opened, before and after compression (see
+// diskqueue's CompressionStats), 0 and 0 for backends that don't compress
+func backendCompressionStats(backend BackendQueue) (int64, int64) {
+	b, ok := backend.(interface {
+		CompressionStats() (int64, int64)
+	})
+	if !ok {
+		return 0, 0
+	}
+	return b.CompressionStats()
+}
+
+// backendPutBatch writes all of data, or (on error) none, to backend with
+// its PutBatch (see diskqueue's). Backends without one get a Put per record,
+// for which an error can leave the first records written.
+func backendPutBatch(backend BackendQueue, data [][]byte) error {
+	b, ok := backend.(interface {
+		PutBatch([][]byte) error
+	})
+	if ok {
+		return b.PutBatch(data)
+	}
+	for _, d := range data {
+		err := backend.Put(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendInternals returns where backend will read and write next (see
+// diskqueue's Positions), nil for backends without files
+func backendInternals(backend BackendQueue) *BackendInternals {
+	b, ok := backend.(interface {
+		Positions() (int64, int64, int64, int64, error)
+	})
+	if !ok {
+		return nil
+	}
+	readFileNum, readPos, writeFileNum, writePos, err := b.Positions()
+	if err != nil {
+		return nil
+	}
+	return &BackendInternals{
+		ReadFileNum:  readFileNum,
+		ReadPos:      readPos,
+		WriteFileNum: writeFileNum,
+		WritePos:     writePos,
+	}
+}
+
+// BackendQueueFactory creates the backend of a topic or channel. name is
+// unique within an nsqd (a channel's includes its topic's), and any files
+// belong in dataPath.
+type BackendQueueFactory func(name string, dataPath string, opts *Options) BackendQueue
+
+var backendQueueFactories = map[string]BackendQueueFactory{
+	"diskqueue": newDiskQueueBackend,
+	"memory":    newMemoryBackend,
+}
+
+// RegisterBackendQueue makes a backend available to --backend under name.
+// It is not safe for concurrent use and is meant to be called from an init
+// function. It panics if name is already registered.
+func RegisterBackendQueue(name string, factory BackendQueueFactory) {
+	if _, ok := backendQueueFactories[name]; ok {
+		panic(fmt.Sprintf("backend queue %q registered twice", name))
+	}
+	backendQueueFactories[name] = factory
+}
+
+func backendQueueNames() string {
+	names := make([]string, 0, len(backendQueueFactories))
+	for name := range backendQueueFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newBackendQueue creates a backend of the kind chosen by opts.Backend
+// (which is validated in New)
+func newBackendQueue(name string, dataPath string, opts *Options) BackendQueue {
+	return backendQueueFactories[opts.Backend](name, dataPath, opts)
+}
+
+func newDiskQueueBackend(name string, dataPath string, opts *Options) BackendQueue {
+	dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
+		lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
+	}
+	dq := diskqueue.New(
+		name,
+		dataPath,
+		opts.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		maxStoredMsgSize(opts),
+		opts.SyncEvery,
+		opts.SyncTimeout,
+		opts.ReadBufferSize,
+		diskQueueFormat(opts),
+		dataEncryptionKeyring(opts),
+		dqLogf,
+	)
+	dq.SetMaxWriteRate(opts.MaxDiskWriteRate)
+	dq.SetMmapReads(opts.DiskQueueMmap)
+	dq.SetCompression(diskQueueCompression(opts))
+	return dq
+}
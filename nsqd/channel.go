@@ -3,15 +3,14 @@ package nsqd
 import (
 	"container/heap"
 	"errors"
+	"fmt"
 	"math"
+	"math/rand"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/pqueue"
 	"github.com/nsqio/nsq/internal/quantile"
 )
@@ -21,6 +20,12 @@ type Consumer interface {
 	Pause()
 	Close() error
 	TimedOutMessage()
+	TimeoutWarning(MessageID)
+	AckedMessage(time.Duration)
+	IsSlow() bool
+	Evict() bool
+	IsForwarder() bool
+	IsReadyForMessages() bool
 	Stats() ClientStats
 	Empty()
 }
@@ -39,6 +44,47 @@ type Channel struct {
 	messageCount uint64
 	timeoutCount uint64
 
+	// histogram of REQ reasons, indexed by RequeueReason
+	requeueReasons [numRequeueReasons]uint64
+
+	firstDeliveryCount uint64
+	redeliveryCount    uint64
+
+	// timeout warnings sent, and warned messages FIN'd or TOUCHed in time
+	timeoutWarningCount  uint64
+	timeoutsAvoidedCount uint64
+
+	// messages dropped after --max-msg-attempts deliveries or once expired
+	// (see --msg-ttl), and those of them republished to the dead-letter topic
+	discardCount    uint64
+	expiredCount    uint64
+	deadLetterCount uint64
+
+	// messages finished, without delivery, for not matching a SUB filter
+	filteredCount uint64
+
+	// deliveries to local consumers and to forwarders
+	localDeliveryCount     uint64
+	forwardedDeliveryCount uint64
+
+	// messages FIN'd by clients
+	finishCount uint64
+
+	// copies of delivered messages archived, and those dropped, see
+	// archiveDelivery
+	archivedCount       uint64
+	archiveDroppedCount uint64
+
+	// client messagePumps subscribed to the channel
+	goroutines int64
+
+	// per-channel QueueOptions, and its topic's
+	limits      queueLimits
+	topicLimits *queueLimits
+
+	// enforces the max_delivery_rate QueueOption
+	deliveryLimit tokenBucket
+
 	sync.RWMutex
 
 	topicName string
@@ -46,13 +92,42 @@ type Channel struct {
 	nsqd      *NSQD
 
 	backend BackendQueue
+	// where backend's files are kept, see NSQD.backendDataPath
+	dataPath string
 
 	memoryMsgChan chan *Message
 	exitFlag      int32
 	exitMutex     sync.RWMutex
 
+	// requeued messages are kept apart from new ones (unless
+	// --requeue-policy=fifo) so clients can interleave the two
+	requeueMsgChan chan *Message
+
+	// high priority messages, taken ahead of the others
+	priority *priorityQueue
+
+	// an ordered channel's clients take messages from orderedMsgChan, see
+	// orderedLoop
+	orderedMsgChan     chan *Message
+	orderedRequeueChan chan *Message
+	orderedDoneChan    chan int
+	orderedMtx         sync.Mutex
+	orderedQuitChan    chan int
+	orderedExitChan    chan int
+
+	// with --queue-scheduling=fifo or weighted clients take messages from
+	// scheduledMsgChan, see scheduleLoop
+	scheduler        *queueScheduler
+	scheduledMsgChan chan *Message
+	scheduleMtx      sync.Mutex
+	scheduleQuitChan chan int
+	scheduleExitChan chan int
+
 	// state tracking
 	clients        map[int64]Consumer
+	labels         map[string]string
+	deadLetter     string
+	archive        ChannelArchive
 	paused         int32
 	ephemeral      bool
 	deleteCallback func(*Channel)
@@ -61,6 +136,9 @@ type Channel struct {
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
 
+	// samples of the counters above, see Rates
+	rateHistory rateHistory
+
 	// TODO: these can be DRYd up
 	deferredMessages map[MessageID]*pqueue.Item
 	deferredPQ       pqueue.PriorityQueue
@@ -68,6 +146,17 @@ type Channel struct {
 	inFlightMessages map[MessageID]*Message
 	inFlightPQ       inFlightPqueue
 	inFlightMutex    sync.Mutex
+	warningPQ        pqueue.PriorityQueue
+	warningMutex     sync.Mutex
+}
+
+// timeoutWarning is scheduled (see Consumer.TimeoutWarning) for the in-flight
+// messages of clients that asked for them, it is stale (and dropped) if the
+// message is no longer in flight to that client with that deadline
+type timeoutWarning struct {
+	id       MessageID
+	clientID int64
+	deadline int64
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
@@ -81,10 +170,22 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 		clients:        make(map[int64]Consumer),
 		deleteCallback: deleteCallback,
 		nsqd:           nsqd,
+		limits:         newQueueLimits(),
+		priority:       newPriorityQueue(nsqd.getOpts()),
+
+		orderedMsgChan:     make(chan *Message),
+		orderedRequeueChan: make(chan *Message, 1),
+		orderedDoneChan:    make(chan int, 1),
 	}
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
 	if nsqd.getOpts().MemQueueSize > 0 {
 		c.memoryMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
+		if nsqd.getOpts().RequeuePolicy != "fifo" {
+			c.requeueMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
+		}
+		c.scheduler = newQueueScheduler(nsqd.getOpts(),
+			func() int64 { return c.backend.Depth() }, c.decodeBackendMessage)
+		c.scheduledMsgChan = make(chan *Message)
 	}
 	if len(nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = quantile.New(
@@ -99,24 +200,14 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 		c.ephemeral = true
 		c.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
 		// backend names, for uniqueness, automatically include the topic...
 		backendName := getBackendName(topicName, channelName)
-		c.backend = diskqueue.New(
-			backendName,
-			nsqd.getOpts().DataPath,
-			nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			nsqd.getOpts().SyncEvery,
-			nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		c.dataPath = nsqd.backendDataPath(backendName, topicName)
+		c.backend = newBackendQueue(backendName, c.dataPath, nsqd.getOpts())
 	}
 
+	c.setScheduled(true)
+
 	c.nsqd.Notify(c)
 
 	return c
@@ -134,6 +225,10 @@ func (c *Channel) initPQ() {
 	c.deferredMessages = make(map[MessageID]*pqueue.Item)
 	c.deferredPQ = pqueue.New(pqSize)
 	c.deferredMutex.Unlock()
+
+	c.warningMutex.Lock()
+	c.warningPQ = pqueue.New(pqSize)
+	c.warningMutex.Unlock()
 }
 
 // Exiting returns a boolean indicating if this channel is closed/exiting
@@ -159,6 +254,9 @@ func (c *Channel) exit(deleted bool) error {
 		return errors.New("exiting")
 	}
 
+	c.setScheduled(false)
+	c.setOrdered(false)
+
 	if deleted {
 		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): deleting", c.name)
 
@@ -195,10 +293,19 @@ func (c *Channel) Empty() error {
 	for _, client := range c.clients {
 		client.Empty()
 	}
+	c.orderedDone()
+
+	// scheduleLoop puts back what it holds to be emptied too
+	if !c.Exiting() {
+		c.setScheduled(false)
+		defer c.setScheduled(!c.limits.isOrdered())
+	}
 
 	for {
 		select {
 		case <-c.memoryMsgChan:
+		case <-c.requeueMsgChan:
+		case <-c.priority.msgChan:
 		default:
 			goto finish
 		}
@@ -211,21 +318,25 @@ finish:
 // flush persists all the messages in internal memory buffers to the backend
 // it does not drain inflight/deferred because it is only called in Close()
 func (c *Channel) flush() error {
-	if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
+	memoryDepth := len(c.memoryMsgChan) + len(c.requeueMsgChan) + len(c.priority.msgChan)
+	if memoryDepth > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
 		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
-			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
+			c.name, memoryDepth, len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
 	for {
+		var msg *Message
 		select {
-		case msg := <-c.memoryMsgChan:
-			err := writeMessageToBackend(msg, c.backend)
-			if err != nil {
-				c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
-			}
+		case msg = <-c.memoryMsgChan:
+		case msg = <-c.requeueMsgChan:
+		case msg = <-c.priority.msgChan:
 		default:
 			goto finish
 		}
+		err := writeMessageToBackend(msg, c.backend)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+		}
 	}
 
 finish:
@@ -252,7 +363,26 @@ finish:
 }
 
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return int64(len(c.memoryMsgChan)) + int64(len(c.requeueMsgChan)) +
+		c.priority.depth() + c.scheduler.Held() + c.backend.Depth()
+}
+
+// isIdle returns true if the channel has no clients and no messages
+// (queued, in-flight or deferred)
+func (c *Channel) isIdle() bool {
+	c.RLock()
+	numClients := len(c.clients)
+	c.RUnlock()
+
+	c.inFlightMutex.Lock()
+	numInFlight := len(c.inFlightMessages)
+	c.inFlightMutex.Unlock()
+
+	c.deferredMutex.Lock()
+	numDeferred := len(c.deferredMessages)
+	c.deferredMutex.Unlock()
+
+	return numClients == 0 && numInFlight == 0 && numDeferred == 0 && c.Depth() == 0
 }
 
 func (c *Channel) Pause() error {
@@ -286,6 +416,86 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// SetLabels replaces the channel's labels, which are echoed in stats so that
+// channels can be grouped (by team, service, etc.). labels must not be
+// modified afterwards.
+func (c *Channel) SetLabels(labels map[string]string) {
+	c.Lock()
+	c.labels = labels
+	c.Unlock()
+}
+
+// ResetStats zeroes the channel's cumulative counters (messages, requeues,
+// timeouts, etc.), leaving its messages, depth and in-flight state untouched
+func (c *Channel) ResetStats() {
+	atomic.StoreUint64(&c.messageCount, 0)
+	atomic.StoreUint64(&c.requeueCount, 0)
+	atomic.StoreUint64(&c.timeoutCount, 0)
+	for i := range c.requeueReasons {
+		atomic.StoreUint64(&c.requeueReasons[i], 0)
+	}
+	atomic.StoreUint64(&c.firstDeliveryCount, 0)
+	atomic.StoreUint64(&c.redeliveryCount, 0)
+	atomic.StoreUint64(&c.timeoutWarningCount, 0)
+	atomic.StoreUint64(&c.timeoutsAvoidedCount, 0)
+	atomic.StoreUint64(&c.discardCount, 0)
+	atomic.StoreUint64(&c.expiredCount, 0)
+	atomic.StoreUint64(&c.deadLetterCount, 0)
+	atomic.StoreUint64(&c.localDeliveryCount, 0)
+	atomic.StoreUint64(&c.forwardedDeliveryCount, 0)
+	atomic.StoreUint64(&c.finishCount, 0)
+	atomic.StoreUint64(&c.archivedCount, 0)
+	atomic.StoreUint64(&c.archiveDroppedCount, 0)
+	c.rateHistory.reset()
+}
+
+// SetQueueOptions overrides the nsqd-wide options sizing the channel's
+// queues, qo must be valid
+func (c *Channel) SetQueueOptions(qo QueueOptions) {
+	c.limits.set(qo)
+	var maxDeliveryRate int64
+	if qo.MaxDeliveryRate != nil {
+		maxDeliveryRate = *qo.MaxDeliveryRate
+	}
+	c.deliveryLimit.setRate(maxDeliveryRate)
+	if !c.ephemeral {
+		c.limits.applyTo(c.backend, c.nsqd.getOpts())
+	}
+	// orderedLoop and scheduleLoop both read the queues, never at once
+	ordered := qo.Ordered != nil && *qo.Ordered
+	if ordered {
+		c.setScheduled(false)
+	}
+	c.setOrdered(ordered)
+	if !ordered {
+		c.setScheduled(true)
+	}
+}
+
+func (c *Channel) QueueOptions() QueueOptions {
+	return c.limits.options()
+}
+
+func (c *Channel) Labels() map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.labels
+}
+
+// SetDeadLetterTopic sets the topic messages discarded after
+// --max-msg-attempts are republished to, "" to drop them
+func (c *Channel) SetDeadLetterTopic(topicName string) {
+	c.Lock()
+	c.deadLetter = topicName
+	c.Unlock()
+}
+
+func (c *Channel) DeadLetterTopic() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.deadLetter
+}
+
 // PutMessage writes a Message to the queue
 func (c *Channel) PutMessage(m *Message) error {
 	c.RLock()
@@ -302,20 +512,65 @@ func (c *Channel) PutMessage(m *Message) error {
 }
 
 func (c *Channel) put(m *Message) error {
+	memoryMsgChan := c.limits.memoryQueue(c.memoryMsgChan)
+	if m.Priority > PriorityNormal {
+		// a full priority queue spills to the backend too, rather than
+		// behind the normal messages in memory
+		memoryMsgChan = c.limits.memoryQueue(c.priority.msgChan)
+	}
+	if c.limits.isOrdered() {
+		// the backend is strictly FIFO
+		memoryMsgChan = nil
+	}
 	select {
-	case c.memoryMsgChan <- m:
+	case memoryMsgChan <- m:
 	default:
+		span := c.nsqd.newSpan(spanEnqueueDisk, m, c.topicName, c.name)
 		err := writeMessageToBackend(m, c.backend)
-		c.nsqd.SetHealth(err)
+		if err != errMemoryQueueFull {
+			c.nsqd.SetHealth(err)
+		}
 		if err != nil {
 			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
 				c.name, err)
 			return err
 		}
+		c.nsqd.emitSpan(span)
 	}
 	return nil
 }
 
+// requeue puts a message that has already been delivered back on the queue.
+//
+// With --requeue-policy=fifo it goes to the tail, behind every message
+// already queued. Otherwise it goes to requeueMsgChan, which clients drain
+// ahead of (requeue-first) or interleaved with (ratio) new messages, so with
+// requeue-first it is effectively inserted at the head of the channel.
+//
+// Only in-memory requeues can jump the queue: when requeueMsgChan is full
+// (or --mem-queue-size=0) the message spills to the backend, which is
+// strictly FIFO, and so always goes to the tail.
+func (c *Channel) requeue(m *Message) error {
+	if m.Attempts == 0 {
+		// a deferred publish, not a redelivery
+		return c.put(m)
+	}
+	if c.limits.isOrdered() {
+		// the one message of an ordered channel that's out, see orderedLoop
+		select {
+		case c.orderedRequeueChan <- m:
+			return nil
+		default:
+		}
+	}
+	select {
+	case c.limits.memoryQueue(c.requeueMsgChan) <- m:
+		return nil
+	default:
+		return c.put(m)
+	}
+}
+
 func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
 	atomic.AddUint64(&c.messageCount, 1)
 	c.StartDeferredTimeout(msg, timeout)
@@ -323,11 +578,22 @@ func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
 
 // TouchMessage resets the timeout for an in-flight message
 func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout time.Duration) error {
+	return c.touchMessage(clientID, id, clientMsgTimeout, 0)
+}
+
+// touchMessage is TouchMessage, scheduling a timeout warning to the client
+// warning before the new timeout if warning > 0
+func (c *Channel) touchMessage(clientID int64, id MessageID, clientMsgTimeout time.Duration, warning time.Duration) error {
 	msg, err := c.popInFlightMessage(clientID, id)
 	if err != nil {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	c.removeTimeoutWarning(msg)
+	if msg.warned {
+		msg.warned = false
+		atomic.AddUint64(&c.timeoutsAvoidedCount, 1)
+	}
 
 	newTimeout := time.Now().Add(clientMsgTimeout)
 	if newTimeout.Sub(msg.deliveryTS) >=
@@ -337,11 +603,13 @@ func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout ti
 	}
 
 	msg.pri = newTimeout.UnixNano()
+	item := c.newTimeoutWarning(msg, warning)
 	err = c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	c.addToWarningPQ(item)
 	return nil
 }
 
@@ -352,9 +620,18 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	c.removeTimeoutWarning(msg)
+	if msg.warned {
+		atomic.AddUint64(&c.timeoutsAvoidedCount, 1)
+	}
+	atomic.AddUint64(&c.finishCount, 1)
+	c.ackedMessage(clientID, msg)
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
+	c.nsqd.trace(spanFinish, msg, c.topicName, c.name)
+	msg.release()
+	c.orderedDone()
 	return nil
 }
 
@@ -364,22 +641,40 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 // `timeoutMs`  > 0 - asynchronously wait for the specified timeout
 //     and requeue a message (aka "deferred requeue")
 //
-func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Duration) error {
+// Where the message re-enters the channel depends on --requeue-policy, see
+// requeue(). With requeue_backoff the timeout is at least requeueDelay.
+//
+func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Duration, reason RequeueReason) error {
 	// remove from inflight first
 	msg, err := c.popInFlightMessage(clientID, id)
 	if err != nil {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	c.removeTimeoutWarning(msg)
 	atomic.AddUint64(&c.requeueCount, 1)
+	c.ackedMessage(clientID, msg)
+	if reason < 0 || reason >= numRequeueReasons {
+		reason = RequeueReasonOther
+	}
+	atomic.AddUint64(&c.requeueReasons[reason], 1)
+	c.nsqd.trace(spanRequeue, msg, c.topicName, c.name)
 
+	if c.exhausted(msg) {
+		c.discardMessage(msg)
+		return nil
+	}
+
+	if delay := c.requeueDelay(msg); timeout < delay {
+		timeout = delay
+	}
 	if timeout == 0 {
 		c.exitMutex.RLock()
 		if c.Exiting() {
 			c.exitMutex.RUnlock()
 			return errors.New("exiting")
 		}
-		err := c.put(msg)
+		err := c.requeue(msg)
 		c.exitMutex.RUnlock()
 		return err
 	}
@@ -388,6 +683,129 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	return c.StartDeferredTimeout(msg, timeout)
 }
 
+// requeueDelay returns the least timeout of a REQ of msg with the channel's
+// requeue_backoff (0 without it): requeue_backoff doubled for each attempt
+// after the first, plus up to a quarter at random, up to requeue_backoff_max
+// and --max-req-timeout
+func (c *Channel) requeueDelay(msg *Message) time.Duration {
+	backoff, max := c.limits.requeueBackoffs()
+	if backoff == 0 {
+		return 0
+	}
+	if maxReqTimeout := c.nsqd.getOpts().MaxReqTimeout; max == 0 || max > maxReqTimeout {
+		max = maxReqTimeout
+	}
+	delay := backoff
+	for i := uint16(1); i < msg.Attempts && delay < max; i++ {
+		delay *= 2
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/4 + 1))
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// exhausted returns whether msg, back from a client, has been delivered
+// --max-msg-attempts times and must not be delivered again
+func (c *Channel) exhausted(msg *Message) bool {
+	maxAttempts := c.nsqd.getOpts().MaxMsgAttempts
+	return maxAttempts > 0 && int(msg.Attempts) >= maxAttempts
+}
+
+// discardMessage drops an exhausted msg instead of delivering it again, see
+// dropMessage
+func (c *Channel) discardMessage(msg *Message) {
+	atomic.AddUint64(&c.discardCount, 1)
+	c.dropMessage(msg, fmt.Sprintf("after %d attempts", msg.Attempts))
+}
+
+// msgTimeout returns the channel's msg_timeout, if it has one (up to
+// --max-msg-timeout, which may have been lowered since), or else
+// clientMsgTimeout
+func (c *Channel) msgTimeout(clientMsgTimeout time.Duration) time.Duration {
+	timeout := c.limits.timeout()
+	if timeout == 0 {
+		return clientMsgTimeout
+	}
+	if max := c.nsqd.getOpts().MaxMsgTimeout; timeout > max {
+		return max
+	}
+	return timeout
+}
+
+// msgTTL returns the channel's message TTL, its topic's or else --msg-ttl
+func (c *Channel) msgTTL() time.Duration {
+	if ttl, ok := c.limits.ttl(); ok {
+		return ttl
+	}
+	if c.topicLimits != nil {
+		if ttl, ok := c.topicLimits.ttl(); ok {
+			return ttl
+		}
+	}
+	return c.nsqd.getOpts().MsgTTL
+}
+
+// expired returns whether msg was published longer ago than the channel's
+// message TTL
+func (c *Channel) expired(msg *Message) bool {
+	ttl := c.msgTTL()
+	return ttl > 0 && time.Now().UnixNano()-msg.Timestamp > int64(ttl)
+}
+
+// expireMessage drops an expired msg instead of delivering it, see
+// dropMessage
+func (c *Channel) expireMessage(msg *Message) {
+	atomic.AddUint64(&c.expiredCount, 1)
+	c.dropMessage(msg, "expired")
+}
+
+// filterMessage finishes msg, which doesn't match the filter of the client
+// it would have been sent to, without delivering it
+func (c *Channel) filterMessage(msg *Message) {
+	atomic.AddUint64(&c.filteredCount, 1)
+	msg.release()
+	c.orderedDone()
+}
+
+// dropMessage republishes msg (with its ID and attempts) to the channel's
+// dead-letter topic, if any, or else drops it.
+//
+// it looks the topic up so it must not be called with exitMutex held,
+// NSQD.Exit closes channels while holding the NSQD lock
+func (c *Channel) dropMessage(msg *Message, reason string) {
+	defer c.orderedDone()
+	if topicName := c.DeadLetterTopic(); topicName != "" {
+		err := c.putDeadLetter(topicName, msg)
+		if err == nil {
+			atomic.AddUint64(&c.deadLetterCount, 1)
+			msg.release()
+			return
+		}
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to dead-letter msg(%s) to topic %s - %s",
+			c.name, msg.ID, topicName, err)
+	}
+	c.nsqd.logf(LOG_WARN, "CHANNEL(%s): discarding msg(%s) %s", c.name, msg.ID, reason)
+	msg.release()
+}
+
+// putDeadLetter publishes a copy of msg to topicName, its timestamp is that
+// of the new publish so that it doesn't expire there right away
+func (c *Channel) putDeadLetter(topicName string, msg *Message) error {
+	topic, err := c.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return err
+	}
+	// msg's body may be pooled, and is released by the caller
+	body := make([]byte, len(msg.Body))
+	copy(body, msg.Body)
+	m := NewMessage(msg.ID, body)
+	m.Attempts = msg.Attempts
+	m.Headers = msg.Headers
+	return topic.PutMessage(m)
+}
+
 // AddClient adds a client to the Channel's client list
 func (c *Channel) AddClient(clientID int64, client Consumer) error {
 	c.Lock()
@@ -423,16 +841,268 @@ func (c *Channel) RemoveClient(clientID int64) {
 	}
 }
 
+// requeueInFlight requeues the messages in flight to a client which has gone
+// away (it can no longer FIN or TOUCH them) rather than waiting for them to
+// time out, they're counted as timeouts all the same
+func (c *Channel) requeueInFlight(clientID int64) {
+	// discarded once exitMutex is released, see discardMessage
+	var exhausted []*Message
+	defer func() {
+		for _, msg := range exhausted {
+			c.discardMessage(msg)
+		}
+	}()
+
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+
+	if c.Exiting() {
+		return
+	}
+
+	var ids []MessageID
+	c.inFlightMutex.Lock()
+	for id, msg := range c.inFlightMessages {
+		if msg.clientID == clientID {
+			ids = append(ids, id)
+		}
+	}
+	c.inFlightMutex.Unlock()
+
+	for _, id := range ids {
+		// it may have timed out in the meantime
+		msg, err := c.popInFlightMessage(clientID, id)
+		if err != nil {
+			continue
+		}
+		c.removeFromInFlightPQ(msg)
+		c.removeTimeoutWarning(msg)
+		atomic.AddUint64(&c.timeoutCount, 1)
+		c.nsqd.trace(spanTimeout, msg, c.topicName, c.name)
+		if c.exhausted(msg) {
+			exhausted = append(exhausted, msg)
+			continue
+		}
+		c.requeue(msg)
+	}
+}
+
+// Goroutines returns the number of goroutines (client messagePumps) working
+// on the channel
+func (c *Channel) Goroutines() int64 {
+	return atomic.LoadInt64(&c.goroutines)
+}
+
+// hasReadyConsumers returns whether any of the channel's forwarders (or
+// local consumers, if forwarder is false) is ready for more messages
+func (c *Channel) hasReadyConsumers(forwarder bool) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for _, client := range c.clients {
+		if client.IsForwarder() == forwarder && client.IsReadyForMessages() {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryChans returns the chans clients take messages from: the memory
+// queue, the backend and the requeue chan, or for an ordered channel
+// orderedMsgChan alone
+func (c *Channel) deliveryChans() (chan *Message, <-chan []byte, chan *Message) {
+	if c.limits.isOrdered() {
+		return c.orderedMsgChan, nil, nil
+	}
+	if c.scheduler != nil {
+		return c.scheduledMsgChan, nil, c.requeueMsgChan
+	}
+	return c.memoryMsgChan, c.backend.ReadChan(), c.requeueMsgChan
+}
+
+// priorityDeliveryChan returns the chan of high priority messages, which
+// clients take from ahead of those of deliveryChans, or nil if it's the
+// others' turn (see priorityQueue)
+func (c *Channel) priorityDeliveryChan() chan *Message {
+	if c.limits.isOrdered() {
+		return nil
+	}
+	return c.priority.turn(c.Depth() > c.priority.depth())
+}
+
+// setOrdered starts or stops orderedLoop
+func (c *Channel) setOrdered(ordered bool) {
+	c.orderedMtx.Lock()
+	defer c.orderedMtx.Unlock()
+	if ordered == (c.orderedQuitChan != nil) {
+		return
+	}
+	if ordered {
+		c.orderedQuitChan = make(chan int)
+		c.orderedExitChan = make(chan int)
+		go c.orderedLoop(c.orderedQuitChan, c.orderedExitChan)
+		return
+	}
+	close(c.orderedQuitChan)
+	<-c.orderedExitChan
+	c.orderedQuitChan = nil
+}
+
+// orderedDone signals orderedLoop that the message out was finished (or
+// dropped)
+func (c *Channel) orderedDone() {
+	select {
+	case c.orderedDoneChan <- 1:
+	default:
+	}
+}
+
+// orderedLoop delivers an ordered channel's messages one at a time in the
+// order they were queued (put writes them all to the backend): it hands one
+// to whichever client takes it from orderedMsgChan and, until it's finished,
+// only delivers it again if it's requeued
+func (c *Channel) orderedLoop(quitChan chan int, exitChan chan int) {
+	defer close(exitChan)
+
+	var out bool
+	for {
+		var msg *Message
+		if out {
+			select {
+			case msg = <-c.orderedRequeueChan:
+			case <-c.orderedDoneChan:
+				out = false
+				continue
+			case <-quitChan:
+				return
+			}
+		} else {
+			select {
+			case msg = <-c.orderedRequeueChan:
+			case msg = <-c.memoryMsgChan:
+			case msg = <-c.requeueMsgChan:
+			case msg = <-c.priority.msgChan:
+			case b := <-c.backend.ReadChan():
+				var err error
+				msg, err = decodeBackendMessage(c.backend, b, c.nsqd.getOpts().MessagePool)
+				if err != nil {
+					c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message - %s", c.name, err)
+					continue
+				}
+			case <-c.orderedDoneChan:
+				continue
+			case <-quitChan:
+				return
+			}
+		}
+
+		out = true
+		select {
+		case c.orderedMsgChan <- msg:
+		case <-quitChan:
+			c.put(msg)
+			return
+		}
+	}
+}
+
+// decodeBackendMessage decodes a message read from the backend, nil if it
+// can't be
+func (c *Channel) decodeBackendMessage(b []byte) *Message {
+	msg, err := decodeBackendMessage(c.backend, b, c.nsqd.getOpts().MessagePool)
+	if err != nil {
+		c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to decode message - %s", c.name, err)
+		return nil
+	}
+	return msg
+}
+
+// setScheduled starts or stops scheduleLoop, if there's a scheduler
+func (c *Channel) setScheduled(scheduled bool) {
+	if c.scheduler == nil {
+		return
+	}
+	c.scheduleMtx.Lock()
+	defer c.scheduleMtx.Unlock()
+	if scheduled == (c.scheduleQuitChan != nil) {
+		return
+	}
+	if scheduled {
+		c.scheduleQuitChan = make(chan int)
+		c.scheduleExitChan = make(chan int)
+		go c.scheduleLoop(c.scheduleQuitChan, c.scheduleExitChan)
+		return
+	}
+	close(c.scheduleQuitChan)
+	<-c.scheduleExitChan
+	c.scheduleQuitChan = nil
+}
+
+// scheduleLoop hands the messages of the channel's in-memory and backend
+// queues to whichever client takes them from scheduledMsgChan, in the order
+// c.scheduler decides. When it's stopped the messages it holds are put back.
+func (c *Channel) scheduleLoop(quitChan chan int, exitChan chan int) {
+	defer close(exitChan)
+
+	s := c.scheduler
+	for {
+		s.fill(c.memoryMsgChan, c.backend.ReadChan())
+		msg := s.next()
+		if msg == nil {
+			select {
+			case msg = <-c.memoryMsgChan:
+				s.hold(msg, false)
+			case b := <-c.backend.ReadChan():
+				if msg = c.decodeBackendMessage(b); msg != nil {
+					s.hold(msg, true)
+				}
+			case <-quitChan:
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.scheduledMsgChan <- msg:
+			s.done()
+		case <-quitChan:
+			c.put(msg)
+			s.done()
+			for _, msg := range s.drain() {
+				c.put(msg)
+			}
+			return
+		}
+	}
+}
+
 func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout time.Duration) error {
+	return c.startInFlightTimeout(msg, clientID, timeout, 0)
+}
+
+// startInFlightTimeout is StartInFlightTimeout, scheduling a timeout warning
+// to the client warning before the timeout if warning > 0
+func (c *Channel) startInFlightTimeout(msg *Message, clientID int64, timeout time.Duration, warning time.Duration) error {
 	now := time.Now()
 	msg.clientID = clientID
 	msg.deliveryTS = now
 	msg.pri = now.Add(timeout).UnixNano()
+	msg.warned = false
+	item := c.newTimeoutWarning(msg, warning)
+	redelivery := msg.Attempts > 1
+	span := c.nsqd.newSpan(spanDeliver, msg, c.topicName, c.name)
+	c.archiveDelivery(msg)
 	err := c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	c.addToWarningPQ(item)
+	c.nsqd.emitSpan(span)
+	if redelivery {
+		atomic.AddUint64(&c.redeliveryCount, 1)
+	} else {
+		atomic.AddUint64(&c.firstDeliveryCount, 1)
+	}
 	return nil
 }
 
@@ -527,6 +1197,92 @@ func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	c.deferredMutex.Unlock()
 }
 
+// newTimeoutWarning returns the warning to schedule (with addToWarningPQ)
+// warning before msg times out, nil if warning <= 0
+//
+// it must be called before msg is put in flight, a FIN could otherwise
+// release it to the pool under our feet
+func (c *Channel) newTimeoutWarning(msg *Message, warning time.Duration) *pqueue.Item {
+	msg.warning = nil
+	if warning <= 0 {
+		return nil
+	}
+	msg.warning = &pqueue.Item{
+		Value:    &timeoutWarning{id: msg.ID, clientID: msg.clientID, deadline: msg.pri},
+		Priority: msg.pri - int64(warning),
+		Index:    -1,
+	}
+	return msg.warning
+}
+
+func (c *Channel) addToWarningPQ(item *pqueue.Item) {
+	if item == nil {
+		return
+	}
+	c.warningMutex.Lock()
+	heap.Push(&c.warningPQ, item)
+	c.warningMutex.Unlock()
+}
+
+// removeTimeoutWarning removes msg's pending timeout warning, if any,
+// msg must have been popped from the in-flight messages
+func (c *Channel) removeTimeoutWarning(msg *Message) {
+	if msg.warning == nil {
+		return
+	}
+	c.warningMutex.Lock()
+	if msg.warning.Index != -1 {
+		heap.Remove(&c.warningPQ, msg.warning.Index)
+	}
+	c.warningMutex.Unlock()
+	msg.warning = nil
+}
+
+// processTimeoutWarnings sends the timeout warnings due by t
+func (c *Channel) processTimeoutWarnings(t int64) bool {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+
+	if c.Exiting() {
+		return false
+	}
+
+	dirty := false
+	for {
+		c.warningMutex.Lock()
+		item, _ := c.warningPQ.PeekAndShift(t)
+		c.warningMutex.Unlock()
+
+		if item == nil {
+			goto exit
+		}
+		dirty = true
+
+		w := item.Value.(*timeoutWarning)
+		c.inFlightMutex.Lock()
+		msg, ok := c.inFlightMessages[w.id]
+		ok = ok && msg.clientID == w.clientID && msg.pri == w.deadline
+		if ok {
+			msg.warned = true
+		}
+		c.inFlightMutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		c.RLock()
+		client, ok := c.clients[w.clientID]
+		c.RUnlock()
+		if ok {
+			atomic.AddUint64(&c.timeoutWarningCount, 1)
+			client.TimeoutWarning(w.id)
+		}
+	}
+
+exit:
+	return dirty
+}
+
 func (c *Channel) processDeferredQueue(t int64) bool {
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
@@ -551,7 +1307,7 @@ func (c *Channel) processDeferredQueue(t int64) bool {
 		if err != nil {
 			goto exit
 		}
-		c.put(msg)
+		c.requeue(msg)
 	}
 
 exit:
@@ -559,6 +1315,14 @@ exit:
 }
 
 func (c *Channel) processInFlightQueue(t int64) bool {
+	// discarded once exitMutex is released, see discardMessage
+	var exhausted []*Message
+	defer func() {
+		for _, msg := range exhausted {
+			c.discardMessage(msg)
+		}
+	}()
+
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
 
@@ -581,14 +1345,21 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		if err != nil {
 			goto exit
 		}
+		c.removeTimeoutWarning(msg)
 		atomic.AddUint64(&c.timeoutCount, 1)
+		c.nsqd.trace(spanTimeout, msg, c.topicName, c.name)
 		c.RLock()
 		client, ok := c.clients[msg.clientID]
 		c.RUnlock()
 		if ok {
 			client.TimedOutMessage()
+			c.checkSlowConsumer(msg.clientID, client)
+		}
+		if c.exhausted(msg) {
+			exhausted = append(exhausted, msg)
+			continue
 		}
-		c.put(msg)
+		c.requeue(msg)
 	}
 
 exit:
@@ -59,6 +59,70 @@ func TestPutMessage2Chan(t *testing.T) {
 	test.Equal(t, msg.Body, outputMsg2.Body)
 }
 
+func TestRequeuePosition(t *testing.T) {
+	// fifo requeues go to the tail, requeue-first ones to the head unless
+	// they spill to the backend (c)
+	testRequeuePosition(t, "fifo", "deabc")
+	testRequeuePosition(t, "requeue-first", "abdec")
+}
+
+func testRequeuePosition(t *testing.T, policy string, expected string) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	opts.RequeuePolicy = policy
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_requeue_position" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	var id MessageID
+	put := func(body string) {
+		id[0]++
+		channel.PutMessage(NewMessage(id, []byte(body)))
+	}
+	// drain the channel the way a client using requeue-first would
+	get := func() *Message {
+		select {
+		case msg := <-channel.requeueMsgChan:
+			return msg
+		default:
+		}
+		select {
+		case msg := <-channel.memoryMsgChan:
+			return msg
+		default:
+		}
+		msg, err := decodeMessage(<-channel.backend.ReadChan())
+		test.Nil(t, err)
+		return msg
+	}
+
+	var inFlight []*Message
+	for _, body := range []string{"a", "b", "c"} {
+		put(body)
+		msg := get()
+		msg.Attempts++
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		inFlight = append(inFlight, msg)
+	}
+	put("d")
+	put("e")
+
+	for _, msg := range inFlight {
+		err := channel.RequeueMessage(0, msg.ID, 0, RequeueReasonUnspecified)
+		test.Nil(t, err)
+	}
+
+	var actual string
+	for range expected {
+		actual += string(get().Body)
+	}
+	test.Equal(t, expected, actual)
+}
+
 func TestInFlightWorker(t *testing.T) {
 	count := 250
 
@@ -122,7 +186,7 @@ func TestChannelEmpty(t *testing.T) {
 		msgs = append(msgs, msg)
 	}
 
-	channel.RequeueMessage(0, msgs[len(msgs)-1].ID, 100*time.Millisecond)
+	channel.RequeueMessage(0, msgs[len(msgs)-1].ID, 100*time.Millisecond, RequeueReasonUnspecified)
 	test.Equal(t, 24, len(channel.inFlightMessages))
 	test.Equal(t, 24, len(channel.inFlightPQ))
 	test.Equal(t, 1, len(channel.deferredMessages))
@@ -248,3 +312,173 @@ func TestChannelHealth(t *testing.T) {
 	resp.Body.Close()
 	test.Equal(t, "OK", string(body))
 }
+
+func TestChannelResetStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_reset_stats" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+		}
+	}
+	consume := func(n int, fin bool) {
+		for i := 0; i < n; i++ {
+			msg := <-channel.memoryMsgChan
+			channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+			if fin {
+				test.Nil(t, channel.FinishMessage(0, msg.ID))
+			} else {
+				test.Nil(t, channel.RequeueMessage(0, msg.ID, time.Hour, RequeueReasonTransient))
+			}
+		}
+	}
+
+	// leave 1 message deferred, 1 in flight and 3 in the queue
+	put(10)
+	consume(1, false)
+	consume(5, true)
+	msg := <-channel.memoryMsgChan
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(10), stats.MessageCount)
+	test.Equal(t, uint64(1), stats.RequeueCount)
+	test.Equal(t, uint64(1), stats.RequeueReasons["transient"])
+	test.Equal(t, uint64(7), stats.FirstDeliveryCount)
+
+	channel.ResetStats()
+
+	stats = NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(0), stats.MessageCount)
+	test.Equal(t, uint64(0), stats.RequeueCount)
+	test.Equal(t, uint64(0), stats.FirstDeliveryCount)
+	test.Equal(t, 0, len(stats.RequeueReasons))
+	test.Equal(t, int64(3), stats.Depth)
+	test.Equal(t, 1, stats.InFlightCount)
+	test.Equal(t, 1, stats.DeferredCount)
+
+	// messages keep flowing (and counting) after a reset
+	done := make(chan int)
+	go func() {
+		consume(23, true)
+		close(done)
+	}()
+	put(20)
+	<-done
+	test.Nil(t, channel.FinishMessage(0, msg.ID))
+
+	stats = NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(20), stats.MessageCount)
+	test.Equal(t, uint64(23), stats.FirstDeliveryCount)
+	test.Equal(t, uint64(0), stats.RequeueCount)
+	test.Equal(t, int64(0), stats.Depth)
+	test.Equal(t, 0, stats.InFlightCount)
+	test.Equal(t, 1, stats.DeferredCount)
+}
+
+func TestChannelQueueScheduling(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		weight   int
+		memory   []int64
+		backend  []int64
+		expected []int64
+	}{
+		// by timestamp
+		{schedulingFIFO, 1, []int64{2, 4}, []int64{1, 3}, []int64{1, 2, 3, 4}},
+		// 2 from memory per one from the backend
+		{schedulingWeighted, 2, []int64{1, 2, 3, 4}, []int64{5, 6}, []int64{1, 2, 5, 3, 4, 6}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			opts := NewOptions()
+			opts.Logger = test.NewTestLogger(t)
+			opts.QueueScheduling = tc.policy
+			opts.QueueSchedulingWeight = tc.weight
+			_, _, nsqd := mustStartNSQD(opts)
+			defer os.RemoveAll(opts.DataPath)
+			defer nsqd.Exit()
+
+			topicName := "test_channel_queue_scheduling" + strconv.Itoa(int(time.Now().Unix()))
+			channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+			// queue them all before scheduleLoop takes any
+			channel.setScheduled(false)
+			for _, ts := range tc.memory {
+				msg := NewMessage(MessageID{}, []byte(strconv.FormatInt(ts, 10)))
+				msg.Timestamp = ts
+				channel.memoryMsgChan <- msg
+			}
+			for _, ts := range tc.backend {
+				msg := NewMessage(MessageID{}, []byte(strconv.FormatInt(ts, 10)))
+				msg.Timestamp = ts
+				test.Nil(t, writeMessageToBackend(msg, channel.backend))
+			}
+			test.Equal(t, int64(len(tc.expected)), channel.Depth())
+			channel.setScheduled(true)
+
+			memoryMsgChan, backendChan, _ := channel.deliveryChans()
+			test.Equal(t, true, backendChan == nil)
+			var timestamps []int64
+			for range tc.expected {
+				msg := <-memoryMsgChan
+				timestamps = append(timestamps, msg.Timestamp)
+			}
+			test.Equal(t, tc.expected, timestamps)
+			// the depth is updated just after a message is handed out
+			for i := 0; i < 100 && channel.Depth() > 0; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			test.Equal(t, int64(0), channel.Depth())
+		})
+	}
+}
+
+func TestChannelRequeueBackoff(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_backoff" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 3
+	test.Equal(t, time.Duration(0), channel.requeueDelay(msg))
+
+	backoff := int64(100)
+	backoffMax := int64(1000)
+	channel.SetQueueOptions(QueueOptions{RequeueBackoff: &backoff, RequeueBackoffMax: &backoffMax})
+	for _, tc := range []struct {
+		attempts uint16
+		min      time.Duration
+		max      time.Duration
+	}{
+		{1, 100 * time.Millisecond, 125 * time.Millisecond},
+		{2, 200 * time.Millisecond, 250 * time.Millisecond},
+		{3, 400 * time.Millisecond, 500 * time.Millisecond},
+		{4, 800 * time.Millisecond, time.Second},
+		{10, time.Second, time.Second},
+	} {
+		msg.Attempts = tc.attempts
+		delay := channel.requeueDelay(msg)
+		test.Equal(t, true, delay >= tc.min && delay <= tc.max)
+	}
+
+	// a REQ with no timeout is deferred anyway
+	msg.Attempts = 1
+	test.Nil(t, channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout))
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0, RequeueReasonOther))
+	test.Equal(t, 1, len(channel.deferredMessages))
+	test.Equal(t, int64(0), channel.Depth())
+}
@@ -25,19 +25,23 @@ const (
 )
 
 type identifyDataV2 struct {
-	ClientID            string `json:"client_id"`
-	Hostname            string `json:"hostname"`
-	HeartbeatInterval   int    `json:"heartbeat_interval"`
-	OutputBufferSize    int    `json:"output_buffer_size"`
-	OutputBufferTimeout int    `json:"output_buffer_timeout"`
-	FeatureNegotiation  bool   `json:"feature_negotiation"`
-	TLSv1               bool   `json:"tls_v1"`
-	Deflate             bool   `json:"deflate"`
-	DeflateLevel        int    `json:"deflate_level"`
-	Snappy              bool   `json:"snappy"`
-	SampleRate          int32  `json:"sample_rate"`
-	UserAgent           string `json:"user_agent"`
-	MsgTimeout          int    `json:"msg_timeout"`
+	ClientID            string  `json:"client_id"`
+	Hostname            string  `json:"hostname"`
+	HeartbeatInterval   int     `json:"heartbeat_interval"`
+	OutputBufferSize    int     `json:"output_buffer_size"`
+	OutputBufferTimeout int     `json:"output_buffer_timeout"`
+	FeatureNegotiation  bool    `json:"feature_negotiation"`
+	TLSv1               bool    `json:"tls_v1"`
+	Deflate             bool    `json:"deflate"`
+	DeflateLevel        int     `json:"deflate_level"`
+	Snappy              bool    `json:"snappy"`
+	SampleRate          int32   `json:"sample_rate"`
+	UserAgent           string  `json:"user_agent"`
+	MsgTimeout          int     `json:"msg_timeout"`
+	MsgTimeoutWarning   float64 `json:"msg_timeout_warning"`
+	Forwarder           bool    `json:"forwarder"`
+	MsgHeaders          bool    `json:"msg_headers"`
+	PublishDurability   string  `json:"publish_durability"`
 }
 
 type identifyEvent struct {
@@ -45,6 +49,7 @@ type identifyEvent struct {
 	HeartbeatInterval   time.Duration
 	SampleRate          int32
 	MsgTimeout          time.Duration
+	MsgTimeoutWarning   float64
 }
 
 type clientV2 struct {
@@ -55,6 +60,19 @@ type clientV2 struct {
 	FinishCount   uint64
 	RequeueCount  uint64
 
+	// when (in ns) the client last sent a NOP, its reply to a heartbeat
+	lastHeartbeat int64
+
+	// Writer's Buffered() and Size() as of the last write, see
+	// updateOutputBuffer
+	outputBuffered   int64
+	outputBufferSize int64
+
+	// set while protocolV2.messagePump runs
+	pumpRunning int32
+
+	ackStats
+
 	pubCounts map[string]uint64
 
 	writeLock sync.RWMutex
@@ -82,6 +100,25 @@ type clientV2 struct {
 
 	MsgTimeout time.Duration
 
+	// fraction of MsgTimeout after which in-flight messages get a timeout
+	// warning (0 to disable), see TimeoutWarning
+	MsgTimeoutWarning  float64
+	TimeoutWarningChan chan int
+	timeoutWarnings    []MessageID
+	timeoutWarningLock sync.Mutex
+
+	// a forwarder (e.g. nsq_to_nsq) relays messages to a remote nsqd,
+	// see --delivery-preference
+	Forwarder bool
+
+	// messages to and from the client are encoded with headers, see
+	// msgHeadersFlag
+	MsgHeaders bool
+	// when its PUBs and MPUBs are OK, see DurabilityMemory and DurabilityFsync
+	PublishDurability string
+	// the filter the client SUBscribed with, if any
+	filter msgFilter
+
 	State          int32
 	ConnectTime    time.Time
 	Channel        *Channel
@@ -106,6 +143,11 @@ type clientV2 struct {
 
 	AuthSecret string
 	AuthState  *auth.State
+
+	// of its TLS client certificate, see certIdentities
+	tlsIdentities []string
+	// granted by its TLS client certificate, see --tls-client-authorization
+	tlsAuthorizations []auth.Authorization
 }
 
 func newClientV2(id int64, conn net.Conn, nsqd *NSQD) *clientV2 {
@@ -126,14 +168,19 @@ func newClientV2(id int64, conn net.Conn, nsqd *NSQD) *clientV2 {
 		OutputBufferSize:    defaultBufferSize,
 		OutputBufferTimeout: nsqd.getOpts().OutputBufferTimeout,
 
+		outputBufferSize: defaultBufferSize,
+
 		MsgTimeout: nsqd.getOpts().MsgTimeout,
 
 		// ReadyStateChan has a buffer of 1 to guarantee that in the event
 		// there is a race the state update is not lost
 		ReadyStateChan: make(chan int, 1),
 		ExitChan:       make(chan int),
-		ConnectTime:    time.Now(),
-		State:          stateInit,
+
+		TimeoutWarningChan: make(chan int, 1),
+
+		ConnectTime: time.Now(),
+		State:       stateInit,
 
 		ClientID: identifier,
 		Hostname: identifier,
@@ -183,11 +230,25 @@ func (c *clientV2) Identify(data identifyDataV2) error {
 		return err
 	}
 
+	err = c.SetMsgTimeoutWarning(data.MsgTimeoutWarning)
+	if err != nil {
+		return err
+	}
+
+	if !isValidDurability(data.PublishDurability) {
+		return fmt.Errorf("publish durability (%s) is invalid", data.PublishDurability)
+	}
+
+	c.Forwarder = data.Forwarder
+	c.MsgHeaders = data.MsgHeaders
+	c.PublishDurability = data.PublishDurability
+
 	ie := identifyEvent{
 		OutputBufferTimeout: c.OutputBufferTimeout,
 		HeartbeatInterval:   c.HeartbeatInterval,
 		SampleRate:          c.SampleRate,
 		MsgTimeout:          c.MsgTimeout,
+		MsgTimeoutWarning:   c.MsgTimeoutWarning,
 	}
 
 	// update the client's message pump
@@ -231,6 +292,7 @@ func (c *clientV2) Stats() ClientStats {
 		FinishCount:     atomic.LoadUint64(&c.FinishCount),
 		RequeueCount:    atomic.LoadUint64(&c.RequeueCount),
 		ConnectTime:     c.ConnectTime.Unix(),
+		LastHeartbeat:   atomic.LoadInt64(&c.lastHeartbeat) / int64(time.Second),
 		SampleRate:      atomic.LoadInt32(&c.SampleRate),
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:         atomic.LoadInt32(&c.Deflate) == 1,
@@ -239,7 +301,9 @@ func (c *clientV2) Stats() ClientStats {
 		AuthIdentity:    identity,
 		AuthIdentityURL: identityURL,
 		PubCounts:       pubCounts,
+		Forwarder:       c.Forwarder,
 	}
+	c.fillStats(&stats, c.nsqd.getOpts())
 	if stats.TLS {
 		p := prettyConnectionState{c.tlsConn.ConnectionState()}
 		stats.CipherSuite = p.GetCipherSuite()
@@ -250,6 +314,10 @@ func (c *clientV2) Stats() ClientStats {
 	return stats
 }
 
+func (c *clientV2) IsSlow() bool {
+	return c.isSlow(c.nsqd.getOpts())
+}
+
 func (c *clientV2) IsProducer() bool {
 	c.metaLock.RLock()
 	retval := len(c.pubCounts) > 0
@@ -310,7 +378,7 @@ func (p *prettyConnectionState) GetVersion() string {
 }
 
 func (c *clientV2) IsReadyForMessages() bool {
-	if c.Channel.IsPaused() {
+	if c.Channel.IsPaused() || c.isEvicted() {
 		return false
 	}
 
@@ -326,6 +394,10 @@ func (c *clientV2) IsReadyForMessages() bool {
 	return true
 }
 
+func (c *clientV2) IsForwarder() bool {
+	return c.Forwarder
+}
+
 func (c *clientV2) SetReadyCount(count int64) {
 	oldCount := atomic.SwapInt64(&c.ReadyCount, count)
 
@@ -367,10 +439,32 @@ func (c *clientV2) PublishedMessage(topic string, count uint64) {
 }
 
 func (c *clientV2) TimedOutMessage() {
+	c.timedOut()
 	atomic.AddInt64(&c.InFlightCount, -1)
 	c.tryUpdateReadyState()
 }
 
+// TimeoutWarning queues a warning that the in-flight message id is
+// about to time out, sent by the client's messagePump
+func (c *clientV2) TimeoutWarning(id MessageID) {
+	c.timeoutWarningLock.Lock()
+	c.timeoutWarnings = append(c.timeoutWarnings, id)
+	c.timeoutWarningLock.Unlock()
+
+	select {
+	case c.TimeoutWarningChan <- 1:
+	default:
+	}
+}
+
+func (c *clientV2) takeTimeoutWarnings() []MessageID {
+	c.timeoutWarningLock.Lock()
+	ids := c.timeoutWarnings
+	c.timeoutWarnings = nil
+	c.timeoutWarningLock.Unlock()
+	return ids
+}
+
 func (c *clientV2) RequeuedMessage() {
 	atomic.AddUint64(&c.RequeueCount, 1)
 	atomic.AddInt64(&c.InFlightCount, -1)
@@ -448,6 +542,7 @@ func (c *clientV2) SetOutputBuffer(desiredSize int, desiredTimeout int) error {
 			return err
 		}
 		c.Writer = bufio.NewWriterSize(c.Conn, c.OutputBufferSize)
+		c.updateOutputBuffer()
 	}
 
 	return nil
@@ -478,6 +573,18 @@ func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
 	return nil
 }
 
+func (c *clientV2) SetMsgTimeoutWarning(fraction float64) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if fraction < 0 || fraction >= 1 {
+		return fmt.Errorf("msg timeout warning (%v) is invalid", fraction)
+	}
+	c.MsgTimeoutWarning = fraction
+
+	return nil
+}
+
 func (c *clientV2) UpgradeTLS() error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -489,6 +596,11 @@ func (c *clientV2) UpgradeTLS() error {
 		return err
 	}
 	c.tlsConn = tlsConn
+	state := tlsConn.ConnectionState()
+	c.tlsIdentities = tlsIdentities(&state)
+	if c.nsqd.tlsClientAuthorizations != nil {
+		c.setTLSAuthorizations()
+	}
 
 	c.Reader = bufio.NewReaderSize(c.tlsConn, defaultBufferSize)
 	c.Writer = bufio.NewWriterSize(c.tlsConn, c.OutputBufferSize)
@@ -547,6 +659,7 @@ func (c *clientV2) Flush() error {
 	if err != nil {
 		return err
 	}
+	c.updateOutputBuffer()
 
 	if c.flateWriter != nil {
 		return c.flateWriter.Flush()
@@ -555,6 +668,14 @@ func (c *clientV2) Flush() error {
 	return nil
 }
 
+// updateOutputBuffer records how much of Writer is in use, for
+// GetInternals (which can't wait on writeLock, held by a blocked write).
+// It's called with writeLock held.
+func (c *clientV2) updateOutputBuffer() {
+	atomic.StoreInt64(&c.outputBuffered, int64(c.Writer.Buffered()))
+	atomic.StoreInt64(&c.outputBufferSize, int64(c.Writer.Size()))
+}
+
 func (c *clientV2) QueryAuthd() error {
 	remoteIP, _, err := net.SplitHostPort(c.String())
 	if err != nil {
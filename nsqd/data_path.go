@@ -0,0 +1,75 @@
+package nsqd
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+)
+
+// backendDataPath returns the path to keep the diskqueue named name (of
+// topicName, or one of its channels) in: wherever it already is, or else
+// the --topic-data-path picked by a hash of the topic name (so that a topic
+// and its channels share a volume), or --data-path if there are none
+func (n *NSQD) backendDataPath(name string, topicName string) string {
+	opts := n.getOpts()
+	if len(opts.TopicDataPaths) == 0 {
+		return opts.DataPath
+	}
+	if diskqueue.Exists(name, opts.DataPath) {
+		return opts.DataPath
+	}
+	for _, dataPath := range opts.TopicDataPaths {
+		if diskqueue.Exists(name, dataPath) {
+			return dataPath
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topicName))
+	return opts.TopicDataPaths[h.Sum32()%uint32(len(opts.TopicDataPaths))]
+}
+
+// DataPathStats is the disk usage of the topics and channels kept in one of
+// --data-path and --topic-data-path
+type DataPathStats struct {
+	Path      string `json:"path"`
+	Queues    int    `json:"queues"`
+	DiskBytes int64  `json:"disk_bytes"`
+}
+
+// GetDataPathStats sums stats by the path each topic and channel is kept
+// in, nil without --topic-data-path
+func (n *NSQD) GetDataPathStats(stats []TopicStats) []DataPathStats {
+	opts := n.getOpts()
+	if len(opts.TopicDataPaths) == 0 {
+		return nil
+	}
+
+	dataPaths := []DataPathStats{{Path: opts.DataPath}}
+	for _, dataPath := range opts.TopicDataPaths {
+		dataPaths = append(dataPaths, DataPathStats{Path: dataPath})
+	}
+	add := func(dataPath string, diskBytes int64) {
+		for i := range dataPaths {
+			if filepath.Clean(dataPaths[i].Path) == filepath.Clean(dataPath) {
+				dataPaths[i].Queues++
+				dataPaths[i].DiskBytes += diskBytes
+				return
+			}
+		}
+		// moved with /topic/migrate
+		dataPaths = append(dataPaths, DataPathStats{Path: dataPath, Queues: 1, DiskBytes: diskBytes})
+	}
+	for _, t := range stats {
+		if !strings.HasSuffix(t.TopicName, "#ephemeral") {
+			add(t.DataPath, t.BackendDiskBytes)
+		}
+		for _, c := range t.Channels {
+			if !strings.HasSuffix(c.ChannelName, "#ephemeral") {
+				add(c.DataPath, c.BackendDiskBytes)
+			}
+		}
+	}
+	return dataPaths
+}
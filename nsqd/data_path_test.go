@@ -0,0 +1,74 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTopicDataPaths(t *testing.T) {
+	dataPaths := make([]string, 2)
+	for i := range dataPaths {
+		tmpDir, err := ioutil.TempDir("", "nsq-test-")
+		test.Nil(t, err)
+		defer os.RemoveAll(tmpDir)
+		dataPaths[i] = tmpDir
+	}
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	// queues already in --data-path stay there
+	topic := nsqd.GetTopic("test_data_path_old")
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	nsqd.Exit()
+
+	opts.TopicDataPaths = dataPaths
+	_, _, nsqd = mustStartNSQD(opts)
+	test.Nil(t, nsqd.LoadMetadata())
+	for i := 0; i < 8; i++ {
+		nsqd.GetTopic(fmt.Sprintf("test_data_path_%d", i)).GetChannel("ch")
+	}
+
+	checkPlacement := func(nsqd *NSQD) {
+		used := make(map[string]bool)
+		for _, ts := range nsqd.GetStats("", "", false) {
+			if ts.TopicName == "test_data_path_old" {
+				test.Equal(t, opts.DataPath, ts.DataPath)
+			} else {
+				test.Equal(t, true, ts.DataPath == dataPaths[0] || ts.DataPath == dataPaths[1])
+			}
+			used[ts.DataPath] = true
+			// a topic and its channels share a volume
+			test.Equal(t, ts.DataPath, ts.Channels[0].DataPath)
+		}
+		test.Equal(t, 3, len(used))
+
+		stats := nsqd.GetDataPathStats(nsqd.GetStats("", "", false))
+		test.Equal(t, 3, len(stats))
+		test.Equal(t, opts.DataPath, stats[0].Path)
+		test.Equal(t, 2, stats[0].Queues)
+		test.Equal(t, true, stats[0].DiskBytes > 0)
+		test.Equal(t, 16, stats[1].Queues+stats[2].Queues)
+	}
+	checkPlacement(nsqd)
+	nsqd.Exit()
+
+	// queues are found where they are, whatever the order of the paths
+	opts.TopicDataPaths = []string{dataPaths[1], dataPaths[0]}
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	checkPlacement(nsqd)
+	topic, err := nsqd.GetExistingTopic("test_data_path_old")
+	test.Nil(t, err)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+}
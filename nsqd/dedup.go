@@ -0,0 +1,130 @@
+package nsqd
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dedupIDHeader is the message header a publisher can set to the ID of a
+// message for the dedup window to go by, instead of a hash of its body
+const dedupIDHeader = "dedup-id"
+
+// maxDedupSize is the most publishes a dedup window remembers, and how many
+// it does if only dedup_window is set
+const maxDedupSize = 1000000
+
+type dedupEntry struct {
+	key  uint64
+	seen int64
+}
+
+// dedupWindow remembers the keys of a topic's recent publishes (see the
+// dedup_window and dedup_size QueueOptions), oldest first
+type dedupWindow struct {
+	sync.Mutex
+	seen    map[uint64]struct{}
+	entries []dedupEntry
+}
+
+// dedupKey returns msg's dedup-id header, or else its body, hashed
+func dedupKey(msg *Message) uint64 {
+	h := fnv.New64a()
+	if id, ok := msg.Headers[dedupIDHeader]; ok {
+		h.Write([]byte(id))
+	} else {
+		h.Write(msg.Body)
+	}
+	return h.Sum64()
+}
+
+// reset forgets all publishes
+func (w *dedupWindow) reset() {
+	w.Lock()
+	w.seen = nil
+	w.entries = nil
+	w.Unlock()
+}
+
+// expire must be called with the lock held
+func (w *dedupWindow) expire(now int64, window int64, size int) {
+	i := 0
+	for ; i < len(w.entries); i++ {
+		e := w.entries[i]
+		if len(w.entries)-i <= size && (window <= 0 || now-e.seen <= window) {
+			break
+		}
+		delete(w.seen, e.key)
+	}
+	// appends re-allocate the (live part of the) slice once it's full
+	w.entries = w.entries[i:]
+}
+
+// contains returns whether key was remembered within window (in ns)
+func (w *dedupWindow) contains(key uint64, window int64, size int) bool {
+	w.Lock()
+	defer w.Unlock()
+	w.expire(time.Now().UnixNano(), window, size)
+	_, ok := w.seen[key]
+	return ok
+}
+
+func (w *dedupWindow) remember(keys []uint64, window int64, size int) {
+	w.Lock()
+	defer w.Unlock()
+	if w.seen == nil {
+		w.seen = make(map[uint64]struct{})
+	}
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		if _, ok := w.seen[key]; ok {
+			continue
+		}
+		w.seen[key] = struct{}{}
+		w.entries = append(w.entries, dedupEntry{key, now})
+	}
+	w.expire(now, window, size)
+}
+
+// dedup returns msgs without those published to the topic within its dedup
+// window (which are released), and the keys to remember once they are put
+func (t *Topic) dedup(msgs []*Message) ([]*Message, []uint64) {
+	window, size := t.limits.dedup()
+	if window <= 0 && size <= 0 {
+		return msgs, nil
+	}
+	if size <= 0 {
+		size = maxDedupSize
+	}
+
+	kept := msgs[:0]
+	keys := make([]uint64, 0, len(msgs))
+	batch := make(map[uint64]struct{}, len(msgs))
+	for _, msg := range msgs {
+		key := dedupKey(msg)
+		_, dup := batch[key]
+		if dup || t.dedupWindow.contains(key, window, size) {
+			atomic.AddUint64(&t.dedupHitCount, 1)
+			msg.release()
+			continue
+		}
+		atomic.AddUint64(&t.dedupMissCount, 1)
+		batch[key] = struct{}{}
+		keys = append(keys, key)
+		kept = append(kept, msg)
+	}
+	return kept, keys
+}
+
+// rememberPublished adds keys (from dedup) to the topic's dedup window
+func (t *Topic) rememberPublished(keys []uint64) {
+	if len(keys) == 0 {
+		return
+	}
+	window, size := t.limits.dedup()
+	if size <= 0 {
+		size = maxDedupSize
+	}
+	t.dedupWindow.remember(keys, window, size)
+}
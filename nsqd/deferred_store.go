@@ -0,0 +1,408 @@
+package nsqd
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/pqueue"
+	"github.com/nsqio/nsq/internal/util"
+)
+
+// each record in a deferred store file is the message's visibility time
+// (unix nano) and the length of the encoded message that follows
+const deferredRecordHeaderSize = 8 + 4
+
+// deferredStore holds a topic's deferred publishes (DPUB) on disk until they
+// are due, rather than in memory in each of its channels.
+//
+// Records are appended to a single file, ordered by a priority queue of their
+// visibility times and offsets (the only per-message state kept in memory).
+// While any are pending, a single goroutine hands them to the topic as they
+// come due. The file is truncated whenever the store drains, and rewritten
+// without the delivered records once they make up most of it.
+type deferredStore struct {
+	sync.Mutex
+
+	fileName string
+	file     *os.File
+	size     int64 // of the file
+	liveSize int64 // of the records still pending
+	writes   int64 // since the last fsync
+	pq       pqueue.PriorityQueue
+
+	pumping    bool
+	notifyChan chan int
+	waitGroup  util.WaitGroupWrapper
+
+	topic *Topic
+}
+
+type deferredRecord struct {
+	offset int64
+	size   int64
+}
+
+func deferredStoreFileName(dataPath string, topicName string) string {
+	return path.Join(dataPath, fmt.Sprintf("%s.deferred.dat", topicName))
+}
+
+// newDeferredStore opens (or creates) the deferred store of topic t, at
+// fileName, and starts delivering any messages it already holds
+func newDeferredStore(t *Topic, fileName string) (*deferredStore, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d := &deferredStore{
+		fileName:   fileName,
+		file:       f,
+		pq:         pqueue.New(1),
+		notifyChan: make(chan int, 1),
+		topic:      t,
+	}
+	err = d.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if d.pq.Len() > 0 {
+		t.nsqd.logf(LOG_INFO, "TOPIC(%s): %d deferred messages pending in %s",
+			t.name, d.pq.Len(), fileName)
+		d.startPump()
+	}
+	return d, nil
+}
+
+// load rebuilds the priority queue from the file, dropping a partially
+// written or corrupt tail
+func (d *deferredStore) load() error {
+	maxSize := int64(maxStoredMsgSize(d.topic.nsqd.getOpts()))
+	r := bufio.NewReader(d.file)
+	var header [deferredRecordHeaderSize]byte
+	var offset int64
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			ts := int64(binary.BigEndian.Uint64(header[:8]))
+			msgSize := int64(binary.BigEndian.Uint32(header[8:]))
+			if msgSize < minValidMsgLength || msgSize > maxSize {
+				err = fmt.Errorf("invalid message size (%d)", msgSize)
+			} else {
+				_, err = r.Discard(int(msgSize))
+			}
+			if err == nil {
+				size := deferredRecordHeaderSize + msgSize
+				heap.Push(&d.pq, &pqueue.Item{
+					Value:    &deferredRecord{offset: offset, size: size},
+					Priority: ts,
+				})
+				offset += size
+				continue
+			}
+		}
+		d.topic.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s): truncating %s at offset %d - %s", d.topic.name, d.fileName, offset, err)
+		err = d.file.Truncate(offset)
+		if err != nil {
+			return err
+		}
+		break
+	}
+	d.size = offset
+	d.liveSize = offset
+	return nil
+}
+
+// Put writes m to the store, to be handed back to the topic at visibleAt
+// (unix nano)
+func (d *deferredStore) Put(m *Message, visibleAt int64) error {
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+
+	var header [deferredRecordHeaderSize]byte
+	buf.Write(header[:])
+	_, err := m.WriteTo(buf)
+	if err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint64(b[:8], uint64(visibleAt))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-deferredRecordHeaderSize))
+
+	d.Lock()
+	defer d.Unlock()
+
+	_, err = d.file.WriteAt(b, d.size)
+	if err != nil {
+		return err
+	}
+	item := &pqueue.Item{
+		Value:    &deferredRecord{offset: d.size, size: int64(len(b))},
+		Priority: visibleAt,
+	}
+	heap.Push(&d.pq, item)
+	d.size += int64(len(b))
+	d.liveSize += int64(len(b))
+
+	d.writes++
+	if d.writes >= d.topic.nsqd.getOpts().SyncEvery {
+		d.sync()
+	}
+
+	if !d.pumping {
+		d.startPump()
+	} else if item.Index == 0 {
+		// the pump is waiting on a later message
+		select {
+		case d.notifyChan <- 1:
+		default:
+		}
+	}
+	return nil
+}
+
+// Count returns the number of messages pending in the store
+func (d *deferredStore) Count() int64 {
+	d.Lock()
+	defer d.Unlock()
+	return int64(d.pq.Len())
+}
+
+// Empty drops all pending messages
+func (d *deferredStore) Empty() error {
+	d.Lock()
+	defer d.Unlock()
+	d.pq = pqueue.New(1)
+	return d.truncate()
+}
+
+// Close waits for the pump (which exits with the topic) and closes the file
+func (d *deferredStore) Close() error {
+	d.waitGroup.Wait()
+	d.Lock()
+	defer d.Unlock()
+	d.sync()
+	return d.file.Close()
+}
+
+// Delete closes and removes the store
+func (d *deferredStore) Delete() error {
+	d.waitGroup.Wait()
+	d.Lock()
+	defer d.Unlock()
+	d.file.Close()
+	return os.Remove(d.fileName)
+}
+
+// startPump must be called with the lock held
+func (d *deferredStore) startPump() {
+	d.pumping = true
+	d.waitGroup.Wrap(d.pump)
+}
+
+// how long pump waits before trying again to put a message the topic
+// refused, doubling with each failure in a row
+const (
+	deferredRetryMin = 100 * time.Millisecond
+	deferredRetryMax = 10 * time.Second
+)
+
+// pump hands messages to the topic as they come due, exiting once the store
+// has drained (or the topic exits). A message the topic refuses stays in the
+// store and is tried again later.
+func (d *deferredStore) pump() {
+	var retry time.Duration
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	syncTicker := time.NewTicker(d.topic.nsqd.getOpts().SyncTimeout)
+	defer syncTicker.Stop()
+
+	for {
+		d.Lock()
+		if d.pq.Len() == 0 {
+			d.pumping = false
+			err := d.truncate()
+			if err != nil {
+				d.topic.nsqd.logf(LOG_ERROR,
+					"TOPIC(%s): failed to truncate %s - %s", d.topic.name, d.fileName, err)
+			}
+			d.Unlock()
+			return
+		}
+		item := d.pq[0]
+		now := time.Now().UnixNano()
+		if item.Priority > now {
+			d.Unlock()
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Duration(item.Priority - now))
+			select {
+			case <-timer.C:
+			case <-d.notifyChan:
+			case <-syncTicker.C:
+				d.Lock()
+				d.sync()
+				d.Unlock()
+			case <-d.topic.exitChan:
+				d.stopPump()
+				return
+			}
+			continue
+		}
+		msg, err := d.read(item.Value.(*deferredRecord))
+		d.Unlock()
+
+		if err == nil {
+			// not holding the lock, topic.putDeferred takes the topic's
+			err = d.topic.putDeferred(msg)
+			if err != nil {
+				if d.topic.Exiting() {
+					d.stopPump()
+					return
+				}
+				retry *= 2
+				if retry < deferredRetryMin {
+					retry = deferredRetryMin
+				} else if retry > deferredRetryMax {
+					retry = deferredRetryMax
+				}
+				d.topic.nsqd.logf(LOG_ERROR,
+					"TOPIC(%s): failed to put deferred msg(%s), retrying in %s - %s",
+					d.topic.name, msg.ID, retry, err)
+				d.Lock()
+				// Empty() may have dropped the item in the meantime
+				if item.Index >= 0 && item.Index < d.pq.Len() && d.pq[item.Index] == item {
+					item.Priority = time.Now().Add(retry).UnixNano()
+					heap.Fix(&d.pq, item.Index)
+				}
+				d.Unlock()
+				continue
+			}
+			retry = 0
+		} else {
+			d.topic.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s): failed to read deferred message from %s - %s",
+				d.topic.name, d.fileName, err)
+		}
+
+		d.Lock()
+		// Empty() may have dropped the item in the meantime
+		if item.Index >= 0 && item.Index < d.pq.Len() && d.pq[item.Index] == item {
+			heap.Remove(&d.pq, item.Index)
+			d.liveSize -= item.Value.(*deferredRecord).size
+			d.maybeCompact()
+		}
+		d.Unlock()
+	}
+}
+
+func (d *deferredStore) stopPump() {
+	d.Lock()
+	d.pumping = false
+	d.Unlock()
+}
+
+func (d *deferredStore) read(r *deferredRecord) (*Message, error) {
+	b := make([]byte, r.size)
+	_, err := d.file.ReadAt(b, r.offset)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(b[deferredRecordHeaderSize:])
+}
+
+// maybeCompact rewrites the file without delivered records once they make up
+// most of it (i.e. when the store never drains long enough to be truncated)
+func (d *deferredStore) maybeCompact() {
+	dead := d.size - d.liveSize
+	if dead < d.liveSize || dead < d.topic.nsqd.getOpts().MaxBytesPerFile {
+		return
+	}
+	err := d.compact()
+	if err != nil {
+		d.topic.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s): failed to compact %s - %s", d.topic.name, d.fileName, err)
+	}
+}
+
+func (d *deferredStore) compact() error {
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", d.fileName, time.Now().UnixNano())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	offsets := make([]int64, len(d.pq))
+	var offset int64
+	for i, item := range d.pq {
+		r := item.Value.(*deferredRecord)
+		b := make([]byte, r.size)
+		_, err = d.file.ReadAt(b, r.offset)
+		if err == nil {
+			_, err = f.WriteAt(b, offset)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmpFileName)
+			return err
+		}
+		offsets[i] = offset
+		offset += r.size
+	}
+	err = f.Sync()
+	if err == nil {
+		err = os.Rename(tmpFileName, d.fileName)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	for i, item := range d.pq {
+		item.Value.(*deferredRecord).offset = offsets[i]
+	}
+	d.file.Close()
+	d.file = f
+	d.size = offset
+	d.liveSize = offset
+	d.writes = 0
+	return nil
+}
+
+func (d *deferredStore) truncate() error {
+	if d.size == 0 {
+		return nil
+	}
+	d.size = 0
+	d.liveSize = 0
+	d.writes = 0
+	return d.file.Truncate(0)
+}
+
+func (d *deferredStore) sync() {
+	if d.writes == 0 {
+		return
+	}
+	err := d.file.Sync()
+	if err != nil {
+		d.topic.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s): failed to sync %s - %s", d.topic.name, d.fileName, err)
+		return
+	}
+	d.writes = 0
+}
@@ -0,0 +1,134 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func waitForDepth(t *testing.T, c *Channel, depth int64) {
+	for i := 0; i < 200; i++ {
+		if c.Depth() == depth {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("channel depth %d, expected %d", c.Depth(), depth)
+}
+
+func TestDeferredStore(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	opts.MaxBytesPerFile = 1
+	opts.PersistDeferred = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_deferred_store" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	// more deferred messages than fit in memory, and one much later
+	// which keeps the store from draining
+	put := func(deferred time.Duration) {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.deferred = deferred
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	put(time.Hour)
+	for i := 0; i < 100; i++ {
+		put(200 * time.Millisecond)
+	}
+	test.Equal(t, int64(101), topic.DeferredDiskCount())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, 0, len(channel.deferredMessages))
+
+	waitForDepth(t, channel, 100)
+	test.Equal(t, int64(1), topic.DeferredDiskCount())
+	test.Equal(t, uint64(101), NewTopicStats(topic, nil).MessageCount)
+
+	// the delivered records have been compacted away
+	fi, err := os.Stat(deferredStoreFileName(opts.DataPath, topicName))
+	test.Nil(t, err)
+	test.Equal(t, int64(deferredRecordHeaderSize+minValidMsgLength+len("test")), fi.Size())
+
+	test.Nil(t, topic.Empty())
+	test.Equal(t, int64(0), topic.DeferredDiskCount())
+}
+
+func TestDeferredStoreRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PersistDeferred = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_deferred_store_restart" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.deferred = time.Second
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	test.Equal(t, int64(10), topic.DeferredDiskCount())
+	nsqd.Exit()
+
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(10), topic.DeferredDiskCount())
+	test.Equal(t, int64(0), channel.Depth())
+
+	waitForDepth(t, channel, 10)
+	test.Equal(t, int64(0), topic.DeferredDiskCount())
+	fi, err := os.Stat(deferredStoreFileName(opts.DataPath, topicName))
+	test.Nil(t, err)
+	test.Equal(t, int64(0), fi.Size())
+}
+
+func TestDeferredStoreRetry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.PersistDeferred = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_deferred_store_retry" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Lock()
+	backend := topic.backend
+	topic.backend = &errorBackendQueue{}
+	topic.Unlock()
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.deferred = 10 * time.Millisecond
+	test.Nil(t, topic.PutMessage(msg))
+
+	// the message the topic refuses stays in the store
+	time.Sleep(300 * time.Millisecond)
+	test.Equal(t, int64(1), topic.DeferredDiskCount())
+	test.Equal(t, int64(0), topic.Depth())
+
+	// and is put once the topic takes it
+	topic.Lock()
+	topic.backend = backend
+	topic.Unlock()
+	for i := 0; i < 200 && topic.Depth() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), topic.Depth())
+	test.Equal(t, int64(0), topic.DeferredDiskCount())
+}
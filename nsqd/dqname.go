@@ -2,8 +2,22 @@
 
 package nsqd
 
+import (
+	"strings"
+)
+
 func getBackendName(topicName, channelName string) string {
 	// backend names, for uniqueness, automatically include the topic... <topic>:<channel>
 	backendName := topicName + ":" + channelName
 	return backendName
 }
+
+// splitBackendName is the reverse of getBackendName, it returns false for the
+// backend name of a topic
+func splitBackendName(backendName string) (string, string, bool) {
+	i := strings.Index(backendName, ":")
+	if i < 0 {
+		return backendName, "", false
+	}
+	return backendName[:i], backendName[i+1:], true
+}
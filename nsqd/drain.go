@@ -0,0 +1,122 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDrained is returned by Main once a Drain that was to exit when empty
+// has finished
+var ErrDrained = errors.New("drained")
+
+// how often drainLoop checks whether the node is empty
+const drainCheckInterval = time.Second
+
+// DrainStats is the progress of a Drain, see GetDrainStats
+type DrainStats struct {
+	StartTime     int64 `json:"start_time"`
+	StartDepth    int64 `json:"start_depth"`
+	Depth         int64 `json:"depth"`
+	InFlightCount int64 `json:"in_flight_count"`
+	DeferredCount int64 `json:"deferred_count"`
+	ExitWhenEmpty bool  `json:"exit_when_empty"`
+}
+
+// Remaining returns the number of messages left to drain
+func (d *DrainStats) Remaining() int64 {
+	return d.Depth + d.InFlightCount + d.DeferredCount
+}
+
+// Drain puts the node into drain mode, to decommission it: new publishes
+// and subscriptions are refused and its topics are unregistered from
+// nsqlookupd, while existing consumers keep being served until it's empty.
+// With exitWhenEmpty Main then returns ErrDrained.
+//
+// There's no way back, short of a restart. Draining again only adds
+// exitWhenEmpty.
+func (n *NSQD) Drain(exitWhenEmpty bool) {
+	n.drainMtx.Lock()
+	defer n.drainMtx.Unlock()
+	if n.drain != nil {
+		n.drain.ExitWhenEmpty = n.drain.ExitWhenEmpty || exitWhenEmpty
+		return
+	}
+
+	d := drainStats(n.GetStats("", "", false))
+	d.StartTime = time.Now().Unix()
+	d.StartDepth = d.Remaining()
+	d.ExitWhenEmpty = exitWhenEmpty
+	n.drain = &d
+	atomic.StoreInt32(&n.draining, 1)
+	n.logf(LOG_INFO, "DRAIN: draining %d messages (exit when empty: %t)",
+		d.StartDepth, exitWhenEmpty)
+
+	close(n.drainChan)
+	n.waitGroup.Wrap(n.drainLoop)
+}
+
+// IsDraining returns true once Drain has been called
+func (n *NSQD) IsDraining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// GetDrainStats returns the progress of a Drain from stats (of every topic),
+// nil if the node isn't draining
+func (n *NSQD) GetDrainStats(stats []TopicStats) *DrainStats {
+	n.drainMtx.Lock()
+	defer n.drainMtx.Unlock()
+	if n.drain == nil {
+		return nil
+	}
+	d := drainStats(stats)
+	d.StartTime = n.drain.StartTime
+	d.StartDepth = n.drain.StartDepth
+	d.ExitWhenEmpty = n.drain.ExitWhenEmpty
+	return &d
+}
+
+// drainStats sums the messages left in stats
+func drainStats(stats []TopicStats) DrainStats {
+	var d DrainStats
+	for _, t := range stats {
+		d.Depth += t.Depth
+		d.DeferredCount += t.DeferredDiskCount
+		for _, c := range t.Channels {
+			d.Depth += c.Depth
+			d.InFlightCount += int64(c.InFlightCount)
+			d.DeferredCount += int64(c.DeferredCount)
+		}
+	}
+	return d
+}
+
+// drainLoop waits for a draining node to be empty, then closes drainedChan
+// if it's to exit
+func (n *NSQD) drainLoop() {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	empty := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			return
+		}
+
+		d := n.GetDrainStats(n.GetStats("", "", false))
+		if d.Remaining() > 0 {
+			empty = false
+			continue
+		}
+		if !empty {
+			n.logf(LOG_INFO, "DRAIN: empty")
+			empty = true
+		}
+		if d.ExitWhenEmpty {
+			n.logf(LOG_INFO, "DRAIN: exiting")
+			close(n.drainedChan)
+			return
+		}
+	}
+}
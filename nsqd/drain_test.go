@@ -0,0 +1,143 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/test"
+	"github.com/nsqio/nsq/nsqlookupd"
+)
+
+func TestDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/drain?exit=maybe", httpAddr), "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, false, nsqd.IsDraining())
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/drain?exit=true", httpAddr), "application/octet-stream", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var d DrainStats
+	test.Nil(t, json.Unmarshal(body, &d))
+	test.Equal(t, int64(1), d.StartDepth)
+	test.Equal(t, true, d.ExitWhenEmpty)
+
+	// new publishes and subscriptions are refused
+	resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 503, resp.StatusCode)
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	identify(t, conn2, nil, frameTypeResponse)
+	_, err = nsq.Subscribe(topicName, "ch2").WriteTo(conn2)
+	test.Nil(t, err)
+	readValidate(t, conn2, frameTypeError, "E_DRAINING SUB failed nsqd is draining")
+
+	// existing consumers are served until it's empty
+	stats := nsqd.GetDrainStats(nsqd.GetStats("", "", false))
+	test.Equal(t, int64(1), stats.Remaining())
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp2, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	_, data, err := nsq.UnpackResponse(resp2)
+	test.Nil(t, err)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, []byte("test"), msg.Body)
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	select {
+	case <-nsqd.drainedChan:
+	case <-time.After(5 * drainCheckInterval):
+		t.Fatal("nsqd did not exit when drained")
+	}
+	stats = nsqd.GetDrainStats(nsqd.GetStats("", "", false))
+	test.Equal(t, int64(0), stats.Remaining())
+}
+
+func TestDrainUnregisters(t *testing.T) {
+	lopts := nsqlookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	lopts.BroadcastAddress = "127.0.0.1"
+	_, _, lookupd := mustStartNSQLookupd(lopts)
+	defer lookupd.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	opts.BroadcastAddress = "127.0.0.1"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_drain_lookup" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	var lr struct {
+		Producers []struct {
+			TCPPort int `json:"tcp_port"`
+		} `json:"producers"`
+		Channels []string `json:"channels"`
+	}
+	lookup := func() {
+		// allow some time for nsqd to push info to nsqlookupd
+		time.Sleep(350 * time.Millisecond)
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", lookupd.RealHTTPAddr(), topicName)
+		lr.Producers = nil
+		err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+		test.Nil(t, err)
+	}
+	lookup()
+	test.Equal(t, 1, len(lr.Producers))
+
+	nsqd.Drain(false)
+	lookup()
+	test.Equal(t, 0, len(lr.Producers))
+
+	// topics created while draining aren't registered either
+	nsqd.GetTopic(topicName + "_new")
+	time.Sleep(350 * time.Millisecond)
+	endpoint := fmt.Sprintf("http://%s/topics", lookupd.RealHTTPAddr())
+	var topics struct {
+		Topics []string `json:"topics"`
+	}
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &topics)
+	test.Nil(t, err)
+	for _, name := range topics.Topics {
+		test.NotEqual(t, topicName+"_new", name)
+	}
+}
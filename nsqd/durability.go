@@ -0,0 +1,49 @@
+package nsqd
+
+import (
+	"errors"
+)
+
+// ErrNotDurable is returned by PutMessagesDurable when the topic's backend
+// can't be fsynced, as for ephemeral topics and --backend=memory
+var ErrNotDurable = errors.New("topic is not persisted to disk")
+
+// publish durability levels, see IDENTIFY publish_durability and
+// /pub?durability=
+const (
+	// OK once a message is queued, in memory or on disk
+	DurabilityMemory = "memory"
+	// OK once a message is written to the topic's diskqueue and fsynced
+	// (for PUB, MPUB, PPUB and a DPUB without a timeout, a deferred message
+	// is kept by the deferred store and can't be)
+	DurabilityFsync = "fsync"
+)
+
+// isValidDurability returns whether s is a durability level, "" being
+// DurabilityMemory
+func isValidDurability(s string) bool {
+	switch s {
+	case "", DurabilityMemory, DurabilityFsync:
+		return true
+	}
+	return false
+}
+
+// backendSync fsyncs what was written to backend so far (see diskqueue's
+// Sync), ErrNotDurable for backends that aren't on disk
+func backendSync(backend BackendQueue) error {
+	b, ok := backend.(interface {
+		Sync() error
+	})
+	if !ok {
+		return ErrNotDurable
+	}
+	return b.Sync()
+}
+
+// PutMessagesDurable writes msgs to the topic's backend, bypassing its
+// memory queue, and returns once they are fsynced. If the write fails none
+// of them are written, if the fsync does they may yet be delivered.
+func (t *Topic) PutMessagesDurable(msgs []*Message) error {
+	return t.putMessages(msgs, true)
+}
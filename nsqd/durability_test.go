@@ -0,0 +1,111 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestPublishDurability(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_durability" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{
+		"publish_durability": DurabilityFsync,
+	}, frameTypeResponse)
+	r := struct {
+		PublishDurability string `json:"publish_durability"`
+	}{}
+	test.Nil(t, json.Unmarshal(data, &r))
+	test.Equal(t, DurabilityFsync, r.PublishDurability)
+
+	// the messages are on disk, though there's room in memory
+	_, err = nsq.Publish(topicName, []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("test"), []byte("test")})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	cmd = &nsq.Command{Name: []byte("PPUB"), Params: [][]byte{[]byte(topicName), []byte("1")}, Body: []byte("test")}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.DeferredPublish(topicName, 0, []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	topic := nsqd.GetTopic(topicName)
+	test.Equal(t, int64(5), topic.backend.Depth())
+	test.Equal(t, 0, len(topic.memoryMsgChan))
+	test.Equal(t, 0, len(topic.priority.msgChan))
+
+	// deferred messages are kept by the deferred store
+	_, err = nsq.DeferredPublish(topicName, time.Second, []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_NOT_DURABLE DPUB deferred messages can't be fsynced")
+	test.Equal(t, int64(5), topic.Depth())
+
+	// ephemeral topics aren't on disk
+	_, err = nsq.Publish(topicName+"#ephemeral", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_NOT_DURABLE PUB failed topic is not persisted to disk")
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	data = identify(t, conn2, map[string]interface{}{
+		"publish_durability": "disk",
+	}, frameTypeError)
+	test.Equal(t, "E_BAD_BODY IDENTIFY publish durability (disk) is invalid", string(data))
+}
+
+func TestHTTPPublishDurability(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_publish_durability" + strconv.Itoa(int(time.Now().Unix()))
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=%s&durability=fsync", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/mpub?topic=%s&durability=fsync", httpAddr, topicName),
+		"application/octet-stream", bytes.NewBufferString("test\ntest"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	topic := nsqd.GetTopic(topicName)
+	test.Equal(t, int64(3), topic.backend.Depth())
+	test.Equal(t, 0, len(topic.memoryMsgChan))
+
+	for _, params := range []string{"durability=disk", "durability=fsync&defer=1000"} {
+		resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s&%s", httpAddr, topicName, params),
+			"application/octet-stream", bytes.NewBufferString("test"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 400, resp.StatusCode)
+	}
+}
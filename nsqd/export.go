@@ -0,0 +1,140 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// peeker is a BackendQueue that can read its queued messages without
+// consuming them (see diskqueue's Peek)
+type peeker interface {
+	Peek(func([]byte) error) error
+}
+
+// export calls fn with each of the channel's deferred messages, soonest
+// first, then each in its memory queues (requeued, high priority, then
+// normal) and each queued in its backend, oldest first, without consuming
+// them.
+//
+// The memory queues are snapshotted under the channel lock, by taking their
+// messages and putting them back in order. In-flight messages are out with
+// clients and are left out (they're exported again once they're requeued or
+// time out).
+func (c *Channel) export(fn func(jsonMessage) error) error {
+	memory := c.snapshotMemory()
+
+	c.deferredMutex.Lock()
+	items := make([]*exportItem, 0, len(c.deferredPQ))
+	for _, item := range c.deferredPQ {
+		// fields are copied under the lock, the message is delivered once
+		// it's popped
+		items = append(items, &exportItem{item.Priority, newJSONMessage(item.Value.(*Message))})
+	}
+	c.deferredMutex.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].priority < items[j].priority })
+	for _, item := range items {
+		err := fn(item.msg)
+		if err != nil {
+			return err
+		}
+	}
+	for _, msg := range memory {
+		err := fn(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	p, ok := c.backend.(peeker)
+	if !ok {
+		return nil
+	}
+	return p.Peek(func(b []byte) error {
+		msg, err := decodeMessage(b)
+		if err != nil {
+			return err
+		}
+		return fn(newJSONMessage(msg))
+	})
+}
+
+// snapshotMemory returns the messages in the channel's memory queues, in
+// the order clients get them. Receiving from a channel is the only way to
+// read it, so each queue is drained and refilled while PutMessage (and
+// Empty) wait on the lock. A message that can't go back, because a client
+// requeued one into the room meanwhile, goes to the backend instead.
+func (c *Channel) snapshotMemory() []jsonMessage {
+	c.Lock()
+	defer c.Unlock()
+
+	var snapshot []jsonMessage
+	for _, ch := range []chan *Message{c.requeueMsgChan, c.priority.msgChan, c.memoryMsgChan} {
+		var msgs []*Message
+	drain:
+		for {
+			select {
+			case msg := <-ch:
+				msgs = append(msgs, msg)
+			default:
+				break drain
+			}
+		}
+		for _, msg := range msgs {
+			snapshot = append(snapshot, newJSONMessage(msg))
+			select {
+			case ch <- msg:
+			default:
+				err := writeMessageToBackend(msg, c.backend)
+				if err != nil {
+					c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+						c.name, err)
+				}
+			}
+		}
+	}
+	return snapshot
+}
+
+// exportItem is a deferred message, by when it's due
+type exportItem struct {
+	priority int64
+	msg      jsonMessage
+}
+
+// doExportChannel streams the messages queued on a channel (see
+// Channel.export) as newline-delimited JSON, for debugging
+func (s *httpServer) doExportChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	err := s.checkSecret(req, true)
+	if err != nil {
+		http_api.RespondV1(w, 403, err)
+		return nil, err
+	}
+
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		http_api.RespondV1(w, err.(http_api.Err).Code, err)
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		err = http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		http_api.RespondV1(w, 404, err)
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err = channel.export(func(msg jsonMessage) error {
+		return enc.Encode(msg)
+	})
+	if err != nil {
+		// the response has started, it's cut short
+		s.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to export - %s", channel.name, err)
+	}
+	return nil, nil
+}
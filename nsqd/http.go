@@ -12,9 +12,11 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -53,39 +55,63 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 		router:      router,
 	}
 
+	authAdmin := s.requireSecret(true)
+	authRead := s.requireSecret(false)
+
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
-	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
+	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, authRead, log, http_api.V1))
 
 	// v1 negotiate
 	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))
-	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, authRead, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, authRead, log, http_api.PlainText))
+	router.Handle("GET", "/ws", s.requireSecretHandle(s.doWebSocket))
+	router.Handle("GET", "/message", http_api.Decorate(s.doMessage, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/fin", http_api.Decorate(s.doFIN, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/req", http_api.Decorate(s.doREQ, authAdmin, log, http_api.V1))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
-	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
-	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/migrate", http_api.Decorate(s.doMigrateTopic, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/labels", http_api.Decorate(s.doTopicLabels, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/fanout", http_api.Decorate(s.doTopicFanOut, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/topic/config", http_api.Decorate(s.doTopicConfig, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/labels", http_api.Decorate(s.doChannelLabels, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/deadletter", http_api.Decorate(s.doChannelDeadLetter, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/archive", http_api.Decorate(s.doChannelArchive, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/config", http_api.Decorate(s.doChannelConfig, authAdmin, log, http_api.V1))
+	router.Handle("POST", "/channel/resetstats", http_api.Decorate(s.doResetChannelStats, authAdmin, log, http_api.V1))
+	router.Handle("GET", "/channel/export", http_api.Decorate(s.doExportChannel, log))
+	router.Handle("POST", "/drain", http_api.Decorate(s.doDrain, authAdmin, log, http_api.V1))
+	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, authRead, log, http_api.V1))
+	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, authAdmin, log, http_api.V1))
 
 	// debug
-	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
-	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("POST", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("GET", "/debug/pprof/profile", pprof.Profile)
-	router.Handler("GET", "/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handler("GET", "/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))
-	router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, log, http_api.PlainText))
-	router.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+	router.Handle("GET", "/debug/internals", http_api.Decorate(s.doInternals, authRead, log, http_api.V1))
+	if nsqd.getOpts().PprofEnabled {
+		// /debug/pprof/cmdline shows the command line, --http-auth-secret too
+		pprofHandler := s.requireSecretHandler
+		router.Handler("GET", "/debug/pprof/", pprofHandler(http.HandlerFunc(pprof.Index)))
+		router.Handler("GET", "/debug/pprof/cmdline", pprofHandler(http.HandlerFunc(pprof.Cmdline)))
+		router.Handler("GET", "/debug/pprof/symbol", pprofHandler(http.HandlerFunc(pprof.Symbol)))
+		router.Handler("POST", "/debug/pprof/symbol", pprofHandler(http.HandlerFunc(pprof.Symbol)))
+		router.Handler("GET", "/debug/pprof/profile", pprofHandler(http.HandlerFunc(pprof.Profile)))
+		router.Handler("GET", "/debug/pprof/heap", pprofHandler(pprof.Handler("heap")))
+		router.Handler("GET", "/debug/pprof/goroutine", pprofHandler(pprof.Handler("goroutine")))
+		router.Handler("GET", "/debug/pprof/block", pprofHandler(pprof.Handler("block")))
+		router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, authAdmin, log, http_api.PlainText))
+		router.Handler("GET", "/debug/pprof/threadcreate", pprofHandler(pprof.Handler("threadcreate")))
+	}
 
 	return s
 }
@@ -126,19 +152,25 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, http_api.Err{500, err.Error()}
 	}
 	return struct {
-		Version          string `json:"version"`
-		BroadcastAddress string `json:"broadcast_address"`
-		Hostname         string `json:"hostname"`
-		HTTPPort         int    `json:"http_port"`
-		TCPPort          int    `json:"tcp_port"`
-		StartTime        int64  `json:"start_time"`
+		Version           string         `json:"version"`
+		BroadcastAddress  string         `json:"broadcast_address"`
+		BroadcastTCPPort  int            `json:"broadcast_tcp_port"`
+		BroadcastHTTPPort int            `json:"broadcast_http_port"`
+		Hostname          string         `json:"hostname"`
+		HTTPPort          int            `json:"http_port"`
+		TCPPort           int            `json:"tcp_port"`
+		StartTime         int64          `json:"start_time"`
+		Goroutines        GoroutineStats `json:"goroutines"`
 	}{
-		Version:          version.Binary,
-		BroadcastAddress: s.nsqd.getOpts().BroadcastAddress,
-		Hostname:         hostname,
-		TCPPort:          s.nsqd.RealTCPAddr().Port,
-		HTTPPort:         s.nsqd.RealHTTPAddr().Port,
-		StartTime:        s.nsqd.GetStartTime().Unix(),
+		Version:           version.Binary,
+		BroadcastAddress:  s.nsqd.getOpts().BroadcastAddress,
+		BroadcastTCPPort:  s.nsqd.getOpts().BroadcastTCPPort,
+		BroadcastHTTPPort: s.nsqd.getOpts().BroadcastHTTPPort,
+		Hostname:          hostname,
+		TCPPort:           s.nsqd.RealTCPAddr().Port,
+		HTTPPort:          s.nsqd.RealHTTPAddr().Port,
+		StartTime:         s.nsqd.GetStartTime().Unix(),
+		Goroutines:        s.nsqd.GetGoroutineStats(),
 	}, nil
 }
 
@@ -178,11 +210,31 @@ func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, e
 	if !protocol.IsValidTopicName(topicName) {
 		return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
 	}
+	if err := s.admitTopic(req, topicName); err != nil {
+		return nil, nil, err
+	}
 
 	return reqParams, s.nsqd.GetTopic(topicName), nil
 }
 
+// admitTopic returns the error for a request for the topic topicName that
+// its namespace refuses, if the client hasn't one of its identities or it
+// would create the topic over max_topics
+func (s *httpServer) admitTopic(req *http.Request, topicName string) error {
+	if !s.nsqd.isNamespaceAuthorized(topicName, tlsIdentities(req.TLS)) {
+		return http_api.Err{403, "UNAUTHORIZED"}
+	}
+	if err := s.nsqd.admitTopic(topicName); err != nil {
+		return http_api.Err{429, "TOPIC_LIMIT"}
+	}
+	return nil
+}
+
 func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.nsqd.IsDraining() {
+		return nil, http_api.Err{503, "DRAINING"}
+	}
+
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
@@ -208,6 +260,7 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 	if err != nil {
 		return nil, err
 	}
+	topic = topic.partition([]byte(reqParams.Get("partition_key")))
 
 	var deferred time.Duration
 	if ds, ok := reqParams["defer"]; ok {
@@ -222,12 +275,54 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 
+	headers, err := headerParams(req, reqParams)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := priorityParam(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	durable, err := durabilityParam(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	if durable && deferred != 0 {
+		// deferred messages are kept by the deferred store
+		return nil, http_api.Err{400, "INVALID_DURABILITY"}
+	}
+
 	msg := NewMessage(topic.GenerateID(), body)
+	msg.Headers = headers
+	msg.Priority = priority
 	msg.deferred = deferred
-	err = topic.PutMessage(msg)
+	msgs, dedupKeys := topic.dedup([]*Message{msg})
+	if len(msgs) == 0 {
+		// a re-publish within the topic's dedup window, dropped
+		return "OK", nil
+	}
+	if err := topic.admitPublish(1, len(body)); err != nil {
+		return nil, admitHTTPErr(err)
+	}
+	replication := topic.replication(msgs)
+	if durable {
+		err = topic.PutMessagesDurable(msgs)
+	} else {
+		err = topic.PutMessage(msg)
+	}
+	if err == ErrTopicFull {
+		return nil, http_api.Err{503, "TOPIC_FULL"}
+	}
+	if err == ErrNotDurable {
+		return nil, http_api.Err{400, "NOT_DURABLE"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, http_api.Err{503, "REPLICATION_FAILED"}
+	}
 
 	return "OK", nil
 }
@@ -236,6 +331,10 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	var msgs []*Message
 	var exit bool
 
+	if s.nsqd.IsDraining() {
+		return nil, http_api.Err{503, "DRAINING"}
+	}
+
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
@@ -247,6 +346,20 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	if err != nil {
 		return nil, err
 	}
+	topic = topic.partition([]byte(reqParams.Get("partition_key")))
+
+	headers, err := headerParams(req, reqParams)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := priorityParam(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	durable, err := durabilityParam(reqParams)
+	if err != nil {
+		return nil, err
+	}
 
 	// text mode is default, but unrecognized binary opt considered true
 	binaryMode := false
@@ -259,7 +372,7 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	if binaryMode {
 		tmp := make([]byte, 4)
 		msgs, err = readMPUB(req.Body, tmp, topic,
-			s.nsqd.getOpts().MaxMsgSize, s.nsqd.getOpts().MaxBodySize)
+			s.nsqd.getOpts().MaxMsgSize, s.nsqd.getOpts().MaxBodySize, s.nsqd.getOpts().MessagePool)
 		if err != nil {
 			return nil, http_api.Err{413, err.(*protocol.FatalClientErr).Code[2:]}
 		}
@@ -302,17 +415,304 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		}
 	}
 
-	err = topic.PutMessages(msgs)
+	for _, m := range msgs {
+		m.Headers = headers
+		m.Priority = priority
+	}
+	msgs, dedupKeys := topic.dedup(msgs)
+	if len(msgs) == 0 {
+		return "OK", nil
+	}
+	size := 0
+	for _, m := range msgs {
+		size += len(m.Body)
+	}
+	if err := topic.admitPublish(len(msgs), size); err != nil {
+		return nil, admitHTTPErr(err)
+	}
+	replication := topic.replication(msgs)
+
+	if durable {
+		err = topic.PutMessagesDurable(msgs)
+	} else {
+		err = topic.PutMessages(msgs)
+	}
+	if err == ErrTopicFull {
+		return nil, http_api.Err{503, "TOPIC_FULL"}
+	}
+	if err == ErrNotDurable {
+		return nil, http_api.Err{400, "NOT_DURABLE"}
+	}
 	if err != nil {
 		return nil, http_api.Err{503, "EXITING"}
 	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, http_api.Err{503, "REPLICATION_FAILED"}
+	}
 
 	return "OK", nil
 }
 
+// priorityParam returns the message priority given as the priority query
+// param, PriorityNormal if there isn't one
+func priorityParam(reqParams url.Values) (uint8, error) {
+	ps, ok := reqParams["priority"]
+	if !ok {
+		return PriorityNormal, nil
+	}
+	priority, ok := parsePriority(ps[0])
+	if !ok {
+		return 0, http_api.Err{400, "INVALID_PRIORITY"}
+	}
+	return priority, nil
+}
+
+// durabilityParam returns whether the durability query param asks for
+// DurabilityFsync
+func durabilityParam(reqParams url.Values) (bool, error) {
+	durability := reqParams.Get("durability")
+	if !isValidDurability(durability) {
+		return false, http_api.Err{400, "INVALID_DURABILITY"}
+	}
+	return durability == DurabilityFsync, nil
+}
+
+// headerParams returns the message headers given as header=key:value query
+// params, and the trace-id of an X-NSQ-Trace-ID request header, nil if there
+// are none
+func headerParams(req *http.Request, reqParams url.Values) (map[string]string, error) {
+	var headers map[string]string
+	for _, h := range reqParams["header"] {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, http_api.Err{400, "INVALID_HEADER"}
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[h[:i]] = h[i+1:]
+	}
+	if traceID := req.Header.Get(traceIDHTTPHeader); traceID != "" {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[traceIDHeader] = traceID
+	}
+	if checkPublishedHeaders(headers) != nil {
+		return nil, http_api.Err{400, "INVALID_HEADER"}
+	}
+	return headers, nil
+}
+
+// admitHTTPErr returns the error for a publish admitPublish rejected
+func admitHTTPErr(err error) error {
+	if err == ErrQuotaExceeded || err == ErrNamespaceQuotaExceeded {
+		return http_api.Err{429, "QUOTA_EXCEEDED"}
+	}
+	return http_api.Err{429, "RATE_LIMITED"}
+}
+
+// httpConsumerID is the client ID messages taken with GET /message are in
+// flight for (client IDs start at 1), and so what /fin and /req own them as
+const httpConsumerID int64 = 0
+
+const (
+	defaultPollTimeout = 10 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// doMessage waits up to the timeout query param (in seconds) for a message
+// from channel, and returns it in flight for --msg-timeout. It must be
+// acknowledged with /fin or /req, or it's requeued when it times out.
+func (s *httpServer) doMessage(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	timeout := defaultPollTimeout
+	if ts, err := reqParams.Get("timeout"); err == nil {
+		ti, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+		timeout = time.Duration(ti) * time.Second
+		if timeout < 0 || timeout > maxPollTimeout {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+	}
+
+	if err := s.admitTopic(req, topicName); err != nil {
+		return nil, err
+	}
+
+	channel := s.nsqd.GetTopic(topicName).GetChannel(channelName)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var memoryMsgChan chan *Message
+		var backendMsgChan <-chan []byte
+		var requeueMsgChan chan *Message
+		var priorityMsgChan chan *Message
+		var retryChan <-chan time.Time
+		if channel.IsPaused() {
+			retryChan = time.After(100 * time.Millisecond)
+		} else if d := channel.deliveryLimit.wait(); d > 0 {
+			retryChan = time.After(d)
+		} else {
+			memoryMsgChan, backendMsgChan, requeueMsgChan = channel.deliveryChans()
+			priorityMsgChan = channel.priorityDeliveryChan()
+		}
+
+		var msg *Message
+		// high priority messages go first, unless it's the others' turn
+		select {
+		case msg = <-priorityMsgChan:
+		default:
+		}
+		if msg == nil {
+			select {
+			case <-retryChan:
+			case msg = <-memoryMsgChan:
+			case msg = <-requeueMsgChan:
+			case msg = <-priorityMsgChan:
+			case b := <-backendMsgChan:
+				msg, err = decodeBackendMessage(channel.backend, b, s.nsqd.getOpts().MessagePool)
+				if err != nil {
+					s.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				}
+			case <-timer.C:
+				return nil, http_api.Err{404, "NO_MESSAGE"}
+			case <-req.Context().Done():
+				return nil, http_api.Err{503, "EXITING"}
+			case <-s.nsqd.exitChan:
+				return nil, http_api.Err{503, "EXITING"}
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		channel.priority.took(msg)
+		if channel.expired(msg) {
+			channel.expireMessage(msg)
+			continue
+		}
+
+		channel.deliveryLimit.take(1)
+		msg.Attempts++
+		data := newJSONMessage(msg)
+		// msg must not be touched once it is in flight
+		channel.StartInFlightTimeout(msg, httpConsumerID, channel.msgTimeout(s.nsqd.getOpts().MsgTimeout))
+		atomic.AddUint64(&channel.localDeliveryCount, 1)
+		return data, nil
+	}
+}
+
+// getInFlightFromQuery returns the channel and the message ID of a /fin or
+// /req
+func (s *httpServer) getInFlightFromQuery(req *http.Request) (*http_api.ReqParams, *Channel, *MessageID, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, nil, nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	id, err := reqParams.Get("id")
+	if err != nil {
+		return nil, nil, nil, http_api.Err{400, "MISSING_ARG_ID"}
+	}
+	msgID, err := getMessageID([]byte(id))
+	if err != nil {
+		return nil, nil, nil, http_api.Err{400, "INVALID_ID"}
+	}
+
+	return reqParams, channel, msgID, nil
+}
+
+func (s *httpServer) doFIN(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, channel, msgID, err := s.getInFlightFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = channel.FinishMessage(httpConsumerID, *msgID)
+	if err != nil {
+		return nil, http_api.Err{404, "MSG_NOT_IN_FLIGHT"}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doREQ(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, channel, msgID, err := s.getInFlightFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var delay time.Duration
+	if ds, err := reqParams.Get("delay"); err == nil {
+		di, err := strconv.ParseInt(ds, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_DELAY"}
+		}
+		delay = time.Duration(di) * time.Millisecond
+		if delay < 0 || delay > s.nsqd.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{400, "INVALID_DELAY"}
+		}
+	}
+
+	err = channel.RequeueMessage(httpConsumerID, *msgID, delay, RequeueReasonOther)
+	if err != nil {
+		return nil, http_api.Err{404, "MSG_NOT_IN_FLIGHT"}
+	}
+
+	return nil, nil
+}
+
+// maxPartitions is the most partitions /topic/create can give a topic
+const maxPartitions = 1024
+
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	partitionsParam, ok := reqParams["partitions"]
+	if !ok {
+		return nil, nil
+	}
+	partitions, err := strconv.Atoi(partitionsParam[0])
+	if err != nil || partitions < 1 || partitions > maxPartitions ||
+		!protocol.IsValidTopicName(partitionName(topic.name, partitions-1)) {
+		return nil, http_api.Err{400, "INVALID_PARTITIONS"}
+	}
+	// changing the number of partitions would reorder messages with the same
+	// key
+	if n := topic.Partitions(); n != 0 && n != partitions {
+		return nil, http_api.Err{400, "PARTITIONS_MISMATCH"}
+	}
+	for i := 0; i < partitions; i++ {
+		s.nsqd.GetTopic(partitionName(topic.name, i))
+	}
+	topic.SetPartitions(partitions)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+
+	return nil, nil
 }
 
 func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -399,6 +799,49 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 	return nil, nil
 }
 
+func (s *httpServer) doMigrateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	dataPath, err := reqParams.Get("data_path")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_DATA_PATH"}
+	}
+	fi, err := os.Stat(dataPath)
+	if err != nil || !fi.IsDir() {
+		return nil, http_api.Err{400, "INVALID_DATA_PATH"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	if topic.ephemeral {
+		return nil, http_api.Err{400, "INVALID_TOPIC"}
+	}
+
+	err = topic.MigrateBackend(dataPath)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	// pro-actively persist metadata so in case of process failure
+	// nsqd re-opens the topic from its new location
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
@@ -441,6 +884,22 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 	return nil, nil
 }
 
+func (s *httpServer) doResetChannelStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	channel.ResetStats()
+
+	return nil, nil
+}
+
 func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
@@ -470,6 +929,465 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+var validLabelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_\.-]{1,64}$`)
+
+// parseLabels returns the labels given as label=<key>=<value> query params
+// (nil if there are none)
+func parseLabels(reqParams *http_api.ReqParams) (map[string]string, error) {
+	params, _ := reqParams.GetAll("label")
+	var labels map[string]string
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || !validLabelKeyRegex.MatchString(kv[0]) {
+			return nil, http_api.Err{400, "INVALID_LABEL"}
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(params))
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+func (s *httpServer) doTopicLabels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	labels, err := parseLabels(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	topic.SetLabels(labels)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// parseQueueOptions returns qo updated with the mem_queue_size,
+// max_bytes_per_file, max_disk_write_rate (bytes per second),
+// read_buffer_size, max_depth, overflow_policy, max_publish_rate (per
+// second), daily_byte_quota, dedup_window (in ms), dedup_size, msg_ttl (in
+// ms), max_delivery_rate (per second), ordered, depth_alert, msg_timeout (in
+// ms), requeue_backoff (in ms) and requeue_backoff_max (in ms) query params,
+// an empty one removes the override
+func (s *httpServer) parseQueueOptions(reqParams *http_api.ReqParams, qo QueueOptions) (QueueOptions, error) {
+	opts := s.nsqd.getOpts()
+	if v, err := reqParams.Get("mem_queue_size"); err == nil {
+		qo.MemQueueSize = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 || n > opts.MemQueueSize {
+				return qo, http_api.Err{400, "INVALID_MEM_QUEUE_SIZE"}
+			}
+			qo.MemQueueSize = &n
+		}
+	}
+	if v, err := reqParams.Get("max_bytes_per_file"); err == nil {
+		qo.MaxBytesPerFile = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_MAX_BYTES_PER_FILE"}
+			}
+			qo.MaxBytesPerFile = &n
+		}
+	}
+	if v, err := reqParams.Get("max_disk_write_rate"); err == nil {
+		qo.MaxDiskWriteRate = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_MAX_DISK_WRITE_RATE"}
+			}
+			qo.MaxDiskWriteRate = &n
+		}
+	}
+	if v, err := reqParams.Get("read_buffer_size"); err == nil {
+		qo.ReadBufferSize = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !isValidReadBufferSize(n) {
+				return qo, http_api.Err{400, "INVALID_READ_BUFFER_SIZE"}
+			}
+			qo.ReadBufferSize = &n
+		}
+	}
+	if v, err := reqParams.Get("max_depth"); err == nil {
+		qo.MaxDepth = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return qo, http_api.Err{400, "INVALID_MAX_DEPTH"}
+			}
+			qo.MaxDepth = &n
+		}
+	}
+	if v, err := reqParams.Get("overflow_policy"); err == nil {
+		qo.OverflowPolicy = nil
+		if v != "" {
+			if !isValidOverflowPolicy(v) {
+				return qo, http_api.Err{400, "INVALID_OVERFLOW_POLICY"}
+			}
+			qo.OverflowPolicy = &v
+		}
+	}
+	if v, err := reqParams.Get("max_publish_rate"); err == nil {
+		qo.MaxPublishRate = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_MAX_PUBLISH_RATE"}
+			}
+			qo.MaxPublishRate = &n
+		}
+	}
+	if v, err := reqParams.Get("daily_byte_quota"); err == nil {
+		qo.DailyByteQuota = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_DAILY_BYTE_QUOTA"}
+			}
+			qo.DailyByteQuota = &n
+		}
+	}
+	if v, err := reqParams.Get("dedup_window"); err == nil {
+		qo.DedupWindow = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_DEDUP_WINDOW"}
+			}
+			qo.DedupWindow = &n
+		}
+	}
+	if v, err := reqParams.Get("dedup_size"); err == nil {
+		qo.DedupSize = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 || n > maxDedupSize {
+				return qo, http_api.Err{400, "INVALID_DEDUP_SIZE"}
+			}
+			qo.DedupSize = &n
+		}
+	}
+	if v, err := reqParams.Get("msg_ttl"); err == nil {
+		qo.MsgTTL = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return qo, http_api.Err{400, "INVALID_MSG_TTL"}
+			}
+			qo.MsgTTL = &n
+		}
+	}
+	if v, err := reqParams.Get("max_delivery_rate"); err == nil {
+		qo.MaxDeliveryRate = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_MAX_DELIVERY_RATE"}
+			}
+			qo.MaxDeliveryRate = &n
+		}
+	}
+	if v, err := reqParams.Get("ordered"); err == nil {
+		qo.Ordered = nil
+		if v != "" {
+			b, ok := boolParams[v]
+			if !ok {
+				return qo, http_api.Err{400, "INVALID_ORDERED"}
+			}
+			qo.Ordered = &b
+		}
+	}
+	if v, err := reqParams.Get("depth_alert"); err == nil {
+		qo.DepthAlert = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return qo, http_api.Err{400, "INVALID_DEPTH_ALERT"}
+			}
+			qo.DepthAlert = &n
+		}
+	}
+	if v, err := reqParams.Get("msg_timeout"); err == nil {
+		qo.MsgTimeout = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !isValidMsgTimeout(n, opts) {
+				return qo, http_api.Err{400, "INVALID_MSG_TIMEOUT"}
+			}
+			qo.MsgTimeout = &n
+		}
+	}
+	if v, err := reqParams.Get("requeue_backoff"); err == nil {
+		qo.RequeueBackoff = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !isValidRequeueBackoff(n, opts) {
+				return qo, http_api.Err{400, "INVALID_REQUEUE_BACKOFF"}
+			}
+			qo.RequeueBackoff = &n
+		}
+	}
+	if v, err := reqParams.Get("requeue_backoff_max"); err == nil {
+		qo.RequeueBackoffMax = nil
+		if v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || !isValidRequeueBackoff(n, opts) {
+				return qo, http_api.Err{400, "INVALID_REQUEUE_BACKOFF_MAX"}
+			}
+			qo.RequeueBackoffMax = &n
+		}
+	}
+	return qo, nil
+}
+
+func (s *httpServer) doTopicConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	qo, err := s.parseQueueOptions(reqParams, topic.QueueOptions())
+	if err != nil {
+		return nil, err
+	}
+	// delivery is from channels, and alerts are on their depth
+	if qo.MaxDeliveryRate != nil || qo.Ordered != nil || qo.DepthAlert != nil ||
+		qo.MsgTimeout != nil || qo.RequeueBackoff != nil || qo.RequeueBackoffMax != nil {
+		return nil, http_api.Err{400, "INVALID_TOPIC_OPTION"}
+	}
+	topic.SetQueueOptions(qo)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return qo, nil
+}
+
+func (s *httpServer) doTopicFanOut(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	mode, err := reqParams.Get("mode")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_MODE"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	err = topic.SetFanOutMode(mode)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_MODE"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doChannelLabels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	labels, err := parseLabels(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	channel.SetLabels(labels)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// doChannelDeadLetter sets the topic the channel's messages are republished to
+// when they're discarded after --max-msg-attempts, an empty dead_letter_topic
+// drops them again
+func (s *httpServer) doChannelDeadLetter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	deadLetter, err := reqParams.Get("dead_letter_topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_DEAD_LETTER_TOPIC"}
+	}
+
+	if deadLetter != "" {
+		if !protocol.IsValidTopicName(deadLetter) || deadLetter == topic.name {
+			return nil, http_api.Err{400, "INVALID_DEAD_LETTER_TOPIC"}
+		}
+		s.nsqd.GetTopic(deadLetter)
+	}
+	channel.SetDeadLetterTopic(deadLetter)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+// doChannelArchive sets where copies of the messages delivered on the
+// channel are archived: published to archive_topic, and/or passed to the
+// ArchiveSink with sink=true. With neither they're no longer archived.
+func (s *httpServer) doChannelArchive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	var archive ChannelArchive
+	archive.Topic, _ = reqParams.Get("archive_topic")
+	if archive.Topic != "" {
+		// archiving to the channel's own topic would deliver the copies on
+		// the channel again
+		if !protocol.IsValidTopicName(archive.Topic) || archive.Topic == topic.name {
+			return nil, http_api.Err{400, "INVALID_ARCHIVE_TOPIC"}
+		}
+	}
+	if sink, _ := reqParams.Get("sink"); sink != "" {
+		archive.Sink, err = strconv.ParseBool(sink)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_SINK"}
+		}
+		if archive.Sink && s.nsqd.getOpts().ArchiveSink == nil {
+			return nil, http_api.Err{400, "NO_ARCHIVE_SINK"}
+		}
+	}
+	if archive.Topic != "" {
+		s.nsqd.GetTopic(archive.Topic)
+	}
+	channel.SetArchive(archive)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doChannelConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	qo, err := s.parseQueueOptions(reqParams, channel.QueueOptions())
+	if err != nil {
+		return nil, err
+	}
+	// a publish is to the topic, and checks its channels' depth
+	if qo.MaxDepth != nil || qo.OverflowPolicy != nil ||
+		qo.MaxPublishRate != nil || qo.DailyByteQuota != nil ||
+		qo.DedupWindow != nil || qo.DedupSize != nil {
+		return nil, http_api.Err{400, "INVALID_CHANNEL_OPTION"}
+	}
+	channel.SetQueueOptions(qo)
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return qo, nil
+}
+
+// doDrain puts the node into drain mode, with exit=true to exit once it's
+// empty (see NSQD.Drain)
+func (s *httpServer) doDrain(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var exitWhenEmpty bool
+	if exit, _ := reqParams.Get("exit"); exit != "" {
+		exitWhenEmpty, err = strconv.ParseBool(exit)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_EXIT"}
+		}
+	}
+
+	s.nsqd.Drain(exitWhenEmpty)
+	return s.nsqd.GetDrainStats(s.nsqd.GetStats("", "", false)), nil
+}
+
+// doInternals reports the queues and goroutines of the topic and channel
+// query params (all of them if they're missing), see GetInternals
+func (s *httpServer) doInternals(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName, _ := reqParams.Get("topic")
+	channelName, _ := reqParams.Get("channel")
+	return s.nsqd.GetInternals(topicName, channelName), nil
+}
+
 func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var producerStats []ClientStats
 
@@ -481,6 +1399,7 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 	formatString, _ := reqParams.Get("format")
 	topicName, _ := reqParams.Get("topic")
 	channelName, _ := reqParams.Get("channel")
+	namespaceName, _ := reqParams.Get("namespace")
 	includeClientsParam, _ := reqParams.Get("include_clients")
 	includeMemParam, _ := reqParams.Get("include_mem")
 	jsonFormat := formatString == "json"
@@ -499,6 +1418,18 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 
 	stats := s.nsqd.GetStats(topicName, channelName, includeClients)
 	health := s.nsqd.GetHealth()
+	replicaStats := s.nsqd.GetReplicaStats()
+	var dataPathStats []DataPathStats
+	var orphanedQueues []OrphanedQueue
+	var drainStats *DrainStats
+	var namespaceStats []NamespaceStats
+	if len(topicName) == 0 {
+		// totals are of every topic
+		dataPathStats = s.nsqd.GetDataPathStats(stats)
+		orphanedQueues = s.nsqd.GetOrphanedQueues()
+		drainStats = s.nsqd.GetDrainStats(stats)
+		namespaceStats = s.nsqd.GetNamespaceStats(stats)
+	}
 	startTime := s.nsqd.GetStartTime()
 	uptime := time.Since(startTime)
 
@@ -543,26 +1474,40 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		producerStats = filteredProducerStats
 	}
 
+	// filter by namespace (if specified)
+	if len(namespaceName) > 0 {
+		stats, producerStats, namespaceStats = s.nsqd.filterNamespaceStats(namespaceName,
+			stats, producerStats, namespaceStats)
+	}
+
 	var ms *memStats
 	if includeMem {
 		m := getMemStats()
 		ms = &m
 	}
 	if !jsonFormat {
-		return s.printStats(stats, producerStats, ms, health, startTime, uptime), nil
+		return s.printStats(stats, producerStats, replicaStats, dataPathStats, orphanedQueues, drainStats, namespaceStats, ms, health, startTime, uptime), nil
 	}
 
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    *memStats     `json:"memory,omitempty"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats, ms, producerStats}, nil
+		Version        string           `json:"version"`
+		Health         string           `json:"health"`
+		StartTime      int64            `json:"start_time"`
+		Topics         []TopicStats     `json:"topics"`
+		Memory         *memStats        `json:"memory,omitempty"`
+		Producers      []ClientStats    `json:"producers"`
+		Replicas       []ReplicaStats   `json:"replicas,omitempty"`
+		DataPaths      []DataPathStats  `json:"data_paths,omitempty"`
+		OrphanedQueues []OrphanedQueue  `json:"orphaned_queues,omitempty"`
+		Drain          *DrainStats      `json:"drain,omitempty"`
+		Namespaces     []NamespaceStats `json:"namespaces,omitempty"`
+		TCPAddresses   []string         `json:"tcp_addresses"`
+		HTTPAddresses  []string         `json:"http_addresses"`
+	}{version.Binary, health, startTime.Unix(), stats, ms, producerStats, replicaStats, dataPathStats,
+		orphanedQueues, drainStats, namespaceStats, s.nsqd.TCPAddrs(), s.nsqd.HTTPAddrs()}, nil
 }
 
-func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
+func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, replicaStats []ReplicaStats, dataPathStats []DataPathStats, orphanedQueues []OrphanedQueue, drainStats *DrainStats, namespaceStats []NamespaceStats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
 	var buf bytes.Buffer
 	w := &buf
 
@@ -571,9 +1516,35 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 	fmt.Fprintf(w, "%s\n", version.String("nsqd"))
 	fmt.Fprintf(w, "start_time %v\n", startTime.Format(time.RFC3339))
 	fmt.Fprintf(w, "uptime %s\n", uptime)
+	fmt.Fprintf(w, "tcp_addresses %s\n", strings.Join(s.nsqd.TCPAddrs(), ","))
+	fmt.Fprintf(w, "http_addresses %s\n", strings.Join(s.nsqd.HTTPAddrs(), ","))
 
 	fmt.Fprintf(w, "\nHealth: %s\n", health)
 
+	if drainStats != nil {
+		fmt.Fprintf(w, "\nDraining: since %s, %d of %d messages left (depth: %d inflt: %d def: %d) exit when empty: %t\n",
+			time.Unix(drainStats.StartTime, 0).Format(time.RFC3339), drainStats.Remaining(), drainStats.StartDepth,
+			drainStats.Depth, drainStats.InFlightCount, drainStats.DeferredCount, drainStats.ExitWhenEmpty)
+	}
+
+	if len(namespaceStats) > 0 {
+		fmt.Fprintf(w, "\nNamespaces:\n")
+		for _, ns := range namespaceStats {
+			fmt.Fprintf(w, "   [%-15s] topics: %d/%d disk: %d/%d depth: %-5d msgs: %-8d rate-limited: %d quota-exceeded: %d topic-limit: %d\n",
+				ns.Name,
+				ns.Topics,
+				ns.MaxTopics,
+				ns.DiskBytes,
+				ns.MaxDiskBytes,
+				ns.Depth,
+				ns.MessageCount,
+				ns.RateLimitedCount,
+				ns.QuotaExceededCount,
+				ns.TopicLimitCount,
+			)
+		}
+	}
+
 	if ms != nil {
 		fmt.Fprintf(w, "\nMemory:\n")
 		fmt.Fprintf(w, "   %-25s\t%d\n", "heap_objects", ms.HeapObjects)
@@ -600,13 +1571,14 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 		} else {
 			pausedPrefix = "   "
 		}
-		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d e2e%%: %s\n",
+		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d e2e%%: %s rates/s (1m/5m): %s\n",
 			pausedPrefix,
 			t.TopicName,
 			t.Depth,
 			t.BackendDepth,
 			t.MessageCount,
 			t.E2eProcessingLatency,
+			t.Rates,
 		)
 		for _, c := range t.Channels {
 			if c.Paused {
@@ -614,7 +1586,7 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 			} else {
 				pausedPrefix = "      "
 			}
-			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s rates/s (1m/5m): %s\n",
 				pausedPrefix,
 				c.ChannelName,
 				c.Depth,
@@ -625,12 +1597,17 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 				c.TimeoutCount,
 				c.MessageCount,
 				c.E2eProcessingLatency,
+				c.Rates,
 			)
 			for _, client := range c.Clients {
 				connectTime := time.Unix(client.ConnectTime, 0)
 				// truncate to the second
 				duration := time.Duration(int64(now.Sub(connectTime).Seconds())) * time.Second
-				fmt.Fprintf(w, "        [%s %-21s] state: %d inflt: %-4d rdy: %-4d fin: %-8d re-q: %-8d msgs: %-8d connected: %s\n",
+				var slow string
+				if client.Slow {
+					slow = " (slow)"
+				}
+				fmt.Fprintf(w, "        [%s %-21s] state: %d inflt: %-4d rdy: %-4d fin: %-8d re-q: %-8d timeout: %-8d msgs: %-8d connected: %s%s\n",
 					client.Version,
 					client.ClientID,
 					client.State,
@@ -638,8 +1615,10 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 					client.ReadyCount,
 					client.FinishCount,
 					client.RequeueCount,
+					client.TimeoutCount,
 					client.MessageCount,
 					duration,
+					slow,
 				)
 			}
 		}
@@ -672,9 +1651,47 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 		}
 	}
 
+	if len(replicaStats) > 0 {
+		fmt.Fprintf(w, "\nReplicas:\n")
+		for _, r := range replicaStats {
+			fmt.Fprintf(w, "   [%-21s] healthy: %-5t replicated: %-8d failed: %-8d queued: %-5d %s\n",
+				r.Address,
+				r.Healthy,
+				r.ReplicatedCount,
+				r.FailedCount,
+				r.QueueDepth,
+				r.LastError,
+			)
+		}
+	}
+
+	if len(dataPathStats) > 0 {
+		fmt.Fprintf(w, "\nData Paths:\n")
+		for _, d := range dataPathStats {
+			fmt.Fprintf(w, "   [%-25s] queues: %-5d disk-bytes: %d\n", d.Path, d.Queues, d.DiskBytes)
+		}
+	}
+
+	if len(orphanedQueues) > 0 {
+		fmt.Fprintf(w, "\nOrphaned Queues:\n")
+		for _, q := range orphanedQueues {
+			fmt.Fprintf(w, "   [%-25s] path: %s files: %-5d bytes: %-10d %s\n",
+				q.Name, q.DataPath, q.Files, q.Bytes, q.Reason)
+		}
+	}
+
 	return buf.Bytes()
 }
 
+// doMetrics returns the stats in the Prometheus text format
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var buf bytes.Buffer
+	writePrometheusMetrics(&buf, s.nsqd.GetStats("", "", false), len(s.nsqd.GetProducerStats()),
+		atomic.LoadUint64(&s.nsqd.expiredTopicCount), atomic.LoadUint64(&s.nsqd.expiredChannelCount))
+	w.Header().Set("Content-Type", prometheusContentType)
+	return buf.Bytes(), nil
+}
+
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
@@ -735,6 +1752,9 @@ func getOptByCfgName(opts interface{}, name string) (interface{}, bool) {
 		if name != cfgName {
 			continue
 		}
+		if field.Tag.Get("redact") == "true" && val.Field(i).Len() > 0 {
+			return redacted, true
+		}
 		return val.FieldByName(field.Name).Interface(), true
 	}
 	return nil, false
@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// requireSecret returns a Decorator rejecting requests that fail
+// checkSecret
+func (s *httpServer) requireSecret(admin bool) http_api.Decorator {
+	return func(f http_api.APIHandler) http_api.APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			if err := s.checkSecret(req, admin); err != nil {
+				return nil, err
+			}
+			return f(w, req, ps)
+		}
+	}
+}
+
+// requireSecretHandler wraps h, an http.Handler that isn't an APIHandler
+// (like pprof's and the websocket's), to reject requests that fail
+// checkSecret(req, true)
+func (s *httpServer) requireSecretHandler(h http.Handler) http.Handler {
+	handle := s.requireSecretHandle(func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, req)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handle(w, req, nil)
+	})
+}
+
+// requireSecretHandle is requireSecretHandler for an httprouter.Handle
+func (s *httpServer) requireSecretHandle(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if err := s.checkSecret(req, true); err != nil {
+			http.Error(w, err.(http_api.Err).Text, err.(http_api.Err).Code)
+			return
+		}
+		h(w, req, ps)
+	}
+}
+
+// checkSecret returns a 403 for a request that doesn't have
+// --http-auth-secret, when it's set, as its bearer token or basic auth
+// password. Those that change topics, channels or options, consume or
+// export messages, or profile (admin) always need it, the others only with
+// --http-auth-read.
+func (s *httpServer) checkSecret(req *http.Request, admin bool) error {
+	opts := s.nsqd.getOpts()
+	if opts.HTTPAuthSecret == "" || (!admin && !opts.HTTPAuthRead) {
+		return nil
+	}
+	if !hasHTTPAuthSecret(req, opts.HTTPAuthSecret) {
+		s.nsqd.logf(LOG_WARN, "AUDIT: rejected %s %s from %s - missing or wrong secret",
+			req.Method, req.URL.RequestURI(), req.RemoteAddr)
+		return http_api.Err{403, "FORBIDDEN"}
+	}
+	return nil
+}
+
+func hasHTTPAuthSecret(req *http.Request, secret string) bool {
+	var given string
+	if _, password, ok := req.BasicAuth(); ok {
+		given = password
+	} else if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		given = strings.TrimPrefix(h, "Bearer ")
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/internal/version"
+	"github.com/nsqio/nsq/internal/websocket"
 	"github.com/nsqio/nsq/nsqlookupd"
 )
 
@@ -29,12 +30,16 @@ type ErrMessage struct {
 }
 
 type InfoDoc struct {
-	Version          string `json:"version"`
-	BroadcastAddress string `json:"broadcast_address"`
-	Hostname         string `json:"hostname"`
-	HTTPPort         int    `json:"http_port"`
-	TCPPort          int    `json:"tcp_port"`
-	StartTime        int64  `json:"start_time"`
+	Version           string `json:"version"`
+	BroadcastAddress  string `json:"broadcast_address"`
+	BroadcastTCPPort  int    `json:"broadcast_tcp_port"`
+	BroadcastHTTPPort int    `json:"broadcast_http_port"`
+	Hostname          string `json:"hostname"`
+	HTTPPort          int    `json:"http_port"`
+	TCPPort           int    `json:"tcp_port"`
+	StartTime         int64  `json:"start_time"`
+
+	Goroutines GoroutineStats `json:"goroutines"`
 }
 
 func TestHTTPpub(t *testing.T) {
@@ -60,6 +65,323 @@ func TestHTTPpub(t *testing.T) {
 	test.Equal(t, int64(1), topic.Depth())
 }
 
+func TestHTTPpubHeadersMaxMsgSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxMsgSize = 100
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_headers_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	// headers don't count against --max-msg-size, the backend has room for
+	// them on top of a body of that size
+	body := bytes.Repeat([]byte("x"), int(opts.MaxMsgSize))
+	for _, endpoint := range []string{"pub", "mpub"} {
+		url := fmt.Sprintf("http://%s/%s?topic=%s&header=a:b", httpAddr, endpoint, topicName)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(body))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+	test.Equal(t, "OK", nsqd.GetHealth())
+	test.Equal(t, int64(2), topic.Depth())
+
+	for i := 0; i < 2; i++ {
+		msg, err := decodeMessage(<-topic.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, map[string]string{"a": "b"}, msg.Headers)
+		test.Equal(t, body, msg.Body)
+	}
+}
+
+func TestHTTPpubHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// so that messages round-trip through the diskqueue
+	opts.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_headers" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s&header=content-type:application/json&header=trace-id:a:b",
+		httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	for _, header := range []string{":x", "%00priority:1"} {
+		url = fmt.Sprintf("http://%s/pub?topic=%s&header=%s", httpAddr, topicName, header)
+		resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, 400, resp.StatusCode)
+		test.Equal(t, `{"message":"INVALID_HEADER"}`, string(body))
+	}
+
+	msg, err := decodeMessage(<-topic.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, map[string]string{"content-type": "application/json", "trace-id": "a:b"}, msg.Headers)
+	test.Equal(t, []byte("test message"), msg.Body)
+}
+
+func TestWebSocket(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_websocket" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/ws?topic=%s", httpAddr, topicName))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	conn, err := websocket.Dial(fmt.Sprintf("ws://%s/ws?topic=%s", httpAddr, topicName))
+	test.Nil(t, err)
+	defer conn.Close()
+
+	// the ephemeral channel is there as soon as the client is subscribed
+	var channel *Channel
+	for i := 0; channel == nil; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+		topic.RLock()
+		for _, c := range topic.channelMap {
+			channel = c
+		}
+		topic.RUnlock()
+	}
+	test.Equal(t, true, channel.ephemeral)
+
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	msg.Headers = map[string]string{"type": "order"}
+	topic.PutMessage(msg)
+
+	err = conn.WriteMessage(websocket.OpText, []byte(`{"rdy":1}`))
+	test.Nil(t, err)
+	_, data, err := conn.ReadMessage()
+	test.Nil(t, err)
+	var m jsonMessage
+	err = json.Unmarshal(data, &m)
+	test.Nil(t, err)
+	test.Equal(t, string(msg.ID[:]), m.ID)
+	test.Equal(t, uint16(1), m.Attempts)
+	test.Equal(t, "test body", m.Body)
+	test.Equal(t, msg.Headers, m.Headers)
+
+	err = conn.WriteMessage(websocket.OpText, []byte(fmt.Sprintf(`{"fin":%q}`, m.ID)))
+	test.Nil(t, err)
+	for i := 0; ; i++ {
+		channel.inFlightMutex.Lock()
+		n := len(channel.inFlightMessages)
+		channel.inFlightMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a FIN for a message that isn't in flight is not fatal
+	err = conn.WriteMessage(websocket.OpText, []byte(fmt.Sprintf(`{"fin":%q}`, m.ID)))
+	test.Nil(t, err)
+	_, data, err = conn.ReadMessage()
+	test.Nil(t, err)
+	test.Equal(t, true, strings.HasPrefix(string(data), `{"error":"E_FIN_FAILED`))
+
+	err = conn.WriteMessage(websocket.OpText, []byte(`{"bogus":1}`))
+	test.Nil(t, err)
+	_, data, err = conn.ReadMessage()
+	test.Nil(t, err)
+	test.Equal(t, `{"error":"E_INVALID invalid command"}`, string(data))
+
+	// the ephemeral channel goes away with its last client
+	for i := 0; ; i++ {
+		topic.RLock()
+		n := len(topic.channelMap)
+		topic.RUnlock()
+		if n == 0 {
+			break
+		}
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MsgTimeout = 100 * time.Millisecond
+	opts.QueueScanInterval = 10 * time.Millisecond
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	get := func(query string) (int, []byte) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/message?topic=%s&channel=ch%s", httpAddr, topicName, query))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	post := func(endpoint string, query string) (int, []byte) {
+		resp, err := http.Post(fmt.Sprintf("http://%s/%s?topic=%s&channel=ch%s", httpAddr, endpoint, topicName, query),
+			"application/octet-stream", nil)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	code, body := get("&timeout=0")
+	test.Equal(t, 404, code)
+	test.Equal(t, `{"message":"NO_MESSAGE"}`, string(body))
+	code, _ = get("&timeout=x")
+	test.Equal(t, 400, code)
+
+	// a long-poll is answered as soon as a message is published
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}()
+	code, body = get("&timeout=5")
+	test.Equal(t, 200, code)
+	var m jsonMessage
+	err := json.Unmarshal(body, &m)
+	test.Nil(t, err)
+	test.Equal(t, uint16(1), m.Attempts)
+	test.Equal(t, "test body", m.Body)
+
+	// not acknowledged within --msg-timeout it's redelivered
+	code, body = get("&timeout=5")
+	test.Equal(t, 200, code)
+	err = json.Unmarshal(body, &m)
+	test.Nil(t, err)
+	test.Equal(t, uint16(2), m.Attempts)
+
+	code, _ = post("req", "&id="+m.ID+"&delay=-1")
+	test.Equal(t, 400, code)
+	code, _ = post("req", "&id="+m.ID)
+	test.Equal(t, 200, code)
+
+	code, body = get("&timeout=5")
+	test.Equal(t, 200, code)
+	err = json.Unmarshal(body, &m)
+	test.Nil(t, err)
+	test.Equal(t, uint16(3), m.Attempts)
+
+	code, _ = post("fin", "&id="+m.ID)
+	test.Equal(t, 200, code)
+	code, body = post("fin", "&id="+m.ID)
+	test.Equal(t, 404, code)
+	test.Equal(t, `{"message":"MSG_NOT_IN_FLIGHT"}`, string(body))
+	code, body = post("fin", "&id=bogus")
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"INVALID_ID"}`, string(body))
+
+	code, _ = get("&timeout=0")
+	test.Equal(t, 404, code)
+}
+
+func TestPartitionedTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_partitioned" + strconv.Itoa(int(time.Now().Unix()))
+
+	post := func(endpoint string, body string) (int, string) {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, endpoint),
+			"application/octet-stream", bytes.NewBufferString(body))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	for _, p := range []string{"0", "x", "1025"} {
+		code, body := post("/topic/create?topic="+topicName+"&partitions="+p, "")
+		test.Equal(t, 400, code)
+		test.Equal(t, `{"message":"INVALID_PARTITIONS"}`, body)
+	}
+	code, _ := post("/topic/create?topic="+topicName+"&partitions=4", "")
+	test.Equal(t, 200, code)
+	code, body := post("/topic/create?topic="+topicName+"&partitions=3", "")
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"PARTITIONS_MISMATCH"}`, body)
+
+	var partitions []*Topic
+	for i := 0; i < 4; i++ {
+		topic, err := nsqd.GetExistingTopic(partitionName(topicName, i))
+		test.Nil(t, err)
+		partitions = append(partitions, topic)
+	}
+	depths := func() []int64 {
+		var depths []int64
+		for _, topic := range partitions {
+			depths = append(depths, topic.Depth())
+		}
+		return depths
+	}
+
+	// messages with the same key go to the same partition, whether
+	// published over HTTP or TCP
+	for i := 0; i < 3; i++ {
+		code, _ = post("/pub?topic="+topicName+"&partition_key=user-1", "test body")
+		test.Equal(t, 200, code)
+	}
+	code, _ = post("/mpub?topic="+topicName+"&partition_key=user-1", "one\ntwo")
+	test.Equal(t, 200, code)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	cmd := &nsq.Command{Name: []byte("PUB"), Params: [][]byte{[]byte(topicName), []byte("user-1")}, Body: []byte("test body")}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	var total int64
+	for _, d := range depths() {
+		test.Equal(t, true, d == 0 || d == 6)
+		total += d
+	}
+	test.Equal(t, int64(6), total)
+
+	// those without a key round-robin
+	for i := 0; i < 4; i++ {
+		code, _ = post("/pub?topic="+topicName, "test body")
+		test.Equal(t, 200, code)
+	}
+	for _, d := range depths() {
+		test.Equal(t, true, d == 1 || d == 7)
+	}
+
+	// consumers subscribe to the partitions
+	subFail(t, conn, topicName, "ch")
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, 4, stats[0].Partitions)
+}
+
 func TestHTTPpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -229,6 +551,35 @@ func TestHTTPpubDefer(t *testing.T) {
 	test.Equal(t, 1, numDef)
 }
 
+func TestHTTPpubPriority(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_priority" + strconv.Itoa(int(time.Now().Unix()))
+	ch := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s&priority=1", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+
+	msg := <-ch.priority.msgChan
+	test.Equal(t, PriorityHigh, msg.Priority)
+
+	buf = bytes.NewBuffer([]byte("test message"))
+	url = fmt.Sprintf("http://%s/mpub?topic=%s&priority=high", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
 func TestHTTPSRequire(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -564,6 +915,461 @@ func TestHTTPClientStats(t *testing.T) {
 	test.Nil(t, d.Memory)
 }
 
+func TestHTTPLabels(t *testing.T) {
+	topicName := "test_http_labels" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	url := fmt.Sprintf("http://%s/topic/labels?topic=%s&label=team=core&label=env=prod", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	url = fmt.Sprintf("http://%s/channel/labels?topic=%s&channel=ch&label=owner=billing", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+
+	url = fmt.Sprintf("http://%s/topic/labels?topic=%s&label=bad%%20key=x", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"message":"INVALID_LABEL"}`, string(body))
+
+	var d struct {
+		Topics []struct {
+			Labels   map[string]string `json:"labels"`
+			Channels []struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"channels"`
+		} `json:"topics"`
+	}
+	checkStats := func(httpAddr *net.TCPAddr) {
+		endpoint := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+		err := client.GETV1(endpoint, &d)
+		test.Nil(t, err)
+		test.Equal(t, map[string]string{"team": "core", "env": "prod"}, d.Topics[0].Labels)
+		test.Equal(t, map[string]string{"owner": "billing"}, d.Topics[0].Channels[0].Labels)
+	}
+	checkStats(httpAddr)
+
+	// labels survive a restart
+	nsqd.Exit()
+	_, httpAddr, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	checkStats(httpAddr)
+
+	// no labels clears them
+	url = fmt.Sprintf("http://%s/channel/labels?topic=%s&channel=ch", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	channel, _ := topic.GetExistingChannel("ch")
+	test.Nil(t, channel.Labels())
+}
+
+func TestHTTPChannelDeadLetter(t *testing.T) {
+	topicName := "test_http_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	deadLetterName := topicName + "_dlq"
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	url := fmt.Sprintf("http://%s/channel/deadletter?topic=%s&channel=ch&dead_letter_topic=%s", httpAddr, topicName, deadLetterName)
+	test.Nil(t, client.POSTV1(url))
+	test.Equal(t, deadLetterName, channel.DeadLetterTopic())
+	// the dead-letter topic is created
+	_, err := nsqd.GetExistingTopic(deadLetterName)
+	test.Nil(t, err)
+
+	for _, bad := range []string{topicName, "bad%20name"} {
+		url = fmt.Sprintf("http://%s/channel/deadletter?topic=%s&channel=ch&dead_letter_topic=%s", httpAddr, topicName, bad)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, `{"message":"INVALID_DEAD_LETTER_TOPIC"}`, string(body))
+	}
+
+	// the dead-letter topic survives a restart
+	nsqd.Exit()
+	_, httpAddr, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, deadLetterName, channel.DeadLetterTopic())
+
+	// an empty dead_letter_topic clears it
+	url = fmt.Sprintf("http://%s/channel/deadletter?topic=%s&channel=ch&dead_letter_topic=", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	test.Equal(t, "", channel.DeadLetterTopic())
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, prometheusContentType, resp.Header.Get("Content-Type"))
+	test.Equal(t, true, strings.Contains(string(body), "# TYPE nsq_topic_depth gauge\n"))
+	test.Equal(t, true, strings.Contains(string(body),
+		fmt.Sprintf("nsq_topic_messages_total{topic=\"%s\"} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(string(body), "\ngo_goroutines "))
+
+	topic.GetChannel("ch")
+	resp, err = http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	test.Equal(t, true, strings.Contains(string(body),
+		fmt.Sprintf("nsq_channel_clients{topic=\"%s\",channel=\"ch\"} 0\n", topicName)))
+}
+
+func TestHTTPQueueOptions(t *testing.T) {
+	topicName := "test_http_queue_options" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	url := fmt.Sprintf("http://%s/topic/config?topic=%s&mem_queue_size=0&max_bytes_per_file=1024", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	url = fmt.Sprintf("http://%s/channel/config?topic=%s&channel=ch&mem_queue_size=100&msg_timeout=2000&read_buffer_size=65536", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+
+	for _, q := range []string{"mem_queue_size=-1", "mem_queue_size=100000", "max_bytes_per_file=0",
+		"max_depth=-1", "overflow_policy=drop-newest", "channel=ch&max_depth=10", "msg_ttl=-1",
+		"max_delivery_rate=10", "channel=ch&max_delivery_rate=0", "max_publish_rate=0",
+		"daily_byte_quota=-1", "channel=ch&max_publish_rate=10", "ordered=true",
+		"channel=ch&ordered=x", "dedup_window=0", "dedup_size=0", "channel=ch&dedup_window=10",
+		"depth_alert=10", "channel=ch&depth_alert=0", "max_disk_write_rate=0",
+		"msg_timeout=5000", "channel=ch&msg_timeout=999", "channel=ch&msg_timeout=86400000",
+		"requeue_backoff=100", "channel=ch&requeue_backoff=0",
+		"channel=ch&requeue_backoff_max=86400000", "read_buffer_size=0",
+		"channel=ch&read_buffer_size=1000000000"} {
+		endpoint := "topic"
+		if strings.HasPrefix(q, "channel=") {
+			endpoint = "channel"
+		}
+		url = fmt.Sprintf("http://%s/%s/config?topic=%s&%s", httpAddr, endpoint, topicName, q)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	var d struct {
+		Topics []struct {
+			QueueOptions QueueOptions `json:"queue_options"`
+			Channels     []struct {
+				QueueOptions QueueOptions `json:"queue_options"`
+			} `json:"channels"`
+		} `json:"topics"`
+	}
+	checkStats := func(httpAddr *net.TCPAddr) {
+		endpoint := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+		test.Nil(t, client.GETV1(endpoint, &d))
+		test.Equal(t, int64(0), *d.Topics[0].QueueOptions.MemQueueSize)
+		test.Equal(t, int64(1024), *d.Topics[0].QueueOptions.MaxBytesPerFile)
+		test.Equal(t, int64(100), *d.Topics[0].Channels[0].QueueOptions.MemQueueSize)
+		test.Nil(t, d.Topics[0].Channels[0].QueueOptions.MaxBytesPerFile)
+		test.Equal(t, int64(2000), *d.Topics[0].Channels[0].QueueOptions.MsgTimeout)
+		test.Equal(t, int64(65536), *d.Topics[0].Channels[0].QueueOptions.ReadBufferSize)
+		test.Nil(t, d.Topics[0].QueueOptions.ReadBufferSize)
+	}
+	checkStats(httpAddr)
+
+	// the overrides survive a restart
+	nsqd.Exit()
+	_, httpAddr, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	checkStats(httpAddr)
+
+	// an empty value removes an override
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&mem_queue_size=", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, topic.QueueOptions().MemQueueSize)
+	test.Equal(t, int64(1024), *topic.QueueOptions().MaxBytesPerFile)
+}
+
+func TestHTTPTopicFanOut(t *testing.T) {
+	topicName := "test_http_fan_out" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic(topicName)
+	test.Equal(t, "copy", topic.FanOutMode())
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	url := fmt.Sprintf("http://%s/topic/fanout?topic=%s&mode=shared", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	test.Equal(t, "shared", topic.FanOutMode())
+
+	url = fmt.Sprintf("http://%s/topic/fanout?topic=%s&mode=borrowed", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"message":"INVALID_MODE"}`, string(body))
+
+	var d struct {
+		Topics []struct {
+			FanOutMode string `json:"fan_out_mode"`
+		} `json:"topics"`
+	}
+	endpoint := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
+	test.Nil(t, client.GETV1(endpoint, &d))
+	test.Equal(t, "shared", d.Topics[0].FanOutMode)
+
+	// the mode survives a restart
+	nsqd.Exit()
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	topic, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, "shared", topic.FanOutMode())
+}
+
+func TestHTTPAuthSecret(t *testing.T) {
+	topicName := "test_http_auth_secret" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPAuthSecret = "s3cret"
+	opts.PprofEnabled = true
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	do := func(method, path string, auth func(req *http.Request)) (int, string) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", httpAddr, path), nil)
+		test.Nil(t, err)
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	bearer := func(secret string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+	}
+	basic := func(req *http.Request) {
+		req.SetBasicAuth("admin", "s3cret")
+	}
+
+	createTopic := "/topic/create?topic=" + topicName
+	code, body := do("POST", createTopic, nil)
+	test.Equal(t, 403, code)
+	test.Equal(t, `{"message":"FORBIDDEN"}`, body)
+	code, _ = do("POST", createTopic, bearer("wrong"))
+	test.Equal(t, 403, code)
+	_, err := nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+
+	code, _ = do("POST", createTopic, bearer("s3cret"))
+	test.Equal(t, 200, code)
+	code, _ = do("POST", "/channel/create?topic="+topicName+"&channel=ch", basic)
+	test.Equal(t, 200, code)
+
+	// consuming, exporting and profiling always need the secret
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/message?topic=" + topicName + "&channel=ch"},
+		{"POST", "/fin?topic=" + topicName + "&channel=ch"},
+		{"POST", "/req?topic=" + topicName + "&channel=ch"},
+		{"GET", "/ws?topic=" + topicName + "&channel=ch"},
+		{"GET", "/channel/export?topic=" + topicName + "&channel=ch"},
+		{"GET", "/debug/pprof/"},
+		{"GET", "/debug/pprof/cmdline"},
+	} {
+		code, body = do(r.method, r.path, nil)
+		test.Equal(t, 403, code)
+		test.Equal(t, false, strings.Contains(body, "s3cret"))
+	}
+	code, _ = do("GET", "/debug/pprof/cmdline", basic)
+	test.Equal(t, 200, code)
+
+	// reads are open, unless --http-auth-read
+	code, _ = do("GET", "/stats", nil)
+	test.Equal(t, 200, code)
+	opts.HTTPAuthRead = true
+	_, _, err = nsqd.ReloadOptions(opts)
+	test.Nil(t, err)
+	code, _ = do("GET", "/stats", nil)
+	test.Equal(t, 403, code)
+	code, _ = do("GET", "/channel/export?topic="+topicName+"&channel=ch", nil)
+	test.Equal(t, 403, code)
+	code, _ = do("GET", "/stats", basic)
+	test.Equal(t, 200, code)
+	code, _ = do("GET", "/ping", nil)
+	test.Equal(t, 200, code)
+}
+
+func TestHTTPChannelResetStats(t *testing.T) {
+	topicName := "test_http_reset_stats" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	test.Equal(t, uint64(1), NewChannelStats(channel, nil, 0).MessageCount)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	url := fmt.Sprintf("http://%s/channel/resetstats?topic=%s&channel=ch", httpAddr, topicName)
+	test.Nil(t, client.POSTV1(url))
+	test.Equal(t, uint64(0), NewChannelStats(channel, nil, 0).MessageCount)
+	test.Equal(t, int64(1), channel.Depth())
+
+	url = fmt.Sprintf("http://%s/channel/resetstats?topic=%s&channel=none", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 404, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestHTTPExportChannel(t *testing.T) {
+	topicName := "test_http_export_channel" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for _, body := range []string{"one", "two"} {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+	}
+	deferred := NewMessage(topic.GenerateID(), []byte("later"))
+	deferred.Headers = map[string]string{"type": "order"}
+	channel.PutMessageDeferred(deferred, time.Hour)
+
+	url := fmt.Sprintf("http://%s/channel/export?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	dec := json.NewDecoder(resp.Body)
+	var msgs []jsonMessage
+	for dec.More() {
+		var msg jsonMessage
+		test.Nil(t, dec.Decode(&msg))
+		msgs = append(msgs, msg)
+	}
+	resp.Body.Close()
+
+	// deferred messages first, then the backend's
+	test.Equal(t, 3, len(msgs))
+	test.Equal(t, string(deferred.ID[:]), msgs[0].ID)
+	test.Equal(t, "later", msgs[0].Body)
+	test.Equal(t, map[string]string{"type": "order"}, msgs[0].Headers)
+	test.Equal(t, "one", msgs[1].Body)
+	test.Equal(t, "two", msgs[2].Body)
+	test.Equal(t, true, msgs[1].Timestamp > 0)
+
+	// nothing was consumed
+	test.Equal(t, int64(2), channel.Depth())
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, 1, stats.DeferredCount)
+
+	url = fmt.Sprintf("http://%s/channel/export?topic=%s&channel=none", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+	test.Equal(t, `{"message":"CHANNEL_NOT_FOUND"}`, string(body))
+}
+
+func TestHTTPExportChannelMemory(t *testing.T) {
+	topicName := "test_http_export_channel_memory" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	// "three" spills to the backend
+	for _, body := range []string{"one", "two", "three"} {
+		channel.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+	}
+	urgent := NewMessage(topic.GenerateID(), []byte("urgent"))
+	urgent.Priority = PriorityNormal + 1
+	channel.PutMessage(urgent)
+
+	url := fmt.Sprintf("http://%s/channel/export?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	dec := json.NewDecoder(resp.Body)
+	var bodies []string
+	for dec.More() {
+		var msg jsonMessage
+		test.Nil(t, dec.Decode(&msg))
+		bodies = append(bodies, msg.Body)
+	}
+	resp.Body.Close()
+
+	// the memory queues in the order clients get them, then the backend
+	test.Equal(t, []string{"urgent", "one", "two", "three"}, bodies)
+
+	// nothing was consumed, and the memory queue kept its order
+	test.Equal(t, int64(4), channel.Depth())
+	test.Equal(t, 2, len(channel.memoryMsgChan))
+	test.Equal(t, "one", string((<-channel.memoryMsgChan).Body))
+	test.Equal(t, "two", string((<-channel.memoryMsgChan).Body))
+}
+
 func TestHTTPgetStatusJSON(t *testing.T) {
 	testTime := time.Now()
 	opts := NewOptions()
@@ -877,10 +1683,15 @@ func TestEmptyChannel(t *testing.T) {
 func TestInfo(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.BroadcastAddress = "nsqd.example.com"
+	opts.BroadcastTCPPort = 14150
 	_, httpAddr, nsqd := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqd.Exit()
 
+	topicName := "test_info" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
 	info := InfoDoc{}
 
 	url := fmt.Sprintf("http://%s/info", httpAddr)
@@ -894,6 +1705,97 @@ func TestInfo(t *testing.T) {
 	err = json.Unmarshal(body, &info)
 	test.Nil(t, err)
 	test.Equal(t, version.Binary, info.Version)
+	test.Equal(t, "nsqd.example.com", info.BroadcastAddress)
+	test.Equal(t, 14150, info.BroadcastTCPPort)
+	test.Equal(t, httpAddr.Port, info.BroadcastHTTPPort)
+	test.Equal(t, httpAddr.Port, info.HTTPPort)
+	test.Equal(t, true, info.Goroutines.Total > 0)
+	test.Equal(t, int64(1), info.Goroutines.Topics[topicName].Goroutines)
+	test.Equal(t, map[string]int64{"ch": 0}, info.Goroutines.Topics[topicName].Channels)
+}
+
+func TestHTTPPprof(t *testing.T) {
+	test.Equal(t, false, NewOptions().PprofEnabled)
+	for _, enabled := range []bool{true, false} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.PprofEnabled = enabled
+		_, httpAddr, nsqd := mustStartNSQD(opts)
+
+		url := fmt.Sprintf("http://%s/debug/pprof/goroutine", httpAddr)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		resp.Body.Close()
+		if enabled {
+			test.Equal(t, 200, resp.StatusCode)
+		} else {
+			test.Equal(t, 404, resp.StatusCode)
+		}
+
+		nsqd.Exit()
+		os.RemoveAll(opts.DataPath)
+	}
+}
+
+func TestHTTPInternals(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_internals" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	for i := 0; len(channel.memoryMsgChan) < 2; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	url := fmt.Sprintf("http://%s/debug/internals?topic=%s", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var internals Internals
+	test.Nil(t, json.Unmarshal(body, &internals))
+	test.Equal(t, true, internals.Goroutines > 0)
+	test.Equal(t, 1, len(internals.Topics))
+
+	topicInternals := internals.Topics[0]
+	test.Equal(t, topicName, topicInternals.TopicName)
+	test.Equal(t, true, topicInternals.MessagePump)
+	test.Equal(t, ChanInternals{0, int(opts.MemQueueSize)}, topicInternals.MemoryMsgChan)
+	test.Equal(t, &BackendInternals{}, topicInternals.Backend)
+	test.Equal(t, 1, len(topicInternals.Channels))
+
+	channelInternals := topicInternals.Channels[0]
+	test.Equal(t, "ch", channelInternals.ChannelName)
+	test.Equal(t, ChanInternals{2, int(opts.MemQueueSize)}, channelInternals.MemoryMsgChan)
+	test.Equal(t, "stopped", channelInternals.OrderedLoop)
+	test.Equal(t, 1, len(channelInternals.Clients))
+	test.Equal(t, "V2", channelInternals.Clients[0].Version)
+	test.Equal(t, true, channelInternals.Clients[0].MessagePump)
+	test.Equal(t, int64(defaultBufferSize), channelInternals.Clients[0].OutputBufferSize)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/debug/internals?topic=missing", httpAddr))
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Nil(t, json.Unmarshal(body, &internals))
+	test.Equal(t, 0, len(internals.Topics))
 }
 
 func BenchmarkHTTPpub(b *testing.B) {
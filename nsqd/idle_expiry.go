@@ -0,0 +1,122 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleSince is when a topic or channel was first seen without clients, and
+// its message count then (a message published or put in it since resets it)
+type idleSince struct {
+	since        time.Time
+	messageCount uint64
+}
+
+// nextIdleSince returns the idleSince of key (a topic or channel) with
+// messageCount, given the previous ones
+func nextIdleSince(prev map[interface{}]idleSince, key interface{},
+	messageCount uint64, now time.Time) idleSince {
+	it, ok := prev[key]
+	if !ok || it.messageCount != messageCount {
+		it = idleSince{since: now, messageCount: messageCount}
+	}
+	return it
+}
+
+// numClients returns the number of clients subscribed to the topic's
+// channels
+func (t *Topic) numClients() int {
+	t.RLock()
+	defer t.RUnlock()
+	var n int
+	for _, c := range t.channelMap {
+		c.RLock()
+		n += len(c.clients)
+		c.RUnlock()
+	}
+	return n
+}
+
+// idleExpiryLoop periodically looks for topics and channels that have had
+// no clients, and no messages published to them, for IdleExpiry and deletes
+// them (with their messages and backend files)
+func (n *NSQD) idleExpiryLoop() {
+	var idle map[interface{}]idleSince
+
+	expiry := n.getOpts().IdleExpiry
+	ticker := time.NewTicker(expiry / 2)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+
+		if atomic.LoadInt32(&n.isLoading) == 1 {
+			continue
+		}
+
+		n.RLock()
+		topics := make([]*Topic, 0, len(n.topicMap))
+		for _, t := range n.topicMap {
+			topics = append(topics, t)
+		}
+		n.RUnlock()
+
+		now := time.Now()
+		prev := idle
+		idle = make(map[interface{}]idleSince)
+		for _, t := range topics {
+			if t.Exiting() || t.numClients() > 0 {
+				continue
+			}
+			it := nextIdleSince(prev, t, atomic.LoadUint64(&t.messageCount), now)
+			if now.Sub(it.since) >= expiry {
+				n.logf(LOG_INFO, "IDLE-EXPIRY: deleting topic %s, idle since %s",
+					t.name, it.since.Format(time.RFC3339))
+				if n.DeleteExistingTopic(t.name) == nil {
+					atomic.AddUint64(&n.expiredTopicCount, 1)
+				}
+				continue
+			}
+			idle[t] = it
+		}
+
+		// the channels of topics that are still in use
+		for _, t := range topics {
+			if t.Exiting() {
+				continue
+			}
+			t.RLock()
+			channels := make([]*Channel, 0, len(t.channelMap))
+			for _, c := range t.channelMap {
+				channels = append(channels, c)
+			}
+			t.RUnlock()
+
+			for _, c := range channels {
+				c.RLock()
+				numClients := len(c.clients)
+				c.RUnlock()
+				if c.Exiting() || numClients > 0 {
+					continue
+				}
+				it := nextIdleSince(prev, c, atomic.LoadUint64(&c.messageCount), now)
+				if now.Sub(it.since) >= expiry {
+					n.logf(LOG_INFO, "IDLE-EXPIRY: deleting channel %s of topic %s, idle since %s",
+						c.name, t.name, it.since.Format(time.RFC3339))
+					if t.DeleteExistingChannel(c.name) == nil {
+						atomic.AddUint64(&n.expiredChannelCount, 1)
+					}
+					continue
+				}
+				idle[c] = it
+			}
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "IDLE-EXPIRY: closing")
+	ticker.Stop()
+}
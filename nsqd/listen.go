@@ -0,0 +1,53 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenTCP listens on addr (of network tcp, tcp4 or tcp6) with SO_REUSEADDR set, so that a restarting nsqd
+// can rebind while connections of the previous process are in TIME_WAIT.
+// If backlog > 0 it replaces the default (somaxconn) accept backlog.
+func listenTCP(network, addr string, backlog int) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if backlog <= 0 {
+		return l, nil
+	}
+
+	// calling listen(2) again on a listening socket updates its backlog
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package nsqd
+
+import (
+	"net"
+)
+
+// listenTCP listens on addr (of network tcp, tcp4 or tcp6). On Windows
+// SO_REUSEADDR allows another socket to steal the port, so it is not set, and
+// the accept backlog is not tunable.
+func listenTCP(network, addr string, backlog int) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
@@ -20,6 +20,9 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 		ci["http_port"] = n.getOpts().BroadcastHTTPPort
 		ci["hostname"] = hostname
 		ci["broadcast_address"] = n.getOpts().BroadcastAddress
+		ci["node_id"] = n.getOpts().ID
+		ci["tcp_addresses"] = n.TCPAddrs()
+		ci["http_addresses"] = n.HTTPAddrs()
 
 		cmd, err := nsq.Identify(ci)
 		if err != nil {
@@ -34,6 +37,10 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 			n.logf(LOG_INFO, "LOOKUPD(%s): lookupd returned %s", lp, resp)
 			lp.Close()
 			return
+		} else if bytes.HasPrefix(resp, []byte("E_DUPLICATE_NODE_ID")) {
+			n.logf(LOG_ERROR, "LOOKUPD(%s): %s (set a unique --node-id)", lp, resp)
+			lp.Close()
+			return
 		} else {
 			err = json.Unmarshal(resp, &lp.Info)
 			if err != nil {
@@ -48,6 +55,11 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 			}
 		}
 
+		if n.IsDraining() {
+			// the node's topics aren't advertised anymore, see Drain
+			return
+		}
+
 		// build all the commands first so we exit the lock(s) as fast as possible
 		var commands []*nsq.Command
 		n.RLock()
@@ -79,6 +91,7 @@ func (n *NSQD) lookupLoop() {
 	var lookupPeers []*lookupPeer
 	var lookupAddrs []string
 	connect := true
+	drainChan := n.drainChan
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -127,7 +140,7 @@ func (n *NSQD) lookupLoop() {
 				channel := val.(*Channel)
 				if channel.Exiting() == true {
 					cmd = nsq.UnRegister(channel.topicName, channel.name)
-				} else {
+				} else if !n.IsDraining() {
 					cmd = nsq.Register(channel.topicName, channel.name)
 				}
 			case *Topic:
@@ -136,10 +149,13 @@ func (n *NSQD) lookupLoop() {
 				topic := val.(*Topic)
 				if topic.Exiting() == true {
 					cmd = nsq.UnRegister(topic.name, "")
-				} else {
+				} else if !n.IsDraining() {
 					cmd = nsq.Register(topic.name, "")
 				}
 			}
+			if cmd == nil {
+				continue
+			}
 
 			for _, lookupPeer := range lookupPeers {
 				n.logf(LOG_INFO, "LOOKUPD(%s): %s %s", lookupPeer, branch, cmd)
@@ -148,6 +164,25 @@ func (n *NSQD) lookupLoop() {
 					n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
 				}
 			}
+		case <-drainChan:
+			// stop advertising the node's topics (which unregisters their
+			// channels too), so that no new consumers find it
+			drainChan = nil
+			var commands []*nsq.Command
+			n.RLock()
+			for _, topic := range n.topicMap {
+				commands = append(commands, nsq.UnRegister(topic.name, ""))
+			}
+			n.RUnlock()
+			for _, lookupPeer := range lookupPeers {
+				for _, cmd := range commands {
+					n.logf(LOG_INFO, "LOOKUPD(%s): drain %s", lookupPeer, cmd)
+					_, err := lookupPeer.Command(cmd)
+					if err != nil {
+						n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+					}
+				}
+			}
 		case <-n.optsNotificationChan:
 			var tmpPeers []*lookupPeer
 			var tmpAddrs []string
@@ -0,0 +1,147 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+)
+
+// errMemoryQueueFull is returned by the memory backend for messages beyond
+// its --memory-backend-size
+var errMemoryQueueFull = errors.New("memory queue full")
+
+// memoryBackendQueue is the "memory" backend, a bounded FIFO queue of the
+// messages beyond a topic's or channel's memory queue. It keeps them only in
+// memory, so they're lost when nsqd exits.
+type memoryBackendQueue struct {
+	sync.RWMutex
+	msgs    [][]byte
+	maxSize int
+	exiting bool
+
+	readChan  chan []byte
+	writeChan chan struct{} // signals ioLoop that there are msgs
+	emptyChan chan chan struct{}
+	exitChan  chan struct{}
+	exitOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func newMemoryBackend(name string, dataPath string, opts *Options) BackendQueue {
+	m := &memoryBackendQueue{
+		maxSize:   int(opts.MemoryBackendSize),
+		readChan:  make(chan []byte),
+		writeChan: make(chan struct{}, 1),
+		emptyChan: make(chan chan struct{}),
+		exitChan:  make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.ioLoop()
+	return m
+}
+
+func (m *memoryBackendQueue) Put(data []byte) error {
+	return m.PutBatch([][]byte{data})
+}
+
+// PutBatch queues all of data, or (when there isn't room for all of it)
+// none
+func (m *memoryBackendQueue) PutBatch(data [][]byte) error {
+	m.Lock()
+	if m.exiting {
+		m.Unlock()
+		return errors.New("exiting")
+	}
+	if len(m.msgs)+len(data) > m.maxSize {
+		m.Unlock()
+		return errMemoryQueueFull
+	}
+	for _, d := range data {
+		// the caller's buffer is reused
+		b := make([]byte, len(d))
+		copy(b, d)
+		m.msgs = append(m.msgs, b)
+	}
+	m.Unlock()
+
+	select {
+	case m.writeChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (m *memoryBackendQueue) ReadChan() <-chan []byte {
+	return m.readChan
+}
+
+func (m *memoryBackendQueue) Close() error {
+	return m.exit()
+}
+
+func (m *memoryBackendQueue) Delete() error {
+	return m.exit()
+}
+
+func (m *memoryBackendQueue) exit() error {
+	m.exitOnce.Do(func() {
+		m.Lock()
+		m.exiting = true
+		m.Unlock()
+		close(m.exitChan)
+		m.wg.Wait()
+	})
+	return nil
+}
+
+// Depth returns the number of messages queued, a message counts until it's
+// been read from ReadChan
+func (m *memoryBackendQueue) Depth() int64 {
+	m.RLock()
+	defer m.RUnlock()
+	return int64(len(m.msgs))
+}
+
+// Empty drops every queued message
+func (m *memoryBackendQueue) Empty() error {
+	done := make(chan struct{})
+	select {
+	case m.emptyChan <- done:
+	case <-m.exitChan:
+		return errors.New("exiting")
+	}
+	<-done
+	return nil
+}
+
+// ioLoop hands the queued messages to ReadChan in order, it's the only one
+// to remove them from msgs
+func (m *memoryBackendQueue) ioLoop() {
+	defer m.wg.Done()
+
+	for {
+		var r chan []byte
+		var next []byte
+		m.RLock()
+		if len(m.msgs) > 0 {
+			r = m.readChan
+			next = m.msgs[0]
+		}
+		m.RUnlock()
+
+		select {
+		case r <- next:
+			m.Lock()
+			m.msgs[0] = nil
+			m.msgs = m.msgs[1:]
+			m.Unlock()
+		case <-m.writeChan:
+		case done := <-m.emptyChan:
+			m.Lock()
+			m.msgs = nil
+			m.Unlock()
+			close(done)
+		case <-m.exitChan:
+			return
+		}
+	}
+}
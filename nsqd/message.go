@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"time"
+
+	"github.com/nsqio/nsq/internal/pqueue"
 )
 
 const (
@@ -19,6 +21,8 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+	Headers   map[string]string // nil for none, see msgHeadersFlag
+	Priority  uint8             // PriorityNormal or PriorityHigh
 
 	// for in-flight handling
 	deliveryTS time.Time
@@ -26,6 +30,12 @@ type Message struct {
 	pri        int64
 	index      int
 	deferred   time.Duration
+	warning    *pqueue.Item // pending timeout warning
+	warned     bool         // a timeout warning was sent
+
+	// for --message-pool
+	pooled bool
+	body   *messageBody
 }
 
 func NewMessage(id MessageID, body []byte) *Message {
@@ -36,12 +46,27 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// WriteTo writes m, with its headers (and priority), as it's stored
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return m.encode(w, true, m.storedHeaders())
+}
+
+// writeTo writes m in the encoding with headers or, for clients that
+// didn't IDENTIFY with msg_headers, the original one (without them)
+func (m *Message) writeTo(w io.Writer, withHeaders bool) (int64, error) {
+	return m.encode(w, withHeaders, m.Headers)
+}
+
+func (m *Message) encode(w io.Writer, withHeaders bool, headers map[string]string) (int64, error) {
 	var buf [10]byte
 	var total int64
 
-	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
-	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
+	timestamp := uint64(m.Timestamp)
+	if withHeaders && len(headers) > 0 {
+		timestamp |= msgHeadersFlag
+	}
+	binary.BigEndian.PutUint64(buf[:8], timestamp)
+	binary.BigEndian.PutUint16(buf[8:10], m.Attempts)
 
 	n, err := w.Write(buf[:])
 	total += int64(n)
@@ -55,6 +80,14 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if timestamp&msgHeadersFlag != 0 {
+		hn, err := writeHeaders(w, headers)
+		total += hn
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(m.Body)
 	total += int64(n)
 	if err != nil {
@@ -74,19 +107,47 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                        (uint16)
 //                         2-byte
 //                        attempts
+//
+// (with msgHeadersFlag set in the timestamp, a header block follows the ID)
 func decodeMessage(b []byte) (*Message, error) {
 	var msg Message
+	err := decodeMessageTo(&msg, b)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
 
+// decodeMessageTo is decodeMessage into msg, whose Body aliases b
+func decodeMessageTo(msg *Message, b []byte) error {
 	if len(b) < minValidMsgLength {
-		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+		return fmt.Errorf("invalid message buffer size (%d)", len(b))
 	}
 
-	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	timestamp := binary.BigEndian.Uint64(b[:8])
+	msg.Timestamp = int64(timestamp &^ msgHeadersFlag)
 	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
 	copy(msg.ID[:], b[10:10+MsgIDLength])
 	msg.Body = b[10+MsgIDLength:]
 
-	return &msg, nil
+	if timestamp&msgHeadersFlag != 0 {
+		headers, body, err := readHeaders(msg.Body)
+		if err != nil {
+			return err
+		}
+		msg.Headers = headers
+		msg.Body = body
+		msg.takePriorityHeader()
+	}
+
+	return nil
+}
+
+// maxStoredMsgSize returns the size limit of a stored message (see WriteTo),
+// whose body can be --max-msg-size with headers of up to maxHeadersSize on
+// top (as /pub and /mpub take them besides the body)
+func maxStoredMsgSize(opts *Options) int32 {
+	return int32(opts.MaxMsgSize) + minValidMsgLength + 2 + maxHeadersSize
 }
 
 func writeMessageToBackend(msg *Message, bq BackendQueue) error {
@@ -98,3 +159,26 @@ func writeMessageToBackend(msg *Message, bq BackendQueue) error {
 	}
 	return bq.Put(buf.Bytes())
 }
+
+// writeMessagesToBackend writes all of msgs to bq, or (on error) none if bq
+// supports batches (see backendPutBatch)
+func writeMessagesToBackend(msgs []*Message, bq BackendQueue) error {
+	buf := bufferPoolGet()
+	defer bufferPoolPut(buf)
+	ends := make([]int, len(msgs))
+	for i, msg := range msgs {
+		_, err := msg.WriteTo(buf)
+		if err != nil {
+			return err
+		}
+		ends[i] = buf.Len()
+	}
+	b := buf.Bytes()
+	batch := make([][]byte, len(msgs))
+	start := 0
+	for i, end := range ends {
+		batch[i] = b[start:end]
+		start = end
+	}
+	return backendPutBatch(bq, batch)
+}
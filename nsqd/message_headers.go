@@ -0,0 +1,177 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// msgHeadersFlag is set in the timestamp of an encoded message that has a
+// header block after its ID:
+//
+//    [2-byte block length][2-byte key length][key][2-byte value length][value]...
+//
+// messages are encoded that way on disk, and to and from clients that
+// IDENTIFY with msg_headers (for which PUB, DPUB and MPUB message bodies
+// start with a header block, of length 0 for none).
+//
+// It's the sign bit, which no version of nsqd sets in a timestamp (of
+// time.Now().UnixNano()), so records written before headers existed can't
+// be mistaken for ones with a header block, whatever their attempts.
+const (
+	msgHeadersFlag = 1 << 63
+	maxHeadersSize = 1<<16 - 1
+)
+
+var errHeadersTooBig = fmt.Errorf("headers longer than %d bytes", maxHeadersSize)
+
+// reservedHeaderPrefix starts the keys nsqd keeps for itself in the stored
+// header block (see msgPriorityHeader)
+const reservedHeaderPrefix = "\x00"
+
+// maxPublishedHeadersSize leaves room in the stored header block for the
+// priority nsqd adds to it (a uint8, see Message.storedHeaders)
+const maxPublishedHeadersSize = maxHeadersSize - (2 + len(msgPriorityHeader) + 2 + 3)
+
+// checkPublishedHeaders returns an error if a client can't publish headers
+func checkPublishedHeaders(headers map[string]string) error {
+	if headersSize(headers) > maxPublishedHeadersSize {
+		return fmt.Errorf("headers longer than %d bytes", maxPublishedHeadersSize)
+	}
+	for k := range headers {
+		if strings.HasPrefix(k, reservedHeaderPrefix) {
+			return fmt.Errorf("reserved header key %q", k)
+		}
+	}
+	return nil
+}
+
+// headersSize returns the length of the header block for headers
+func headersSize(headers map[string]string) int {
+	n := 0
+	for k, v := range headers {
+		n += 2 + len(k) + 2 + len(v)
+	}
+	return n
+}
+
+// writeHeaders writes the header block for headers, with its length
+func writeHeaders(w io.Writer, headers map[string]string) (int64, error) {
+	size := headersSize(headers)
+	if size > maxHeadersSize {
+		return 0, errHeadersTooBig
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 2, 2+size)
+	binary.BigEndian.PutUint16(buf, uint16(size))
+	for _, k := range keys {
+		buf = appendHeaderString(buf, k)
+		buf = appendHeaderString(buf, headers[k])
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func appendHeaderString(buf []byte, s string) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(s)))
+	return append(append(buf, l[:]...), s...)
+}
+
+// readHeaders parses the header block (with its length) at the start of b,
+// returning the headers (nil for none) and the rest of b
+func readHeaders(b []byte) (map[string]string, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("missing headers length")
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < size {
+		return nil, nil, fmt.Errorf("invalid headers length (%d)", size)
+	}
+	block, rest := b[:size], b[size:]
+
+	var headers map[string]string
+	for len(block) > 0 {
+		var k, v string
+		var err error
+		k, block, err = readHeaderString(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, block, err = readHeaderString(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		if k == "" {
+			return nil, nil, errors.New("empty header key")
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[k] = v
+	}
+	return headers, rest, nil
+}
+
+func readHeaderString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated headers")
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", nil, errors.New("truncated headers")
+	}
+	return string(b[2 : 2+l]), b[2+l:], nil
+}
+
+// msgFilter is the filter a client SUBscribed with, it only gets the
+// messages whose headers match all of its terms
+type msgFilter []filterTerm
+
+type filterTerm struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// parseMsgFilter parses a comma separated list of key=value and
+// key!=value terms (a message without the header doesn't match key=value)
+func parseMsgFilter(s string) (msgFilter, error) {
+	var f msgFilter
+	for _, term := range strings.Split(s, ",") {
+		var t filterTerm
+		i := strings.Index(term, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid filter term %q", term)
+		}
+		t.key, t.value = term[:i], term[i+1:]
+		if strings.HasSuffix(t.key, "!") {
+			t.key = t.key[:len(t.key)-1]
+			t.negate = true
+		}
+		if t.key == "" {
+			return nil, fmt.Errorf("invalid filter term %q", term)
+		}
+		f = append(f, t)
+	}
+	return f, nil
+}
+
+func (f msgFilter) match(headers map[string]string) bool {
+	for _, t := range f {
+		v, ok := headers[t.key]
+		if (ok && v == t.value) == t.negate {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessageHeadersRoundTrip(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+
+	msg := NewMessage(id, []byte("body"))
+	msg.Attempts = 3
+	msg.Headers = map[string]string{"type": "order", "trace-id": "abc", "empty": ""}
+
+	buf := &bytes.Buffer{}
+	_, err := msg.WriteTo(buf)
+	test.Nil(t, err)
+	out, err := decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, msg.ID, out.ID)
+	test.Equal(t, msg.Timestamp, out.Timestamp)
+	test.Equal(t, uint16(3), out.Attempts)
+	test.Equal(t, msg.Headers, out.Headers)
+	test.Equal(t, []byte("body"), out.Body)
+
+	// without headers, and for clients that didn't ask for them, the
+	// encoding is the original one
+	buf.Reset()
+	_, err = msg.writeTo(buf, false)
+	test.Nil(t, err)
+	test.Equal(t, 10+MsgIDLength+len("body"), buf.Len())
+	out, err = decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, 0, len(out.Headers))
+	test.Equal(t, []byte("body"), out.Body)
+
+	msg.Headers = nil
+	buf.Reset()
+	_, err = msg.WriteTo(buf)
+	test.Nil(t, err)
+	test.Equal(t, 10+MsgIDLength+len("body"), buf.Len())
+
+	_, _, err = readHeaders([]byte{0, 5, 0, 1})
+	test.NotNil(t, err)
+
+	// attempts aren't limited by the encoding with headers
+	msg.Attempts = 40000
+	msg.Headers = map[string]string{"type": "order"}
+	buf.Reset()
+	_, err = msg.WriteTo(buf)
+	test.Nil(t, err)
+	out, err = decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, uint16(40000), out.Attempts)
+	test.Equal(t, msg.Timestamp, out.Timestamp)
+	test.Equal(t, msg.Headers, out.Headers)
+}
+
+func TestMessageHeadersOldRecord(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+
+	// a record written before headers, whatever its attempts, has none
+	b := make([]byte, 10, 10+MsgIDLength+4)
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(b[8:10], 1<<15|3)
+	b = append(append(b, id[:]...), 0, 5, 0, 1)
+	out, err := decodeMessage(b)
+	test.Nil(t, err)
+	test.Equal(t, uint16(1<<15|3), out.Attempts)
+	test.Equal(t, 0, len(out.Headers))
+	test.Equal(t, []byte{0, 5, 0, 1}, out.Body)
+}
+
+func TestMsgFilter(t *testing.T) {
+	headers := map[string]string{"type": "order", "region": "us"}
+
+	for _, c := range []struct {
+		filter string
+		match  bool
+	}{
+		{"type=order", true},
+		{"type=refund", false},
+		{"type=order,region=us", true},
+		{"type=order,region!=us", false},
+		{"type=order,region!=eu", true},
+		{"missing=x", false},
+		{"missing!=x", true},
+	} {
+		f, err := parseMsgFilter(c.filter)
+		test.Nil(t, err)
+		test.Equal(t, c.match, f.match(headers))
+	}
+
+	for _, s := range []string{"", "type", "=order", "!=order", "type=order,"} {
+		_, err := parseMsgFilter(s)
+		test.NotNil(t, err)
+	}
+}
@@ -0,0 +1,144 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// with --message-pool, Message structs and small message bodies are
+// recycled once a message has been FIN'd (see Message.release)
+
+const (
+	minPooledBodySize = 64
+	maxPooledBodySize = 4096
+)
+
+var mp sync.Pool
+
+// bodyPools[i] holds buffers of minPooledBodySize<<i bytes
+var bodyPools [7]sync.Pool
+
+func init() {
+	mp.New = func() interface{} {
+		return &Message{}
+	}
+}
+
+// messageBody is a pooled buffer backing a message's Body, it is shared by
+// the copies of the message delivered to each channel
+type messageBody struct {
+	refs int32
+	buf  []byte
+}
+
+func bodyPoolIndex(size int) int {
+	i := 0
+	for n := minPooledBodySize; n < size; n <<= 1 {
+		i++
+	}
+	return i
+}
+
+// newMessageBody returns a buffer of size bytes for a message body, taken
+// from bodyPools if pooled is set and size is small enough (in which case
+// the pooled buffer is returned too, to be passed on to newMessage)
+func newMessageBody(size int, pooled bool) ([]byte, *messageBody) {
+	if !pooled || size > maxPooledBodySize {
+		return make([]byte, size), nil
+	}
+	i := bodyPoolIndex(size)
+	b, _ := bodyPools[i].Get().(*messageBody)
+	if b == nil {
+		b = &messageBody{buf: make([]byte, minPooledBodySize<<uint(i))}
+	}
+	b.refs = 1
+	return b.buf[:size], b
+}
+
+func (b *messageBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		bodyPools[bodyPoolIndex(cap(b.buf))].Put(b)
+	}
+}
+
+// newMessage is NewMessage, taking the Message from the pool if pooled is set.
+// pb is the pooled buffer backing body (from newMessageBody), if any.
+func newMessage(id MessageID, body []byte, pb *messageBody, pooled bool) *Message {
+	if !pooled {
+		return NewMessage(id, body)
+	}
+	m := mp.Get().(*Message)
+	m.ID = id
+	m.Body = body
+	m.Timestamp = time.Now().UnixNano()
+	m.pooled = true
+	m.body = pb
+	return m
+}
+
+// decodeBackendMessage decodes b, read from backend. With pooled set the
+// Message is taken from the pool and, when backend can take b back for
+// reuse (see diskqueue's Recycle), a small body is copied to a pooled one
+// so b can be handed back.
+func decodeBackendMessage(backend BackendQueue, b []byte, pooled bool) (*Message, error) {
+	if !pooled {
+		return decodeMessage(b)
+	}
+	m := mp.Get().(*Message)
+	m.pooled = true
+	err := decodeMessageTo(m, b)
+	if err != nil {
+		m.release()
+		return nil, err
+	}
+	r, ok := backend.(interface {
+		Recycle([]byte)
+	})
+	if !ok || len(m.Body) > maxPooledBodySize {
+		return m, nil
+	}
+	body, pb := newMessageBody(len(m.Body), true)
+	copy(body, m.Body)
+	m.Body = body
+	m.body = pb
+	r.Recycle(b)
+	return m, nil
+}
+
+// copy returns a new instance of m (sharing its Body) for another channel
+func (m *Message) copy() *Message {
+	c := newMessage(m.ID, m.Body, m.body, m.pooled)
+	if m.body != nil {
+		atomic.AddInt32(&m.body.refs, 1)
+	}
+	c.Timestamp = m.Timestamp
+	c.Headers = m.Headers
+	c.Priority = m.Priority
+	c.deferred = m.deferred
+	return c
+}
+
+// clone returns a new instance of m, with its own copy of Body, for another channel
+func (m *Message) clone() *Message {
+	body, pb := newMessageBody(len(m.Body), m.pooled)
+	copy(body, m.Body)
+	c := newMessage(m.ID, body, pb, m.pooled)
+	c.Timestamp = m.Timestamp
+	c.Headers = m.Headers
+	c.Priority = m.Priority
+	c.deferred = m.deferred
+	return c
+}
+
+// release returns m, and its share of a pooled body, to the pools.
+// m must not be used afterwards. It is a no-op for unpooled messages.
+func (m *Message) release() {
+	if m.body != nil {
+		m.body.release()
+	}
+	if m.pooled {
+		*m = Message{}
+		mp.Put(m)
+	}
+}
@@ -0,0 +1,253 @@
+package nsqd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessagePoolRelease(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+
+	body, pb := newMessageBody(100, true)
+	test.NotNil(t, pb)
+	test.Equal(t, 100, len(body))
+	test.Equal(t, 128, cap(body))
+	copy(body, bytes.Repeat([]byte("a"), 100))
+
+	msg := newMessage(id, body, pb, true)
+	msg.Attempts = 3
+	msg.deliveryTS = time.Now()
+	msg.clientID = 42
+	msg.pri = 1234
+	msg.index = 7
+	msg.deferred = time.Second
+
+	chanMsg := msg.copy()
+	test.Equal(t, msg.ID, chanMsg.ID)
+	test.Equal(t, msg.Timestamp, chanMsg.Timestamp)
+	test.Equal(t, uint16(0), chanMsg.Attempts)
+	test.Equal(t, int32(2), pb.refs)
+
+	// the body is still referenced by chanMsg
+	msg.release()
+	test.Equal(t, true, reflect.DeepEqual(Message{}, *msg))
+	test.Equal(t, int32(1), pb.refs)
+	test.Equal(t, bytes.Repeat([]byte("a"), 100), chanMsg.Body)
+
+	chanMsg.release()
+	test.Equal(t, true, reflect.DeepEqual(Message{}, *chanMsg))
+	test.Equal(t, int32(0), pb.refs)
+
+	// unpooled
+	body, pb = newMessageBody(100, false)
+	test.Nil(t, pb)
+	test.Equal(t, 100, cap(body))
+	body, pb = newMessageBody(maxPooledBodySize+1, true)
+	test.Nil(t, pb)
+	msg = newMessage(id, body, pb, false)
+	msg.release()
+	test.Equal(t, id, msg.ID)
+}
+
+func TestMessageClone(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+
+	for _, pooled := range []bool{false, true} {
+		body, pb := newMessageBody(100, pooled)
+		copy(body, bytes.Repeat([]byte("a"), 100))
+		msg := newMessage(id, body, pb, pooled)
+		msg.deferred = time.Second
+
+		chanMsg := msg.clone()
+		test.Equal(t, msg.ID, chanMsg.ID)
+		test.Equal(t, msg.Timestamp, chanMsg.Timestamp)
+		test.Equal(t, msg.deferred, chanMsg.deferred)
+		test.Equal(t, msg.Body, chanMsg.Body)
+		test.Equal(t, false, &msg.Body[0] == &chanMsg.Body[0])
+		if pooled {
+			test.Equal(t, int32(1), pb.refs)
+			test.Equal(t, int32(1), chanMsg.body.refs)
+		}
+
+		// modifying (or releasing) one doesn't affect the other
+		msg.Body[0] = 'b'
+		test.Equal(t, byte('a'), chanMsg.Body[0])
+		msg.release()
+		test.Equal(t, bytes.Repeat([]byte("a"), 100), chanMsg.Body)
+		chanMsg.release()
+	}
+}
+
+type recyclingBackendQueue struct {
+	dummyBackendQueue
+	recycled [][]byte
+}
+
+func (d *recyclingBackendQueue) Recycle(b []byte) { d.recycled = append(d.recycled, b) }
+
+func TestDecodeBackendMessage(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := NewMessage(id, bytes.Repeat([]byte("a"), 100))
+	msg.Attempts = 2
+	msg.Headers = map[string]string{"k": "v"}
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	test.Nil(t, err)
+
+	for _, pooled := range []bool{false, true} {
+		backend := &recyclingBackendQueue{}
+		b := append([]byte(nil), buf.Bytes()...)
+		decoded, err := decodeBackendMessage(backend, b, pooled)
+		test.Nil(t, err)
+		test.Equal(t, msg.ID, decoded.ID)
+		test.Equal(t, msg.Timestamp, decoded.Timestamp)
+		test.Equal(t, msg.Attempts, decoded.Attempts)
+		test.Equal(t, msg.Headers, decoded.Headers)
+		test.Equal(t, msg.Body, decoded.Body)
+		test.Equal(t, pooled, decoded.pooled)
+		if !pooled {
+			test.Equal(t, 0, len(backend.recycled))
+			continue
+		}
+		// b was handed back, the body is a copy
+		test.Equal(t, 1, len(backend.recycled))
+		test.NotNil(t, decoded.body)
+		b[len(b)-1] = 'b'
+		test.Equal(t, msg.Body, decoded.Body)
+		decoded.release()
+	}
+
+	// a body too big to pool stays in the backend's buffer
+	backend := &recyclingBackendQueue{}
+	msg.Body = make([]byte, maxPooledBodySize+1)
+	buf.Reset()
+	_, err = msg.WriteTo(&buf)
+	test.Nil(t, err)
+	decoded, err := decodeBackendMessage(backend, buf.Bytes(), true)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(backend.recycled))
+	test.Equal(t, true, decoded.body == nil)
+
+	_, err = decodeBackendMessage(backend, []byte("short"), true)
+	test.NotNil(t, err)
+}
+
+func TestMessagePoolChannels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MessagePool = true
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_message_pool" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch1 := topic.GetChannel("ch1")
+	ch2 := topic.GetChannel("ch2")
+
+	put := func(i int) {
+		body, pb := newMessageBody(10, true)
+		copy(body, []byte("msg "+strconv.Itoa(i)))
+		topic.PutMessage(newMessage(topic.GenerateID(), body, pb, true))
+	}
+
+	// FIN everything on ch1 (releasing it) while ch2 still holds its copies,
+	// then publish more messages that may reuse the released buffers
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			put(round*100 + i)
+		}
+		for i := 0; i < 100; i++ {
+			msg := <-ch1.memoryMsgChan
+			ch1.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+			test.Nil(t, ch1.FinishMessage(0, msg.ID))
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		msg := <-ch2.memoryMsgChan
+		expected := make([]byte, 10)
+		copy(expected, []byte("msg "+strconv.Itoa(i)))
+		test.Equal(t, expected, msg.Body)
+	}
+}
+
+func BenchmarkTopicToChannelFin(b *testing.B) {
+	benchmarkTopicToChannelFin(b, false)
+}
+
+func BenchmarkTopicToChannelFinPooled(b *testing.B) {
+	benchmarkTopicToChannelFin(b, true)
+}
+
+func benchmarkTopicToChannelFin(b *testing.B, pooled bool) {
+	b.StopTimer()
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	opts.MessagePool = pooled
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	topic := nsqd.GetTopic("bench_topic_to_channel_fin" + strconv.Itoa(b.N))
+	channel := topic.GetChannel("bench")
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		body, pb := newMessageBody(100, pooled)
+		topic.PutMessage(newMessage(topic.GenerateID(), body, pb, pooled))
+		msg := <-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+		channel.FinishMessage(0, msg.ID)
+	}
+}
+
+func BenchmarkDecodeBackendMessage(b *testing.B) {
+	benchmarkDecodeBackendMessage(b, false)
+}
+
+func BenchmarkDecodeBackendMessagePooled(b *testing.B) {
+	benchmarkDecodeBackendMessage(b, true)
+}
+
+// a diskqueue read, decoded and FIN'd
+func benchmarkDecodeBackendMessage(b *testing.B, pooled bool) {
+	b.StopTimer()
+	l := func(lvl diskqueue.LogLevel, f string, args ...interface{}) {}
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := diskqueue.New("bench_decode_backend_message", tmpDir, 1024768, minValidMsgLength, 1<<20,
+		2500, 2*time.Second, 0, diskqueue.FormatLengthPrefixed, nil, l)
+	defer dq.Close()
+
+	var id MessageID
+	var buf bytes.Buffer
+	NewMessage(id, make([]byte, 1024)).WriteTo(&buf)
+	for i := 0; i < b.N; i++ {
+		dq.Put(buf.Bytes())
+	}
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg, err := decodeBackendMessage(dq, <-dq.ReadChan(), pooled)
+		if err != nil {
+			panic(err)
+		}
+		msg.release()
+	}
+}
@@ -0,0 +1,140 @@
+package nsqd
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// listenAll listens on each of the comma separated addrs (see listen),
+// returning a listener accepting connections from all of them
+func listenAll(addrs string, backlog int, perm os.FileMode) (net.Listener, error) {
+	var split []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			split = append(split, addr)
+		}
+	}
+	if len(split) <= 1 {
+		return listen("tcp", strings.TrimSpace(addrs), backlog, perm)
+	}
+
+	var listeners []net.Listener
+	for _, addr := range split {
+		l, err := listen(tcpNetwork(addr), addr, backlog, perm)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return newMultiListener(listeners), nil
+}
+
+// tcpNetwork returns tcp4 or tcp6 for an addr with an IPv4 or IPv6 host, so
+// that 0.0.0.0:4150 and [::]:4150 (which would otherwise both be dual-stack)
+// can be listened on together, or tcp for a hostname
+func tcpNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "tcp"
+	}
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts the connections of several listeners
+type multiListener struct {
+	listeners  []net.Listener
+	acceptChan chan acceptResult
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners:  listeners,
+		acceptChan: make(chan acceptResult),
+		closeChan:  make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.acceptLoop(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case ml.acceptChan <- acceptResult{conn, err}:
+		case <-ml.closeChan:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.acceptChan:
+		return r.conn, r.err
+	case <-ml.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.closeChan)
+		for _, l := range ml.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// listenerAddrs returns every address l listens on
+func listenerAddrs(l net.Listener) []string {
+	if l == nil {
+		return nil
+	}
+	ml, ok := l.(*multiListener)
+	if !ok {
+		return []string{l.Addr().String()}
+	}
+	addrs := make([]string, 0, len(ml.listeners))
+	for _, l := range ml.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
@@ -0,0 +1,302 @@
+package nsqd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// ErrNamespaceTopicLimit is returned by admitTopic when creating a topic
+// would take its namespace over max_topics
+var ErrNamespaceTopicLimit = errors.New("namespace topic limit reached")
+
+// ErrNamespaceQuotaExceeded is returned by admitPublish when a topic's
+// namespace is at its max_disk_bytes
+var ErrNamespaceQuotaExceeded = errors.New("namespace disk quota exceeded")
+
+// namespaceSeparator separates a topic's namespace from the rest of its
+// name. It has to be valid in topic names, which clients check too.
+const namespaceSeparator = "."
+
+// how long a namespace's disk usage is cached for, see diskUsage
+const namespaceDiskUsageTTL = time.Second
+
+// namespaceConfig is a --namespace: the topics named <Name>.<topic> (and
+// their channels) share its quotas, 0 for no limit, and if Identities are
+// given only clients with one of them may publish or subscribe to them
+type namespaceConfig struct {
+	Name           string   `json:"name"`
+	MaxTopics      int      `json:"max_topics"`
+	MaxDiskBytes   int64    `json:"max_disk_bytes"`
+	MaxPublishRate int64    `json:"max_publish_rate"`
+	Identities     []string `json:"identities"`
+}
+
+type namespace struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	rateLimitedCount   uint64
+	quotaExceededCount uint64
+	topicLimitCount    uint64
+
+	namespaceConfig
+	publishLimit tokenBucket
+
+	diskMtx     sync.Mutex
+	diskBytes   int64
+	diskUpdated time.Time
+}
+
+// parseNamespaces returns the namespaces of --namespace values, JSON
+// objects like
+// {"name":"orders","max_topics":100,"max_disk_bytes":10737418240,"max_publish_rate":5000,"identities":["orders.example.com"]}
+// by name, or nil if there are none
+func parseNamespaces(values []string) (map[string]*namespace, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	namespaces := make(map[string]*namespace)
+	for _, v := range values {
+		ns := &namespace{}
+		dec := json.NewDecoder(strings.NewReader(v))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&ns.namespaceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%q is invalid - %s", v, err)
+		}
+		if !protocol.IsValidTopicName(ns.Name) || strings.Contains(ns.Name, namespaceSeparator) ||
+			strings.HasSuffix(ns.Name, "#ephemeral") {
+			return nil, fmt.Errorf("%q has invalid name %q", v, ns.Name)
+		}
+		if _, ok := namespaces[ns.Name]; ok {
+			return nil, fmt.Errorf("%q is a duplicate of namespace %q", v, ns.Name)
+		}
+		if ns.MaxTopics < 0 || ns.MaxDiskBytes < 0 || ns.MaxPublishRate < 0 {
+			return nil, fmt.Errorf("%q has a negative limit", v)
+		}
+		ns.publishLimit.setRate(ns.MaxPublishRate)
+		namespaces[ns.Name] = ns
+	}
+	return namespaces, nil
+}
+
+// namespaceOf returns the namespace of the topic topicName, nil if it isn't
+// in one
+func (n *NSQD) namespaceOf(topicName string) *namespace {
+	i := strings.Index(topicName, namespaceSeparator)
+	if i < 0 {
+		return nil
+	}
+	return n.namespaces[topicName[:i]]
+}
+
+// Namespace returns the name of the topic's namespace, "" if it isn't in one
+func (t *Topic) Namespace() string {
+	if ns := t.nsqd.namespaceOf(t.name); ns != nil {
+		return ns.Name
+	}
+	return ""
+}
+
+// namespaceTopics returns the topics of ns
+func (n *NSQD) namespaceTopics(ns *namespace) []*Topic {
+	var topics []*Topic
+	n.RLock()
+	for name, t := range n.topicMap {
+		if n.namespaceOf(name) == ns {
+			topics = append(topics, t)
+		}
+	}
+	n.RUnlock()
+	return topics
+}
+
+// admitTopic checks the creation of the topic topicName, unless it already
+// exists, against the max_topics of its namespace, returning
+// ErrNamespaceTopicLimit if it's over
+func (n *NSQD) admitTopic(topicName string) error {
+	ns := n.namespaceOf(topicName)
+	if ns == nil || ns.MaxTopics == 0 {
+		return nil
+	}
+	n.RLock()
+	_, exists := n.topicMap[topicName]
+	n.RUnlock()
+	if exists || len(n.namespaceTopics(ns)) < ns.MaxTopics {
+		return nil
+	}
+	atomic.AddUint64(&ns.topicLimitCount, 1)
+	return ErrNamespaceTopicLimit
+}
+
+// admitPublish checks a publish of count messages to one of the
+// namespace's topics against its max_publish_rate and max_disk_bytes,
+// returning ErrRateLimited or ErrNamespaceQuotaExceeded if it's over either
+func (ns *namespace) admitPublish(n *NSQD, count int) error {
+	if !ns.publishLimit.allow(count) {
+		atomic.AddUint64(&ns.rateLimitedCount, uint64(count))
+		return ErrRateLimited
+	}
+	if ns.MaxDiskBytes > 0 && ns.diskUsage(n) >= ns.MaxDiskBytes {
+		atomic.AddUint64(&ns.quotaExceededCount, uint64(count))
+		return ErrNamespaceQuotaExceeded
+	}
+	return nil
+}
+
+// diskUsage returns the size of the diskqueue files of the namespace's
+// topics and channels, as of at most namespaceDiskUsageTTL ago
+func (ns *namespace) diskUsage(n *NSQD) int64 {
+	ns.diskMtx.Lock()
+	defer ns.diskMtx.Unlock()
+	if time.Since(ns.diskUpdated) < namespaceDiskUsageTTL {
+		return ns.diskBytes
+	}
+	var diskBytes int64
+	for _, t := range n.namespaceTopics(ns) {
+		diskBytes += t.BackendDiskBytes()
+		t.RLock()
+		for _, c := range t.channelMap {
+			diskBytes += backendDiskBytes(c.backend)
+		}
+		t.RUnlock()
+	}
+	ns.diskBytes = diskBytes
+	ns.diskUpdated = time.Now()
+	return diskBytes
+}
+
+// isNamespaceAuthorized returns whether a client with identities may publish
+// or subscribe to the topic topicName, any may unless its namespace has
+// identities
+func (n *NSQD) isNamespaceAuthorized(topicName string, identities []string) bool {
+	ns := n.namespaceOf(topicName)
+	if ns == nil || len(ns.Identities) == 0 {
+		return true
+	}
+	for _, id := range identities {
+		for _, allowed := range ns.Identities {
+			if id == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identities returns the identities of c, those of its TLS client
+// certificate and its auth server identity
+func (c *clientV2) identities() []string {
+	ids := c.tlsIdentities
+	c.metaLock.RLock()
+	if c.AuthState != nil && c.AuthState.Identity != "" {
+		ids = append(ids[:len(ids):len(ids)], c.AuthState.Identity)
+	}
+	c.metaLock.RUnlock()
+	return ids
+}
+
+// tlsIdentities returns the identities of the TLS client certificate of a
+// connection
+func tlsIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return certIdentities(state.PeerCertificates[0])
+}
+
+// filterNamespaceStats returns the stats of the topics, publishes and
+// namespace of the namespace name
+func (n *NSQD) filterNamespaceStats(name string, stats []TopicStats, producerStats []ClientStats,
+	namespaceStats []NamespaceStats) ([]TopicStats, []ClientStats, []NamespaceStats) {
+	filteredStats := make([]TopicStats, 0)
+	for _, t := range stats {
+		if t.Namespace == name {
+			filteredStats = append(filteredStats, t)
+		}
+	}
+
+	filteredProducerStats := make([]ClientStats, 0)
+	for _, clientStat := range producerStats {
+		var pubCounts []PubCount
+		for _, v := range clientStat.PubCounts {
+			if ns := n.namespaceOf(v.Topic); ns != nil && ns.Name == name {
+				pubCounts = append(pubCounts, v)
+			}
+		}
+		if len(pubCounts) == 0 {
+			continue
+		}
+		clientStat.PubCounts = pubCounts
+		filteredProducerStats = append(filteredProducerStats, clientStat)
+	}
+
+	var filteredNamespaceStats []NamespaceStats
+	for _, s := range namespaceStats {
+		if s.Name == name {
+			filteredNamespaceStats = append(filteredNamespaceStats, s)
+		}
+	}
+	return filteredStats, filteredProducerStats, filteredNamespaceStats
+}
+
+// NamespaceStats are the quotas and usage of a namespace
+type NamespaceStats struct {
+	Name               string `json:"name"`
+	Topics             int    `json:"topics"`
+	MaxTopics          int    `json:"max_topics"`
+	DiskBytes          int64  `json:"disk_bytes"`
+	MaxDiskBytes       int64  `json:"max_disk_bytes"`
+	MaxPublishRate     int64  `json:"max_publish_rate"`
+	Depth              int64  `json:"depth"`
+	MessageCount       uint64 `json:"message_count"`
+	RateLimitedCount   uint64 `json:"rate_limited_count"`
+	QuotaExceededCount uint64 `json:"quota_exceeded_count"`
+	TopicLimitCount    uint64 `json:"topic_limit_count"`
+}
+
+// GetNamespaceStats returns the stats of each namespace from stats (of
+// every topic), sorted by name
+func (n *NSQD) GetNamespaceStats(stats []TopicStats) []NamespaceStats {
+	if len(n.namespaces) == 0 {
+		return nil
+	}
+	byName := make(map[string]*NamespaceStats, len(n.namespaces))
+	var nsStats []NamespaceStats
+	for _, ns := range n.namespaces {
+		nsStats = append(nsStats, NamespaceStats{
+			Name:               ns.Name,
+			MaxTopics:          ns.MaxTopics,
+			MaxDiskBytes:       ns.MaxDiskBytes,
+			MaxPublishRate:     ns.MaxPublishRate,
+			RateLimitedCount:   atomic.LoadUint64(&ns.rateLimitedCount),
+			QuotaExceededCount: atomic.LoadUint64(&ns.quotaExceededCount),
+			TopicLimitCount:    atomic.LoadUint64(&ns.topicLimitCount),
+		})
+	}
+	sort.Slice(nsStats, func(i, j int) bool { return nsStats[i].Name < nsStats[j].Name })
+	for i := range nsStats {
+		byName[nsStats[i].Name] = &nsStats[i]
+	}
+	for _, t := range stats {
+		s, ok := byName[t.Namespace]
+		if !ok {
+			continue
+		}
+		s.Topics++
+		s.DiskBytes += t.BackendDiskBytes
+		s.Depth += t.Depth
+		s.MessageCount += t.MessageCount
+		for _, c := range t.Channels {
+			s.DiskBytes += c.BackendDiskBytes
+		}
+	}
+	return nsStats
+}
@@ -0,0 +1,186 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestParseNamespaces(t *testing.T) {
+	namespaces, err := parseNamespaces(nil)
+	test.Nil(t, err)
+	test.Nil(t, namespaces)
+
+	namespaces, err = parseNamespaces([]string{
+		`{"name":"orders","max_topics":2,"identities":["orders.example.com"]}`,
+		`{"name":"billing","max_disk_bytes":1024,"max_publish_rate":10}`,
+	})
+	test.Nil(t, err)
+	test.Equal(t, 2, len(namespaces))
+	test.Equal(t, 2, namespaces["orders"].MaxTopics)
+	test.Equal(t, []string{"orders.example.com"}, namespaces["orders"].Identities)
+	test.Equal(t, int64(1024), namespaces["billing"].MaxDiskBytes)
+	test.Equal(t, int64(10), namespaces["billing"].MaxPublishRate)
+
+	for _, v := range []string{
+		`{"name":"orders","max_topicz":2}`,
+		`{"name":"or.ders"}`,
+		`{"name":"orders#ephemeral"}`,
+		`{"name":""}`,
+		`{"name":"orders","max_disk_bytes":-1}`,
+	} {
+		_, err = parseNamespaces([]string{v})
+		test.NotNil(t, err)
+	}
+	_, err = parseNamespaces([]string{`{"name":"orders"}`, `{"name":"orders"}`})
+	test.NotNil(t, err)
+}
+
+func TestNamespaceTopicLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Namespaces = []string{`{"name":"orders","max_topics":1}`}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	_, err = nsq.Publish("orders.a", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	// existing topics, and those outside the namespace, aren't limited
+	_, err = nsq.Publish("orders.a", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish("billing.a", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=orders.b", httpAddr),
+		"application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+
+	_, err = nsq.Publish("orders.b", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_LIMIT PUB failed namespace topic limit reached")
+
+	_, err = nsqd.GetExistingTopic("orders.b")
+	test.NotNil(t, err)
+	test.Equal(t, uint64(2), nsqd.namespaces["orders"].topicLimitCount)
+}
+
+func TestNamespacePublishQuotas(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Namespaces = []string{
+		`{"name":"orders","max_publish_rate":1}`,
+		`{"name":"billing","max_disk_bytes":1024}`,
+	}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// the rate is shared by the namespace's topics
+	test.Nil(t, nsqd.GetTopic("orders.a").admitPublish(1, 4))
+	test.Equal(t, ErrRateLimited, nsqd.GetTopic("orders.b").admitPublish(1, 4))
+
+	billing := nsqd.namespaces["billing"]
+	test.Nil(t, nsqd.GetTopic("billing.a").admitPublish(1, 4))
+	billing.diskMtx.Lock()
+	billing.diskBytes = 1024
+	billing.diskUpdated = time.Now()
+	billing.diskMtx.Unlock()
+	test.Equal(t, ErrNamespaceQuotaExceeded, nsqd.GetTopic("billing.a").admitPublish(1, 4))
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=billing.a", httpAddr),
+		"application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+	test.Equal(t, `{"message":"QUOTA_EXCEEDED"}`, string(body))
+	test.Equal(t, uint64(2), billing.quotaExceededCount)
+}
+
+func TestNamespaceIdentities(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Namespaces = []string{`{"name":"orders","identities":["orders.example.com"]}`}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/pub?topic=orders.a", httpAddr),
+		"application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 403, resp.StatusCode)
+	_, err = nsqd.GetExistingTopic("orders.a")
+	test.NotNil(t, err)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish("billing.a", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Subscribe("orders.a", "ch").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_UNAUTHORIZED namespace not authorized for SUB on "orders.a"`)
+
+	test.Equal(t, true, nsqd.isNamespaceAuthorized("orders.a", []string{"orders.example.com"}))
+	test.Equal(t, false, nsqd.isNamespaceAuthorized("orders.a", []string{"billing.example.com"}))
+	test.Equal(t, true, nsqd.isNamespaceAuthorized("orders", nil))
+}
+
+func TestNamespaceStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Namespaces = []string{`{"name":"orders","max_topics":10}`}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_namespace_stats" + strconv.Itoa(int(time.Now().Unix()))
+	for _, name := range []string{"orders.a", "orders.b", topicName} {
+		topic := nsqd.GetTopic(name)
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats?format=json&namespace=orders", httpAddr))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	var stats struct {
+		Topics     []TopicStats     `json:"topics"`
+		Namespaces []NamespaceStats `json:"namespaces"`
+	}
+	test.Nil(t, json.Unmarshal(body, &stats))
+	test.Equal(t, 2, len(stats.Topics))
+	for _, topicStats := range stats.Topics {
+		test.Equal(t, "orders", topicStats.Namespace)
+	}
+	test.Equal(t, 1, len(stats.Namespaces))
+	test.Equal(t, "orders", stats.Namespaces[0].Name)
+	test.Equal(t, 2, stats.Namespaces[0].Topics)
+	test.Equal(t, 10, stats.Namespaces[0].MaxTopics)
+	test.Equal(t, int64(2), stats.Namespaces[0].Depth)
+}
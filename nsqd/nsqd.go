@@ -8,18 +8,26 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/nsqio/nsq/internal/auth"
 	"github.com/nsqio/nsq/internal/clusterinfo"
 	"github.com/nsqio/nsq/internal/dirlock"
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/statsd"
 	"github.com/nsqio/nsq/internal/util"
@@ -45,6 +53,10 @@ type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	clientIDSequence int64
 
+	// topics and channels deleted by idleExpiryLoop
+	expiredTopicCount   uint64
+	expiredChannelCount uint64
+
 	sync.RWMutex
 
 	opts atomic.Value
@@ -67,6 +79,19 @@ type NSQD struct {
 	httpsListener net.Listener
 	tlsConfig     *tls.Config
 
+	// by identity, see --tls-client-authorization
+	tlsClientAuthorizations map[string][]auth.Authorization
+
+	// by name, see --namespace
+	namespaces map[string]*namespace
+
+	// see Tracer, httpTracer is the one for --trace-endpoint
+	tracers    []Tracer
+	httpTracer *httpTracer
+
+	// copies of delivered messages for archiveLoop
+	archiveChan chan *ArchivedMessage
+
 	poolSize int
 
 	notifyChan           chan interface{}
@@ -75,6 +100,19 @@ type NSQD struct {
 	waitGroup            util.WaitGroupWrapper
 
 	ci *clusterinfo.ClusterInfo
+
+	replicas []*replica
+
+	// diskqueues found by recoverOrphanedQueues on startup
+	orphanedQueues []OrphanedQueue
+
+	// see Drain, drainChan is closed when it starts and drainedChan when
+	// drainLoop finds the node empty and it's to exit
+	draining    int32
+	drainMtx    sync.Mutex
+	drain       *DrainStats
+	drainChan   chan int
+	drainedChan chan int
 }
 
 func New(opts *Options) (*NSQD, error) {
@@ -85,8 +123,15 @@ func New(opts *Options) (*NSQD, error) {
 		cwd, _ := os.Getwd()
 		dataPath = cwd
 	}
+	if opts.LogFormat != "text" && opts.LogFormat != "json" {
+		return nil, errors.New("--log-format must be one of text or json")
+	}
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		if opts.LogFormat == "json" {
+			opts.Logger = lg.NewJSONLogger(os.Stderr)
+		} else {
+			opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		}
 	}
 
 	n := &NSQD{
@@ -97,6 +142,9 @@ func New(opts *Options) (*NSQD, error) {
 		notifyChan:           make(chan interface{}),
 		optsNotificationChan: make(chan struct{}, 1),
 		dl:                   dirlock.New(dataPath),
+		archiveChan:          make(chan *ArchivedMessage, archiveBufferSize),
+		drainChan:            make(chan int),
+		drainedChan:          make(chan int),
 	}
 	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
 	n.ci = clusterinfo.New(n.logf, httpcli)
@@ -111,13 +159,12 @@ func New(opts *Options) (*NSQD, error) {
 		return nil, fmt.Errorf("failed to lock data-path: %v", err)
 	}
 
-	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
-		return nil, errors.New("--max-deflate-level must be [1,9]")
+	err = validateOptions(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	if opts.ID < 0 || opts.ID >= 1024 {
-		return nil, errors.New("--node-id must be [0,1024)")
-	}
+	n.replicas = newReplicas(opts)
 
 	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
 		opts.TLSRequired = TLSRequired
@@ -131,30 +178,38 @@ func New(opts *Options) (*NSQD, error) {
 		return nil, errors.New("cannot require TLS client connections without TLS key and cert")
 	}
 	n.tlsConfig = tlsConfig
+	n.tlsClientAuthorizations, _ = parseTLSClientAuthorizations(opts.TLSClientAuthorizations)
+	n.namespaces, _ = parseNamespaces(opts.Namespaces)
 
-	for _, v := range opts.E2EProcessingLatencyPercentiles {
-		if v <= 0 || v > 1 {
-			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
-		}
+	if opts.Tracer != nil {
+		n.tracers = append(n.tracers, opts.Tracer)
+	}
+	if opts.TraceEndpoint != "" {
+		n.httpTracer = newHTTPTracer()
+		n.tracers = append(n.tracers, n.httpTracer)
 	}
 
 	n.logf(LOG_INFO, version.String("nsqd"))
 	n.logf(LOG_INFO, "ID: %d", opts.ID)
+	n.logf(LOG_INFO, "options: %s", opts.flagString())
 
+	socketPerm, _ := strconv.ParseUint(opts.UnixSocketPerm, 8, 32)
 	n.tcpServer = &tcpServer{}
-	n.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
+	n.tcpListener, err = listenAll(opts.TCPAddress, opts.ListenBacklog, os.FileMode(socketPerm))
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
-	n.httpListener, err = net.Listen("tcp", opts.HTTPAddress)
+	n.httpListener, err = listenAll(opts.HTTPAddress, opts.ListenBacklog, os.FileMode(socketPerm))
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
 	}
 	if n.tlsConfig != nil && opts.HTTPSAddress != "" {
-		n.httpsListener, err = tls.Listen("tcp", opts.HTTPSAddress, n.tlsConfig)
+		var l net.Listener
+		l, err = listenAll(opts.HTTPSAddress, opts.ListenBacklog, os.FileMode(socketPerm))
 		if err != nil {
 			return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPSAddress, err)
 		}
+		n.httpsListener = tls.NewListener(l, n.tlsConfig)
 	}
 
 	if opts.BroadcastHTTPPort == 0 {
@@ -178,6 +233,172 @@ func New(opts *Options) (*NSQD, error) {
 	return n, nil
 }
 
+// validateOptions returns an error for the first invalid option in opts
+// (except the TLS ones, checked building the TLS config)
+func validateOptions(opts *Options) error {
+	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
+		return errors.New("--max-deflate-level must be [1,9]")
+	}
+
+	if _, err := diskqueue.ParseFormat(opts.DiskQueueFormat); err != nil {
+		return errors.New("--diskqueue-format must be one of length-prefixed or framed")
+	}
+	if _, err := diskqueue.ParseCompression(opts.DiskQueueCompression); err != nil {
+		return errors.New("--diskqueue-compression must be one of none, gzip or snappy")
+	}
+	if opts.DiskQueueCompression != diskqueue.CompressionNone.String() && opts.DiskQueueFormat != diskqueue.FormatFramed.String() {
+		return errors.New("--diskqueue-compression requires --diskqueue-format=framed")
+	}
+
+	if opts.HTTPAuthRead && opts.HTTPAuthSecret == "" {
+		return errors.New("--http-auth-read requires --http-auth-secret")
+	}
+
+	if _, err := parseTLSClientAuthorizations(opts.TLSClientAuthorizations); err != nil {
+		return fmt.Errorf("--tls-client-authorization %s", err)
+	}
+	if _, err := parseNamespaces(opts.Namespaces); err != nil {
+		return fmt.Errorf("--namespace %s", err)
+	}
+	if len(opts.TLSClientAuthorizations) > 0 && opts.TLSClientAuthPolicy != "require-verify" {
+		// an unverified certificate can claim any identity
+		return errors.New("--tls-client-authorization requires --tls-client-auth-policy=require-verify")
+	}
+
+	if _, err := parseDataEncryptionKeys(opts.DataEncryptionKeys); err != nil {
+		return fmt.Errorf("--data-encryption-key %s", err)
+	}
+	if len(opts.DataEncryptionKeys) > 0 && opts.DiskQueueFormat != diskqueue.FormatFramed.String() {
+		return errors.New("--data-encryption-key requires --diskqueue-format=framed")
+	}
+
+	for _, dataPath := range opts.TopicDataPaths {
+		fi, err := os.Stat(dataPath)
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("--topic-data-path %s is not a directory", dataPath)
+		}
+	}
+
+	if opts.MaxDiskWriteRate < 0 {
+		return errors.New("--max-disk-write-rate must be >= 0")
+	}
+
+	if _, ok := backendQueueFactories[opts.Backend]; !ok {
+		return fmt.Errorf("--backend must be one of %s", backendQueueNames())
+	}
+	if opts.MemoryBackendSize < 0 {
+		return errors.New("--memory-backend-size must be >= 0")
+	}
+
+	if !isValidFanOutMode(opts.FanOutMode) {
+		return errors.New("--fan-out-mode must be one of copy or shared")
+	}
+
+	if opts.MaxDepth < 0 {
+		return errors.New("--max-depth must be >= 0")
+	}
+
+	if !isValidOverflowPolicy(opts.OverflowPolicy) {
+		return errors.New("--overflow-policy must be one of error, block or drop-oldest")
+	}
+
+	if opts.AlertWebhookURL != "" {
+		u, err := url.Parse(opts.AlertWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("--alert-webhook-url must be an http(s) URL")
+		}
+		if opts.AlertInterval <= 0 {
+			return errors.New("--alert-interval must be > 0")
+		}
+	}
+
+	if opts.TraceEndpoint != "" {
+		u, err := url.Parse(opts.TraceEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("--trace-endpoint must be an http(s) URL")
+		}
+	}
+	if opts.AlertRenotifyInterval < 0 {
+		return errors.New("--alert-renotify-interval must be >= 0")
+	}
+
+	if opts.IdleExpiry < 0 {
+		return errors.New("--idle-expiry must be >= 0")
+	}
+
+	switch opts.ReplicationMode {
+	case "sync", "async":
+	default:
+		return errors.New("--replication-mode must be one of sync or async")
+	}
+
+	switch opts.DeliveryPreference {
+	case "none", "local", "forwarder":
+	default:
+		return errors.New("--delivery-preference must be one of none, local or forwarder")
+	}
+
+	if opts.SlowConsumerAckLatency < 0 {
+		return errors.New("--slow-consumer-ack-latency must be >= 0")
+	}
+	if opts.SlowConsumerTimeouts < 0 {
+		return errors.New("--slow-consumer-timeouts must be >= 0")
+	}
+	switch opts.SlowConsumerPolicy {
+	case slowConsumerFlag, slowConsumerEvict:
+	default:
+		return errors.New("--slow-consumer-policy must be one of flag or evict")
+	}
+
+	switch opts.RequeuePolicy {
+	case "fifo", "requeue-first":
+	case "ratio":
+		if opts.RequeueRatio < 1 {
+			return errors.New("--requeue-ratio must be >= 1")
+		}
+	default:
+		return errors.New("--requeue-policy must be one of fifo, requeue-first or ratio")
+	}
+
+	if opts.PriorityWeight < 1 {
+		return errors.New("--priority-weight must be >= 1")
+	}
+
+	switch opts.QueueScheduling {
+	case schedulingRandom, schedulingFIFO:
+	case schedulingWeighted:
+		if opts.QueueSchedulingWeight < 1 {
+			return errors.New("--queue-scheduling-weight must be >= 1")
+		}
+	default:
+		return errors.New("--queue-scheduling must be one of random, fifo or weighted")
+	}
+
+	if opts.MaxMsgAttempts < 0 || opts.MaxMsgAttempts > math.MaxUint16 {
+		return fmt.Errorf("--max-msg-attempts must be [0,%d]", math.MaxUint16)
+	}
+
+	if opts.MsgTTL < 0 {
+		return errors.New("--msg-ttl must be >= 0")
+	}
+
+	if opts.ID < 0 || opts.ID >= 1024 {
+		return errors.New("--node-id must be [0,1024)")
+	}
+
+	if perm, err := strconv.ParseUint(opts.UnixSocketPerm, 8, 32); err != nil || perm > 0777 {
+		return errors.New("--unix-socket-perm must be an octal file mode, e.g. 0660")
+	}
+
+	for _, v := range opts.E2EProcessingLatencyPercentiles {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("invalid E2E processing latency percentile: %v", v)
+		}
+	}
+
+	return nil
+}
+
 func (n *NSQD) getOpts() *Options {
 	return n.opts.Load().(*Options)
 }
@@ -193,16 +414,91 @@ func (n *NSQD) triggerOptsNotification() {
 	}
 }
 
+// reloadableOpts are the options, by flag name, ReloadOptions can change,
+// those read each time they're used
+var reloadableOpts = map[string]bool{
+	"log-level":                 true,
+	"lookupd-tcp-address":       true,
+	"max-msg-size":              true,
+	"max-body-size":             true,
+	"msg-timeout":               true, // for new clients
+	"max-msg-timeout":           true,
+	"max-req-timeout":           true,
+	"max-msg-attempts":          true,
+	"msg-ttl":                   true,
+	"max-depth":                 true,
+	"overflow-policy":           true,
+	"overflow-timeout":          true,
+	"max-rdy-count":             true,
+	"max-heartbeat-interval":    true,
+	"max-output-buffer-size":    true,
+	"max-output-buffer-timeout": true,
+	"min-output-buffer-timeout": true,
+	"max-channel-consumers":     true,
+	"statsd-prefix":             true,
+	"http-auth-secret":          true,
+	"http-auth-read":            true,
+}
+
+// ReloadOptions applies the options of opts that differ from the current
+// ones and can change while running (see reloadableOpts), and returns the
+// flag names of those it applied and of those that need a restart
+func (n *NSQD) ReloadOptions(opts *Options) ([]string, []string, error) {
+	err := validateOptions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
+		opts.TLSRequired = TLSRequired
+	}
+
+	var updated, needRestart []string
+	cur := n.getOpts()
+	newOpts := *cur
+	curVal := reflect.ValueOf(cur).Elem()
+	newVal := reflect.ValueOf(&newOpts).Elem()
+	val := reflect.ValueOf(opts).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		name := val.Type().Field(i).Tag.Get("flag")
+		if name == "" || reflect.DeepEqual(val.Field(i).Interface(), curVal.Field(i).Interface()) {
+			continue
+		}
+		if !reloadableOpts[name] {
+			needRestart = append(needRestart, name)
+			continue
+		}
+		newVal.Field(i).Set(val.Field(i))
+		updated = append(updated, name)
+	}
+
+	n.swapOpts(&newOpts)
+	n.triggerOptsNotification()
+	n.logf(LOG_INFO, "reloaded options - updated %v, not updated (need a restart) %v", updated, needRestart)
+	return updated, needRestart, nil
+}
+
+// RealTCPAddr returns the address the TCP listener is bound to, empty if it's
+// a unix socket
 func (n *NSQD) RealTCPAddr() *net.TCPAddr {
-	return n.tcpListener.Addr().(*net.TCPAddr)
+	return tcpAddr(n.tcpListener)
 }
 
 func (n *NSQD) RealHTTPAddr() *net.TCPAddr {
-	return n.httpListener.Addr().(*net.TCPAddr)
+	return tcpAddr(n.httpListener)
 }
 
 func (n *NSQD) RealHTTPSAddr() *net.TCPAddr {
-	return n.httpsListener.Addr().(*net.TCPAddr)
+	return tcpAddr(n.httpsListener)
+}
+
+// TCPAddrs returns every address listened on for TCP clients
+func (n *NSQD) TCPAddrs() []string {
+	return listenerAddrs(n.tcpListener)
+}
+
+// HTTPAddrs returns every address listened on for HTTP clients
+func (n *NSQD) HTTPAddrs() []string {
+	return listenerAddrs(n.httpListener)
 }
 
 func (n *NSQD) SetHealth(err error) {
@@ -248,7 +544,8 @@ func (n *NSQD) RemoveClient(clientID int64) {
 }
 
 func (n *NSQD) Main() error {
-	exitCh := make(chan error)
+	// buffered so that the servers can still exit after a Drain
+	exitCh := make(chan error, 1)
 	var once sync.Once
 	exitFunc := func(err error) {
 		once.Do(func() {
@@ -278,21 +575,54 @@ func (n *NSQD) Main() error {
 
 	n.waitGroup.Wrap(n.queueScanLoop)
 	n.waitGroup.Wrap(n.lookupLoop)
+	n.waitGroup.Wrap(n.rateLoop)
 	if n.getOpts().StatsdAddress != "" {
 		n.waitGroup.Wrap(n.statsdLoop)
 	}
+	if n.getOpts().TopicHibernateTimeout > 0 {
+		n.waitGroup.Wrap(n.hibernateLoop)
+	}
+	if n.getOpts().IdleExpiry > 0 {
+		n.waitGroup.Wrap(n.idleExpiryLoop)
+	}
+	if n.getOpts().AlertWebhookURL != "" {
+		n.waitGroup.Wrap(n.alertLoop)
+	}
+	if n.httpTracer != nil {
+		n.waitGroup.Wrap(n.traceLoop)
+	}
+	n.waitGroup.Wrap(n.archiveLoop)
+	for _, r := range n.replicas {
+		if r.queue != nil {
+			r := r
+			n.waitGroup.Wrap(func() { n.replicationLoop(r) })
+		}
+	}
 
-	err := <-exitCh
-	return err
+	select {
+	case err := <-exitCh:
+		return err
+	case <-n.drainedChan:
+		return ErrDrained
+	}
 }
 
 type meta struct {
 	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
+		Name         string            `json:"name"`
+		Paused       bool              `json:"paused"`
+		DataPath     string            `json:"data_path"`
+		FanOut       string            `json:"fan_out_mode"`
+		Labels       map[string]string `json:"labels"`
+		QueueOptions QueueOptions      `json:"queue_options"`
+		Partitions   int               `json:"partitions"`
+		Channels     []struct {
+			Name         string            `json:"name"`
+			Paused       bool              `json:"paused"`
+			Labels       map[string]string `json:"labels"`
+			DeadLetter   string            `json:"dead_letter_topic"`
+			Archive      ChannelArchive    `json:"archive"`
+			QueueOptions QueueOptions      `json:"queue_options"`
 		} `json:"channels"`
 	} `json:"topics"`
 }
@@ -329,6 +659,17 @@ func (n *NSQD) LoadMetadata() error {
 	atomic.StoreInt32(&n.isLoading, 1)
 	defer atomic.StoreInt32(&n.isLoading, 0)
 
+	err := n.loadMetadata()
+	if err != nil {
+		return err
+	}
+	if n.getOpts().Backend == "diskqueue" {
+		n.recoverOrphanedQueues()
+	}
+	return nil
+}
+
+func (n *NSQD) loadMetadata() error {
 	fn := newMetadataFile(n.getOpts())
 
 	data, err := readOrEmpty(fn)
@@ -345,12 +686,43 @@ func (n *NSQD) LoadMetadata() error {
 		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
 	}
 
+	if n.getOpts().VerifyOnStart && n.getOpts().Backend == "diskqueue" {
+		n.verifyData(&m)
+	}
+
 	for _, t := range m.Topics {
 		if !protocol.IsValidTopicName(t.Name) {
 			n.logf(LOG_WARN, "skipping creation of invalid topic %s", t.Name)
 			continue
 		}
 		topic := n.GetTopic(t.Name)
+		topic.RLock()
+		dataPath := topic.dataPath
+		topic.RUnlock()
+		if t.DataPath != "" && filepath.Clean(t.DataPath) != filepath.Clean(dataPath) {
+			err := topic.MigrateBackend(t.DataPath)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to open topic %s in %s - %s", t.Name, t.DataPath, err)
+			}
+		}
+		if t.FanOut != "" {
+			err := topic.SetFanOutMode(t.FanOut)
+			if err != nil {
+				n.logf(LOG_WARN, "topic %s - %s", t.Name, err)
+			}
+		}
+		if len(t.Labels) > 0 {
+			topic.SetLabels(t.Labels)
+		}
+		if t.Partitions > 0 {
+			topic.SetPartitions(t.Partitions)
+		}
+		err := t.QueueOptions.validate(n.getOpts())
+		if err != nil {
+			n.logf(LOG_WARN, "topic %s - %s", t.Name, err)
+		} else {
+			topic.SetQueueOptions(t.QueueOptions)
+		}
 		if t.Paused {
 			topic.Pause()
 		}
@@ -360,6 +732,21 @@ func (n *NSQD) LoadMetadata() error {
 				continue
 			}
 			channel := topic.GetChannel(c.Name)
+			if len(c.Labels) > 0 {
+				channel.SetLabels(c.Labels)
+			}
+			if c.DeadLetter != "" {
+				channel.SetDeadLetterTopic(c.DeadLetter)
+			}
+			if !c.Archive.isEmpty() {
+				channel.SetArchive(c.Archive)
+			}
+			err := c.QueueOptions.validate(n.getOpts())
+			if err != nil {
+				n.logf(LOG_WARN, "channel %s - %s", c.Name, err)
+			} else {
+				channel.SetQueueOptions(c.QueueOptions)
+			}
 			if c.Paused {
 				channel.Pause()
 			}
@@ -369,6 +756,48 @@ func (n *NSQD) LoadMetadata() error {
 	return nil
 }
 
+// verifyData scans the diskqueue files of every topic and channel in m,
+// logging how many valid messages each has and where the first corrupt
+// one is, before any of them are opened
+func (n *NSQD) verifyData(m *meta) {
+	var numQueues, numCorrupt int
+	verify := func(name string, dataPath string) {
+		result, err := n.scanDiskQueue(name, dataPath)
+		if os.IsNotExist(err) {
+			return
+		}
+		numQueues++
+		if err != nil {
+			numCorrupt++
+			n.logf(LOG_ERROR, "DISKQUEUE(%s): failed to verify - %s", name, err)
+			return
+		}
+		if result.CorruptFile != "" {
+			numCorrupt++
+			n.logf(LOG_WARN, "DISKQUEUE(%s): corrupt message in %s at offset %d after %d valid messages (depth %d) - %s",
+				name, result.CorruptFile, result.CorruptPos, result.Records, result.Depth, result.CorruptErr)
+			return
+		}
+		n.logf(LOG_INFO, "DISKQUEUE(%s): verified %d messages (%d bytes) in %d files",
+			name, result.Records, result.Bytes, result.Files)
+	}
+
+	start := time.Now()
+	for _, t := range m.Topics {
+		dataPath := n.backendDataPath(t.Name, t.Name)
+		if t.DataPath != "" {
+			dataPath = t.DataPath
+		}
+		verify(t.Name, dataPath)
+		for _, c := range t.Channels {
+			name := getBackendName(t.Name, c.Name)
+			verify(name, n.backendDataPath(name, t.Name))
+		}
+	}
+	n.logf(LOG_INFO, "NSQ: verified %d diskqueues in %s, %d corrupt",
+		numQueues, time.Since(start), numCorrupt)
+}
+
 func (n *NSQD) PersistMetadata() error {
 	// persist metadata about what topics/channels we have, across restarts
 	fileName := newMetadataFile(n.getOpts())
@@ -386,6 +815,21 @@ func (n *NSQD) PersistMetadata() error {
 		topicData["paused"] = topic.IsPaused()
 		channels := []interface{}{}
 		topic.Lock()
+		if topic.dataPath != n.getOpts().DataPath {
+			topicData["data_path"] = topic.dataPath
+		}
+		if fanOut := topic.FanOutMode(); fanOut != n.getOpts().FanOutMode {
+			topicData["fan_out_mode"] = fanOut
+		}
+		if len(topic.labels) > 0 {
+			topicData["labels"] = topic.labels
+		}
+		if qo := topic.QueueOptions(); !qo.isEmpty() {
+			topicData["queue_options"] = qo
+		}
+		if partitions := topic.Partitions(); partitions > 0 {
+			topicData["partitions"] = partitions
+		}
 		for _, channel := range topic.channelMap {
 			channel.Lock()
 			if channel.ephemeral {
@@ -395,6 +839,18 @@ func (n *NSQD) PersistMetadata() error {
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if len(channel.labels) > 0 {
+				channelData["labels"] = channel.labels
+			}
+			if channel.deadLetter != "" {
+				channelData["dead_letter_topic"] = channel.deadLetter
+			}
+			if !channel.archive.isEmpty() {
+				channelData["archive"] = channel.archive
+			}
+			if qo := channel.QueueOptions(); !qo.isEmpty() {
+				channelData["queue_options"] = qo
+			}
 			channels = append(channels, channelData)
 			channel.Unlock()
 		}
@@ -627,6 +1083,9 @@ func (n *NSQD) queueScanWorker(workCh chan *Channel, responseCh chan bool, close
 		case c := <-workCh:
 			now := time.Now().UnixNano()
 			dirty := false
+			if c.processTimeoutWarnings(now) {
+				dirty = true
+			}
 			if c.processInFlightQueue(now) {
 				dirty = true
 			}
@@ -707,6 +1166,68 @@ exit:
 	refreshTicker.Stop()
 }
 
+// hibernateLoop periodically looks for topics that have been idle (see
+// Topic.isIdle) without any messages being published for
+// TopicHibernateTimeout and hibernates them
+func (n *NSQD) hibernateLoop() {
+	type idleTopic struct {
+		since        time.Time
+		messageCount uint64
+	}
+	var idleTopics map[*Topic]idleTopic
+
+	timeout := n.getOpts().TopicHibernateTimeout
+	ticker := time.NewTicker(timeout / 2)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+
+		if atomic.LoadInt32(&n.isLoading) == 1 {
+			continue
+		}
+
+		n.RLock()
+		topics := make([]*Topic, 0, len(n.topicMap))
+		for _, t := range n.topicMap {
+			topics = append(topics, t)
+		}
+		n.RUnlock()
+
+		now := time.Now()
+		prevIdleTopics := idleTopics
+		idleTopics = make(map[*Topic]idleTopic)
+		for _, t := range topics {
+			if t.IsHibernated() {
+				continue
+			}
+			t.RLock()
+			idle := t.isIdle()
+			t.RUnlock()
+			if !idle {
+				continue
+			}
+
+			messageCount := atomic.LoadUint64(&t.messageCount)
+			it, ok := prevIdleTopics[t]
+			if !ok || it.messageCount != messageCount {
+				it = idleTopic{since: now, messageCount: messageCount}
+			}
+			if now.Sub(it.since) >= timeout && t.hibernate() {
+				continue
+			}
+			idleTopics[t] = it
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "HIBERNATE: closing")
+	ticker.Stop()
+}
+
 func buildTLSConfig(opts *Options) (*tls.Config, error) {
 	var tlsConfig *tls.Config
 
@@ -1,17 +1,25 @@
 package nsqd
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/nsqlookupd"
@@ -37,6 +45,43 @@ func getMetadata(n *NSQD) (*meta, error) {
 	return &m, nil
 }
 
+// checkGoroutineLeaks records the number of running goroutines and returns a
+// func which fails the test if, after a grace period, more are running
+func checkGoroutineLeaks(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+	return func() {
+		var after int
+		for i := 0; i < 200; i++ {
+			after = runtime.NumGoroutine()
+			if after <= before {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		t.Fatalf("%d goroutines leaked\n%s", after-before, buf.String())
+	}
+}
+
+// waitForGoroutines fails the test unless topic's and all of its channels'
+// goroutines exit within a grace period
+func waitForGoroutines(t *testing.T, topic *Topic) {
+	running := func() int64 {
+		n := topic.Goroutines()
+		topic.RLock()
+		for _, c := range topic.channelMap {
+			n += c.Goroutines()
+		}
+		topic.RUnlock()
+		return n
+	}
+	for i := 0; i < 200 && running() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), running())
+}
+
 func TestStartup(t *testing.T) {
 	var msg *Message
 
@@ -157,6 +202,53 @@ func TestStartup(t *testing.T) {
 	<-doneExitChan
 }
 
+func TestIdleExpiry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.IdleExpiry = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicExists := func(name string) bool {
+		nsqd.RLock()
+		defer nsqd.RUnlock()
+		_, ok := nsqd.topicMap[name]
+		return ok
+	}
+
+	// a topic with a client keeps it and its topic, but not its other
+	// channels
+	used := nsqd.GetTopic("test_idle_expiry_used")
+	channel := used.GetChannel("ch")
+	client := newClientV2(0, nil, nsqd)
+	test.Nil(t, channel.AddClient(client.ID, client))
+	defer channel.RemoveClient(client.ID)
+	used.GetChannel("unused")
+
+	// one without any is kept while messages are published to it
+	published := nsqd.GetTopic("test_idle_expiry_published")
+	for i := 0; i < 15; i++ {
+		test.Nil(t, published.PutMessage(NewMessage(published.GenerateID(), []byte("test"))))
+		time.Sleep(20 * time.Millisecond)
+	}
+	test.Equal(t, true, topicExists("test_idle_expiry_published"))
+	_, err := used.GetExistingChannel("unused")
+	test.NotNil(t, err)
+
+	for i := 0; topicExists("test_idle_expiry_published"); i++ {
+		if i > 100 {
+			t.Fatalf("topic did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, topicExists("test_idle_expiry_used"))
+	_, err = used.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, uint64(1), atomic.LoadUint64(&nsqd.expiredTopicCount))
+	test.Equal(t, uint64(1), atomic.LoadUint64(&nsqd.expiredChannelCount))
+}
+
 func TestEphemeralTopicsAndChannels(t *testing.T) {
 	// ephemeral topics/channels are lazily removed after the last channel/client is removed
 	opts := NewOptions()
@@ -415,6 +507,201 @@ func TestCluster(t *testing.T) {
 	test.Equal(t, 0, len(dd["channel:"+topicName+":ch"]))
 }
 
+func TestBackendQueueFactory(t *testing.T) {
+	var names []string
+	RegisterBackendQueue("test", func(name string, dataPath string, opts *Options) BackendQueue {
+		names = append(names, name)
+		return newDummyBackendQueue()
+	})
+	defer delete(backendQueueFactories, "test")
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Backend = "unknown"
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	_, err := New(opts)
+	test.Equal(t, "--backend must be one of diskqueue, memory, test", err.Error())
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Backend = "test"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_backend_queue_factory" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+	nsqd.GetTopic(topicName).GetChannel("ch2#ephemeral")
+	test.Equal(t, []string{topicName, getBackendName(topicName, "ch")}, names)
+}
+
+func TestMemoryBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Backend = "memory"
+	opts.MemQueueSize = 1
+	opts.MemoryBackendSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_memory_backend" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	for i := 0; i < 3; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	for i := 0; i < 9; i++ {
+		test.Equal(t, ErrTopicFull, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	}
+	test.Equal(t, int64(3), topic.Depth())
+	test.Equal(t, int64(2), topic.BackendDepth())
+	test.Equal(t, uint64(9), atomic.LoadUint64(&topic.overflowCount))
+	test.Equal(t, ErrTopicFull, topic.PutMessages([]*Message{
+		NewMessage(topic.GenerateID(), []byte("test")),
+	}))
+	test.Equal(t, "OK", nsqd.GetHealth())
+
+	// the backend's messages are delivered to the channel's (and its memory
+	// queue) once the topic is unpaused
+	channel := topic.GetChannel("ch")
+	topic.UnPause()
+	for i := 0; channel.Depth() != 3; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), topic.Depth())
+
+	files, err := filepath.Glob(filepath.Join(opts.DataPath, topicName+"*"))
+	test.Nil(t, err)
+	test.Equal(t, 0, len(files))
+}
+
+func TestMemoryBackendQueue(t *testing.T) {
+	opts := NewOptions()
+	opts.MemoryBackendSize = 3
+	bq := newMemoryBackend("test", "", opts)
+	defer bq.Close()
+
+	test.Nil(t, writeMessagesToBackend([]*Message{
+		NewMessage(MessageID{'1'}, []byte("1")),
+		NewMessage(MessageID{'2'}, []byte("2")),
+	}, bq))
+	// all or none of a batch
+	test.Equal(t, errMemoryQueueFull, writeMessagesToBackend([]*Message{
+		NewMessage(MessageID{'3'}, []byte("3")),
+		NewMessage(MessageID{'4'}, []byte("4")),
+	}, bq))
+	test.Equal(t, int64(2), bq.Depth())
+	test.Nil(t, writeMessageToBackend(NewMessage(MessageID{'3'}, []byte("3")), bq))
+	test.Equal(t, errMemoryQueueFull, writeMessageToBackend(NewMessage(MessageID{'4'}, []byte("4")), bq))
+
+	for _, body := range []string{"1", "2", "3"} {
+		msg, err := decodeMessage(<-bq.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, []byte(body), msg.Body)
+	}
+	for i := 0; bq.Depth() != 0; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	test.Nil(t, writeMessageToBackend(NewMessage(MessageID{'5'}, []byte("5")), bq))
+	test.Nil(t, bq.Empty())
+	test.Equal(t, int64(0), bq.Depth())
+	select {
+	case <-bq.ReadChan():
+		t.Fatal("read a message from an empty backend")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestDataEncryption(t *testing.T) {
+	key := "1:000102030405060708090a0b0c0d0e0f"
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataEncryptionKeys = []string{key}
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	_, err := New(opts)
+	test.Equal(t, "--data-encryption-key requires --diskqueue-format=framed", err.Error())
+	opts.DiskQueueFormat = "framed"
+	opts.DataEncryptionKeys = []string{"1:0001"}
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	_, err = New(opts)
+	test.Equal(t, "--data-encryption-key key 1 - crypto/aes: invalid key size 2", err.Error())
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.DiskQueueFormat = "framed"
+	opts.DataEncryptionKeys = []string{key}
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	test.Equal(t, false, strings.Contains(opts.flagString(), key))
+	v, _ := getOptByCfgName(opts, "data_encryption_keys")
+	test.Equal(t, redacted, v)
+
+	topicName := "test_data_encryption" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("secret body"))))
+	nsqd.Exit()
+
+	data, err := ioutil.ReadFile(filepath.Join(opts.DataPath, topicName+".diskqueue.000000.dat"))
+	test.Nil(t, err)
+	test.Equal(t, false, bytes.Contains(data, []byte("secret")))
+
+	// rotated, the old key still decrypts
+	opts.DataEncryptionKeys = []string{"2:101112131415161718191a1b1c1d1e1f", key}
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	topic = nsqd.GetTopic(topicName)
+	test.Equal(t, int64(1), topic.Depth())
+	msg, err := decodeMessage(<-topic.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, []byte("secret body"), msg.Body)
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DiskQueueCompression = "snappy"
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	_, err := New(opts)
+	test.Equal(t, "--diskqueue-compression requires --diskqueue-format=framed", err.Error())
+	opts.DiskQueueFormat = "framed"
+	opts.DiskQueueCompression = "lz4"
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	_, err = New(opts)
+	test.Equal(t, "--diskqueue-compression must be one of none, gzip or snappy", err.Error())
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.DiskQueueFormat = "framed"
+	opts.DiskQueueCompression = "gzip"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_diskqueue_compression" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	body := bytes.Repeat([]byte(`{"compress":"me"}`), 100)
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), body)))
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, true, stats[0].BackendUncompressedBytes > int64(len(body)))
+	test.Equal(t, true, stats[0].BackendCompressedBytes < int64(len(body))/10)
+	msg, err := decodeMessage(<-topic.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, body, msg.Body)
+}
+
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -439,3 +726,241 @@ func TestSetHealth(t *testing.T) {
 	test.Equal(t, "OK", nsqd.GetHealth())
 	test.Equal(t, true, nsqd.IsHealthy())
 }
+
+func TestReloadOptions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	newOpts := *nsqd.getOpts()
+	newOpts.LogLevel = LOG_DEBUG
+	newOpts.MaxMsgSize = 1024
+	newOpts.MemQueueSize = 10
+	updated, needRestart, err := nsqd.ReloadOptions(&newOpts)
+	test.Nil(t, err)
+	test.Equal(t, []string{"log-level", "max-msg-size"}, updated)
+	test.Equal(t, []string{"mem-queue-size"}, needRestart)
+	test.Equal(t, LOG_DEBUG, nsqd.getOpts().LogLevel)
+	test.Equal(t, int64(1024), nsqd.getOpts().MaxMsgSize)
+	test.Equal(t, opts.MemQueueSize, nsqd.getOpts().MemQueueSize)
+
+	newOpts = *nsqd.getOpts()
+	newOpts.MaxMsgSize = 2048
+	newOpts.OverflowPolicy = "drop-newest"
+	_, _, err = nsqd.ReloadOptions(&newOpts)
+	test.NotNil(t, err)
+	test.Equal(t, int64(1024), nsqd.getOpts().MaxMsgSize)
+}
+
+func TestListenRebind(t *testing.T) {
+	l, err := listenTCP("tcp", "127.0.0.1:0", 16)
+	test.Nil(t, err)
+	addr := l.Addr().String()
+
+	connChan := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			panic(err)
+		}
+		connChan <- conn
+	}()
+	clientConn, err := net.Dial("tcp", addr)
+	test.Nil(t, err)
+
+	// closing the server side first leaves it in TIME_WAIT
+	serverConn := <-connChan
+	serverConn.Close()
+	clientConn.Close()
+	l.Close()
+
+	l, err = listenTCP("tcp", addr, 16)
+	test.Nil(t, err)
+	defer l.Close()
+	test.Equal(t, addr, l.Addr().String())
+}
+
+func TestUnixSocketListeners(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	tcpSock := filepath.Join(dataPath, "nsqd.sock")
+	httpSock := filepath.Join(dataPath, "nsqd-http.sock")
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	opts.TCPAddress = "unix://" + tcpSock
+	opts.HTTPAddress = "unix://" + httpSock
+	opts.UnixSocketPerm = "0600"
+	nsqd, err := New(opts)
+	test.Nil(t, err)
+	go nsqd.Main()
+
+	fi, err := os.Stat(tcpSock)
+	test.Nil(t, err)
+	test.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	test.Equal(t, 0, nsqd.RealTCPAddr().Port)
+
+	conn, err := net.DialTimeout("unix", tcpSock, time.Second)
+	test.Nil(t, err)
+	conn.Write(nsq.MagicV2)
+	identify(t, conn, nil, frameTypeResponse)
+	conn.Close()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", httpSock)
+		},
+	}}
+	resp, err := client.Get("http://nsqd/ping")
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	nsqd.Exit()
+	_, err = os.Stat(tcpSock)
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(httpSock)
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestMultipleListeners(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is unavailable - %s", err)
+	}
+	l.Close()
+
+	lopts := nsqlookupd.NewOptions()
+	lopts.Logger = test.NewTestLogger(t)
+	_, _, lookupd := mustStartNSQLookupd(lopts)
+	defer lookupd.Exit()
+
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	opts.TCPAddress = "127.0.0.1:0,[::1]:0"
+	opts.HTTPAddress = "127.0.0.1:0, [::1]:0"
+	opts.NSQLookupdTCPAddresses = []string{lookupd.RealTCPAddr().String()}
+	nsqd, err := New(opts)
+	test.Nil(t, err)
+	go nsqd.Main()
+	defer nsqd.Exit()
+
+	tcpAddrs := nsqd.TCPAddrs()
+	test.Equal(t, 2, len(tcpAddrs))
+	test.Equal(t, nsqd.RealTCPAddr().String(), tcpAddrs[0])
+	for _, addr := range tcpAddrs {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		test.Nil(t, err)
+		conn.Write(nsq.MagicV2)
+		identify(t, conn, nil, frameTypeResponse)
+		conn.Close()
+	}
+
+	httpAddrs := nsqd.HTTPAddrs()
+	test.Equal(t, 2, len(httpAddrs))
+	for _, addr := range httpAddrs {
+		resp, err := http.Get(fmt.Sprintf("http://%s/ping", addr))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+
+	var stats struct {
+		TCPAddresses  []string `json:"tcp_addresses"`
+		HTTPAddresses []string `json:"http_addresses"`
+	}
+	endpoint := fmt.Sprintf("http://%s/stats?format=json", httpAddrs[1])
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &stats)
+	test.Nil(t, err)
+	test.Equal(t, tcpAddrs, stats.TCPAddresses)
+	test.Equal(t, httpAddrs, stats.HTTPAddresses)
+
+	// allow some time for nsqd to push info to nsqlookupd
+	time.Sleep(350 * time.Millisecond)
+
+	var nodes struct {
+		Producers []struct {
+			TCPAddresses  []string `json:"tcp_addresses"`
+			HTTPAddresses []string `json:"http_addresses"`
+		} `json:"producers"`
+	}
+	endpoint = fmt.Sprintf("http://%s/nodes", lookupd.RealHTTPAddr())
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &nodes)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(nodes.Producers))
+	test.Equal(t, tcpAddrs, nodes.Producers[0].TCPAddresses)
+	test.Equal(t, httpAddrs, nodes.Producers[0].HTTPAddresses)
+
+	// a wildcard address of each family may share a port
+	l, err = net.Listen("tcp4", "0.0.0.0:0")
+	test.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	ml, err := listenAll(fmt.Sprintf("0.0.0.0:%d,[::]:%d", port, port), 0, 0)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(listenerAddrs(ml)))
+	ml.Close()
+	_, err = ml.Accept()
+	test.NotNil(t, err)
+}
+
+func TestGoroutineLeaks(t *testing.T) {
+	defer checkGoroutineLeaks(t)()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PersistDeferred = true
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_goroutine_leaks" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	deferredMsg := NewMessage(topic.GenerateID(), []byte("test body"))
+	deferredMsg.deferred = time.Hour
+	test.Nil(t, topic.PutMessage(deferredMsg))
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	test.Nil(t, topic.PutMessage(msg))
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, msg.ID, msgOut.ID)
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	// messagePump, the deferred store's pump and the client's messagePump
+	stats := nsqd.GetGoroutineStats()
+	test.Equal(t, int64(2), stats.Topics[topicName].Goroutines)
+	test.Equal(t, int64(1), stats.Topics[topicName].Channels["ch"])
+	test.Equal(t, int64(1), channel.Goroutines())
+
+	conn.Close()
+	for i := 0; i < 200 && channel.Goroutines() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), channel.Goroutines())
+
+	nsqd.Exit()
+	waitForGoroutines(t, topic)
+}
@@ -3,12 +3,17 @@ package nsqd
 import (
 	"crypto/md5"
 	"crypto/tls"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nsqio/nsq/internal/diskqueue"
 	"github.com/nsqio/nsq/internal/lg"
 )
 
@@ -17,11 +22,15 @@ type Options struct {
 	ID        int64       `flag:"node-id" cfg:"id"`
 	LogLevel  lg.LogLevel `flag:"log-level"`
 	LogPrefix string      `flag:"log-prefix"`
+	LogFormat string      `flag:"log-format"`
 	Logger    Logger
 
+	// TCPAddress, HTTPAddress and HTTPSAddress may be comma separated lists
 	TCPAddress               string        `flag:"tcp-address"`
 	HTTPAddress              string        `flag:"http-address"`
 	HTTPSAddress             string        `flag:"https-address"`
+	ListenBacklog            int           `flag:"listen-backlog"`
+	UnixSocketPerm           string        `flag:"unix-socket-perm"`
 	BroadcastAddress         string        `flag:"broadcast-address"`
 	BroadcastTCPPort         int           `flag:"broadcast-tcp-port"`
 	BroadcastHTTPPort        int           `flag:"broadcast-http-port"`
@@ -29,13 +38,42 @@ type Options struct {
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
+	ReplicaHTTPAddresses     []string      `flag:"replica-http-address" cfg:"replica_http_addresses"`
+	ReplicationMode          string        `flag:"replication-mode"`
+	PprofEnabled             bool          `flag:"pprof"`
 
 	// diskqueue options
+	Backend         string        `flag:"backend"`
 	DataPath        string        `flag:"data-path"`
 	MemQueueSize    int64         `flag:"mem-queue-size"`
 	MaxBytesPerFile int64         `flag:"max-bytes-per-file"`
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
+	ReadBufferSize  int           `flag:"read-buffer-size"`
+	VerifyOnStart   bool          `flag:"verify-on-start"`
+	MessagePool     bool          `flag:"message-pool"`
+	PersistDeferred bool          `flag:"persist-deferred"`
+	DiskQueueFormat string        `flag:"diskqueue-format"`
+	DiskQueueMmap   bool          `flag:"diskqueue-mmap"`
+
+	// none, gzip or snappy, of the records of framed diskqueues
+	DiskQueueCompression string `flag:"diskqueue-compression"`
+
+	// messages beyond MemQueueSize --backend=memory keeps (per topic/channel)
+	MemoryBackendSize int64 `flag:"memory-backend-size"`
+
+	// volumes topics' (and their channels') diskqueue files are spread over
+	TopicDataPaths []string `flag:"topic-data-path" cfg:"topic_data_paths"`
+
+	// bytes of messages per second each diskqueue may write, 0 for no limit
+	MaxDiskWriteRate int64 `flag:"max-disk-write-rate"`
+
+	// <id>:<hex AES key>, the first encrypts new diskqueue records
+	DataEncryptionKeys []string `flag:"data-encryption-key" cfg:"data_encryption_keys" redact:"true"`
+
+	// re-create the topics and channels whose diskqueue files are found on
+	// startup but that aren't in the metadata file
+	RecoverOrphanedQueues bool `flag:"recover-orphaned-queues"`
 
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
@@ -43,13 +81,42 @@ type Options struct {
 	QueueScanWorkerPoolMax   int `flag:"queue-scan-worker-pool-max"`
 	QueueScanDirtyPercent    float64
 
+	// how often the counters of topics and channels are sampled for the
+	// rates in their stats
+	RateSampleInterval time.Duration
+
+	// topics and channels without clients or publishes for IdleExpiry are
+	// deleted, 0 to never
+	IdleExpiry time.Duration `flag:"idle-expiry"`
+
+	TopicHibernateTimeout time.Duration `flag:"topic-hibernate-timeout"`
+	FanOutMode            string        `flag:"fan-out-mode"`
+	MaxDepth              int64         `flag:"max-depth"`
+	OverflowPolicy        string        `flag:"overflow-policy"`
+	OverflowTimeout       time.Duration `flag:"overflow-timeout"`
+
+	// topic namespaces and their quotas, as JSON, see parseNamespaces
+	Namespaces []string `flag:"namespace" cfg:"namespaces"`
+
 	// msg and command options
-	MsgTimeout    time.Duration `flag:"msg-timeout"`
-	MaxMsgTimeout time.Duration `flag:"max-msg-timeout"`
-	MaxMsgSize    int64         `flag:"max-msg-size"`
-	MaxBodySize   int64         `flag:"max-body-size"`
-	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
-	ClientTimeout time.Duration
+	MsgTimeout     time.Duration `flag:"msg-timeout"`
+	MaxMsgTimeout  time.Duration `flag:"max-msg-timeout"`
+	MaxMsgSize     int64         `flag:"max-msg-size"`
+	MaxBodySize    int64         `flag:"max-body-size"`
+	MaxReqTimeout  time.Duration `flag:"max-req-timeout"`
+	ClientTimeout  time.Duration
+	RequeuePolicy  string        `flag:"requeue-policy"`
+	RequeueRatio   int           `flag:"requeue-ratio"`
+	MaxMsgAttempts int           `flag:"max-msg-attempts"`
+	MsgTTL         time.Duration `flag:"msg-ttl"`
+
+	// order of the messages of a topic or channel's in-memory and backend
+	// queues, see queueScheduler
+	QueueScheduling       string `flag:"queue-scheduling"`
+	QueueSchedulingWeight int    `flag:"queue-scheduling-weight"`
+
+	// high priority messages delivered per other message, see priorityQueue
+	PriorityWeight int `flag:"priority-weight"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -59,6 +126,15 @@ type Options struct {
 	MinOutputBufferTimeout time.Duration `flag:"min-output-buffer-timeout"`
 	OutputBufferTimeout    time.Duration `flag:"output-buffer-timeout"`
 	MaxChannelConsumers    int           `flag:"max-channel-consumers"`
+	DeliveryPreference     string        `flag:"delivery-preference"`
+
+	// consumers whose average delivery-to-ack latency exceeds
+	// SlowConsumerAckLatency, or with SlowConsumerTimeouts messages timed
+	// out in a row, are flagged as slow in stats (and with
+	// SlowConsumerPolicy=evict disconnected), 0 to disable either
+	SlowConsumerAckLatency time.Duration `flag:"slow-consumer-ack-latency"`
+	SlowConsumerTimeouts   int           `flag:"slow-consumer-timeouts"`
+	SlowConsumerPolicy     string        `flag:"slow-consumer-policy"`
 
 	// statsd integration
 	StatsdAddress       string        `flag:"statsd-address"`
@@ -67,10 +143,28 @@ type Options struct {
 	StatsdMemStats      bool          `flag:"statsd-mem-stats"`
 	StatsdUDPPacketSize int           `flag:"statsd-udp-packet-size"`
 
+	// depth alerts, see the depth_alert channel option
+	AlertWebhookURL       string        `flag:"alert-webhook-url"`
+	AlertInterval         time.Duration `flag:"alert-interval"`
+	AlertRenotifyInterval time.Duration `flag:"alert-renotify-interval"`
+
+	// messages with a trace-id header have their SpanEvents reported to
+	// Tracer, and POSTed to TraceEndpoint
+	Tracer        Tracer
+	TraceEndpoint string `flag:"trace-endpoint"`
+
+	// receives the messages delivered on channels archived with sink=true
+	ArchiveSink ArchiveSink
+
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
 
+	// required by HTTP endpoints that change topics, channels or options (and
+	// with HTTPAuthRead, by /info, /stats, /metrics etc.), see checkSecret
+	HTTPAuthSecret string `flag:"http-auth-secret" redact:"true"`
+	HTTPAuthRead   bool   `flag:"http-auth-read"`
+
 	// TLS config
 	TLSCert             string `flag:"tls-cert"`
 	TLSKey              string `flag:"tls-key"`
@@ -79,6 +173,10 @@ type Options struct {
 	TLSRequired         int    `flag:"tls-required"`
 	TLSMinVersion       uint16 `flag:"tls-min-version"`
 
+	// what TLS clients may publish and subscribe to, by certificate identity,
+	// as JSON, see parseTLSClientAuthorizations
+	TLSClientAuthorizations []string `flag:"tls-client-authorization" cfg:"tls_client_authorizations"`
+
 	// compression
 	DeflateEnabled  bool `flag:"deflate"`
 	MaxDeflateLevel int  `flag:"max-deflate-level"`
@@ -98,11 +196,13 @@ func NewOptions() *Options {
 	return &Options{
 		ID:        defaultID,
 		LogPrefix: "[nsqd] ",
+		LogFormat: "text",
 		LogLevel:  lg.INFO,
 
 		TCPAddress:        "0.0.0.0:4150",
 		HTTPAddress:       "0.0.0.0:4151",
 		HTTPSAddress:      "0.0.0.0:4152",
+		UnixSocketPerm:    "0660",
 		BroadcastAddress:  hostname,
 		BroadcastTCPPort:  0,
 		BroadcastHTTPPort: 0,
@@ -112,11 +212,26 @@ func NewOptions() *Options {
 
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
+		ReplicaHTTPAddresses:     make([]string, 0),
+		ReplicationMode:          "sync",
+		PprofEnabled:             false,
 
+		Backend:         "diskqueue",
 		MemQueueSize:    10000,
 		MaxBytesPerFile: 100 * 1024 * 1024,
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
+		ReadBufferSize:  diskqueue.DefaultReadBufferSize,
+		DiskQueueFormat: diskqueue.FormatLengthPrefixed.String(),
+
+		DiskQueueCompression: diskqueue.CompressionNone.String(),
+
+		MemoryBackendSize: 100000,
+
+		TopicDataPaths:     make([]string, 0),
+		DataEncryptionKeys: make([]string, 0),
+
+		RecoverOrphanedQueues: true,
 
 		QueueScanInterval:        100 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
@@ -124,12 +239,28 @@ func NewOptions() *Options {
 		QueueScanWorkerPoolMax:   4,
 		QueueScanDirtyPercent:    0.25,
 
-		MsgTimeout:    60 * time.Second,
-		MaxMsgTimeout: 15 * time.Minute,
-		MaxMsgSize:    1024 * 1024,
-		MaxBodySize:   5 * 1024 * 1024,
-		MaxReqTimeout: 1 * time.Hour,
-		ClientTimeout: 60 * time.Second,
+		RateSampleInterval: 10 * time.Second,
+
+		FanOutMode:      "copy",
+		MaxDepth:        0,
+		OverflowPolicy:  "error",
+		OverflowTimeout: 1 * time.Second,
+
+		MsgTimeout:     60 * time.Second,
+		MaxMsgTimeout:  15 * time.Minute,
+		MaxMsgSize:     1024 * 1024,
+		MaxBodySize:    5 * 1024 * 1024,
+		MaxReqTimeout:  1 * time.Hour,
+		ClientTimeout:  60 * time.Second,
+		RequeuePolicy:  "fifo",
+		RequeueRatio:   1,
+		MaxMsgAttempts: 0,
+		MsgTTL:         0,
+
+		QueueScheduling:       "random",
+		QueueSchedulingWeight: 1,
+
+		PriorityWeight: 10,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
@@ -138,12 +269,18 @@ func NewOptions() *Options {
 		MinOutputBufferTimeout: 25 * time.Millisecond,
 		OutputBufferTimeout:    250 * time.Millisecond,
 		MaxChannelConsumers:    0,
+		DeliveryPreference:     "none",
+
+		SlowConsumerPolicy: slowConsumerFlag,
 
 		StatsdPrefix:        "nsq.%s",
 		StatsdInterval:      60 * time.Second,
 		StatsdMemStats:      true,
 		StatsdUDPPacketSize: 508,
 
+		AlertInterval:         10 * time.Second,
+		AlertRenotifyInterval: 30 * time.Minute,
+
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
 		DeflateEnabled:  true,
@@ -153,3 +290,32 @@ func NewOptions() *Options {
 		TLSMinVersion: tls.VersionTLS10,
 	}
 }
+
+// redacted is shown instead of the value of a (set) option tagged
+// redact:"true", one that holds secrets
+const redacted = "<redacted>"
+
+// flagString returns the options as the command-line flags that set them,
+// e.g. to log the effective configuration
+func (o *Options) flagString() string {
+	var flags []string
+	v := reflect.ValueOf(o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		val := v.Field(i).Addr().Interface()
+		if v.Type().Field(i).Tag.Get("redact") == "true" && v.Field(i).Len() > 0 {
+			val = redacted
+		} else if s, ok := val.(fmt.Stringer); ok {
+			val = s.String()
+		} else if v.Field(i).Kind() == reflect.String {
+			val = strconv.Quote(v.Field(i).String())
+		} else {
+			val = v.Field(i).Interface()
+		}
+		flags = append(flags, fmt.Sprintf("--%s=%v", name, val))
+	}
+	return strings.Join(flags, " ")
+}
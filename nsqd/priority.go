@@ -0,0 +1,107 @@
+package nsqd
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// message priorities, see PPUB and /pub?priority=
+const (
+	PriorityNormal uint8 = 0
+	PriorityHigh   uint8 = 1
+)
+
+// msgPriorityHeader carries a message's priority in the header block of its
+// stored encoding (see Message.WriteTo), it's taken out again when the
+// message is decoded, so it never reaches clients
+const msgPriorityHeader = "\x00priority"
+
+// parsePriority parses a PPUB or /pub priority param
+func parsePriority(s string) (uint8, bool) {
+	p, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint8(p) > PriorityHigh {
+		return 0, false
+	}
+	return uint8(p), true
+}
+
+// storedHeaders returns the headers to store m with, including its priority
+func (m *Message) storedHeaders() map[string]string {
+	if m.Priority == PriorityNormal {
+		return m.Headers
+	}
+	headers := make(map[string]string, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[msgPriorityHeader] = strconv.Itoa(int(m.Priority))
+	return headers
+}
+
+// takePriorityHeader sets m's priority from the headers it was decoded with
+// (which are m's own), leaving the others
+func (m *Message) takePriorityHeader() {
+	v, ok := m.Headers[msgPriorityHeader]
+	if !ok {
+		return
+	}
+	m.Priority, _ = parsePriority(v)
+	delete(m.Headers, msgPriorityHeader)
+	if len(m.Headers) == 0 {
+		m.Headers = nil
+	}
+}
+
+// priorityQueue is the in-memory queue of a topic's or channel's high
+// priority messages. They're taken ahead of the others, but no more than
+// --priority-weight in a row while there are others waiting.
+type priorityQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	// high priority messages taken since the last other one
+	inARow int64
+
+	weight  int64
+	msgChan chan *Message // nil with --mem-queue-size=0
+}
+
+func newPriorityQueue(opts *Options) *priorityQueue {
+	q := &priorityQueue{weight: int64(opts.PriorityWeight)}
+	if opts.MemQueueSize > 0 {
+		q.msgChan = make(chan *Message, opts.MemQueueSize)
+	}
+	return q
+}
+
+// turn returns msgChan, to take a message from ahead of the others, or nil
+// if it's the others' turn (which only are if othersWaiting)
+func (q *priorityQueue) turn(othersWaiting bool) chan *Message {
+	if othersWaiting && atomic.LoadInt64(&q.inARow) >= q.weight {
+		return nil
+	}
+	return q.msgChan
+}
+
+// took records that msg, of either priority, was taken
+func (q *priorityQueue) took(msg *Message) {
+	if msg.Priority > PriorityNormal {
+		atomic.AddInt64(&q.inARow, 1)
+	} else if atomic.LoadInt64(&q.inARow) != 0 {
+		atomic.StoreInt64(&q.inARow, 0)
+	}
+}
+
+func (q *priorityQueue) depth() int64 {
+	return int64(len(q.msgChan))
+}
+
+// drain takes the messages queued, calling fn with each
+func (q *priorityQueue) drain(fn func(*Message)) {
+	for {
+		select {
+		case msg := <-q.msgChan:
+			fn(msg)
+		default:
+			return
+		}
+	}
+}
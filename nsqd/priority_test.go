@@ -0,0 +1,112 @@
+package nsqd
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMessagePriorityRoundTrip(t *testing.T) {
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+
+	msg := NewMessage(id, []byte("body"))
+	msg.Priority = PriorityHigh
+
+	buf := &bytes.Buffer{}
+	_, err := msg.WriteTo(buf)
+	test.Nil(t, err)
+	out, err := decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, PriorityHigh, out.Priority)
+	test.Equal(t, 0, len(out.Headers))
+	test.Equal(t, []byte("body"), out.Body)
+
+	msg.Headers = map[string]string{"type": "order"}
+	buf.Reset()
+	_, err = msg.WriteTo(buf)
+	test.Nil(t, err)
+	out, err = decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, PriorityHigh, out.Priority)
+	test.Equal(t, msg.Headers, out.Headers)
+
+	// clients don't see it
+	buf.Reset()
+	_, err = msg.writeTo(buf, true)
+	test.Nil(t, err)
+	out, err = decodeMessage(buf.Bytes())
+	test.Nil(t, err)
+	test.Equal(t, PriorityNormal, out.Priority)
+	test.Equal(t, msg.Headers, out.Headers)
+}
+
+func TestChannelPriorityWeight(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PriorityWeight = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_priority_weight" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	for i := 0; i < 3; i++ {
+		test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("normal"))))
+	}
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("high"))
+		msg.Priority = PriorityHigh
+		test.Nil(t, channel.PutMessage(msg))
+	}
+	test.Equal(t, int64(8), channel.Depth())
+
+	next := func() string {
+		var msg *Message
+		select {
+		case msg = <-channel.priorityDeliveryChan():
+		default:
+			msg = <-channel.memoryMsgChan
+		}
+		channel.priority.took(msg)
+		return string(msg.Body)
+	}
+	var got []string
+	for i := 0; i < 8; i++ {
+		got = append(got, next())
+	}
+	test.Equal(t, []string{"high", "high", "normal", "high", "high", "normal", "high", "normal"}, got)
+}
+
+func TestTopicPriority(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_priority" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	channel := topic.GetChannel("ch")
+
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("normal"))))
+	msg := NewMessage(topic.GenerateID(), []byte("high"))
+	msg.Priority = PriorityHigh
+	test.Nil(t, topic.PutMessage(msg))
+	test.Equal(t, int64(2), topic.Depth())
+
+	// the high priority message is passed on first, and ends up in the
+	// channel's high priority queue
+	topic.UnPause()
+	msg = <-channel.priority.msgChan
+	test.Equal(t, []byte("high"), msg.Body)
+	msg = <-channel.memoryMsgChan
+	test.Equal(t, []byte("normal"), msg.Body)
+}
@@ -0,0 +1,192 @@
+package nsqd
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// topicMetric is a metric family of /metrics with a sample per topic
+type topicMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(TopicStats) float64
+}
+
+// channelMetric is a metric family of /metrics with a sample per channel
+type channelMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(ChannelStats) float64
+}
+
+var topicMetrics = []topicMetric{
+	{"nsq_topic_depth", "gauge", "Messages queued in the topic (memory and backend).",
+		func(s TopicStats) float64 { return float64(s.Depth) }},
+	{"nsq_topic_backend_depth", "gauge", "Messages queued in the topic's backend.",
+		func(s TopicStats) float64 { return float64(s.BackendDepth) }},
+	{"nsq_topic_backend_disk_bytes", "gauge", "Size of the files of the topic's backend.",
+		func(s TopicStats) float64 { return float64(s.BackendDiskBytes) }},
+	{"nsq_topic_backend_throttled_writes_total", "counter", "Writes to the topic's backend that waited on its max_disk_write_rate.",
+		func(s TopicStats) float64 { return float64(s.BackendThrottledWrites) }},
+	{"nsq_topic_backend_uncompressed_bytes_total", "counter", "Bytes of messages written to the topic's backend, before compression.",
+		func(s TopicStats) float64 { return float64(s.BackendUncompressedBytes) }},
+	{"nsq_topic_backend_compressed_bytes_total", "counter", "Bytes of messages written to the topic's backend, after compression.",
+		func(s TopicStats) float64 { return float64(s.BackendCompressedBytes) }},
+	{"nsq_topic_messages_total", "counter", "Messages published to the topic.",
+		func(s TopicStats) float64 { return float64(s.MessageCount) }},
+	{"nsq_topic_message_bytes_total", "counter", "Bytes of message bodies published to the topic.",
+		func(s TopicStats) float64 { return float64(s.MessageBytes) }},
+	{"nsq_topic_overflow_total", "counter", "Publishes rejected or messages dropped by the topic's overflow policy.",
+		func(s TopicStats) float64 { return float64(s.OverflowCount) }},
+	{"nsq_topic_rate_limited_total", "counter", "Published messages rejected by the topic's max_publish_rate.",
+		func(s TopicStats) float64 { return float64(s.RateLimitedCount) }},
+	{"nsq_topic_quota_exceeded_total", "counter", "Published messages rejected by the topic's daily_byte_quota.",
+		func(s TopicStats) float64 { return float64(s.QuotaExceededCount) }},
+	{"nsq_topic_dedup_hits_total", "counter", "Published messages dropped as duplicates by the topic's dedup window.",
+		func(s TopicStats) float64 { return float64(s.DedupHitCount) }},
+	{"nsq_topic_dedup_misses_total", "counter", "Published messages checked against the topic's dedup window and let through.",
+		func(s TopicStats) float64 { return float64(s.DedupMissCount) }},
+	{"nsq_topic_paused", "gauge", "Whether the topic is paused.",
+		func(s TopicStats) float64 { return boolMetric(s.Paused) }},
+}
+
+var channelMetrics = []channelMetric{
+	{"nsq_channel_depth", "gauge", "Messages queued in the channel (memory and backend).",
+		func(s ChannelStats) float64 { return float64(s.Depth) }},
+	{"nsq_channel_backend_depth", "gauge", "Messages queued in the channel's backend.",
+		func(s ChannelStats) float64 { return float64(s.BackendDepth) }},
+	{"nsq_channel_backend_disk_bytes", "gauge", "Size of the files of the channel's backend.",
+		func(s ChannelStats) float64 { return float64(s.BackendDiskBytes) }},
+	{"nsq_channel_backend_throttled_writes_total", "counter", "Writes to the channel's backend that waited on its max_disk_write_rate.",
+		func(s ChannelStats) float64 { return float64(s.BackendThrottledWrites) }},
+	{"nsq_channel_backend_uncompressed_bytes_total", "counter", "Bytes of messages written to the channel's backend, before compression.",
+		func(s ChannelStats) float64 { return float64(s.BackendUncompressedBytes) }},
+	{"nsq_channel_backend_compressed_bytes_total", "counter", "Bytes of messages written to the channel's backend, after compression.",
+		func(s ChannelStats) float64 { return float64(s.BackendCompressedBytes) }},
+	{"nsq_channel_in_flight", "gauge", "Messages sent to clients and not yet finished, requeued or timed out.",
+		func(s ChannelStats) float64 { return float64(s.InFlightCount) }},
+	{"nsq_channel_deferred", "gauge", "Messages requeued with a delay or published deferred.",
+		func(s ChannelStats) float64 { return float64(s.DeferredCount) }},
+	{"nsq_channel_messages_total", "counter", "Messages put in the channel.",
+		func(s ChannelStats) float64 { return float64(s.MessageCount) }},
+	{"nsq_channel_requeued_total", "counter", "Messages requeued by clients.",
+		func(s ChannelStats) float64 { return float64(s.RequeueCount) }},
+	{"nsq_channel_timed_out_total", "counter", "In-flight messages that timed out.",
+		func(s ChannelStats) float64 { return float64(s.TimeoutCount) }},
+	{"nsq_channel_discarded_total", "counter", "Messages discarded after --max-msg-attempts deliveries.",
+		func(s ChannelStats) float64 { return float64(s.DiscardCount) }},
+	{"nsq_channel_expired_total", "counter", "Messages dropped for being older than their TTL.",
+		func(s ChannelStats) float64 { return float64(s.ExpiredCount) }},
+	{"nsq_channel_filtered_total", "counter", "Messages finished without delivery for not matching a client's SUB filter.",
+		func(s ChannelStats) float64 { return float64(s.FilteredCount) }},
+	{"nsq_channel_dead_lettered_total", "counter", "Messages republished to the channel's dead-letter topic.",
+		func(s ChannelStats) float64 { return float64(s.DeadLetterCount) }},
+	{"nsq_channel_archived_total", "counter", "Copies of delivered messages archived.",
+		func(s ChannelStats) float64 { return float64(s.ArchivedCount) }},
+	{"nsq_channel_archive_dropped_total", "counter", "Copies of delivered messages that couldn't be archived.",
+		func(s ChannelStats) float64 { return float64(s.ArchiveDroppedCount) }},
+	{"nsq_channel_clients", "gauge", "Clients subscribed to the channel.",
+		func(s ChannelStats) float64 { return float64(s.ClientCount) }},
+	{"nsq_channel_paused", "gauge", "Whether the channel is paused.",
+		func(s ChannelStats) float64 { return boolMetric(s.Paused) }},
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetric writes one sample, labels are name/value pairs
+func writeMetric(w io.Writer, name string, value float64, labels ...string) {
+	io.WriteString(w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(w, `%s%s="%s"`, sep, labels[i], labelValueReplacer.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func writeMetricHeader(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writePrometheusMetrics writes the topic, channel and client stats, the
+// counts of expired topics and channels (see --idle-expiry) and the Go
+// runtime's in the Prometheus text format
+func writePrometheusMetrics(w io.Writer, stats []TopicStats, producerCount int,
+	expiredTopics uint64, expiredChannels uint64) {
+	for _, m := range topicMetrics {
+		writeMetricHeader(w, m.name, m.typ, m.help)
+		for _, t := range stats {
+			writeMetric(w, m.name, m.value(t), "topic", t.TopicName)
+		}
+	}
+	for _, m := range channelMetrics {
+		writeMetricHeader(w, m.name, m.typ, m.help)
+		for _, t := range stats {
+			for _, c := range t.Channels {
+				writeMetric(w, m.name, m.value(c), "topic", t.TopicName, "channel", c.ChannelName)
+			}
+		}
+	}
+
+	writeMetricHeader(w, "nsq_channel_e2e_processing_latency_seconds", "gauge",
+		"Quantiles of the time from publish to finish of the channel's messages.")
+	for _, t := range stats {
+		for _, c := range t.Channels {
+			if c.E2eProcessingLatency == nil {
+				continue
+			}
+			for _, item := range c.E2eProcessingLatency.Percentiles {
+				writeMetric(w, "nsq_channel_e2e_processing_latency_seconds", item["value"]/1e9,
+					"topic", t.TopicName, "channel", c.ChannelName,
+					"quantile", strconv.FormatFloat(item["quantile"], 'f', -1, 64))
+			}
+		}
+	}
+
+	writeMetricHeader(w, "nsq_producers", "gauge", "Clients connected over TCP that have published.")
+	writeMetric(w, "nsq_producers", float64(producerCount))
+
+	writeMetricHeader(w, "nsq_expired_topics_total", "counter", "Topics deleted after --idle-expiry without clients or publishes.")
+	writeMetric(w, "nsq_expired_topics_total", float64(expiredTopics))
+	writeMetricHeader(w, "nsq_expired_channels_total", "counter", "Channels deleted after --idle-expiry without clients or publishes.")
+	writeMetric(w, "nsq_expired_channels_total", float64(expiredChannels))
+
+	ms := getMemStats()
+	writeMetricHeader(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	writeMetric(w, "go_goroutines", float64(runtime.NumGoroutine()))
+	writeMetricHeader(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	writeMetric(w, "go_memstats_heap_objects", float64(ms.HeapObjects))
+	writeMetricHeader(w, "go_memstats_heap_idle_bytes", "gauge", "Number of heap bytes waiting to be used.")
+	writeMetric(w, "go_memstats_heap_idle_bytes", float64(ms.HeapIdleBytes))
+	writeMetricHeader(w, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	writeMetric(w, "go_memstats_heap_inuse_bytes", float64(ms.HeapInUseBytes))
+	writeMetricHeader(w, "go_memstats_heap_released_bytes", "gauge", "Number of heap bytes released to OS.")
+	writeMetric(w, "go_memstats_heap_released_bytes", float64(ms.HeapReleasedBytes))
+	writeMetricHeader(w, "go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.")
+	writeMetric(w, "go_memstats_next_gc_bytes", float64(ms.NextGCBytes))
+	writeMetricHeader(w, "go_gc_runs_total", "counter", "Number of completed GC cycles.")
+	writeMetric(w, "go_gc_runs_total", float64(ms.GCTotalRuns))
+	writeMetricHeader(w, "go_gc_pause_seconds", "gauge", "Quantiles of the recent GC pauses.")
+	writeMetric(w, "go_gc_pause_seconds", float64(ms.GCPauseUsec95)/1e6, "quantile", "0.95")
+	writeMetric(w, "go_gc_pause_seconds", float64(ms.GCPauseUsec99)/1e6, "quantile", "0.99")
+	writeMetric(w, "go_gc_pause_seconds", float64(ms.GCPauseUsec100)/1e6, "quantile", "1")
+}
@@ -27,6 +27,7 @@ const (
 
 var separatorBytes = []byte(" ")
 var heartbeatBytes = []byte("_heartbeat_")
+var timeoutWarningBytes = []byte("_timeout_warning_ ")
 var okBytes = []byte("OK")
 
 type protocolV2 struct {
@@ -116,23 +117,36 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	close(client.ExitChan)
 	if client.Channel != nil {
 		client.Channel.RemoveClient(client.ID)
+		client.Channel.requeueInFlight(client.ID)
 	}
 
 	p.nsqd.RemoveClient(client.ID)
 	return err
 }
 
-func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
+// SendMessage puts msg in flight on subChannel and writes it to client,
+// who gets a timeout warning timeoutWarning before it times out (if > 0)
+func (p *protocolV2) SendMessage(client *clientV2, subChannel *Channel, msg *Message, msgTimeout time.Duration, timeoutWarning time.Duration) error {
 	p.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
 
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
 
-	_, err := msg.WriteTo(buf)
+	_, err := msg.writeTo(buf, client.MsgHeaders)
 	if err != nil {
 		return err
 	}
 
+	// msg must not be touched once it is in flight, it can be FIN'd
+	// (and released to the pool) at any time
+	subChannel.startInFlightTimeout(msg, client.ID, msgTimeout, timeoutWarning)
+	client.SendingMessage()
+	if client.IsForwarder() {
+		atomic.AddUint64(&subChannel.forwardedDeliveryCount, 1)
+	} else {
+		atomic.AddUint64(&subChannel.localDeliveryCount, 1)
+	}
+
 	err = p.Send(client, frameTypeMessage, buf.Bytes())
 	if err != nil {
 		return err
@@ -159,6 +173,8 @@ func (p *protocolV2) Send(client *clientV2, frameType int32, data []byte) error
 
 	if frameType != frameTypeMessage {
 		err = client.Flush()
+	} else {
+		client.updateOutputBuffer()
 	}
 
 	client.writeLock.Unlock()
@@ -166,6 +182,24 @@ func (p *protocolV2) Send(client *clientV2, frameType int32, data []byte) error
 	return err
 }
 
+// timeoutWarningLead returns how long before msgTimeout a client that asked
+// for a warning after fraction of it should be warned (0 if it didn't)
+func timeoutWarningLead(msgTimeout time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return 0
+	}
+	return msgTimeout - time.Duration(fraction*float64(msgTimeout))
+}
+
+func (p *protocolV2) decodeBackendMessage(channel *Channel, b []byte) *Message {
+	msg, err := decodeBackendMessage(channel.backend, b, p.nsqd.getOpts().MessagePool)
+	if err != nil {
+		p.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+		return nil
+	}
+	return msg
+}
+
 func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 	if bytes.Equal(params[0], []byte("IDENTIFY")) {
 		return p.IDENTIFY(client, params)
@@ -174,6 +208,10 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if p.nsqd.IsDraining() && isDrainRefused(params[0]) {
+		return nil, protocol.NewFatalClientErr(nil, "E_DRAINING",
+			fmt.Sprintf("%s failed nsqd is draining", params[0]))
+	}
 	switch {
 	case bytes.Equal(params[0], []byte("FIN")):
 		return p.FIN(client, params)
@@ -187,6 +225,8 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.MPUB(client, params)
 	case bytes.Equal(params[0], []byte("DPUB")):
 		return p.DPUB(client, params)
+	case bytes.Equal(params[0], []byte("PPUB")):
+		return p.PPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
@@ -205,6 +245,8 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	var err error
 	var memoryMsgChan chan *Message
 	var backendMsgChan <-chan []byte
+	var requeueMsgChan chan *Message
+	var priorityMsgChan chan *Message
 	var subChannel *Channel
 	// NOTE: `flusherChan` is used to bound message latency for
 	// the pathological case of a channel on a low volume topic
@@ -218,6 +260,22 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	heartbeatTicker := time.NewTicker(client.HeartbeatInterval)
 	heartbeatChan := heartbeatTicker.C
 	msgTimeout := client.MsgTimeout
+	var msgTimeoutWarning float64
+
+	// number of new messages sent since the last requeued one,
+	// used to interleave the two with --requeue-policy=ratio
+	requeuePolicy := p.nsqd.getOpts().RequeuePolicy
+	requeueRatio := p.nsqd.getOpts().RequeueRatio
+	newSinceRequeue := 0
+
+	// with --delivery-preference, a client that should give way to the
+	// channel's preferred consumers stops reading and re-checks periodically
+	deliveryPreference := p.nsqd.getOpts().DeliveryPreference
+	var yieldTicker *time.Ticker
+	var yieldChan <-chan time.Time
+
+	// fires once the channel's max_delivery_rate allows another delivery
+	var rateLimitChan <-chan time.Time
 
 	// v2 opportunistically buffers data to clients to reduce write system calls
 	// we force flush in two cases:
@@ -227,6 +285,9 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	//
 	flushed := true
 
+	atomic.StoreInt32(&client.pumpRunning, 1)
+	defer atomic.StoreInt32(&client.pumpRunning, 0)
+
 	// signal to the goroutine that started the messagePump
 	// that we've started up
 	close(startedChan)
@@ -236,6 +297,7 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			// the client is not ready to receive messages...
 			memoryMsgChan = nil
 			backendMsgChan = nil
+			requeueMsgChan = nil
 			flusherChan = nil
 			// force flush
 			client.writeLock.Lock()
@@ -248,105 +310,199 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 		} else if flushed {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
-			memoryMsgChan = subChannel.memoryMsgChan
-			backendMsgChan = subChannel.backend.ReadChan()
+			memoryMsgChan, backendMsgChan, requeueMsgChan = subChannel.deliveryChans()
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
-			memoryMsgChan = subChannel.memoryMsgChan
-			backendMsgChan = subChannel.backend.ReadChan()
+			memoryMsgChan, backendMsgChan, requeueMsgChan = subChannel.deliveryChans()
 			flusherChan = outputBufferTicker.C
 		}
 
-		select {
-		case <-flusherChan:
-			// if this case wins, we're either starved
-			// or we won the race between other channels...
-			// in either case, force flush
-			client.writeLock.Lock()
-			err = client.Flush()
-			client.writeLock.Unlock()
-			if err != nil {
-				goto exit
+		yieldChan = nil
+		if memoryMsgChan != nil && p.mayYieldDelivery(client, deliveryPreference) {
+			// re-check periodically whether to yield, a preferred consumer
+			// becoming ready doesn't wake this loop
+			if yieldTicker == nil {
+				yieldTicker = time.NewTicker(10 * time.Millisecond)
 			}
-			flushed = true
-		case <-client.ReadyStateChan:
-		case subChannel = <-subEventChan:
-			// you can't SUB anymore
-			subEventChan = nil
-		case identifyData := <-identifyEventChan:
-			// you can't IDENTIFY anymore
-			identifyEventChan = nil
-
-			outputBufferTicker.Stop()
-			if identifyData.OutputBufferTimeout > 0 {
-				outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
+			yieldChan = yieldTicker.C
+			if subChannel.hasReadyConsumers(deliveryPreference == "forwarder") {
+				memoryMsgChan = nil
+				backendMsgChan = nil
+				requeueMsgChan = nil
 			}
+		}
 
-			heartbeatTicker.Stop()
-			heartbeatChan = nil
-			if identifyData.HeartbeatInterval > 0 {
-				heartbeatTicker = time.NewTicker(identifyData.HeartbeatInterval)
-				heartbeatChan = heartbeatTicker.C
+		rateLimitChan = nil
+		if memoryMsgChan != nil {
+			if wait := subChannel.deliveryLimit.wait(); wait > 0 {
+				memoryMsgChan = nil
+				backendMsgChan = nil
+				requeueMsgChan = nil
+				rateLimitChan = time.After(wait)
 			}
+		}
 
-			if identifyData.SampleRate > 0 {
-				sampleRate = identifyData.SampleRate
-			}
+		priorityMsgChan = nil
+		if memoryMsgChan != nil {
+			priorityMsgChan = subChannel.priorityDeliveryChan()
+		}
 
-			msgTimeout = identifyData.MsgTimeout
-		case <-heartbeatChan:
-			err = p.Send(client, frameTypeResponse, heartbeatBytes)
-			if err != nil {
-				goto exit
+		var msg *Message
+		if priorityMsgChan != nil {
+			// high priority messages go first, unless it's the others' turn
+			select {
+			case msg = <-priorityMsgChan:
+			default:
 			}
-		case b := <-backendMsgChan:
-			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
-				continue
-			}
-
-			msg, err := decodeMessage(b)
-			if err != nil {
-				p.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
-				continue
+		}
+		if msg == nil && requeueMsgChan != nil {
+			// give one of the two streams precedence (when it has anything
+			// to offer) according to the requeue policy, otherwise fall
+			// through to the select below where they compete equally
+			if requeuePolicy == "requeue-first" || newSinceRequeue >= requeueRatio {
+				select {
+				case msg = <-requeueMsgChan:
+				default:
+				}
+			} else {
+				select {
+				case msg = <-memoryMsgChan:
+				case b := <-backendMsgChan:
+					msg = p.decodeBackendMessage(subChannel, b)
+					if msg == nil {
+						continue
+					}
+				default:
+				}
 			}
-			msg.Attempts++
+		}
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
-			client.SendingMessage()
-			err = p.SendMessage(client, msg)
-			if err != nil {
+		if msg == nil {
+			select {
+			case <-flusherChan:
+				// if this case wins, we're either starved
+				// or we won the race between other channels...
+				// in either case, force flush
+				client.writeLock.Lock()
+				err = client.Flush()
+				client.writeLock.Unlock()
+				if err != nil {
+					goto exit
+				}
+				flushed = true
+			case <-client.ReadyStateChan:
+			case <-yieldChan:
+			case <-rateLimitChan:
+			case subChannel = <-subEventChan:
+				// you can't SUB anymore
+				subEventChan = nil
+				atomic.AddInt64(&subChannel.goroutines, 1)
+			case identifyData := <-identifyEventChan:
+				// you can't IDENTIFY anymore
+				identifyEventChan = nil
+
+				outputBufferTicker.Stop()
+				if identifyData.OutputBufferTimeout > 0 {
+					outputBufferTicker = time.NewTicker(identifyData.OutputBufferTimeout)
+				}
+
+				heartbeatTicker.Stop()
+				heartbeatChan = nil
+				if identifyData.HeartbeatInterval > 0 {
+					heartbeatTicker = time.NewTicker(identifyData.HeartbeatInterval)
+					heartbeatChan = heartbeatTicker.C
+				}
+
+				if identifyData.SampleRate > 0 {
+					sampleRate = identifyData.SampleRate
+				}
+
+				msgTimeout = identifyData.MsgTimeout
+				msgTimeoutWarning = identifyData.MsgTimeoutWarning
+			case <-heartbeatChan:
+				err = p.Send(client, frameTypeResponse, heartbeatBytes)
+				if err != nil {
+					goto exit
+				}
+			case <-client.TimeoutWarningChan:
+				for _, id := range client.takeTimeoutWarnings() {
+					buf := make([]byte, 0, len(timeoutWarningBytes)+MsgIDLength)
+					buf = append(append(buf, timeoutWarningBytes...), id[:]...)
+					err = p.Send(client, frameTypeResponse, buf)
+					if err != nil {
+						goto exit
+					}
+				}
+			case b := <-backendMsgChan:
+				msg = p.decodeBackendMessage(subChannel, b)
+			case msg = <-memoryMsgChan:
+			case msg = <-requeueMsgChan:
+			case msg = <-priorityMsgChan:
+			case <-client.ExitChan:
 				goto exit
 			}
-			flushed = false
-		case msg := <-memoryMsgChan:
-			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+			if msg == nil {
 				continue
 			}
-			msg.Attempts++
+		}
+		subChannel.priority.took(msg)
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
-			client.SendingMessage()
-			err = p.SendMessage(client, msg)
-			if err != nil {
-				goto exit
-			}
-			flushed = false
-		case <-client.ExitChan:
+		if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+			continue
+		}
+		if client.filter != nil && !client.filter.match(msg.Headers) {
+			subChannel.filterMessage(msg)
+			continue
+		}
+		if subChannel.expired(msg) {
+			subChannel.expireMessage(msg)
+			continue
+		}
+		subChannel.deliveryLimit.take(1)
+		msg.Attempts++
+		if msg.Attempts > 1 {
+			newSinceRequeue = 0
+		} else {
+			newSinceRequeue++
+		}
+
+		timeout := subChannel.msgTimeout(msgTimeout)
+		err = p.SendMessage(client, subChannel, msg, timeout, timeoutWarningLead(timeout, msgTimeoutWarning))
+		if err != nil {
 			goto exit
 		}
+		flushed = false
 	}
 
 exit:
 	p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
+	if yieldTicker != nil {
+		yieldTicker.Stop()
+	}
+	if subChannel != nil {
+		atomic.AddInt64(&subChannel.goroutines, -1)
+	}
 	if err != nil {
 		p.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] messagePump error - %s", client, err)
 	}
 }
 
+// mayYieldDelivery returns whether client is one that gives way to the
+// consumers favoured by the delivery preference (whenever one is ready)
+func (p *protocolV2) mayYieldDelivery(client *clientV2, preference string) bool {
+	switch preference {
+	case "local":
+		return client.IsForwarder()
+	case "forwarder":
+		return !client.IsForwarder()
+	}
+	return false
+}
+
 func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -410,24 +566,28 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 	}
 
 	resp, err := json.Marshal(struct {
-		MaxRdyCount         int64  `json:"max_rdy_count"`
-		Version             string `json:"version"`
-		MaxMsgTimeout       int64  `json:"max_msg_timeout"`
-		MsgTimeout          int64  `json:"msg_timeout"`
-		TLSv1               bool   `json:"tls_v1"`
-		Deflate             bool   `json:"deflate"`
-		DeflateLevel        int    `json:"deflate_level"`
-		MaxDeflateLevel     int    `json:"max_deflate_level"`
-		Snappy              bool   `json:"snappy"`
-		SampleRate          int32  `json:"sample_rate"`
-		AuthRequired        bool   `json:"auth_required"`
-		OutputBufferSize    int    `json:"output_buffer_size"`
-		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		MaxRdyCount         int64   `json:"max_rdy_count"`
+		Version             string  `json:"version"`
+		MaxMsgTimeout       int64   `json:"max_msg_timeout"`
+		MsgTimeout          int64   `json:"msg_timeout"`
+		MsgTimeoutWarning   float64 `json:"msg_timeout_warning"`
+		TLSv1               bool    `json:"tls_v1"`
+		Deflate             bool    `json:"deflate"`
+		DeflateLevel        int     `json:"deflate_level"`
+		MaxDeflateLevel     int     `json:"max_deflate_level"`
+		Snappy              bool    `json:"snappy"`
+		SampleRate          int32   `json:"sample_rate"`
+		AuthRequired        bool    `json:"auth_required"`
+		OutputBufferSize    int     `json:"output_buffer_size"`
+		OutputBufferTimeout int64   `json:"output_buffer_timeout"`
+		MsgHeaders          bool    `json:"msg_headers"`
+		PublishDurability   string  `json:"publish_durability,omitempty"`
 	}{
 		MaxRdyCount:         p.nsqd.getOpts().MaxRdyCount,
 		Version:             version.Binary,
 		MaxMsgTimeout:       int64(p.nsqd.getOpts().MaxMsgTimeout / time.Millisecond),
 		MsgTimeout:          int64(client.MsgTimeout / time.Millisecond),
+		MsgTimeoutWarning:   client.MsgTimeoutWarning,
 		TLSv1:               tlsv1,
 		Deflate:             deflate,
 		DeflateLevel:        deflateLevel,
@@ -437,6 +597,8 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired:        p.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		MsgHeaders:          client.MsgHeaders,
+		PublishDurability:   client.PublishDurability,
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -578,6 +740,16 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 				fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topicName, channelName))
 		}
 	}
+	// and if there are TLS client authorizations, so must its certificate
+	if p.nsqd.tlsClientAuthorizations != nil && !client.isTLSAuthorized(topicName, channelName) {
+		return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("TLS client certificate not authorized for %s on %q %q", cmd, topicName, channelName))
+	}
+	// and if the topic's namespace has identities, it must have one
+	if !p.nsqd.isNamespaceAuthorized(topicName, client.identities()) {
+		return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("namespace not authorized for %s on %q", cmd, topicName))
+	}
 	return nil
 }
 
@@ -594,6 +766,16 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUB insufficient number of parameters")
 	}
 
+	// an optional filter on message headers
+	var filter msgFilter
+	if len(params) > 3 {
+		var err error
+		filter, err = parseMsgFilter(string(params[3]))
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "SUB "+err.Error())
+		}
+	}
+
 	topicName := string(params[1])
 	if !protocol.IsValidTopicName(topicName) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
@@ -609,6 +791,9 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err := p.CheckAuth(client, "SUB", topicName, channelName); err != nil {
 		return nil, err
 	}
+	if err := p.admitTopic("SUB", topicName); err != nil {
+		return nil, err
+	}
 
 	// This retry-loop is a work-around for a race condition, where the
 	// last client can leave the channel between GetChannel() and AddClient().
@@ -616,6 +801,11 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var channel *Channel
 	for {
 		topic := p.nsqd.GetTopic(topicName)
+		if n := topic.Partitions(); n > 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+				fmt.Sprintf("SUB topic %q is partitioned, subscribe to %s ... %s",
+					topicName, partitionName(topicName, 0), partitionName(topicName, n-1)))
+		}
 		channel = topic.GetChannel(channelName)
 		if err := channel.AddClient(client.ID, client); err != nil {
 			return nil, protocol.NewFatalClientErr(nil, "E_TOO_MANY_CHANNEL_CONSUMERS",
@@ -632,6 +822,7 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	}
 	atomic.StoreInt32(&client.State, stateSubscribed)
 	client.Channel = channel
+	client.filter = filter
 	// update message pump
 	client.SubEventChan <- channel
 
@@ -737,7 +928,21 @@ func (p *protocolV2) REQ(client *clientV2, params [][]byte) ([]byte, error) {
 		timeoutDuration = clampedTimeout
 	}
 
-	err = client.Channel.RequeueMessage(client.ID, *id, timeoutDuration)
+	// params are split on spaces, so a reason detail with any would be cut
+	// (other trailing params are ignored, as they always were)
+	if len(params) > 4 && bytes.IndexByte(params[3], ':') >= 0 {
+		return nil, protocol.NewClientErr(nil, "E_INVALID", "REQ reason detail can't contain spaces")
+	}
+
+	reason := RequeueReasonUnspecified
+	if len(params) > 3 {
+		var detail string
+		reason, detail = parseRequeueReason(params[3])
+		p.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] REQ %s reason %s %s",
+			client, *id, reason, detail)
+	}
+
+	err = client.Channel.RequeueMessage(client.ID, *id, timeoutDuration, reason)
 	if err != nil {
 		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
 			fmt.Sprintf("REQ %s failed %s", *id, err.Error()))
@@ -759,6 +964,7 @@ func (p *protocolV2) CLS(client *clientV2, params [][]byte) ([]byte, error) {
 }
 
 func (p *protocolV2) NOP(client *clientV2, params [][]byte) ([]byte, error) {
+	atomic.StoreInt64(&client.lastHeartbeat, time.Now().UnixNano())
 	return nil, nil
 }
 
@@ -790,7 +996,8 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
 	}
 
-	messageBody := make([]byte, bodyLen)
+	pooled := p.nsqd.getOpts().MessagePool
+	messageBody, pb := newMessageBody(int(bodyLen), pooled)
 	_, err = io.ReadFull(client.Reader, messageBody)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body")
@@ -799,13 +1006,43 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err := p.CheckAuth(client, "PUB", topicName, ""); err != nil {
 		return nil, err
 	}
+	if err := p.admitTopic("PUB", topicName); err != nil {
+		return nil, err
+	}
 
-	topic := p.nsqd.GetTopic(topicName)
-	msg := NewMessage(topic.GenerateID(), messageBody)
-	err = topic.PutMessage(msg)
+	topic := p.nsqd.GetTopic(topicName).partition(partitionKey(params, 2))
+	msg := newMessage(topic.GenerateID(), messageBody, pb, pooled)
+	if err := readMessageHeaders(client, msg); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB "+err.Error())
+	}
+	msgs, dedupKeys := topic.dedup([]*Message{msg})
+	if len(msgs) == 0 {
+		// a re-publish within the topic's dedup window, dropped
+		client.PublishedMessage(topicName, 1)
+		return okBytes, nil
+	}
+	if err := topic.admitPublish(1, len(messageBody)); err != nil {
+		return nil, admitErr("PUB", err)
+	}
+	replication := topic.replication(msgs)
+	if client.PublishDurability == DurabilityFsync {
+		err = topic.PutMessagesDurable(msgs)
+	} else {
+		err = topic.PutMessage(msg)
+	}
+	if err == ErrTopicFull {
+		return nil, protocol.NewClientErr(err, "E_TOPIC_FULL", "PUB failed "+err.Error())
+	}
+	if err == ErrNotDurable {
+		return nil, protocol.NewClientErr(err, "E_NOT_DURABLE", "PUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, protocol.NewClientErr(err, "E_REPLICATION_FAILED", "PUB failed "+err.Error())
+	}
 
 	client.PublishedMessage(topicName, 1)
 
@@ -828,8 +1065,11 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
 		return nil, err
 	}
+	if err := p.admitTopic("MPUB", topicName); err != nil {
+		return nil, err
+	}
 
-	topic := p.nsqd.GetTopic(topicName)
+	topic := p.nsqd.GetTopic(topicName).partition(partitionKey(params, 2))
 
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
@@ -847,20 +1087,55 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	}
 
 	messages, err := readMPUB(client.Reader, client.lenSlice, topic,
-		p.nsqd.getOpts().MaxMsgSize, p.nsqd.getOpts().MaxBodySize)
+		p.nsqd.getOpts().MaxMsgSize, p.nsqd.getOpts().MaxBodySize, p.nsqd.getOpts().MessagePool)
 	if err != nil {
 		return nil, err
 	}
+	for _, m := range messages {
+		if err := readMessageHeaders(client, m); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB "+err.Error())
+		}
+	}
+
+	published := len(messages)
+	messages, dedupKeys := topic.dedup(messages)
+	if len(messages) == 0 {
+		client.PublishedMessage(topicName, uint64(published))
+		return okBytes, nil
+	}
+	size := 0
+	for _, m := range messages {
+		size += len(m.Body)
+	}
+	if err := topic.admitPublish(len(messages), size); err != nil {
+		return nil, admitErr("MPUB", err)
+	}
+	replication := topic.replication(messages)
 
 	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
-	// this next call (and no messages will be queued in that case)
-	err = topic.PutMessages(messages)
+	// the only possible errors are that the topic is exiting during
+	// this next call or a failed backend write (and no messages will
+	// be queued in either case)
+	if client.PublishDurability == DurabilityFsync {
+		err = topic.PutMessagesDurable(messages)
+	} else {
+		err = topic.PutMessages(messages)
+	}
+	if err == ErrTopicFull {
+		return nil, protocol.NewClientErr(err, "E_TOPIC_FULL", "MPUB failed "+err.Error())
+	}
+	if err == ErrNotDurable {
+		return nil, protocol.NewClientErr(err, "E_NOT_DURABLE", "MPUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
 	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, protocol.NewClientErr(err, "E_REPLICATION_FAILED", "MPUB failed "+err.Error())
+	}
 
-	client.PublishedMessage(topicName, uint64(len(messages)))
+	client.PublishedMessage(topicName, uint64(published))
 
 	return okBytes, nil
 }
@@ -906,7 +1181,8 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("DPUB message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
 	}
 
-	messageBody := make([]byte, bodyLen)
+	pooled := p.nsqd.getOpts().MessagePool
+	messageBody, pb := newMessageBody(int(bodyLen), pooled)
 	_, err = io.ReadFull(client.Reader, messageBody)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body")
@@ -915,20 +1191,198 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err := p.CheckAuth(client, "DPUB", topicName, ""); err != nil {
 		return nil, err
 	}
+	if err := p.admitTopic("DPUB", topicName); err != nil {
+		return nil, err
+	}
 
-	topic := p.nsqd.GetTopic(topicName)
-	msg := NewMessage(topic.GenerateID(), messageBody)
+	topic := p.nsqd.GetTopic(topicName).partition(partitionKey(params, 3))
+	msg := newMessage(topic.GenerateID(), messageBody, pb, pooled)
+	if err := readMessageHeaders(client, msg); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB "+err.Error())
+	}
 	msg.deferred = timeoutDuration
-	err = topic.PutMessage(msg)
+	if client.PublishDurability == DurabilityFsync && timeoutDuration != 0 {
+		// deferred messages are kept by the deferred store, not the backend
+		return nil, protocol.NewClientErr(nil, "E_NOT_DURABLE", "DPUB deferred messages can't be fsynced")
+	}
+	msgs, dedupKeys := topic.dedup([]*Message{msg})
+	if len(msgs) == 0 {
+		// a re-publish within the topic's dedup window, dropped
+		client.PublishedMessage(topicName, 1)
+		return okBytes, nil
+	}
+	if err := topic.admitPublish(1, len(messageBody)); err != nil {
+		return nil, admitErr("DPUB", err)
+	}
+	replication := topic.replication(msgs)
+	if client.PublishDurability == DurabilityFsync {
+		err = topic.PutMessagesDurable(msgs)
+	} else {
+		err = topic.PutMessage(msg)
+	}
+	if err == ErrTopicFull {
+		return nil, protocol.NewClientErr(err, "E_TOPIC_FULL", "DPUB failed "+err.Error())
+	}
+	if err == ErrNotDurable {
+		return nil, protocol.NewClientErr(err, "E_NOT_DURABLE", "DPUB failed "+err.Error())
+	}
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
 	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, protocol.NewClientErr(err, "E_REPLICATION_FAILED", "DPUB failed "+err.Error())
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return okBytes, nil
+}
+
+// PPUB publishes a message with a priority, PPUB <topic> <priority> [<partition key>]
+func (p *protocolV2) PPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if len(params) < 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "PPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("PPUB topic name %q is not valid", topicName))
+	}
+
+	priority, ok := parsePriority(string(params[2]))
+	if !ok {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("PPUB priority %s out of range %d-%d", params[2], PriorityNormal, PriorityHigh))
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PPUB failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("PPUB invalid message body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.nsqd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("PPUB message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
+	}
+
+	pooled := p.nsqd.getOpts().MessagePool
+	messageBody, pb := newMessageBody(int(bodyLen), pooled)
+	_, err = io.ReadFull(client.Reader, messageBody)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PPUB failed to read message body")
+	}
+
+	if err := p.CheckAuth(client, "PPUB", topicName, ""); err != nil {
+		return nil, err
+	}
+	if err := p.admitTopic("PPUB", topicName); err != nil {
+		return nil, err
+	}
+
+	topic := p.nsqd.GetTopic(topicName).partition(partitionKey(params, 3))
+	msg := newMessage(topic.GenerateID(), messageBody, pb, pooled)
+	if err := readMessageHeaders(client, msg); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "PPUB "+err.Error())
+	}
+	msg.Priority = priority
+	msgs, dedupKeys := topic.dedup([]*Message{msg})
+	if len(msgs) == 0 {
+		// a re-publish within the topic's dedup window, dropped
+		client.PublishedMessage(topicName, 1)
+		return okBytes, nil
+	}
+	if err := topic.admitPublish(1, len(messageBody)); err != nil {
+		return nil, admitErr("PPUB", err)
+	}
+	replication := topic.replication(msgs)
+	if client.PublishDurability == DurabilityFsync {
+		err = topic.PutMessagesDurable(msgs)
+	} else {
+		err = topic.PutMessage(msg)
+	}
+	if err == ErrTopicFull {
+		return nil, protocol.NewClientErr(err, "E_TOPIC_FULL", "PPUB failed "+err.Error())
+	}
+	if err == ErrNotDurable {
+		return nil, protocol.NewClientErr(err, "E_NOT_DURABLE", "PPUB failed "+err.Error())
+	}
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_PPUB_FAILED", "PPUB failed "+err.Error())
+	}
+	topic.rememberPublished(dedupKeys)
+	if err := topic.replicate(replication); err != nil {
+		return nil, protocol.NewClientErr(err, "E_REPLICATION_FAILED", "PPUB failed "+err.Error())
+	}
 
 	client.PublishedMessage(topicName, 1)
 
 	return okBytes, nil
 }
 
+// readMessageHeaders takes the header block off the start of the body of a
+// message published by a client that IDENTIFYed with msg_headers
+func readMessageHeaders(client *clientV2, msg *Message) error {
+	if !client.MsgHeaders {
+		return nil
+	}
+	headers, body, err := readHeaders(msg.Body)
+	if err != nil {
+		return err
+	}
+	if err := checkPublishedHeaders(headers); err != nil {
+		return err
+	}
+	msg.Headers = headers
+	msg.Body = body
+	return nil
+}
+
+// partitionKey returns the optional partition key param of a PUB, MPUB,
+// DPUB or PPUB at index i, nil if there isn't one
+func partitionKey(params [][]byte, i int) []byte {
+	if len(params) > i {
+		return params[i]
+	}
+	return nil
+}
+
+// admitTopic returns a fatal error if cmd would create the topic topicName
+// over its namespace's max_topics (see NSQD.admitTopic)
+func (p *protocolV2) admitTopic(cmd, topicName string) error {
+	if err := p.nsqd.admitTopic(topicName); err != nil {
+		return protocol.NewFatalClientErr(err, "E_TOPIC_LIMIT", cmd+" failed "+err.Error())
+	}
+	return nil
+}
+
+// isDrainRefused returns true for the commands a draining nsqd refuses,
+// those that publish or subscribe (see Drain)
+func isDrainRefused(cmd []byte) bool {
+	switch string(cmd) {
+	case "PUB", "MPUB", "DPUB", "PPUB", "SUB":
+		return true
+	}
+	return false
+}
+
+// admitErr returns the (non-fatal) error for a publish admitPublish rejected
+func admitErr(cmd string, err error) error {
+	code := "E_RATE_LIMITED"
+	if err == ErrQuotaExceeded || err == ErrNamespaceQuotaExceeded {
+		code = "E_QUOTA_EXCEEDED"
+	}
+	return protocol.NewClientErr(err, code, cmd+" failed "+err.Error())
+}
+
 func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
@@ -945,9 +1399,11 @@ func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	}
 
 	client.writeLock.RLock()
-	msgTimeout := client.MsgTimeout
+	msgTimeout := client.Channel.msgTimeout(client.MsgTimeout)
+	msgTimeoutWarning := client.MsgTimeoutWarning
 	client.writeLock.RUnlock()
-	err = client.Channel.TouchMessage(client.ID, *id, msgTimeout)
+	err = client.Channel.touchMessage(client.ID, *id, msgTimeout,
+		timeoutWarningLead(msgTimeout, msgTimeoutWarning))
 	if err != nil {
 		return nil, protocol.NewClientErr(err, "E_TOUCH_FAILED",
 			fmt.Sprintf("TOUCH %s failed %s", *id, err.Error()))
@@ -956,7 +1412,7 @@ func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	return nil, nil
 }
 
-func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBodySize int64) ([]*Message, error) {
+func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBodySize int64, pooled bool) ([]*Message, error) {
 	numMessages, err := readLen(r, tmp)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
@@ -987,13 +1443,13 @@ func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBo
 				fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
 		}
 
-		msgBody := make([]byte, messageSize)
+		msgBody, pb := newMessageBody(int(messageSize), pooled)
 		_, err = io.ReadFull(r, msgBody)
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
 		}
 
-		messages = append(messages, NewMessage(topic.GenerateID(), msgBody))
+		messages = append(messages, newMessage(topic.GenerateID(), msgBody, pb, pooled))
 	}
 
 	return messages, nil
@@ -19,6 +19,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -47,7 +48,7 @@ func mustStartNSQD(opts *Options) (*net.TCPAddr, *net.TCPAddr, *NSQD) {
 	}
 	go func() {
 		err := nsqd.Main()
-		if err != nil {
+		if err != nil && err != ErrDrained {
 			panic(err)
 		}
 	}()
@@ -247,6 +248,52 @@ func TestClientTimeout(t *testing.T) {
 done:
 }
 
+func TestClientTimeoutRequeuesInFlight(t *testing.T) {
+	topicName := "test_client_timeout_requeue" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ClientTimeout = 150 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	// the client stops responding to heartbeats, once it's disconnected its
+	// message is requeued without waiting for --msg-timeout
+	for i := 0; i < 100; i++ {
+		if channel.Depth() == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, int64(1), stats.Depth)
+	test.Equal(t, 0, stats.InFlightCount)
+	test.Equal(t, uint64(1), stats.TimeoutCount)
+}
+
 func TestClientHeartbeat(t *testing.T) {
 	topicName := "test_hb_v2" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -563,6 +610,142 @@ func TestSizeLimits(t *testing.T) {
 	test.Equal(t, fmt.Sprintf("E_BAD_MESSAGE MPUB message too big 101 > 100"), string(data))
 }
 
+func TestPubTopicFull(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxDepth = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_pub_topic_full" + strconv.Itoa(int(time.Now().Unix()))
+
+	identify(t, conn, nil, frameTypeResponse)
+	for i := 0; i < 2; i++ {
+		nsq.Publish(topicName, []byte("test")).WriteTo(conn)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	// the error isn't fatal
+	nsq.Publish(topicName, []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_FULL PUB failed topic full")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("test")})
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_FULL MPUB failed topic full")
+
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, uint64(2), NewTopicStats(topic, nil).OverflowCount)
+}
+
+func TestPubRateLimitAndQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_pub_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+	rate := int64(1)
+	rateTopic := nsqd.GetTopic(topicName)
+	rateTopic.SetQueueOptions(QueueOptions{MaxPublishRate: &rate})
+	quota := int64(10)
+	quotaTopic := nsqd.GetTopic(topicName + "_quota")
+	quotaTopic.SetQueueOptions(QueueOptions{DailyByteQuota: &quota})
+
+	identify(t, conn, nil, frameTypeResponse)
+	nsq.Publish(topicName, []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	// the errors aren't fatal
+	nsq.Publish(topicName, []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_RATE_LIMITED PUB failed publish rate limit exceeded")
+
+	cmd, _ := nsq.MultiPublish(topicName+"_quota", [][]byte{[]byte("test"), []byte("test")})
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	nsq.Publish(topicName+"_quota", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_QUOTA_EXCEEDED PUB failed daily byte quota exceeded")
+
+	stats := NewTopicStats(rateTopic, nil)
+	test.Equal(t, uint64(1), stats.MessageCount)
+	test.Equal(t, uint64(1), stats.RateLimitedCount)
+	stats = NewTopicStats(quotaTopic, nil)
+	test.Equal(t, uint64(2), stats.MessageCount)
+	test.Equal(t, uint64(1), stats.QuotaExceededCount)
+	test.Equal(t, int64(8), stats.QuotaBytesUsed)
+}
+
+func TestPubDedup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_pub_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	window := int64(100)
+	quota := int64(100)
+	topic := nsqd.GetTopic(topicName)
+	topic.SetQueueOptions(QueueOptions{DedupWindow: &window, DailyByteQuota: &quota})
+	size := int64(1)
+	sizeTopic := nsqd.GetTopic(topicName + "_size")
+	sizeTopic.SetQueueOptions(QueueOptions{DedupSize: &size})
+
+	identify(t, conn, nil, frameTypeResponse)
+	for _, body := range []string{"a", "a", "b"} {
+		nsq.Publish(topicName, []byte(body)).WriteTo(conn)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("b"), []byte("c"), []byte("c")})
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, int64(3), topic.Depth())
+
+	// the dedup-id header, rather than the body, identifies a message
+	for _, body := range []string{"d", "e"} {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&header=dedup-id:1", httpAddr, topicName)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString(body))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+	test.Equal(t, int64(4), topic.Depth())
+
+	time.Sleep(150 * time.Millisecond)
+	nsq.Publish(topicName, []byte("a")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, int64(5), topic.Depth())
+
+	// with dedup_size=1 only the last publish is remembered
+	for _, body := range []string{"a", "a", "b", "a"} {
+		nsq.Publish(topicName+"_size", []byte(body)).WriteTo(conn)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+	test.Equal(t, int64(3), sizeTopic.Depth())
+
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, uint64(4), stats.DedupHitCount)
+	test.Equal(t, uint64(5), stats.DedupMissCount)
+	test.Equal(t, uint64(5), stats.MessageCount)
+	// the re-publishes that were dropped aren't charged
+	test.Equal(t, int64(5), stats.QuotaBytesUsed)
+	stats = NewTopicStats(sizeTopic, nil)
+	test.Equal(t, uint64(1), stats.DedupHitCount)
+	test.Equal(t, uint64(3), stats.DedupMissCount)
+}
+
 func TestDPUB(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -606,6 +789,93 @@ func TestDPUB(t *testing.T) {
 	test.Equal(t, fmt.Sprintf("E_INVALID DPUB timeout 3600100 out of range 0-3600000"), string(data))
 }
 
+func TestPPUB(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_ppub_v2" + strconv.Itoa(int(time.Now().Unix()))
+	ch := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	// valid
+	cmd := &nsq.Command{Name: []byte("PPUB"), Params: [][]byte{[]byte(topicName), []byte("1")}, Body: []byte("test")}
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+
+	msg := <-ch.priority.msgChan
+	test.Equal(t, PriorityHigh, msg.Priority)
+	test.Equal(t, []byte("test"), msg.Body)
+
+	// priority out of range
+	cmd = &nsq.Command{Name: []byte("PPUB"), Params: [][]byte{[]byte(topicName), []byte("2")}, Body: []byte("test")}
+	cmd.WriteTo(conn)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_INVALID PPUB priority 2 out of range 0-1", string(data))
+}
+
+func TestPPUBMaxMsgSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxMsgSize = 2 * maxHeadersSize
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_ppub_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	identify(t, conn, map[string]interface{}{"msg_headers": true}, frameTypeResponse)
+
+	// a max-size body with as many headers as can be published, which leave
+	// room for the stored priority
+	ppub := func(headersSize int) {
+		key := strings.Repeat("k", headersSize-4)
+		body := &bytes.Buffer{}
+		_, err := writeHeaders(body, map[string]string{key: ""})
+		test.Nil(t, err)
+		body.Write(bytes.Repeat([]byte("x"), int(opts.MaxMsgSize)-body.Len()))
+		cmd := &nsq.Command{Name: []byte("PPUB"), Params: [][]byte{[]byte(topicName), []byte("1")}, Body: body.Bytes()}
+		cmd.WriteTo(conn)
+	}
+	ppub(maxPublishedHeadersSize)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, "OK", nsqd.GetHealth())
+
+	// it spilled to disk
+	test.Equal(t, int64(1), topic.backend.Depth())
+	msg, err := decodeMessage(<-topic.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, PriorityHigh, msg.Priority)
+	test.Equal(t, maxPublishedHeadersSize, headersSize(msg.Headers))
+	test.Equal(t, int(opts.MaxMsgSize)-2-maxPublishedHeadersSize, len(msg.Body))
+
+	ppub(maxPublishedHeadersSize + 1)
+	readValidate(t, conn, frameTypeError,
+		fmt.Sprintf("E_BAD_MESSAGE PPUB headers longer than %d bytes", maxPublishedHeadersSize))
+	test.Equal(t, "OK", nsqd.GetHealth())
+}
+
 func TestTouch(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -652,6 +922,184 @@ func TestTouch(t *testing.T) {
 	test.Equal(t, uint64(0), channel.timeoutCount)
 }
 
+func TestChannelMsgTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.QueueScanInterval = 10 * time.Millisecond
+	opts.QueueScanRefreshInterval = 50 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_msg_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msgTimeout := int64(1000)
+	channel.SetQueueOptions(QueueOptions{MsgTimeout: &msgTimeout})
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	// the channel's msg_timeout takes precedence over the negotiated one
+	identify(t, conn, map[string]interface{}{
+		"msg_timeout": 30000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	start := time.Now()
+	for attempts := uint16(1); attempts <= 2; attempts++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, frameTypeMessage, frameType)
+		test.Equal(t, msg.ID, msgOut.ID)
+		test.Equal(t, attempts, msgOut.Attempts)
+	}
+	test.Equal(t, true, time.Since(start) < 5*time.Second)
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.timeoutCount))
+}
+
+func TestTimeoutWarning(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MsgTimeout = 500 * time.Millisecond
+	opts.QueueScanInterval = 10 * time.Millisecond
+	opts.QueueScanRefreshInterval = 50 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_timeout_warning" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"msg_timeout_warning": 0.5,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	// a slow consumer TOUCHes the message when warned, twice, then FINs it
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		readValidate(t, conn, frameTypeResponse, "_timeout_warning_ "+string(msg.ID[:]))
+		test.Equal(t, true, time.Since(start) < opts.MsgTimeout)
+
+		_, err = nsq.Touch(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	time.Sleep(opts.MsgTimeout)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(0), stats.TimeoutCount)
+	test.Equal(t, uint64(2), stats.TimeoutWarningCount)
+	test.Equal(t, uint64(2), stats.TimeoutsAvoidedCount)
+	test.Equal(t, 0, stats.InFlightCount)
+	test.Equal(t, 0, channel.warningPQ.Len())
+}
+
+func TestDeliveryPreference(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DeliveryPreference = "local"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_delivery_preference" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	localConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer localConn.Close()
+	identify(t, localConn, nil, frameTypeResponse)
+	sub(t, localConn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(localConn)
+	test.Nil(t, err)
+
+	forwarderConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer forwarderConn.Close()
+	identify(t, forwarderConn, map[string]interface{}{
+		"forwarder": true,
+	}, frameTypeResponse)
+	sub(t, forwarderConn, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(forwarderConn)
+	test.Nil(t, err)
+
+	waitReady := func(forwarder bool) {
+		for i := 0; i < 100 && !channel.hasReadyConsumers(forwarder); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		test.Equal(t, true, channel.hasReadyConsumers(forwarder))
+		// give the forwarder's messagePump time to notice
+		time.Sleep(50 * time.Millisecond)
+	}
+	readMsg := func(conn net.Conn, msg *Message) {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, msg.ID, msgOut.ID)
+	}
+	waitReady(true)
+	waitReady(false)
+
+	// the local consumer gets messages while it's ready, the forwarder only
+	// once it's saturated
+	msg1 := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg1)
+	readMsg(localConn, msg1)
+
+	msg2 := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg2)
+	readMsg(forwarderConn, msg2)
+
+	_, err = nsq.Finish(nsq.MessageID(msg1.ID)).WriteTo(localConn)
+	test.Nil(t, err)
+	waitReady(false)
+
+	msg3 := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg3)
+	readMsg(localConn, msg3)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, "local", stats.DeliveryPreference)
+	test.Equal(t, uint64(2), stats.LocalDeliveryCount)
+	test.Equal(t, uint64(1), stats.ForwardedDeliveryCount)
+}
+
 func TestMaxRdyCount(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1062,16 +1510,80 @@ func TestTLSAuthRequireVerify(t *testing.T) {
 	test.Equal(t, []byte("OK"), data)
 }
 
-func TestDeflate(t *testing.T) {
+func TestTLSClientAuthorization(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	opts.LogLevel = LOG_DEBUG
-	opts.DeflateEnabled = true
+	opts.TLSCert = "./test/certs/server.pem"
+	opts.TLSKey = "./test/certs/server.key"
+	opts.TLSRootCAFile = "./test/certs/ca.pem"
+	opts.TLSClientAuthPolicy = "require-verify"
+	opts.TLSClientAuthorizations = []string{
+		`{"identity":"nsq.io","topic":"^orders$","permissions":["publish"]}`,
+		`{"identity":"nsq.io","topic":"^orders$","channels":["^archive$"],"permissions":["subscribe"]}`,
+		`{"identity":"other.io","topic":".*","channels":[".*"],"permissions":["subscribe","publish"]}`,
+	}
+
 	tcpAddr, _, nsqd := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqd.Exit()
 
-	conn, err := mustConnectNSQD(tcpAddr)
+	connect := func() *tls.Conn {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		identify(t, conn, map[string]interface{}{
+			"tls_v1": true,
+		}, frameTypeResponse)
+		cert, err := tls.LoadX509KeyPair("./test/certs/client.pem", "./test/certs/client.key")
+		test.Nil(t, err)
+		tlsConn := tls.Client(conn, &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		})
+		test.Nil(t, tlsConn.Handshake())
+		readValidate(t, tlsConn, frameTypeResponse, "OK")
+		return tlsConn
+	}
+
+	// the certificate's CN is nsq.io
+	conn := connect()
+	defer conn.Close()
+	_, err := nsq.Publish("orders", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Publish("payments", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError,
+		`E_UNAUTHORIZED TLS client certificate not authorized for PUB on "payments" ""`)
+
+	conn = connect()
+	defer conn.Close()
+	sub(t, conn, "orders", "archive")
+
+	conn = connect()
+	defer conn.Close()
+	subFail(t, conn, "orders", "billing")
+
+	// an unverified certificate can claim any identity
+	opts.TLSClientAuthPolicy = "require"
+	_, _, err = nsqd.ReloadOptions(opts)
+	test.NotNil(t, err)
+	opts.TLSClientAuthPolicy = "require-verify"
+	opts.TLSClientAuthorizations = []string{`{"identity":"nsq.io","topic":"^orders$","permissions":["read"]}`}
+	_, _, err = nsqd.ReloadOptions(opts)
+	test.NotNil(t, err)
+}
+
+func TestDeflate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	opts.DeflateEnabled = true
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
 	test.Nil(t, err)
 	defer conn.Close()
 
@@ -1326,6 +1838,147 @@ func TestTLSSnappy(t *testing.T) {
 	test.Equal(t, []byte("OK"), data)
 }
 
+func TestReqReason(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_req_reason" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	for _, reason := range []string{"validation_error:bad_json", "downstream_timeout", "bogus", ""} {
+		resp, _ := nsq.ReadResponse(conn)
+		_, data, _ := nsq.UnpackResponse(resp)
+		msgOut, err := decodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, msg.ID, msgOut.ID)
+		params := [][]byte{msgOut.ID[:], []byte("0")}
+		if reason != "" {
+			params = append(params, []byte(reason))
+		}
+		_, err = (&nsq.Command{Name: []byte("REQ"), Params: params}).WriteTo(conn)
+		test.Nil(t, err)
+	}
+	resp, _ := nsq.ReadResponse(conn)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msgOut, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, uint16(5), msgOut.Attempts)
+
+	stats := NewChannelStats(ch, nil, 0)
+	test.Equal(t, uint64(4), stats.RequeueCount)
+	test.Equal(t, map[string]uint64{
+		"validation_error":   1,
+		"downstream_timeout": 1,
+		"other":              1,
+		"unspecified":        1,
+	}, stats.RequeueReasons)
+
+	// a reason detail with spaces would be cut at the first one, the REQ
+	// fails but the connection stays open
+	_, err = (&nsq.Command{Name: []byte("REQ"),
+		Params: [][]byte{msgOut.ID[:], []byte("0"), []byte("validation_error:bad"), []byte("json")}}).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_INVALID REQ reason detail can't contain spaces")
+
+	// other trailing params are ignored
+	_, err = (&nsq.Command{Name: []byte("REQ"),
+		Params: [][]byte{msgOut.ID[:], []byte("0"), []byte("transient"), []byte("extra")}}).WriteTo(conn)
+	test.Nil(t, err)
+	resp, _ = nsq.ReadResponse(conn)
+	_, data, _ = nsq.UnpackResponse(resp)
+	msgOut, err = decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, uint16(6), msgOut.Attempts)
+	test.Equal(t, uint64(1), NewChannelStats(ch, nil, 0).RequeueReasons["transient"])
+}
+
+func TestRequeuePolicy(t *testing.T) {
+	// R is a requeued message, N a new one
+	testRequeuePolicy(t, "fifo", 1, "NNNNNNNNNNRRRRRRRRRR")
+	testRequeuePolicy(t, "requeue-first", 1, "RRRRRRRRRRNNNNNNNNNN")
+	testRequeuePolicy(t, "ratio", 2, "RNNRNNRNNRNNRNNRRRRR")
+}
+
+func testRequeuePolicy(t *testing.T, policy string, ratio int, expected string) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RequeuePolicy = policy
+	opts.RequeueRatio = ratio
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_requeue_policy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	for i := 0; i < 20; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	readMsg := func() *Message {
+		resp, _ := nsq.ReadResponse(conn)
+		_, data, _ := nsq.UnpackResponse(resp)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		return msg
+	}
+
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+	var inFlight []*Message
+	for i := 0; i < 10; i++ {
+		inFlight = append(inFlight, readMsg())
+	}
+
+	// requeue a burst of messages while not ready for more
+	_, err = nsq.Ready(0).WriteTo(conn)
+	test.Nil(t, err)
+	for _, msg := range inFlight {
+		_, err = nsq.Requeue(nsq.MessageID(msg.ID), 0).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	_, err = nsq.Ready(20).WriteTo(conn)
+	test.Nil(t, err)
+	var actual []byte
+	for i := 0; i < 20; i++ {
+		if readMsg().Attempts > 1 {
+			actual = append(actual, 'R')
+		} else {
+			actual = append(actual, 'N')
+		}
+	}
+	test.Equal(t, expected, string(actual))
+
+	stats := NewChannelStats(ch, nil, 0)
+	test.Equal(t, uint64(20), stats.FirstDeliveryCount)
+	test.Equal(t, uint64(10), stats.RedeliveryCount)
+}
+
 func TestClientMsgTimeout(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1385,6 +2038,67 @@ func TestClientMsgTimeout(t *testing.T) {
 		string(data))
 }
 
+func TestSlowConsumer(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.QueueScanRefreshInterval = 100 * time.Millisecond
+	opts.SlowConsumerTimeouts = 1
+	opts.SlowConsumerPolicy = "evict"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_slow_consumer" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, map[string]interface{}{
+		"msg_timeout": 1000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, _, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeMessage, frameType)
+
+	// the message times out, and the client is disconnected
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("client was not disconnected")
+	}
+	test.Equal(t, uint64(1), atomic.LoadUint64(&ch.timeoutCount))
+	// and requeued (if the client's messagePump took it again before it
+	// exited, once that times out)
+	for i := 0; ch.Depth() != 1; i++ {
+		test.Equal(t, true, i < 300)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a consumer is also slow once it has acked enough messages, on average
+	// later than --slow-consumer-ack-latency
+	var s ackStats
+	opts = NewOptions()
+	opts.SlowConsumerAckLatency = 100 * time.Millisecond
+	for i := 0; i < slowConsumerMinAcks; i++ {
+		test.Equal(t, false, s.isSlow(opts))
+		s.AckedMessage(time.Second)
+	}
+	test.Equal(t, true, s.isSlow(opts))
+	for i := 0; i < 20; i++ {
+		s.AckedMessage(time.Millisecond)
+	}
+	test.Equal(t, false, s.isSlow(opts))
+}
+
 func TestBadFin(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1411,6 +2125,353 @@ func TestBadFin(t *testing.T) {
 	test.Equal(t, "E_INVALID Invalid Message ID", string(data))
 }
 
+func TestMaxMsgAttempts(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgAttempts = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_max_msg_attempts" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 1; i <= 2; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, msg.ID, msgOut.ID)
+		test.Equal(t, uint16(i), msgOut.Attempts)
+
+		_, err = nsq.Requeue(nsq.MessageID(msg.ID), 0).WriteTo(conn)
+		test.Nil(t, err)
+	}
+
+	// the second REQ brings it back a third time, instead it's discarded
+	for i := 0; i < 100 && atomic.LoadUint64(&channel.discardCount) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, int64(0), stats.Depth)
+	test.Equal(t, 0, stats.InFlightCount)
+	test.Equal(t, uint64(2), stats.RequeueCount)
+	test.Equal(t, uint64(1), stats.DiscardCount)
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgAttempts = 1
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	deadLetterName := topicName + "_dlq"
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.SetDeadLetterTopic(deadLetterName)
+	deadLetterChannel := nsqd.GetTopic(deadLetterName).GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, uint16(1), msgOut.Attempts)
+	_, err = nsq.Requeue(nsq.MessageID(msgOut.ID), 0).WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 0; i < 100 && deadLetterChannel.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(1), stats.DiscardCount)
+	test.Equal(t, uint64(1), stats.DeadLetterCount)
+	test.Equal(t, deadLetterName, stats.DeadLetterTopic)
+
+	// it keeps its ID and attempts, and isn't discarded again on delivery
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+
+	identify(t, conn2, nil, frameTypeResponse)
+	sub(t, conn2, deadLetterName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn2)
+	test.Nil(t, err)
+
+	resp, err = nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ = decodeMessage(data)
+	test.Equal(t, msg.ID, msgOut.ID)
+	test.Equal(t, true, msgOut.Timestamp > msg.Timestamp)
+	test.Equal(t, uint16(2), msgOut.Attempts)
+}
+
+func TestMsgTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_msg_ttl" + strconv.Itoa(int(time.Now().Unix()))
+
+	topic := nsqd.GetTopic(topicName)
+	ttl := int64(1000)
+	topic.SetQueueOptions(QueueOptions{MsgTTL: &ttl})
+	channel := topic.GetChannel("ch")
+
+	oldMsg := NewMessage(topic.GenerateID(), []byte("old"))
+	oldMsg.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+	topic.PutMessage(oldMsg)
+	msg := NewMessage(topic.GenerateID(), []byte("new"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, uint64(1), stats.ExpiredCount)
+}
+
+func TestChannelMaxDeliveryRate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_max_delivery_rate" + strconv.Itoa(int(time.Now().Unix()))
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	rate := int64(10)
+	channel.SetQueueOptions(QueueOptions{MaxDeliveryRate: &rate})
+
+	for i := 0; i < 5; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	start := time.Now()
+	_, err = nsq.Ready(5).WriteTo(conn)
+	test.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, _, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+	}
+	// a burst of 1 then one every 100ms
+	elapsed := time.Since(start)
+	if elapsed < 350*time.Millisecond {
+		t.Fatalf("5 messages delivered in %s at max_delivery_rate=10", elapsed)
+	}
+}
+
+func TestChannelOrdered(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_ordered" + strconv.Itoa(int(time.Now().Unix()))
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	ordered := true
+	channel.SetQueueOptions(QueueOptions{Ordered: &ordered})
+
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i))))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	readMsg := func() *Message {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msg, err := decodeMessage(data)
+		test.Nil(t, err)
+		return msg
+	}
+
+	msg := readMsg()
+	test.Equal(t, "0", string(msg.Body))
+
+	// nothing else is delivered, to any client, until it's finished
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn2, nil, frameTypeResponse)
+	sub(t, conn2, topicName, "ch")
+	_, err = nsq.Ready(10).WriteTo(conn2)
+	test.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	channel.inFlightMutex.Lock()
+	test.Equal(t, 1, len(channel.inFlightMessages))
+	channel.inFlightMutex.Unlock()
+	conn2.Close()
+	// or the requeued message might go to it
+	for i := 0; ; i++ {
+		test.Equal(t, true, i < 100)
+		channel.RLock()
+		numClients := len(channel.clients)
+		channel.RUnlock()
+		if numClients == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a requeued message is delivered again before the next
+	_, err = nsq.Requeue(nsq.MessageID(msg.ID), 0).WriteTo(conn)
+	test.Nil(t, err)
+	msg = readMsg()
+	test.Equal(t, "0", string(msg.Body))
+	test.Equal(t, uint16(2), msg.Attempts)
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			msg = readMsg()
+		}
+		test.Equal(t, strconv.Itoa(i), string(msg.Body))
+		_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+}
+
+func TestSubFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_sub_filter" + strconv.Itoa(int(time.Now().Unix()))
+
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer pubConn.Close()
+	identify(t, pubConn, map[string]interface{}{"msg_headers": true}, frameTypeResponse)
+	for _, headers := range []map[string]string{{"type": "refund"}, {"type": "order"}, nil} {
+		body := &bytes.Buffer{}
+		_, err = writeHeaders(body, headers)
+		test.Nil(t, err)
+		body.WriteString("test body")
+		nsq.Publish(topicName, body.Bytes()).WriteTo(pubConn)
+		readValidate(t, pubConn, frameTypeResponse, "OK")
+	}
+	// the keys nsqd keeps for itself (like a message's priority) can't be
+	// published
+	body := &bytes.Buffer{}
+	_, err = writeHeaders(body, map[string]string{msgPriorityHeader: "1"})
+	test.Nil(t, err)
+	body.WriteString("test body")
+	nsq.Publish(topicName, body.Bytes()).WriteTo(pubConn)
+	readValidate(t, pubConn, frameTypeError, `E_BAD_MESSAGE PUB reserved header key "\x00priority"`)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{"msg_headers": true}, frameTypeResponse)
+	cmd := &nsq.Command{Name: []byte("SUB"), Params: [][]byte{[]byte(topicName), []byte("ch"), []byte("type=order")}}
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, map[string]string{"type": "order"}, msgOut.Headers)
+	test.Equal(t, []byte("test body"), msgOut.Body)
+
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	channel, _ := topic.GetExistingChannel("ch")
+	for i := 0; i < 100 && atomic.LoadUint64(&channel.filteredCount) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, uint64(2), atomic.LoadUint64(&channel.filteredCount))
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	cmd = &nsq.Command{Name: []byte("SUB"), Params: [][]byte{[]byte(topicName), []byte("ch"), []byte("type")}}
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_INVALID SUB invalid filter term "type"`)
+}
+
 func TestReqTimeoutRange(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
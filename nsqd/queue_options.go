@@ -0,0 +1,460 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// QueueOptions override, for one topic or channel, the nsqd-wide options
+// for its queues. nil fields use the nsqd-wide value.
+// (a channel's MsgTTL falls back on its topic's)
+type QueueOptions struct {
+	// at most --mem-queue-size, the memory queue is allocated with that size
+	MemQueueSize *int64 `json:"mem_queue_size,omitempty"`
+	// applies from the next diskqueue file on
+	MaxBytesPerFile *int64 `json:"max_bytes_per_file,omitempty"`
+	// bytes per second, see --max-disk-write-rate
+	MaxDiskWriteRate *int64 `json:"max_disk_write_rate,omitempty"`
+	// applies from the next diskqueue file read on, see --read-buffer-size
+	ReadBufferSize *int64 `json:"read_buffer_size,omitempty"`
+
+	// topics only, see --max-depth and --overflow-policy
+	MaxDepth       *int64  `json:"max_depth,omitempty"`
+	OverflowPolicy *string `json:"overflow_policy,omitempty"`
+
+	// topics only, for PUB, MPUB and DPUB (and the HTTP /pub and /mpub):
+	// messages per second, and bytes of message bodies per (UTC) day
+	MaxPublishRate *int64 `json:"max_publish_rate,omitempty"`
+	DailyByteQuota *int64 `json:"daily_byte_quota,omitempty"`
+
+	// topics only, drop publishes of a message (by its dedup-id header, or
+	// else its body) seen within the last dedup_window ms or dedup_size
+	// publishes
+	DedupWindow *int64 `json:"dedup_window,omitempty"`
+	DedupSize   *int64 `json:"dedup_size,omitempty"`
+
+	// in ms, see --msg-ttl
+	MsgTTL *int64 `json:"msg_ttl,omitempty"`
+
+	// channels only, in messages per second to all of its clients together
+	MaxDeliveryRate *int64 `json:"max_delivery_rate,omitempty"`
+
+	// channels only, deliver one message at a time (to any of its clients)
+	// in the order they were queued, the next once the last is finished
+	Ordered *bool `json:"ordered,omitempty"`
+
+	// channels only, POST an alert to --alert-webhook-url once the
+	// channel's depth reaches depth_alert (and once it's back under it)
+	DepthAlert *int64 `json:"depth_alert,omitempty"`
+
+	// channels only, in ms, the timeout of its in-flight messages in place of
+	// --msg-timeout and what its clients negotiated, [1000,--max-msg-timeout]
+	MsgTimeout *int64 `json:"msg_timeout,omitempty"`
+
+	// channels only, in ms, the least a REQ delays a message whatever the
+	// client asked for: requeue_backoff after its first attempt, doubling
+	// with each one after that (plus up to a quarter at random), up to
+	// requeue_backoff_max (or else --max-req-timeout)
+	RequeueBackoff    *int64 `json:"requeue_backoff,omitempty"`
+	RequeueBackoffMax *int64 `json:"requeue_backoff_max,omitempty"`
+}
+
+// overflow policies, see --overflow-policy
+const (
+	overflowError int32 = iota + 1
+	overflowBlock
+	overflowDropOldest
+)
+
+var overflowPolicies = map[string]int32{
+	"error":       overflowError,
+	"block":       overflowBlock,
+	"drop-oldest": overflowDropOldest,
+}
+
+func isValidOverflowPolicy(policy string) bool {
+	_, ok := overflowPolicies[policy]
+	return ok
+}
+
+func (qo QueueOptions) validate(opts *Options) error {
+	if qo.MemQueueSize != nil && (*qo.MemQueueSize < 0 || *qo.MemQueueSize > opts.MemQueueSize) {
+		return fmt.Errorf("mem_queue_size must be [0,%d]", opts.MemQueueSize)
+	}
+	if qo.MaxBytesPerFile != nil && *qo.MaxBytesPerFile <= 0 {
+		return errors.New("max_bytes_per_file must be > 0")
+	}
+	if qo.MaxDiskWriteRate != nil && *qo.MaxDiskWriteRate <= 0 {
+		return errors.New("max_disk_write_rate must be > 0")
+	}
+	if qo.ReadBufferSize != nil && !isValidReadBufferSize(*qo.ReadBufferSize) {
+		return fmt.Errorf("read_buffer_size must be [1,%d]", maxReadBufferSize)
+	}
+	if qo.MaxDepth != nil && *qo.MaxDepth < 0 {
+		return errors.New("max_depth must be >= 0")
+	}
+	if qo.OverflowPolicy != nil && !isValidOverflowPolicy(*qo.OverflowPolicy) {
+		return fmt.Errorf("invalid overflow_policy %q", *qo.OverflowPolicy)
+	}
+	if qo.MaxPublishRate != nil && *qo.MaxPublishRate <= 0 {
+		return errors.New("max_publish_rate must be > 0")
+	}
+	if qo.DailyByteQuota != nil && *qo.DailyByteQuota <= 0 {
+		return errors.New("daily_byte_quota must be > 0")
+	}
+	if qo.DedupWindow != nil && *qo.DedupWindow <= 0 {
+		return errors.New("dedup_window must be > 0")
+	}
+	if qo.DedupSize != nil && (*qo.DedupSize <= 0 || *qo.DedupSize > maxDedupSize) {
+		return fmt.Errorf("dedup_size must be [1,%d]", maxDedupSize)
+	}
+	if qo.MsgTTL != nil && *qo.MsgTTL < 0 {
+		return errors.New("msg_ttl must be >= 0")
+	}
+	if qo.MaxDeliveryRate != nil && *qo.MaxDeliveryRate <= 0 {
+		return errors.New("max_delivery_rate must be > 0")
+	}
+	if qo.DepthAlert != nil && *qo.DepthAlert <= 0 {
+		return errors.New("depth_alert must be > 0")
+	}
+	if qo.MsgTimeout != nil && !isValidMsgTimeout(*qo.MsgTimeout, opts) {
+		return fmt.Errorf("msg_timeout must be [1000,%d]", int64(opts.MaxMsgTimeout/time.Millisecond))
+	}
+	if qo.RequeueBackoff != nil && !isValidRequeueBackoff(*qo.RequeueBackoff, opts) {
+		return fmt.Errorf("requeue_backoff must be [1,%d]", int64(opts.MaxReqTimeout/time.Millisecond))
+	}
+	if qo.RequeueBackoffMax != nil && !isValidRequeueBackoff(*qo.RequeueBackoffMax, opts) {
+		return fmt.Errorf("requeue_backoff_max must be [1,%d]", int64(opts.MaxReqTimeout/time.Millisecond))
+	}
+	return nil
+}
+
+func (qo QueueOptions) isEmpty() bool {
+	return qo.MemQueueSize == nil && qo.MaxBytesPerFile == nil &&
+		qo.MaxDiskWriteRate == nil && qo.ReadBufferSize == nil &&
+		qo.MaxDepth == nil && qo.OverflowPolicy == nil &&
+		qo.MaxPublishRate == nil && qo.DailyByteQuota == nil &&
+		qo.DedupWindow == nil && qo.DedupSize == nil &&
+		qo.MsgTTL == nil && qo.MaxDeliveryRate == nil &&
+		qo.Ordered == nil && qo.DepthAlert == nil && qo.MsgTimeout == nil &&
+		qo.RequeueBackoff == nil && qo.RequeueBackoffMax == nil
+}
+
+// maxReadBufferSize bounds read_buffer_size, the buffer is allocated for
+// each file read
+const maxReadBufferSize = 64 * 1024 * 1024
+
+// isValidReadBufferSize returns whether n is a read_buffer_size that can be
+// allocated
+func isValidReadBufferSize(n int64) bool {
+	return n >= 1 && n <= maxReadBufferSize
+}
+
+// isValidMsgTimeout returns whether ms is a msg_timeout within the bounds a
+// client may negotiate
+func isValidMsgTimeout(ms int64, opts *Options) bool {
+	return ms >= 1000 && ms <= int64(opts.MaxMsgTimeout/time.Millisecond)
+}
+
+// isValidRequeueBackoff returns whether ms is a requeue_backoff (or
+// requeue_backoff_max) within the bounds of a REQ's timeout
+func isValidRequeueBackoff(ms int64, opts *Options) bool {
+	return ms >= 1 && ms <= int64(opts.MaxReqTimeout/time.Millisecond)
+}
+
+// queueLimits holds the QueueOptions of a topic or channel in a form that
+// can be read without locking
+type queueLimits struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	memQueueSize    int64 // -1 if unset
+	maxBytesPerFile int64 // 0 if unset
+	maxWriteRate    int64 // 0 if unset
+	readBufferSize  int64 // 0 if unset
+	maxDepth        int64 // -1 if unset
+	maxPublishRate  int64 // 0 if unset
+	dailyByteQuota  int64 // 0 if unset
+	dedupWindow     int64 // ns, 0 if unset
+	dedupSize       int64 // 0 if unset
+	msgTTL          int64 // ns, -1 if unset
+	maxDeliveryRate int64 // 0 if unset
+	depthAlert      int64 // 0 if unset
+	msgTimeout      int64 // ns, 0 if unset
+	requeueBackoff  int64 // ns, 0 if unset
+	requeueMax      int64 // ns, 0 if unset
+
+	overflowPolicy int32 // 0 if unset
+	ordered        int32 // -1 if unset
+}
+
+func newQueueLimits() queueLimits {
+	return queueLimits{memQueueSize: -1, maxDepth: -1, msgTTL: -1, ordered: -1}
+}
+
+func (l *queueLimits) set(qo QueueOptions) {
+	memQueueSize := int64(-1)
+	if qo.MemQueueSize != nil {
+		memQueueSize = *qo.MemQueueSize
+	}
+	var maxBytesPerFile int64
+	if qo.MaxBytesPerFile != nil {
+		maxBytesPerFile = *qo.MaxBytesPerFile
+	}
+	var maxWriteRate int64
+	if qo.MaxDiskWriteRate != nil {
+		maxWriteRate = *qo.MaxDiskWriteRate
+	}
+	var readBufferSize int64
+	if qo.ReadBufferSize != nil {
+		readBufferSize = *qo.ReadBufferSize
+	}
+	maxDepth := int64(-1)
+	if qo.MaxDepth != nil {
+		maxDepth = *qo.MaxDepth
+	}
+	var overflowPolicy int32
+	if qo.OverflowPolicy != nil {
+		overflowPolicy = overflowPolicies[*qo.OverflowPolicy]
+	}
+	var maxPublishRate int64
+	if qo.MaxPublishRate != nil {
+		maxPublishRate = *qo.MaxPublishRate
+	}
+	var dailyByteQuota int64
+	if qo.DailyByteQuota != nil {
+		dailyByteQuota = *qo.DailyByteQuota
+	}
+	var dedupWindow int64
+	if qo.DedupWindow != nil {
+		dedupWindow = int64(time.Duration(*qo.DedupWindow) * time.Millisecond)
+	}
+	var dedupSize int64
+	if qo.DedupSize != nil {
+		dedupSize = *qo.DedupSize
+	}
+	msgTTL := int64(-1)
+	if qo.MsgTTL != nil {
+		msgTTL = int64(time.Duration(*qo.MsgTTL) * time.Millisecond)
+	}
+	var maxDeliveryRate int64
+	if qo.MaxDeliveryRate != nil {
+		maxDeliveryRate = *qo.MaxDeliveryRate
+	}
+	var depthAlert int64
+	if qo.DepthAlert != nil {
+		depthAlert = *qo.DepthAlert
+	}
+	var msgTimeout int64
+	if qo.MsgTimeout != nil {
+		msgTimeout = int64(time.Duration(*qo.MsgTimeout) * time.Millisecond)
+	}
+	var requeueBackoff int64
+	if qo.RequeueBackoff != nil {
+		requeueBackoff = int64(time.Duration(*qo.RequeueBackoff) * time.Millisecond)
+	}
+	var requeueMax int64
+	if qo.RequeueBackoffMax != nil {
+		requeueMax = int64(time.Duration(*qo.RequeueBackoffMax) * time.Millisecond)
+	}
+	ordered := int32(-1)
+	if qo.Ordered != nil {
+		ordered = 0
+		if *qo.Ordered {
+			ordered = 1
+		}
+	}
+	atomic.StoreInt64(&l.memQueueSize, memQueueSize)
+	atomic.StoreInt64(&l.maxBytesPerFile, maxBytesPerFile)
+	atomic.StoreInt64(&l.maxWriteRate, maxWriteRate)
+	atomic.StoreInt64(&l.readBufferSize, readBufferSize)
+	atomic.StoreInt64(&l.maxDepth, maxDepth)
+	atomic.StoreInt32(&l.overflowPolicy, overflowPolicy)
+	atomic.StoreInt64(&l.maxPublishRate, maxPublishRate)
+	atomic.StoreInt64(&l.dailyByteQuota, dailyByteQuota)
+	atomic.StoreInt64(&l.dedupWindow, dedupWindow)
+	atomic.StoreInt64(&l.dedupSize, dedupSize)
+	atomic.StoreInt64(&l.msgTTL, msgTTL)
+	atomic.StoreInt64(&l.maxDeliveryRate, maxDeliveryRate)
+	atomic.StoreInt64(&l.depthAlert, depthAlert)
+	atomic.StoreInt64(&l.msgTimeout, msgTimeout)
+	atomic.StoreInt64(&l.requeueBackoff, requeueBackoff)
+	atomic.StoreInt64(&l.requeueMax, requeueMax)
+	atomic.StoreInt32(&l.ordered, ordered)
+}
+
+func (l *queueLimits) options() QueueOptions {
+	var qo QueueOptions
+	if memQueueSize := atomic.LoadInt64(&l.memQueueSize); memQueueSize >= 0 {
+		qo.MemQueueSize = &memQueueSize
+	}
+	if maxBytesPerFile := atomic.LoadInt64(&l.maxBytesPerFile); maxBytesPerFile > 0 {
+		qo.MaxBytesPerFile = &maxBytesPerFile
+	}
+	if maxWriteRate := atomic.LoadInt64(&l.maxWriteRate); maxWriteRate > 0 {
+		qo.MaxDiskWriteRate = &maxWriteRate
+	}
+	if readBufferSize := atomic.LoadInt64(&l.readBufferSize); readBufferSize > 0 {
+		qo.ReadBufferSize = &readBufferSize
+	}
+	if maxDepth := atomic.LoadInt64(&l.maxDepth); maxDepth >= 0 {
+		qo.MaxDepth = &maxDepth
+	}
+	overflowPolicy := atomic.LoadInt32(&l.overflowPolicy)
+	for name, policy := range overflowPolicies {
+		if policy == overflowPolicy {
+			name := name
+			qo.OverflowPolicy = &name
+		}
+	}
+	if maxPublishRate := atomic.LoadInt64(&l.maxPublishRate); maxPublishRate > 0 {
+		qo.MaxPublishRate = &maxPublishRate
+	}
+	if dailyByteQuota := atomic.LoadInt64(&l.dailyByteQuota); dailyByteQuota > 0 {
+		qo.DailyByteQuota = &dailyByteQuota
+	}
+	if dedupWindow := atomic.LoadInt64(&l.dedupWindow); dedupWindow > 0 {
+		ms := int64(time.Duration(dedupWindow) / time.Millisecond)
+		qo.DedupWindow = &ms
+	}
+	if dedupSize := atomic.LoadInt64(&l.dedupSize); dedupSize > 0 {
+		qo.DedupSize = &dedupSize
+	}
+	if msgTTL := atomic.LoadInt64(&l.msgTTL); msgTTL >= 0 {
+		ms := int64(time.Duration(msgTTL) / time.Millisecond)
+		qo.MsgTTL = &ms
+	}
+	if maxDeliveryRate := atomic.LoadInt64(&l.maxDeliveryRate); maxDeliveryRate > 0 {
+		qo.MaxDeliveryRate = &maxDeliveryRate
+	}
+	if depthAlert := atomic.LoadInt64(&l.depthAlert); depthAlert > 0 {
+		qo.DepthAlert = &depthAlert
+	}
+	if msgTimeout := atomic.LoadInt64(&l.msgTimeout); msgTimeout > 0 {
+		ms := int64(time.Duration(msgTimeout) / time.Millisecond)
+		qo.MsgTimeout = &ms
+	}
+	if requeueBackoff := atomic.LoadInt64(&l.requeueBackoff); requeueBackoff > 0 {
+		ms := int64(time.Duration(requeueBackoff) / time.Millisecond)
+		qo.RequeueBackoff = &ms
+	}
+	if requeueMax := atomic.LoadInt64(&l.requeueMax); requeueMax > 0 {
+		ms := int64(time.Duration(requeueMax) / time.Millisecond)
+		qo.RequeueBackoffMax = &ms
+	}
+	if ordered := atomic.LoadInt32(&l.ordered); ordered >= 0 {
+		b := ordered == 1
+		qo.Ordered = &b
+	}
+	return qo
+}
+
+// isOrdered returns whether ordered is set, and true
+func (l *queueLimits) isOrdered() bool {
+	return atomic.LoadInt32(&l.ordered) == 1
+}
+
+// alertDepth returns the depth_alert set, 0 if none is
+func (l *queueLimits) alertDepth() int64 {
+	return atomic.LoadInt64(&l.depthAlert)
+}
+
+// ttl returns the TTL set (ok is false if none is)
+func (l *queueLimits) ttl() (time.Duration, bool) {
+	msgTTL := atomic.LoadInt64(&l.msgTTL)
+	return time.Duration(msgTTL), msgTTL >= 0
+}
+
+// timeout returns the msg_timeout set, 0 if none is
+func (l *queueLimits) timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.msgTimeout))
+}
+
+// requeueBackoffs returns the requeue_backoff and requeue_backoff_max set, 0
+// for those that aren't
+func (l *queueLimits) requeueBackoffs() (time.Duration, time.Duration) {
+	return time.Duration(atomic.LoadInt64(&l.requeueBackoff)),
+		time.Duration(atomic.LoadInt64(&l.requeueMax))
+}
+
+// quota returns the daily byte quota set, 0 if none is
+func (l *queueLimits) quota() int64 {
+	return atomic.LoadInt64(&l.dailyByteQuota)
+}
+
+// dedup returns the dedup window (in ns) and size set, 0 for those that
+// aren't
+func (l *queueLimits) dedup() (int64, int) {
+	return atomic.LoadInt64(&l.dedupWindow), int(atomic.LoadInt64(&l.dedupSize))
+}
+
+// overflow returns the max depth (0 for none) and overflow policy, those
+// set or else the nsqd-wide ones
+func (l *queueLimits) overflow(opts *Options) (int64, int32) {
+	maxDepth := atomic.LoadInt64(&l.maxDepth)
+	if maxDepth < 0 {
+		maxDepth = opts.MaxDepth
+	}
+	overflowPolicy := atomic.LoadInt32(&l.overflowPolicy)
+	if overflowPolicy == 0 {
+		overflowPolicy = overflowPolicies[opts.OverflowPolicy]
+	}
+	return maxDepth, overflowPolicy
+}
+
+// memoryQueue returns ch, or nil (so that sends to it block) if it holds as
+// many messages as mem_queue_size allows
+func (l *queueLimits) memoryQueue(ch chan *Message) chan *Message {
+	memQueueSize := atomic.LoadInt64(&l.memQueueSize)
+	if memQueueSize >= 0 && int64(len(ch)) >= memQueueSize {
+		return nil
+	}
+	return ch
+}
+
+// memoryRoom returns how many more messages ch can take
+func (l *queueLimits) memoryRoom(ch chan *Message) int {
+	room := cap(ch) - len(ch)
+	memQueueSize := atomic.LoadInt64(&l.memQueueSize)
+	if memQueueSize >= 0 && int(memQueueSize)-len(ch) < room {
+		room = int(memQueueSize) - len(ch)
+	}
+	if room < 0 {
+		return 0
+	}
+	return room
+}
+
+// applyTo sets the size backend's files are rolled at, the size of its read
+// buffer, and the rate it writes at, if it supports them (the diskqueue
+// does), to max_bytes_per_file, read_buffer_size and max_disk_write_rate or
+// else --max-bytes-per-file, --read-buffer-size and --max-disk-write-rate
+func (l *queueLimits) applyTo(backend BackendQueue, opts *Options) {
+	if b, ok := backend.(interface {
+		SetMaxBytesPerFile(int64)
+	}); ok {
+		maxBytesPerFile := atomic.LoadInt64(&l.maxBytesPerFile)
+		if maxBytesPerFile <= 0 {
+			maxBytesPerFile = opts.MaxBytesPerFile
+		}
+		b.SetMaxBytesPerFile(maxBytesPerFile)
+	}
+	if b, ok := backend.(interface {
+		SetReadBufferSize(int)
+	}); ok {
+		readBufferSize := atomic.LoadInt64(&l.readBufferSize)
+		if readBufferSize <= 0 {
+			readBufferSize = int64(opts.ReadBufferSize)
+		}
+		b.SetReadBufferSize(int(readBufferSize))
+	}
+	if b, ok := backend.(interface {
+		SetMaxWriteRate(int64)
+	}); ok {
+		maxWriteRate := atomic.LoadInt64(&l.maxWriteRate)
+		if maxWriteRate <= 0 {
+			maxWriteRate = opts.MaxDiskWriteRate
+		}
+		b.SetMaxWriteRate(maxWriteRate)
+	}
+}
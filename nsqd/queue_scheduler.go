@@ -0,0 +1,158 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// --queue-scheduling policies
+const (
+	schedulingRandom   = "random"
+	schedulingFIFO     = "fifo"
+	schedulingWeighted = "weighted"
+)
+
+// backendReadWait bounds how long fill waits for the backend's next message
+// while its depth says there is one (the backend reads it from disk after
+// handing out the previous one)
+const backendReadWait = 100 * time.Millisecond
+
+// queueScheduler decides, with --queue-scheduling=fifo or weighted, whether
+// the next message of a topic or channel comes from its in-memory or its
+// backend queue (otherwise the two are selected on together, and when both
+// have messages it's up to chance which goes next).
+//
+// It holds up to one message taken from each queue, to compare their
+// timestamps (fifo) or to keep to --queue-scheduling-weight (weighted).
+type queueScheduler struct {
+	// 32bit atomic vars, see Held
+	held int32
+
+	policy       string
+	weight       int
+	backendDepth func() int64
+	decode       func([]byte) *Message
+
+	memoryMsg  *Message
+	backendMsg *Message
+	// messages taken from memory, while the backend had one, since the
+	// last one taken from the backend
+	fromMemory int
+}
+
+// newQueueScheduler returns the scheduler for --queue-scheduling, or nil
+// with --queue-scheduling=random, of a queue whose backend has backendDepth
+// and messages that decode returns (nil if it can't)
+func newQueueScheduler(opts *Options, backendDepth func() int64,
+	decode func([]byte) *Message) *queueScheduler {
+	if opts.QueueScheduling == schedulingRandom {
+		return nil
+	}
+	return &queueScheduler{
+		policy:       opts.QueueScheduling,
+		weight:       opts.QueueSchedulingWeight,
+		backendDepth: backendDepth,
+		decode:       decode,
+	}
+}
+
+// Held returns the number of messages taken from the queues that haven't
+// been handed out yet (see done)
+func (s *queueScheduler) Held() int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(atomic.LoadInt32(&s.held))
+}
+
+// hold keeps msg, taken from the in-memory queue or the backend, until next
+// hands it out
+func (s *queueScheduler) hold(msg *Message, fromBackend bool) {
+	if fromBackend {
+		s.backendMsg = msg
+	} else {
+		s.memoryMsg = msg
+	}
+	atomic.AddInt32(&s.held, 1)
+}
+
+// fill takes a message from each queue it isn't already holding one of,
+// without blocking (but see backendReadWait). It returns false if
+// backendChan was closed.
+func (s *queueScheduler) fill(memoryMsgChan chan *Message, backendChan <-chan []byte) bool {
+	if s.memoryMsg == nil {
+		select {
+		case msg := <-memoryMsgChan:
+			s.hold(msg, false)
+		default:
+		}
+	}
+	if backendChan == nil {
+		return true
+	}
+	deadline := time.Now().Add(backendReadWait)
+	for s.backendMsg == nil && s.backendDepth() > 0 && time.Now().Before(deadline) {
+		select {
+		case b, ok := <-backendChan:
+			if !ok {
+				return false
+			}
+			// one that fails to decode is skipped
+			if msg := s.decode(b); msg != nil {
+				s.hold(msg, true)
+			}
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return true
+}
+
+// next returns the message to hand out next, nil if it isn't holding any,
+// which counts as held until done is called
+func (s *queueScheduler) next() *Message {
+	var fromBackend bool
+	switch {
+	case s.memoryMsg == nil && s.backendMsg == nil:
+		return nil
+	case s.memoryMsg == nil:
+		fromBackend = true
+	case s.backendMsg == nil:
+		fromBackend = false
+	case s.policy == schedulingFIFO:
+		fromBackend = s.backendMsg.Timestamp <= s.memoryMsg.Timestamp
+	default:
+		fromBackend = s.fromMemory >= s.weight
+		if fromBackend {
+			s.fromMemory = 0
+		} else {
+			s.fromMemory++
+		}
+	}
+
+	var msg *Message
+	if fromBackend {
+		msg, s.backendMsg = s.backendMsg, nil
+	} else {
+		msg, s.memoryMsg = s.memoryMsg, nil
+	}
+	return msg
+}
+
+// done is called once the message from next has been handed out
+func (s *queueScheduler) done() {
+	atomic.AddInt32(&s.held, -1)
+}
+
+// drain returns the messages it's holding, which the caller puts back
+func (s *queueScheduler) drain() []*Message {
+	var msgs []*Message
+	for _, msg := range []*Message{s.backendMsg, s.memoryMsg} {
+		if msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	s.backendMsg = nil
+	s.memoryMsg = nil
+	atomic.StoreInt32(&s.held, 0)
+	return msgs
+}
@@ -0,0 +1,209 @@
+package nsqd
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the counters whose rates are kept, see MessageRates
+const (
+	ratePublished = iota
+	rateDelivered
+	rateFinished
+	rateRequeued
+	numRateCounters
+)
+
+type rateCounts [numRateCounters]uint64
+
+// RateWindows are the per second rates of a counter over the last minute and
+// the last 5 minutes (or the time since the first sample, if shorter)
+type RateWindows struct {
+	M1 float64 `json:"1m"`
+	M5 float64 `json:"5m"`
+}
+
+// MessageRates are the rates of messages published to, delivered from,
+// finished on and requeued to a channel (or all the channels of a topic, and
+// to the topic itself)
+type MessageRates struct {
+	Published RateWindows `json:"published"`
+	Delivered RateWindows `json:"delivered"`
+	Finished  RateWindows `json:"finished"`
+	Requeued  RateWindows `json:"requeued"`
+}
+
+func (r MessageRates) String() string {
+	return fmt.Sprintf("pub: %.1f/%.1f dlv: %.1f/%.1f fin: %.1f/%.1f re-q: %.1f/%.1f",
+		r.Published.M1, r.Published.M5, r.Delivered.M1, r.Delivered.M5,
+		r.Finished.M1, r.Finished.M5, r.Requeued.M1, r.Requeued.M5)
+}
+
+type rateSample struct {
+	ts     time.Time
+	counts rateCounts
+}
+
+// rateHistory is a ring buffer of the last 5 minutes of samples of a topic's
+// or channel's counters, taken by rateLoop every RateSampleInterval
+type rateHistory struct {
+	sync.Mutex
+	samples []rateSample
+	next    int
+	full    bool
+}
+
+// add records the counts at ts, replacing the oldest sample once 5 minutes
+// of them (at interval) are kept
+func (h *rateHistory) add(ts time.Time, counts rateCounts, interval time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	if h.samples == nil {
+		h.samples = make([]rateSample, int(5*time.Minute/interval)+1)
+	}
+	h.samples[h.next] = rateSample{ts, counts}
+	h.next++
+	if h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// reset forgets the samples, after the counters were reset
+func (h *rateHistory) reset() {
+	h.Lock()
+	h.samples = nil
+	h.next = 0
+	h.full = false
+	h.Unlock()
+}
+
+// rates returns the rates of counts (as of now) since the samples of 1 and 5
+// minutes ago
+func (h *rateHistory) rates(now time.Time, counts rateCounts) MessageRates {
+	h.Lock()
+	defer h.Unlock()
+	var r [numRateCounters]RateWindows
+	for _, w := range []struct {
+		d    time.Duration
+		rate func(i int) *float64
+	}{
+		{time.Minute, func(i int) *float64 { return &r[i].M1 }},
+		{5 * time.Minute, func(i int) *float64 { return &r[i].M5 }},
+	} {
+		s, ok := h.since(now.Add(-w.d))
+		if !ok {
+			continue
+		}
+		elapsed := now.Sub(s.ts).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+		for i := range counts {
+			// a counter may have gone down, with a channel of the topic
+			if counts[i] > s.counts[i] {
+				*w.rate(i) = float64(counts[i]-s.counts[i]) / elapsed
+			}
+		}
+	}
+	return MessageRates{r[ratePublished], r[rateDelivered], r[rateFinished], r[rateRequeued]}
+}
+
+// since returns the most recent sample taken at or before t, or the oldest
+// sample if all are more recent
+func (h *rateHistory) since(t time.Time) (rateSample, bool) {
+	n := h.next
+	start := 0
+	if h.full {
+		n = len(h.samples)
+		start = h.next
+	}
+	if n == 0 {
+		return rateSample{}, false
+	}
+	found := h.samples[start]
+	for i := 1; i < n; i++ {
+		s := h.samples[(start+i)%len(h.samples)]
+		if s.ts.After(t) {
+			break
+		}
+		found = s
+	}
+	return found, true
+}
+
+// rateCounts returns the channel's counters, see MessageRates
+func (c *Channel) rateCounts() rateCounts {
+	return rateCounts{
+		ratePublished: atomic.LoadUint64(&c.messageCount),
+		rateDelivered: atomic.LoadUint64(&c.firstDeliveryCount) + atomic.LoadUint64(&c.redeliveryCount),
+		rateFinished:  atomic.LoadUint64(&c.finishCount),
+		rateRequeued:  atomic.LoadUint64(&c.requeueCount),
+	}
+}
+
+// rateCounts returns the topic's message count, and the totals of the other
+// counters of its channels, see MessageRates
+func (t *Topic) rateCounts() rateCounts {
+	t.RLock()
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.RUnlock()
+	var counts rateCounts
+	for _, c := range channels {
+		cc := c.rateCounts()
+		for i := rateDelivered; i < numRateCounters; i++ {
+			counts[i] += cc[i]
+		}
+	}
+	counts[ratePublished] = atomic.LoadUint64(&t.messageCount)
+	return counts
+}
+
+// Rates returns the channel's MessageRates
+func (c *Channel) Rates() MessageRates {
+	return c.rateHistory.rates(time.Now(), c.rateCounts())
+}
+
+// Rates returns the topic's MessageRates
+func (t *Topic) Rates() MessageRates {
+	return t.rateHistory.rates(time.Now(), t.rateCounts())
+}
+
+// rateLoop samples the counters of every topic and channel every
+// RateSampleInterval, for their MessageRates
+func (n *NSQD) rateLoop() {
+	interval := n.getOpts().RateSampleInterval
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			goto exit
+		}
+
+		n.RLock()
+		topics := make([]*Topic, 0, len(n.topicMap))
+		for _, t := range n.topicMap {
+			topics = append(topics, t)
+		}
+		n.RUnlock()
+
+		now := time.Now()
+		for _, t := range topics {
+			t.rateHistory.add(now, t.rateCounts(), interval)
+			t.RLock()
+			for _, c := range t.channelMap {
+				c.rateHistory.add(now, c.rateCounts(), interval)
+			}
+			t.RUnlock()
+		}
+	}
+
+exit:
+	ticker.Stop()
+}
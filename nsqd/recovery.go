@@ -0,0 +1,148 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/nsqio/nsq/internal/diskqueue"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// OrphanedQueue is a diskqueue found on startup for a topic or channel that
+// isn't in the metadata file, and that wasn't recovered
+type OrphanedQueue struct {
+	Name     string `json:"name"`
+	DataPath string `json:"data_path"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Reason   string `json:"reason"`
+}
+
+// <name>.diskqueue.meta.dat and <name>.diskqueue.<file num>.dat
+var diskQueueFileRegex = regexp.MustCompile(`^(.+)\.diskqueue\.(meta|[0-9]+)\.dat$`)
+
+// scanDiskQueue reads through the messages of the diskqueue named name in
+// dataPath without opening it, see diskqueue.Scan
+func (n *NSQD) scanDiskQueue(name string, dataPath string) (diskqueue.ScanResult, error) {
+	opts := n.getOpts()
+	validate := func(b []byte) error {
+		_, err := decodeMessage(b)
+		return err
+	}
+	return diskqueue.Scan(name, dataPath,
+		int32(minValidMsgLength), maxStoredMsgSize(opts),
+		dataEncryptionKeyring(opts), validate)
+}
+
+// recoverOrphanedQueues looks through --data-path and --topic-data-path for
+// the diskqueue files of topics and channels that aren't in the metadata
+// file, e.g. those created after it was last persisted before a crash. With
+// --recover-orphaned-queues the intact ones are re-created, the others are
+// logged and listed in /stats (see GetOrphanedQueues) rather than ignored.
+func (n *NSQD) recoverOrphanedQueues() {
+	opts := n.getOpts()
+
+	known := make(map[string]bool)
+	n.RLock()
+	for _, t := range n.topicMap {
+		known[t.name] = true
+		t.RLock()
+		for _, c := range t.channelMap {
+			known[getBackendName(t.name, c.name)] = true
+		}
+		t.RUnlock()
+	}
+	n.RUnlock()
+
+	type foundQueue struct {
+		OrphanedQueue
+		hasMeta bool
+	}
+	var queues []*foundQueue
+	scanned := make(map[string]bool)
+	for _, dataPath := range append([]string{opts.DataPath}, opts.TopicDataPaths...) {
+		if scanned[filepath.Clean(dataPath)] {
+			continue
+		}
+		scanned[filepath.Clean(dataPath)] = true
+
+		files, err := ioutil.ReadDir(dataPath)
+		if err != nil {
+			n.logf(LOG_ERROR, "failed to scan %s for orphaned diskqueues - %s", dataPath, err)
+			continue
+		}
+		byName := make(map[string]*foundQueue)
+		for _, fi := range files {
+			m := diskQueueFileRegex.FindStringSubmatch(fi.Name())
+			if m == nil || fi.IsDir() || known[m[1]] {
+				continue
+			}
+			q, ok := byName[m[1]]
+			if !ok {
+				q = &foundQueue{OrphanedQueue: OrphanedQueue{Name: m[1], DataPath: dataPath}}
+				byName[m[1]] = q
+				queues = append(queues, q)
+			}
+			if m[2] == "meta" {
+				q.hasMeta = true
+				continue
+			}
+			q.Files++
+			q.Bytes += fi.Size()
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+
+	var orphaned []OrphanedQueue
+	for _, q := range queues {
+		var reason string
+		var depth int64
+		topicName, channelName, isChannel := splitBackendName(q.Name)
+		if !protocol.IsValidTopicName(topicName) ||
+			(isChannel && !protocol.IsValidChannelName(channelName)) {
+			reason = "invalid topic or channel name"
+		} else if !q.hasMeta {
+			reason = "no diskqueue metadata file"
+		} else if result, err := n.scanDiskQueue(q.Name, q.DataPath); err != nil {
+			reason = fmt.Sprintf("unreadable - %s", err)
+		} else if result.CorruptFile != "" {
+			reason = fmt.Sprintf("corrupt message in %s at offset %d - %s",
+				filepath.Base(result.CorruptFile), result.CorruptPos, result.CorruptErr)
+		} else if !opts.RecoverOrphanedQueues {
+			reason = "not in metadata (--recover-orphaned-queues=false)"
+		} else {
+			depth = result.Depth
+		}
+
+		if reason != "" {
+			n.logf(LOG_WARN, "DISKQUEUE(%s): orphaned in %s (%d files, %d bytes) - %s",
+				q.Name, q.DataPath, q.Files, q.Bytes, reason)
+			q.Reason = reason
+			orphaned = append(orphaned, q.OrphanedQueue)
+			continue
+		}
+
+		topic := n.GetTopic(topicName)
+		if isChannel {
+			topic.GetChannel(channelName)
+		}
+		topic.Start()
+		n.logf(LOG_INFO, "DISKQUEUE(%s): recovered orphaned diskqueue in %s (depth %d)",
+			q.Name, q.DataPath, depth)
+	}
+
+	n.Lock()
+	n.orphanedQueues = orphaned
+	n.Unlock()
+}
+
+// GetOrphanedQueues returns the diskqueues found on startup that weren't
+// recovered, see recoverOrphanedQueues
+func (n *NSQD) GetOrphanedQueues() []OrphanedQueue {
+	n.RLock()
+	defer n.RUnlock()
+	return n.orphanedQueues
+}
@@ -0,0 +1,56 @@
+package nsqd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestRecoverOrphanedQueues(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("test_orphaned")
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	nsqd.Exit()
+
+	// as if nsqd crashed before persisting its metadata
+	test.Nil(t, os.Remove(newMetadataFile(opts)))
+	test.Nil(t, ioutil.WriteFile(filepath.Join(opts.DataPath, "in!valid.diskqueue.000000.dat"), []byte("test"), 0600))
+	test.Nil(t, ioutil.WriteFile(filepath.Join(opts.DataPath, "no_meta.diskqueue.000000.dat"), []byte("test"), 0600))
+
+	// not recovered, only reported
+	opts.RecoverOrphanedQueues = false
+	_, _, nsqd = mustStartNSQD(opts)
+	test.Nil(t, nsqd.LoadMetadata())
+	test.Equal(t, 0, len(nsqd.GetStats("", "", false)))
+	orphaned := nsqd.GetOrphanedQueues()
+	test.Equal(t, 4, len(orphaned))
+	test.Equal(t, "in!valid", orphaned[0].Name)
+	test.Equal(t, "invalid topic or channel name", orphaned[0].Reason)
+	test.Equal(t, "no_meta", orphaned[1].Name)
+	test.Equal(t, opts.DataPath, orphaned[1].DataPath)
+	test.Equal(t, 1, orphaned[1].Files)
+	test.Equal(t, int64(4), orphaned[1].Bytes)
+	test.Equal(t, "no diskqueue metadata file", orphaned[1].Reason)
+	test.Equal(t, "test_orphaned", orphaned[2].Name)
+	test.Equal(t, getBackendName("test_orphaned", "ch"), orphaned[3].Name)
+	nsqd.Exit()
+
+	opts.RecoverOrphanedQueues = true
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	test.Nil(t, nsqd.LoadMetadata())
+	test.Equal(t, 2, len(nsqd.GetOrphanedQueues()))
+	topic, err := nsqd.GetExistingTopic("test_orphaned")
+	test.Nil(t, err)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+}
@@ -0,0 +1,267 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// ErrReplicationFailed is returned by Topic.replicate when a replica didn't
+// accept a publish in --replication-mode=sync
+var ErrReplicationFailed = errors.New("replication failed")
+
+// replicaQueueSize is how many publishes are queued per replica in
+// --replication-mode=async before more are dropped (and counted as failed)
+const replicaQueueSize = 10000
+
+// replicationRequest is a publish to a replica's /pub or /mpub
+type replicationRequest struct {
+	endpoint string
+	body     []byte
+}
+
+// replica is an nsqd (see --replica-http-address) that non-ephemeral
+// topics' publishes are forwarded to over its HTTP API
+type replica struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	replicatedCount uint64
+	failedCount     uint64
+	healthy         int32
+
+	addr   string
+	client *http.Client
+	queue  chan []replicationRequest
+
+	sync.RWMutex
+	lastError string
+}
+
+// ReplicaStats is the health of a replica, as shown in /stats
+type ReplicaStats struct {
+	Address         string `json:"address"`
+	Healthy         bool   `json:"healthy"`
+	ReplicatedCount uint64 `json:"replicated_count"`
+	FailedCount     uint64 `json:"failed_count"`
+	QueueDepth      int    `json:"queue_depth"`
+	LastError       string `json:"last_error,omitempty"`
+}
+
+func newReplicas(opts *Options) []*replica {
+	var replicas []*replica
+	for _, addr := range opts.ReplicaHTTPAddresses {
+		r := &replica{
+			addr:    addr,
+			healthy: 1,
+			client: &http.Client{
+				Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+				Timeout:   opts.HTTPClientRequestTimeout,
+			},
+		}
+		if opts.ReplicationMode == "async" {
+			r.queue = make(chan []replicationRequest, replicaQueueSize)
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+// send makes the requests, returning at the first that fails
+func (r *replica) send(reqs []replicationRequest) error {
+	var err error
+	for _, req := range reqs {
+		err = r.post(req)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&r.failedCount, 1)
+		atomic.StoreInt32(&r.healthy, 0)
+		r.Lock()
+		r.lastError = err.Error()
+		r.Unlock()
+		return err
+	}
+	atomic.AddUint64(&r.replicatedCount, 1)
+	atomic.StoreInt32(&r.healthy, 1)
+	return nil
+}
+
+func (r *replica) post(req replicationRequest) error {
+	resp, err := r.client.Post(fmt.Sprintf("http://%s%s", r.addr, req.endpoint),
+		"application/octet-stream", bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got response %s %q", resp.Status, body)
+	}
+	return nil
+}
+
+func (r *replica) Stats() ReplicaStats {
+	r.RLock()
+	lastError := r.lastError
+	r.RUnlock()
+	return ReplicaStats{
+		Address:         r.addr,
+		Healthy:         atomic.LoadInt32(&r.healthy) == 1,
+		ReplicatedCount: atomic.LoadUint64(&r.replicatedCount),
+		FailedCount:     atomic.LoadUint64(&r.failedCount),
+		QueueDepth:      len(r.queue),
+		LastError:       lastError,
+	}
+}
+
+// replicationLoop sends the replica's queued publishes in
+// --replication-mode=async
+func (n *NSQD) replicationLoop(r *replica) {
+	for {
+		select {
+		case reqs := <-r.queue:
+			err := r.send(reqs)
+			if err != nil {
+				n.logf(LOG_ERROR, "REPLICATION: failed to replicate to %s - %s", r.addr, err)
+			}
+		case <-n.exitChan:
+			if depth := len(r.queue); depth > 0 {
+				n.logf(LOG_WARN, "REPLICATION: exiting with %d publishes unsent to %s", depth, r.addr)
+			}
+			return
+		}
+	}
+}
+
+// GetReplicaStats returns the health of the replicas
+func (n *NSQD) GetReplicaStats() []ReplicaStats {
+	var stats []ReplicaStats
+	for _, r := range n.replicas {
+		stats = append(stats, r.Stats())
+	}
+	return stats
+}
+
+// replicationRequests returns the requests that publish msgs to topic on a
+// replica: one /mpub for messages with the same headers and priority that
+// aren't deferred, otherwise a /pub per message
+func replicationRequests(topic string, msgs []*Message) []replicationRequest {
+	same := len(msgs) > 1
+	for _, msg := range msgs {
+		if msg.deferred != 0 || msg.Priority != msgs[0].Priority ||
+			!reflect.DeepEqual(msg.Headers, msgs[0].Headers) {
+			same = false
+			break
+		}
+	}
+
+	if same {
+		size := 4
+		for _, msg := range msgs {
+			size += 4 + len(msg.Body)
+		}
+		body := make([]byte, 4, size)
+		binary.BigEndian.PutUint32(body, uint32(len(msgs)))
+		for _, msg := range msgs {
+			var l [4]byte
+			binary.BigEndian.PutUint32(l[:], uint32(len(msg.Body)))
+			body = append(body, l[:]...)
+			body = append(body, msg.Body...)
+		}
+		return []replicationRequest{{replicationEndpoint("/mpub", topic, msgs[0]) + "&binary=true", body}}
+	}
+
+	reqs := make([]replicationRequest, 0, len(msgs))
+	for _, msg := range msgs {
+		reqs = append(reqs, replicationRequest{
+			replicationEndpoint("/pub", topic, msg),
+			append([]byte(nil), msg.Body...),
+		})
+	}
+	return reqs
+}
+
+func replicationEndpoint(path string, topic string, msg *Message) string {
+	q := url.Values{}
+	q.Set("topic", topic)
+	if msg.deferred != 0 {
+		q.Set("defer", strconv.FormatInt(int64(msg.deferred/time.Millisecond), 10))
+	}
+	if msg.Priority != PriorityNormal {
+		q.Set("priority", strconv.Itoa(int(msg.Priority)))
+	}
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		q.Add("header", k+":"+msg.Headers[k])
+	}
+	return path + "?" + q.Encode()
+}
+
+// replication returns the requests that forward a publish of msgs to the
+// replicas (see replicate), nil if the topic isn't replicated. They're made
+// before msgs are put, which may be FIN'd (and released) as soon as they are.
+func (t *Topic) replication(msgs []*Message) []replicationRequest {
+	if len(t.nsqd.replicas) == 0 || t.ephemeral {
+		return nil
+	}
+	return replicationRequests(t.name, msgs)
+}
+
+// replicate forwards a publish (see replication) to the replicas once it's
+// been put, so that they never have a message the topic refused, in
+// --replication-mode=sync waiting for all of them to accept it
+func (t *Topic) replicate(reqs []replicationRequest) error {
+	replicas := t.nsqd.replicas
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	if replicas[0].queue != nil {
+		for _, r := range replicas {
+			select {
+			case r.queue <- reqs:
+			default:
+				atomic.AddUint64(&r.failedCount, 1)
+				atomic.StoreInt32(&r.healthy, 0)
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	for _, r := range replicas {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.send(reqs)
+			if err != nil {
+				t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to replicate to %s - %s", t.name, r.addr, err)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&failed) == 1 {
+		return ErrReplicationFailed
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestReplication(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, replicaHTTPAddr, replica := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer replica.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaHTTPAddresses = []string{replicaHTTPAddr.String()}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_replication" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&header=type:order&defer=1", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test body"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("one\ntwo"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	// in sync mode the replica has the messages by the time they're acked
+	replicaTopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, uint64(3), atomic.LoadUint64(&replicaTopic.messageCount))
+	msg := <-replicaTopic.memoryMsgChan
+	test.Equal(t, map[string]string{"type": "order"}, msg.Headers)
+	test.Equal(t, []byte("test body"), msg.Body)
+	test.Equal(t, time.Millisecond, msg.deferred)
+
+	stats := nsqd.GetReplicaStats()
+	test.Equal(t, 1, len(stats))
+	test.Equal(t, true, stats[0].Healthy)
+	test.Equal(t, uint64(2), stats[0].ReplicatedCount)
+	test.Equal(t, uint64(0), stats[0].FailedCount)
+}
+
+func TestReplicationFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	for _, mode := range []string{"sync", "async"} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.ReplicaHTTPAddresses = []string{deadAddr}
+		opts.ReplicationMode = mode
+		_, httpAddr, nsqd := mustStartNSQD(opts)
+
+		topicName := "test_replication_failed" + strconv.Itoa(int(time.Now().Unix()))
+		topic := nsqd.GetTopic(topicName)
+
+		url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test body"))
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if mode == "sync" {
+			test.Equal(t, 503, resp.StatusCode)
+			test.Equal(t, `{"message":"REPLICATION_FAILED"}`, string(body))
+		} else {
+			test.Equal(t, 200, resp.StatusCode)
+		}
+		// the message is only replicated once it's been put
+		test.Equal(t, int64(1), topic.Depth())
+
+		for i := 0; nsqd.GetReplicaStats()[0].FailedCount != 1; i++ {
+			test.Equal(t, true, i < 100)
+			time.Sleep(10 * time.Millisecond)
+		}
+		stats := nsqd.GetReplicaStats()[0]
+		test.Equal(t, false, stats.Healthy)
+		test.Equal(t, true, stats.LastError != "")
+
+		nsqd.Exit()
+		os.RemoveAll(opts.DataPath)
+	}
+}
+
+func TestReplicationRefused(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, replicaHTTPAddr, replica := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer replica.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaHTTPAddresses = []string{replicaHTTPAddr.String()}
+	opts.MaxDepth = 1
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_replication_refused" + strconv.Itoa(int(time.Now().Unix()))
+
+	// the replica doesn't get the publish the topic refuses
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	for _, code := range []int{200, 503} {
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test body"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, code, resp.StatusCode)
+	}
+
+	replicaTopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, uint64(1), atomic.LoadUint64(&replicaTopic.messageCount))
+	test.Equal(t, uint64(1), nsqd.GetReplicaStats()[0].ReplicatedCount)
+}
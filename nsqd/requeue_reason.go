@@ -0,0 +1,56 @@
+package nsqd
+
+import (
+	"bytes"
+)
+
+// RequeueReason classifies why a consumer sent REQ for a message
+type RequeueReason int
+
+const (
+	RequeueReasonUnspecified RequeueReason = iota
+	RequeueReasonDownstreamTimeout
+	RequeueReasonValidationError
+	RequeueReasonTransient
+	RequeueReasonOther
+
+	numRequeueReasons
+)
+
+var requeueReasonNames = [numRequeueReasons]string{
+	RequeueReasonUnspecified:       "unspecified",
+	RequeueReasonDownstreamTimeout: "downstream_timeout",
+	RequeueReasonValidationError:   "validation_error",
+	RequeueReasonTransient:         "transient",
+	RequeueReasonOther:             "other",
+}
+
+func (r RequeueReason) String() string {
+	if r < 0 || r >= numRequeueReasons {
+		return requeueReasonNames[RequeueReasonOther]
+	}
+	return requeueReasonNames[r]
+}
+
+// parseRequeueReason parses the optional REQ reason param, which is
+// a reason code optionally followed by a free-form detail:
+//
+//	<code>[:<detail>]
+//
+// unknown codes are counted as RequeueReasonOther (the whole
+// param is returned as the detail). Like any param, neither may
+// contain spaces.
+func parseRequeueReason(b []byte) (RequeueReason, string) {
+	code := b
+	var detail []byte
+	if i := bytes.IndexByte(b, ':'); i >= 0 {
+		code = b[:i]
+		detail = b[i+1:]
+	}
+	for r, name := range requeueReasonNames {
+		if string(code) == name {
+			return RequeueReason(r), string(detail)
+		}
+	}
+	return RequeueReasonOther, string(b)
+}
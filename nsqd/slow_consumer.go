@@ -0,0 +1,111 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// --slow-consumer-policy values
+const (
+	slowConsumerFlag  = "flag"
+	slowConsumerEvict = "evict"
+)
+
+// slowConsumerMinAcks is the number of acks (FINs and REQs) a consumer's
+// average latency needs before it's compared to --slow-consumer-ack-latency
+const slowConsumerMinAcks = 10
+
+// ackStats track how long a consumer takes to FIN or REQ the messages sent
+// to it, and how many of them time out instead. Consumers that are too slow
+// (see isSlow) are flagged in their stats, and with
+// --slow-consumer-policy=evict disconnected.
+type ackStats struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	ackCount     uint64
+	ackLatency   int64 // ns, a moving average
+	timeoutCount uint64
+	// messages timed out since the last ack
+	timeoutsSinceAck int64
+
+	evicted int32
+}
+
+// AckedMessage records the latency of a FIN or REQ, the time since the
+// message was delivered
+func (s *ackStats) AckedMessage(latency time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.ackLatency)
+		avg := int64(latency)
+		if old != 0 {
+			avg = old + (int64(latency)-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&s.ackLatency, old, avg) {
+			break
+		}
+	}
+	atomic.AddUint64(&s.ackCount, 1)
+	atomic.StoreInt64(&s.timeoutsSinceAck, 0)
+}
+
+func (s *ackStats) timedOut() {
+	atomic.AddUint64(&s.timeoutCount, 1)
+	atomic.AddInt64(&s.timeoutsSinceAck, 1)
+}
+
+// isSlow returns whether the consumer's average ack latency exceeds
+// --slow-consumer-ack-latency, or --slow-consumer-timeouts of its messages
+// timed out in a row
+func (s *ackStats) isSlow(opts *Options) bool {
+	if opts.SlowConsumerAckLatency > 0 &&
+		atomic.LoadUint64(&s.ackCount) >= slowConsumerMinAcks &&
+		time.Duration(atomic.LoadInt64(&s.ackLatency)) > opts.SlowConsumerAckLatency {
+		return true
+	}
+	return opts.SlowConsumerTimeouts > 0 &&
+		atomic.LoadInt64(&s.timeoutsSinceAck) >= int64(opts.SlowConsumerTimeouts)
+}
+
+// fillStats sets the ack stats of stats
+func (s *ackStats) fillStats(stats *ClientStats, opts *Options) {
+	stats.TimeoutCount = atomic.LoadUint64(&s.timeoutCount)
+	stats.AckLatency = atomic.LoadInt64(&s.ackLatency) / int64(time.Millisecond)
+	stats.Slow = s.isSlow(opts)
+}
+
+// checkSlowConsumer disconnects client, with --slow-consumer-policy=evict,
+// if it's slow. The messages in flight to it are then requeued as it exits
+// (see requeueInFlight), or at the latest when they time out.
+func (c *Channel) checkSlowConsumer(clientID int64, client Consumer) {
+	opts := c.nsqd.getOpts()
+	if opts.SlowConsumerPolicy != slowConsumerEvict || !client.IsSlow() {
+		return
+	}
+	if !client.Evict() {
+		return
+	}
+	c.nsqd.logf(LOG_WARN, "CHANNEL(%s): evicting slow consumer %d", c.name, clientID)
+	client.Close()
+}
+
+// Evict marks the consumer as evicted, it returns false if it already was
+func (s *ackStats) Evict() bool {
+	return atomic.CompareAndSwapInt32(&s.evicted, 0, 1)
+}
+
+// isEvicted returns whether the consumer was evicted, it's sent no more
+// messages
+func (s *ackStats) isEvicted() bool {
+	return atomic.LoadInt32(&s.evicted) == 1
+}
+
+// ackedMessage records the ack latency of msg, FIN'd or REQ'd by clientID
+func (c *Channel) ackedMessage(clientID int64, msg *Message) {
+	c.RLock()
+	client, ok := c.clients[clientID]
+	c.RUnlock()
+	if !ok {
+		return
+	}
+	client.AckedMessage(time.Since(msg.deliveryTS))
+	c.checkSlowConsumer(clientID, client)
+}
@@ -9,45 +9,144 @@ import (
 )
 
 type TopicStats struct {
-	TopicName    string         `json:"topic_name"`
-	Channels     []ChannelStats `json:"channels"`
-	Depth        int64          `json:"depth"`
-	BackendDepth int64          `json:"backend_depth"`
-	MessageCount uint64         `json:"message_count"`
-	MessageBytes uint64         `json:"message_bytes"`
-	Paused       bool           `json:"paused"`
+	TopicName        string         `json:"topic_name"`
+	Channels         []ChannelStats `json:"channels"`
+	Depth            int64          `json:"depth"`
+	BackendDepth     int64          `json:"backend_depth"`
+	BackendDiskBytes int64          `json:"backend_disk_bytes"`
+	MessageCount     uint64         `json:"message_count"`
+	MessageBytes     uint64         `json:"message_bytes"`
+	Paused           bool           `json:"paused"`
+	Hibernated       bool           `json:"hibernated"`
 
-	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+	DeferredDiskCount         int64  `json:"deferred_disk_count"`
+	BackendSkippedCount       int64  `json:"backend_skipped_count"`
+	BackendChecksumErrorCount int64  `json:"backend_checksum_error_count"`
+	BackendWriteThrottled     bool   `json:"backend_write_throttled"`
+	BackendThrottledWrites    int64  `json:"backend_throttled_writes"`
+	BackendUncompressedBytes  int64  `json:"backend_uncompressed_bytes"`
+	BackendCompressedBytes    int64  `json:"backend_compressed_bytes"`
+	OverflowCount             uint64 `json:"overflow_count"`
+	RateLimitedCount          uint64 `json:"rate_limited_count"`
+	QuotaExceededCount        uint64 `json:"quota_exceeded_count"`
+	QuotaBytesUsed            int64  `json:"quota_bytes_used"`
+	DedupHitCount             uint64 `json:"dedup_hit_count"`
+	DedupMissCount            uint64 `json:"dedup_miss_count"`
+
+	Rates                MessageRates           `json:"rates"`
+	DataPath             string                 `json:"data_path,omitempty"`
+	FanOutMode           string                 `json:"fan_out_mode"`
+	Namespace            string                 `json:"namespace,omitempty"`
+	QueueOptions         QueueOptions           `json:"queue_options"`
+	Labels               map[string]string      `json:"labels,omitempty"`
+	Partitions           int                    `json:"partitions,omitempty"`
+	BackendMigration     *BackendMigrationStats `json:"backend_migration,omitempty"`
+	E2eProcessingLatency *quantile.Result       `json:"e2e_processing_latency"`
+}
+
+type BackendMigrationStats struct {
+	DataPath     string `json:"data_path"`
+	InProgress   bool   `json:"in_progress"`
+	MessageCount int64  `json:"message_count"`
+	MessageBytes int64  `json:"message_bytes"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	var migrationStats *BackendMigrationStats
+	t.RLock()
+	m := t.migration
+	dataPath := t.dataPath
+	t.RUnlock()
+	writeThrottled, throttledWrites := t.BackendWriteThrottle()
+	uncompressedBytes, compressedBytes := t.BackendCompressionStats()
+	if m != nil {
+		migrationStats = &BackendMigrationStats{
+			DataPath:     m.dataPath,
+			InProgress:   atomic.LoadInt32(&m.done) == 0,
+			MessageCount: atomic.LoadInt64(&m.messageCount),
+			MessageBytes: atomic.LoadInt64(&m.messageBytes),
+		}
+	}
+
 	return TopicStats{
-		TopicName:    t.name,
-		Channels:     channels,
-		Depth:        t.Depth(),
-		BackendDepth: t.backend.Depth(),
-		MessageCount: atomic.LoadUint64(&t.messageCount),
-		MessageBytes: atomic.LoadUint64(&t.messageBytes),
-		Paused:       t.IsPaused(),
+		TopicName:        t.name,
+		Channels:         channels,
+		Depth:            t.Depth(),
+		BackendDepth:     t.BackendDepth(),
+		BackendDiskBytes: t.BackendDiskBytes(),
+		MessageCount:     atomic.LoadUint64(&t.messageCount),
+		MessageBytes:     atomic.LoadUint64(&t.messageBytes),
+		Paused:           t.IsPaused(),
+		Hibernated:       t.IsHibernated(),
+
+		DeferredDiskCount:         t.DeferredDiskCount(),
+		BackendSkippedCount:       t.BackendSkippedCount(),
+		BackendChecksumErrorCount: t.BackendChecksumErrorCount(),
+		BackendWriteThrottled:     writeThrottled,
+		BackendThrottledWrites:    throttledWrites,
+		BackendUncompressedBytes:  uncompressedBytes,
+		BackendCompressedBytes:    compressedBytes,
+		OverflowCount:             atomic.LoadUint64(&t.overflowCount),
+		RateLimitedCount:          atomic.LoadUint64(&t.rateLimitedCount),
+		QuotaExceededCount:        atomic.LoadUint64(&t.quotaExceededCount),
+		QuotaBytesUsed:            t.quotaUsed(),
+		DedupHitCount:             atomic.LoadUint64(&t.dedupHitCount),
+		DedupMissCount:            atomic.LoadUint64(&t.dedupMissCount),
 
+		Rates:                t.Rates(),
+		DataPath:             dataPath,
+		FanOutMode:           t.FanOutMode(),
+		Namespace:            t.Namespace(),
+		QueueOptions:         t.QueueOptions(),
+		Labels:               t.Labels(),
+		Partitions:           t.Partitions(),
+		BackendMigration:     migrationStats,
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	ClientCount   int           `json:"client_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName      string        `json:"channel_name"`
+	Depth            int64         `json:"depth"`
+	BackendDepth     int64         `json:"backend_depth"`
+	BackendDiskBytes int64         `json:"backend_disk_bytes"`
+	InFlightCount    int           `json:"in_flight_count"`
+	DeferredCount    int           `json:"deferred_count"`
+	MessageCount     uint64        `json:"message_count"`
+	RequeueCount     uint64        `json:"requeue_count"`
+	TimeoutCount     uint64        `json:"timeout_count"`
+	DiscardCount     uint64        `json:"discard_count"`
+	ExpiredCount     uint64        `json:"expired_count"`
+	FilteredCount    uint64        `json:"filtered_count"`
+	FinishCount      uint64        `json:"finish_count"`
+	ClientCount      int           `json:"client_count"`
+	Clients          []ClientStats `json:"clients"`
+	Paused           bool          `json:"paused"`
 
-	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+	Labels                    map[string]string `json:"labels,omitempty"`
+	DataPath                  string            `json:"data_path,omitempty"`
+	BackendSkippedCount       int64             `json:"backend_skipped_count"`
+	BackendChecksumErrorCount int64             `json:"backend_checksum_error_count"`
+	BackendWriteThrottled     bool              `json:"backend_write_throttled"`
+	BackendThrottledWrites    int64             `json:"backend_throttled_writes"`
+	BackendUncompressedBytes  int64             `json:"backend_uncompressed_bytes"`
+	BackendCompressedBytes    int64             `json:"backend_compressed_bytes"`
+	FirstDeliveryCount        uint64            `json:"first_delivery_count"`
+	RedeliveryCount           uint64            `json:"redelivery_count"`
+	TimeoutWarningCount       uint64            `json:"timeout_warning_count"`
+	TimeoutsAvoidedCount      uint64            `json:"timeouts_avoided_count"`
+	DeliveryPreference        string            `json:"delivery_preference"`
+	LocalDeliveryCount        uint64            `json:"local_delivery_count"`
+	ForwardedDeliveryCount    uint64            `json:"forwarded_delivery_count"`
+	DeadLetterTopic           string            `json:"dead_letter_topic,omitempty"`
+	DeadLetterCount           uint64            `json:"dead_letter_count"`
+	Archive                   *ChannelArchive   `json:"archive,omitempty"`
+	ArchivedCount             uint64            `json:"archived_count"`
+	ArchiveDroppedCount       uint64            `json:"archive_dropped_count"`
+	QueueOptions              QueueOptions      `json:"queue_options"`
+	RequeueReasons            map[string]uint64 `json:"requeue_reasons,omitempty"`
+	Rates                     MessageRates      `json:"rates"`
+	E2eProcessingLatency      *quantile.Result  `json:"e2e_processing_latency"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) ChannelStats {
@@ -58,21 +157,289 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	deferred := len(c.deferredMessages)
 	c.deferredMutex.Unlock()
 
+	writeThrottled, throttledWrites := backendWriteThrottle(c.backend)
+	uncompressedBytes, compressedBytes := backendCompressionStats(c.backend)
+
+	var requeueReasons map[string]uint64
+	for i := range c.requeueReasons {
+		count := atomic.LoadUint64(&c.requeueReasons[i])
+		if count == 0 {
+			continue
+		}
+		if requeueReasons == nil {
+			requeueReasons = make(map[string]uint64)
+		}
+		requeueReasons[RequeueReason(i).String()] = count
+	}
+
+	var archive *ChannelArchive
+	if a := c.Archive(); !a.isEmpty() {
+		archive = &a
+	}
+
 	return ChannelStats{
-		ChannelName:   c.name,
-		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
-		InFlightCount: inflight,
-		DeferredCount: deferred,
-		MessageCount:  atomic.LoadUint64(&c.messageCount),
-		RequeueCount:  atomic.LoadUint64(&c.requeueCount),
-		TimeoutCount:  atomic.LoadUint64(&c.timeoutCount),
-		ClientCount:   clientCount,
-		Clients:       clients,
-		Paused:        c.IsPaused(),
+		ChannelName:      c.name,
+		Depth:            c.Depth(),
+		BackendDepth:     c.backend.Depth(),
+		BackendDiskBytes: backendDiskBytes(c.backend),
+		InFlightCount:    inflight,
+		DeferredCount:    deferred,
+		MessageCount:     atomic.LoadUint64(&c.messageCount),
+		RequeueCount:     atomic.LoadUint64(&c.requeueCount),
+		TimeoutCount:     atomic.LoadUint64(&c.timeoutCount),
+		DiscardCount:     atomic.LoadUint64(&c.discardCount),
+		ExpiredCount:     atomic.LoadUint64(&c.expiredCount),
+		FilteredCount:    atomic.LoadUint64(&c.filteredCount),
+		FinishCount:      atomic.LoadUint64(&c.finishCount),
+		ClientCount:      clientCount,
+		Clients:          clients,
+		Paused:           c.IsPaused(),
+
+		Labels:                    c.Labels(),
+		DataPath:                  c.dataPath,
+		BackendSkippedCount:       backendSkippedCount(c.backend),
+		BackendChecksumErrorCount: backendChecksumErrorCount(c.backend),
+		BackendWriteThrottled:     writeThrottled,
+		BackendThrottledWrites:    throttledWrites,
+		BackendUncompressedBytes:  uncompressedBytes,
+		BackendCompressedBytes:    compressedBytes,
+		FirstDeliveryCount:        atomic.LoadUint64(&c.firstDeliveryCount),
+		RedeliveryCount:           atomic.LoadUint64(&c.redeliveryCount),
+		TimeoutWarningCount:       atomic.LoadUint64(&c.timeoutWarningCount),
+		TimeoutsAvoidedCount:      atomic.LoadUint64(&c.timeoutsAvoidedCount),
+		DeliveryPreference:        c.nsqd.getOpts().DeliveryPreference,
+		LocalDeliveryCount:        atomic.LoadUint64(&c.localDeliveryCount),
+		ForwardedDeliveryCount:    atomic.LoadUint64(&c.forwardedDeliveryCount),
+		DeadLetterTopic:           c.DeadLetterTopic(),
+		DeadLetterCount:           atomic.LoadUint64(&c.deadLetterCount),
+		Archive:                   archive,
+		ArchivedCount:             atomic.LoadUint64(&c.archivedCount),
+		ArchiveDroppedCount:       atomic.LoadUint64(&c.archiveDroppedCount),
+		QueueOptions:              c.QueueOptions(),
+		RequeueReasons:            requeueReasons,
+		Rates:                     c.Rates(),
+		E2eProcessingLatency:      c.e2eProcessingLatencyStream.Result(),
+	}
+}
+
+type GoroutineStats struct {
+	Total  int                            `json:"total"`
+	Topics map[string]TopicGoroutineStats `json:"topics"`
+}
 
-		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
+type TopicGoroutineStats struct {
+	Goroutines int64            `json:"goroutines"`
+	Channels   map[string]int64 `json:"channels"`
+}
+
+// GetGoroutineStats returns the number of goroutines working on each topic
+// and channel, alongside the process total
+func (n *NSQD) GetGoroutineStats() GoroutineStats {
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	stats := GoroutineStats{
+		Total:  runtime.NumGoroutine(),
+		Topics: make(map[string]TopicGoroutineStats, len(topics)),
+	}
+	for _, t := range topics {
+		t.RLock()
+		channels := make(map[string]int64, len(t.channelMap))
+		for _, c := range t.channelMap {
+			channels[c.name] = c.Goroutines()
+		}
+		t.RUnlock()
+		stats.Topics[t.name] = TopicGoroutineStats{
+			Goroutines: t.Goroutines(),
+			Channels:   channels,
+		}
+	}
+	return stats
+}
+
+// Internals describes the queues and goroutines of an nsqd's topics and
+// channels, for debugging a stuck topic or channel (see /debug/internals)
+type Internals struct {
+	Goroutines int              `json:"goroutines"`
+	Topics     []TopicInternals `json:"topics"`
+}
+
+type TopicInternals struct {
+	TopicName       string             `json:"topic_name"`
+	MessagePump     bool               `json:"message_pump"`
+	MemoryMsgChan   ChanInternals      `json:"memory_msg_chan"`
+	PriorityMsgChan ChanInternals      `json:"priority_msg_chan"`
+	Backend         *BackendInternals  `json:"backend,omitempty"`
+	Channels        []ChannelInternals `json:"channels"`
+}
+
+type ChannelInternals struct {
+	ChannelName     string            `json:"channel_name"`
+	MemoryMsgChan   ChanInternals     `json:"memory_msg_chan"`
+	RequeueMsgChan  ChanInternals     `json:"requeue_msg_chan"`
+	PriorityMsgChan ChanInternals     `json:"priority_msg_chan"`
+	Backend         *BackendInternals `json:"backend,omitempty"`
+	OrderedLoop     string            `json:"ordered_loop"`
+	ScheduleLoop    string            `json:"schedule_loop"`
+	Clients         []ClientInternals `json:"clients"`
+}
+
+// ChanInternals is the length and capacity of a Go channel
+type ChanInternals struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// BackendInternals is where a diskqueue backend will read and write next
+type BackendInternals struct {
+	ReadFileNum  int64 `json:"read_file_num"`
+	ReadPos      int64 `json:"read_pos"`
+	WriteFileNum int64 `json:"write_file_num"`
+	WritePos     int64 `json:"write_pos"`
+}
+
+// ClientInternals is a consumer's message pump and output buffer, as of its
+// last write (websocket clients don't buffer)
+type ClientInternals struct {
+	ID               int64  `json:"id"`
+	Version          string `json:"version"`
+	RemoteAddress    string `json:"remote_address"`
+	MessagePump      bool   `json:"message_pump"`
+	OutputBuffered   int64  `json:"output_buffered"`
+	OutputBufferSize int64  `json:"output_buffer_size"`
+}
+
+// the state of a channel's orderedLoop or scheduleLoop
+const (
+	loopStopped = "stopped"
+	loopRunning = "running"
+	// it returned without being stopped
+	loopExited = "exited"
+)
+
+func newChanInternals(c chan *Message) ChanInternals {
+	return ChanInternals{Len: len(c), Cap: cap(c)}
+}
+
+// loopState returns the state of a loop started with quitChan (nil when it
+// isn't), which closes exitChan when it returns. It's called with the lock
+// guarding them held.
+func loopState(quitChan chan int, exitChan chan int) string {
+	if quitChan == nil {
+		return loopStopped
+	}
+	select {
+	case <-exitChan:
+		return loopExited
+	default:
+		return loopRunning
+	}
+}
+
+func newChannelInternals(c *Channel) ChannelInternals {
+	c.orderedMtx.Lock()
+	orderedLoop := loopState(c.orderedQuitChan, c.orderedExitChan)
+	c.orderedMtx.Unlock()
+	c.scheduleMtx.Lock()
+	scheduleLoop := loopState(c.scheduleQuitChan, c.scheduleExitChan)
+	c.scheduleMtx.Unlock()
+
+	c.RLock()
+	consumers := make([]Consumer, 0, len(c.clients))
+	for _, client := range c.clients {
+		consumers = append(consumers, client)
+	}
+	c.RUnlock()
+
+	clients := make([]ClientInternals, 0, len(consumers))
+	for _, consumer := range consumers {
+		switch client := consumer.(type) {
+		case *clientV2:
+			clients = append(clients, ClientInternals{
+				ID:               client.ID,
+				Version:          "V2",
+				RemoteAddress:    client.RemoteAddr().String(),
+				MessagePump:      atomic.LoadInt32(&client.pumpRunning) == 1,
+				OutputBuffered:   atomic.LoadInt64(&client.outputBuffered),
+				OutputBufferSize: atomic.LoadInt64(&client.outputBufferSize),
+			})
+		case *wsClient:
+			clients = append(clients, ClientInternals{
+				ID:            client.ID,
+				Version:       "WS",
+				RemoteAddress: client.conn.RemoteAddr().String(),
+				MessagePump:   atomic.LoadInt32(&client.pumpRunning) == 1,
+			})
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	return ChannelInternals{
+		ChannelName:     c.name,
+		MemoryMsgChan:   newChanInternals(c.memoryMsgChan),
+		RequeueMsgChan:  newChanInternals(c.requeueMsgChan),
+		PriorityMsgChan: newChanInternals(c.priority.msgChan),
+		Backend:         backendInternals(c.backend),
+		OrderedLoop:     orderedLoop,
+		ScheduleLoop:    scheduleLoop,
+		Clients:         clients,
+	}
+}
+
+// GetInternals returns the Internals of topicName (all topics if it's
+// empty), and of its channelName (all its channels if it's empty). Unlike
+// GetStats it doesn't wait on the locks a blocked client write holds.
+func (n *NSQD) GetInternals(topicName string, channelName string) Internals {
+	n.RLock()
+	var topics []*Topic
+	if topicName == "" {
+		topics = make([]*Topic, 0, len(n.topicMap))
+		for _, t := range n.topicMap {
+			topics = append(topics, t)
+		}
+	} else if t, ok := n.topicMap[topicName]; ok {
+		topics = []*Topic{t}
+	}
+	n.RUnlock()
+	sort.Slice(topics, func(i, j int) bool { return topics[i].name < topics[j].name })
+
+	internals := Internals{
+		Goroutines: runtime.NumGoroutine(),
+		Topics:     make([]TopicInternals, 0, len(topics)),
+	}
+	for _, t := range topics {
+		t.RLock()
+		backend := t.backend
+		var channels []*Channel
+		if channelName == "" {
+			channels = make([]*Channel, 0, len(t.channelMap))
+			for _, c := range t.channelMap {
+				channels = append(channels, c)
+			}
+		} else if c, ok := t.channelMap[channelName]; ok {
+			channels = []*Channel{c}
+		}
+		t.RUnlock()
+		sort.Slice(channels, func(i, j int) bool { return channels[i].name < channels[j].name })
+
+		channelInternals := make([]ChannelInternals, 0, len(channels))
+		for _, c := range channels {
+			channelInternals = append(channelInternals, newChannelInternals(c))
+		}
+		internals.Topics = append(internals.Topics, TopicInternals{
+			TopicName:       t.name,
+			MessagePump:     t.waitGroup.Running() > 0,
+			MemoryMsgChan:   newChanInternals(t.memoryMsgChan),
+			PriorityMsgChan: newChanInternals(t.priority.msgChan),
+			Backend:         backendInternals(backend),
+			Channels:        channelInternals,
+		})
 	}
+	return internals
 }
 
 type PubCount struct {
@@ -91,11 +458,16 @@ type ClientStats struct {
 	MessageCount    uint64 `json:"message_count"`
 	FinishCount     uint64 `json:"finish_count"`
 	RequeueCount    uint64 `json:"requeue_count"`
+	TimeoutCount    uint64 `json:"timeout_count"`
+	AckLatency      int64  `json:"ack_latency_ms"`
+	Slow            bool   `json:"slow,omitempty"`
 	ConnectTime     int64  `json:"connect_ts"`
+	LastHeartbeat   int64  `json:"last_heartbeat_ts"`
 	SampleRate      int32  `json:"sample_rate"`
 	Deflate         bool   `json:"deflate"`
 	Snappy          bool   `json:"snappy"`
 	UserAgent       string `json:"user_agent"`
+	Forwarder       bool   `json:"forwarder,omitempty"`
 	Authed          bool   `json:"authed,omitempty"`
 	AuthIdentity    string `json:"auth_identity,omitempty"`
 	AuthIdentityURL string `json:"auth_identity_url,omitempty"`
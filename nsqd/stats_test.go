@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 )
@@ -65,6 +66,62 @@ func TestStats(t *testing.T) {
 	test.Equal(t, 0, len(stats))
 }
 
+func TestStatsBackendDiskBytes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.SyncTimeout = 50 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_backend_disk_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, true, stats[0].BackendDiskBytes > 0)
+
+	// once the topic's backend is drained into the channel's its file is
+	// removed, on the next --sync-timeout
+	topic.GetChannel("ch")
+	for i := 0; nsqd.GetStats(topicName, "", false)[0].BackendDiskBytes != 0; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; nsqd.GetStats(topicName, "ch", false)[0].Channels[0].BackendDiskBytes == 0; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatsBackendThrottledWrites(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_backend_throttled_writes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	maxDiskWriteRate := int64(1000)
+	topic.SetQueueOptions(QueueOptions{MaxDiskWriteRate: &maxDiskWriteRate})
+	for i := 0; i < 10; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body"))))
+	}
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, false, stats[0].BackendWriteThrottled)
+	test.Equal(t, true, stats[0].BackendThrottledWrites > 0)
+
+	// the channel's backend isn't throttled
+	topic.GetChannel("ch")
+	for i := 0; nsqd.GetStats(topicName, "ch", false)[0].Channels[0].BackendDepth != 10; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), nsqd.GetStats(topicName, "ch", false)[0].Channels[0].BackendThrottledWrites)
+}
+
 func TestClientAttributes(t *testing.T) {
 	userAgent := "Test User Agent"
 
@@ -118,6 +175,37 @@ func TestClientAttributes(t *testing.T) {
 	test.Equal(t, true, d.Topics[0].Channels[0].Clients[0].Snappy)
 }
 
+func TestClientLastHeartbeat(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	topicName := "test_client_last_heartbeat" + strconv.Itoa(int(time.Now().Unix()))
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	lastHeartbeat := func() int64 {
+		stats := nsqd.GetStats(topicName, "ch", true)
+		return stats[0].Channels[0].Clients[0].LastHeartbeat
+	}
+	test.Equal(t, int64(0), lastHeartbeat())
+
+	start := time.Now().Unix()
+	_, err = nsq.Nop().WriteTo(conn)
+	test.Nil(t, err)
+	// a NOP has no response, poll for it to be handled
+	for i := 0; i < 100 && lastHeartbeat() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, lastHeartbeat() >= start)
+}
+
 func TestStatsChannelLocking(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -157,3 +245,62 @@ func TestStatsChannelLocking(t *testing.T) {
 	test.Equal(t, 1, len(stats[0].Channels))
 	test.Equal(t, 25, stats[0].Channels[0].InFlightCount)
 }
+
+func TestRateHistory(t *testing.T) {
+	var h rateHistory
+	start := time.Now()
+	interval := 10 * time.Second
+
+	test.Equal(t, MessageRates{}, h.rates(start, rateCounts{ratePublished: 10}))
+
+	// 10 publishes/s for 5 minutes, then none for a minute
+	var counts rateCounts
+	for s := 0; s <= 360; s += 10 {
+		counts[ratePublished] = uint64(10 * s)
+		if s > 300 {
+			counts[ratePublished] = 3000
+		}
+		counts[rateFinished] = uint64(s)
+		h.add(start.Add(time.Duration(s)*time.Second), counts, interval)
+	}
+	r := h.rates(start.Add(360*time.Second), counts)
+	test.Equal(t, 0.0, r.Published.M1)
+	test.Equal(t, 8.0, r.Published.M5)
+	test.Equal(t, 1.0, r.Finished.M1)
+	test.Equal(t, 1.0, r.Finished.M5)
+	test.Equal(t, 0.0, r.Requeued.M5)
+
+	// counters that went down have no rate
+	test.Equal(t, 0.0, h.rates(start.Add(360*time.Second), rateCounts{}).Finished.M1)
+
+	h.reset()
+	test.Equal(t, MessageRates{}, h.rates(start, counts))
+}
+
+func TestStatsRates(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.RateSampleInterval = 10 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_stats_rates" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body"))))
+	}
+	for i := 0; channel.Depth() != 10; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, true, stats[0].Rates.Published.M1 > 0)
+	test.Equal(t, true, stats[0].Rates.Published.M5 > 0)
+	test.Equal(t, true, stats[0].Channels[0].Rates.Published.M1 > 0)
+	test.Equal(t, 0.0, stats[0].Channels[0].Rates.Finished.M1)
+}
@@ -24,6 +24,15 @@ func (s Uint64Slice) Less(i, j int) bool {
 	return s[i] < s[j]
 }
 
+// counterDiff returns how much a counter grew since it was last seen, a
+// channel's counters start from 0 again after Channel.ResetStats
+func counterDiff(count uint64, last uint64) uint64 {
+	if count < last {
+		return count
+	}
+	return count - last
+}
+
 func (n *NSQD) statsdLoop() {
 	var lastMemStats memStats
 	var lastStats []TopicStats
@@ -71,6 +80,33 @@ func (n *NSQD) statsdLoop() {
 				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
 				client.Gauge(stat, topic.BackendDepth)
 
+				stat = fmt.Sprintf("topic.%s.backend_disk_bytes", topic.TopicName)
+				client.Gauge(stat, topic.BackendDiskBytes)
+
+				diff = counterDiff(uint64(topic.BackendThrottledWrites), uint64(lastTopic.BackendThrottledWrites))
+				stat = fmt.Sprintf("topic.%s.backend_throttled_writes", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = counterDiff(topic.OverflowCount, lastTopic.OverflowCount)
+				stat = fmt.Sprintf("topic.%s.overflow_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = counterDiff(topic.RateLimitedCount, lastTopic.RateLimitedCount)
+				stat = fmt.Sprintf("topic.%s.rate_limited_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = counterDiff(topic.QuotaExceededCount, lastTopic.QuotaExceededCount)
+				stat = fmt.Sprintf("topic.%s.quota_exceeded_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = counterDiff(topic.DedupHitCount, lastTopic.DedupHitCount)
+				stat = fmt.Sprintf("topic.%s.dedup_hit_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = counterDiff(topic.DedupMissCount, lastTopic.DedupMissCount)
+				stat = fmt.Sprintf("topic.%s.dedup_miss_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
 					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
 					// We can cast the value to int64 since a value of 1 is the
@@ -88,7 +124,7 @@ func (n *NSQD) statsdLoop() {
 							break
 						}
 					}
-					diff := channel.MessageCount - lastChannel.MessageCount
+					diff := counterDiff(channel.MessageCount, lastChannel.MessageCount)
 					stat := fmt.Sprintf("topic.%s.channel.%s.message_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
@@ -98,20 +134,65 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, channel.BackendDepth)
 
+					stat = fmt.Sprintf("topic.%s.channel.%s.backend_disk_bytes", topic.TopicName, channel.ChannelName)
+					client.Gauge(stat, channel.BackendDiskBytes)
+
+					diff = counterDiff(uint64(channel.BackendThrottledWrites), uint64(lastChannel.BackendThrottledWrites))
+					stat = fmt.Sprintf("topic.%s.channel.%s.backend_throttled_writes", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.InFlightCount))
 
 					stat = fmt.Sprintf("topic.%s.channel.%s.deferred_count", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.DeferredCount))
 
-					diff = channel.RequeueCount - lastChannel.RequeueCount
+					diff = counterDiff(channel.RequeueCount, lastChannel.RequeueCount)
 					stat = fmt.Sprintf("topic.%s.channel.%s.requeue_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
-					diff = channel.TimeoutCount - lastChannel.TimeoutCount
+					for reason, count := range channel.RequeueReasons {
+						diff = counterDiff(count, lastChannel.RequeueReasons[reason])
+						stat = fmt.Sprintf("topic.%s.channel.%s.requeue_reason.%s", topic.TopicName, channel.ChannelName, reason)
+						client.Incr(stat, int64(diff))
+					}
+
+					diff = counterDiff(channel.TimeoutCount, lastChannel.TimeoutCount)
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
+					diff = counterDiff(channel.DiscardCount, lastChannel.DiscardCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.discard_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.ExpiredCount, lastChannel.ExpiredCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.expired_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.FilteredCount, lastChannel.FilteredCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.filtered_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.DeadLetterCount, lastChannel.DeadLetterCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.dead_letter_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.TimeoutWarningCount, lastChannel.TimeoutWarningCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_warning_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.TimeoutsAvoidedCount, lastChannel.TimeoutsAvoidedCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.timeouts_avoided_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.LocalDeliveryCount, lastChannel.LocalDeliveryCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.local_delivery_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = counterDiff(channel.ForwardedDeliveryCount, lastChannel.ForwardedDeliveryCount)
+					stat = fmt.Sprintf("topic.%s.channel.%s.forwarded_delivery_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.ClientCount))
 
@@ -43,14 +43,16 @@ func (p *tcpServer) Handle(clientConn net.Conn) {
 		return
 	}
 
-	p.conns.Store(clientConn.RemoteAddr(), clientConn)
+	// keyed by the conn itself, the remote addresses of unix socket clients
+	// aren't unique
+	p.conns.Store(clientConn, clientConn)
 
 	err = prot.IOLoop(clientConn)
 	if err != nil {
 		p.nsqd.logf(LOG_ERROR, "client(%s) - %s", clientConn.RemoteAddr(), err)
 	}
 
-	p.conns.Delete(clientConn.RemoteAddr())
+	p.conns.Delete(clientConn)
 }
 
 func (p *tcpServer) CloseAll() {
@@ -0,0 +1,96 @@
+package nsqd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/auth"
+)
+
+// tlsClientAuthorization is a --tls-client-authorization: a TLS client
+// whose certificate has Identity, as its subject CN or one of its SANs, may
+// publish and/or subscribe to the topics and channels of Authorization
+type tlsClientAuthorization struct {
+	Identity string `json:"identity"`
+	auth.Authorization
+}
+
+// parseTLSClientAuthorizations returns the authorizations of each identity
+// of --tls-client-authorization values, JSON objects like
+// {"identity":"orders.example.com","topic":"^orders$","channels":[".*"],"permissions":["subscribe","publish"]}
+// or nil if there are none
+func parseTLSClientAuthorizations(values []string) (map[string][]auth.Authorization, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	authorizations := make(map[string][]auth.Authorization)
+	for _, v := range values {
+		var a tlsClientAuthorization
+		dec := json.NewDecoder(strings.NewReader(v))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&a)
+		if err != nil {
+			return nil, fmt.Errorf("%q is invalid - %s", v, err)
+		}
+		if a.Identity == "" {
+			return nil, fmt.Errorf("%q has no identity", v)
+		}
+		if len(a.Permissions) == 0 {
+			return nil, fmt.Errorf("%q has no permissions", v)
+		}
+		for _, p := range a.Permissions {
+			if p != "subscribe" && p != "publish" {
+				return nil, fmt.Errorf("%q has invalid permission %q", v, p)
+			}
+		}
+		for _, re := range append([]string{a.Topic}, a.Channels...) {
+			if _, err := regexp.Compile(re); err != nil {
+				return nil, fmt.Errorf("%q has invalid regexp %q", v, re)
+			}
+		}
+		// channels only restrict subscribing, a publish is checked against ""
+		a.Channels = append(a.Channels, "^$")
+		authorizations[a.Identity] = append(authorizations[a.Identity], a.Authorization)
+	}
+	return authorizations, nil
+}
+
+// certIdentities returns the identities of cert, its subject CN and SANs
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// setTLSAuthorizations sets the authorizations (see
+// --tls-client-authorization) of c from the identities of its client
+// certificate, once it has upgraded to TLS
+func (c *clientV2) setTLSAuthorizations() {
+	for _, id := range c.tlsIdentities {
+		c.tlsAuthorizations = append(c.tlsAuthorizations, c.nsqd.tlsClientAuthorizations[id]...)
+	}
+}
+
+// isTLSAuthorized returns whether c's client certificate allows publishing
+// to topic (channel == "") or subscribing to channel of topic
+func (c *clientV2) isTLSAuthorized(topic, channel string) bool {
+	for _, a := range c.tlsAuthorizations {
+		if a.IsAllowed(topic, channel) {
+			return true
+		}
+	}
+	return false
+}
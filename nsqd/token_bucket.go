@@ -0,0 +1,94 @@
+package nsqd
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits the rate of events to rate per second, letting bursts
+// of a tenth of a second's worth (at least 1) through. The zero value
+// doesn't limit.
+type tokenBucket struct {
+	enabled int32
+
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate sets the rate, 0 for no limit
+func (b *tokenBucket) setRate(rate int64) {
+	b.Lock()
+	b.rate = float64(rate)
+	b.burst = math.Max(1, b.rate/10)
+	b.tokens = b.burst
+	b.last = time.Now()
+	b.Unlock()
+	var enabled int32
+	if rate > 0 {
+		enabled = 1
+	}
+	atomic.StoreInt32(&b.enabled, enabled)
+}
+
+// refill must be called with the lock held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until there is a token to take, 0 if there is one
+func (b *tokenBucket) wait() time.Duration {
+	if atomic.LoadInt32(&b.enabled) == 0 {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill()
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes n tokens, possibly leaving a debt (when several takers checked
+// wait at once) that's paid off before wait returns 0 again
+func (b *tokenBucket) take(n int) {
+	if atomic.LoadInt32(&b.enabled) == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.rate == 0 {
+		return
+	}
+	b.refill()
+	b.tokens -= float64(n)
+}
+
+// allow takes n tokens if there is one to take, returning whether it did
+// (so a batch bigger than the burst gets through, and is paid off after)
+func (b *tokenBucket) allow(n int) bool {
+	if atomic.LoadInt32(&b.enabled) == 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
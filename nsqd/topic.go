@@ -2,22 +2,70 @@ package nsqd
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/util"
 )
 
+// ErrTopicFull is returned by PutMessage(s) when the topic is at its max
+// depth (see --max-depth and --overflow-policy)
+var ErrTopicFull = errors.New("topic full")
+
+// ErrRateLimited and ErrQuotaExceeded are returned by admitPublish when a
+// publish is over the topic's max_publish_rate or daily_byte_quota
+var (
+	ErrRateLimited   = errors.New("publish rate limit exceeded")
+	ErrQuotaExceeded = errors.New("daily byte quota exceeded")
+)
+
+// how often a publish blocked by --overflow-policy=block checks for room
+const overflowPollInterval = 10 * time.Millisecond
+
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	messageCount uint64
 	messageBytes uint64
 
+	// messages rejected or dropped by the overflow policy
+	overflowCount uint64
+
+	// messages rejected by max_publish_rate and daily_byte_quota
+	rateLimitedCount   uint64
+	quotaExceededCount uint64
+
+	// publishes dropped, and let through, by the dedup window
+	dedupHitCount  uint64
+	dedupMissCount uint64
+
+	// per-topic QueueOptions
+	limits queueLimits
+
+	// enforce the max_publish_rate and daily_byte_quota QueueOptions,
+	// quotaBytes are those published on quotaDay (days since the epoch)
+	publishLimit tokenBucket
+	quotaMtx     sync.Mutex
+	quotaDay     int64
+	quotaBytes   int64
+
+	// remembers recent publishes for the dedup_window and dedup_size
+	// QueueOptions
+	dedupWindow dedupWindow
+
+	// publishes to a topic with partitions are routed to the topics
+	// <name>.0 ... <name>.<partitions-1>, those without a partition key
+	// round-robin by partitionSeq
+	partitionSeq uint64
+	partitions   int32
+
 	sync.RWMutex
 
 	name              string
@@ -38,9 +86,47 @@ type Topic struct {
 	paused    int32
 	pauseChan chan int
 
+	dataPath  string
+	migrating int32
+	migration *backendMigration
+
+	labels map[string]string
+
+	// deferred holds deferred publishes on disk (see --persist-deferred)
+	deferred *deferredStore
+
+	// sharedFanOut is set when channels share message bodies (see SetFanOutMode)
+	sharedFanOut int32
+
+	// hibernateMtx serializes hibernate() and wake(), and signals
+	// to messagePump (which isn't running while hibernated)
+	hibernateMtx  sync.Mutex
+	hibernated    int32
+	hibernateChan chan int
+
+	// orders the messages of memoryMsgChan and backend for messagePump,
+	// nil with --queue-scheduling=random
+	scheduler *queueScheduler
+
+	// high priority messages, taken ahead of the others
+	priority *priorityQueue
+
+	// samples of messageCount and its channels' counters, see Rates
+	rateHistory rateHistory
+
 	nsqd *NSQD
 }
 
+// backendMigration tracks the progress of a MigrateBackend call
+type backendMigration struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	messageCount int64
+	messageBytes int64
+	done         int32
+
+	dataPath string
+}
+
 // Topic constructor
 func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic {
 	t := &Topic{
@@ -53,40 +139,54 @@ func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic
 		nsqd:              nsqd,
 		paused:            0,
 		pauseChan:         make(chan int),
+		hibernateChan:     make(chan int),
 		deleteCallback:    deleteCallback,
 		idFactory:         NewGUIDFactory(nsqd.getOpts().ID),
+		dataPath:          nsqd.getOpts().DataPath,
+		limits:            newQueueLimits(),
+		priority:          newPriorityQueue(nsqd.getOpts()),
 	}
+	t.SetFanOutMode(nsqd.getOpts().FanOutMode)
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
 	if nsqd.getOpts().MemQueueSize > 0 {
 		t.memoryMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
+		t.scheduler = newQueueScheduler(nsqd.getOpts(), t.BackendDepth, t.decodeBackendMessage)
 	}
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
-		t.backend = diskqueue.New(
-			topicName,
-			nsqd.getOpts().DataPath,
-			nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			nsqd.getOpts().SyncEvery,
-			nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
+		t.dataPath = nsqd.backendDataPath(t.name, t.name)
+		t.backend = t.newBackend(t.dataPath)
 	}
 
 	t.waitGroup.Wrap(t.messagePump)
 
+	// a topic's deferred store is kept after --persist-deferred is turned
+	// off, until the messages already in it have been delivered
+	if !t.ephemeral {
+		fileName := deferredStoreFileName(nsqd.getOpts().DataPath, t.name)
+		_, err := os.Stat(fileName)
+		if nsqd.getOpts().PersistDeferred || err == nil {
+			t.deferred, err = newDeferredStore(t, fileName)
+			if err != nil {
+				t.nsqd.logf(LOG_ERROR,
+					"TOPIC(%s): failed to open deferred store %s - %s", t.name, fileName, err)
+			}
+		}
+	}
+
 	t.nsqd.Notify(t)
 
 	return t
 }
 
+func (t *Topic) newBackend(dataPath string) BackendQueue {
+	backend := newBackendQueue(t.name, dataPath, t.nsqd.getOpts())
+	t.limits.applyTo(backend, t.nsqd.getOpts())
+	return backend
+}
+
 func (t *Topic) Start() {
 	select {
 	case t.startChan <- 1:
@@ -103,16 +203,16 @@ func (t *Topic) Exiting() bool {
 // to return a pointer to a Channel object (potentially new)
 // for the given Topic
 func (t *Topic) GetChannel(channelName string) *Channel {
+	// a new subscriber is coming, revive a hibernating topic
+	t.wake()
+
 	t.Lock()
 	channel, isNew := t.getOrCreateChannel(channelName)
 	t.Unlock()
 
 	if isNew {
 		// update messagePump state
-		select {
-		case t.channelUpdateChan <- 1:
-		case <-t.exitChan:
-		}
+		t.signalPump(t.channelUpdateChan)
 	}
 
 	return channel
@@ -126,6 +226,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel = NewChannel(t.name, channelName, t.nsqd, deleteCallback)
+		channel.topicLimits = &t.limits
 		t.channelMap[channelName] = channel
 		t.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -163,10 +264,7 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	channel.Delete()
 
 	// update messagePump state
-	select {
-	case t.channelUpdateChan <- 1:
-	case <-t.exitChan:
-	}
+	t.signalPump(t.channelUpdateChan)
 
 	if numChannels == 0 && t.ephemeral == true {
 		go t.deleter.Do(func() { t.deleteCallback(t) })
@@ -177,39 +275,122 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 
 // PutMessage writes a Message to the queue
 func (t *Topic) PutMessage(m *Message) error {
-	t.RLock()
+	err := t.makeRoom(1)
+	if err != nil {
+		return err
+	}
+	t.rlockAwake()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
-	err := t.put(m)
+	// m may be FIN'd (and released to the pool) as soon as it is put
+	size := len(m.Body)
+	span := t.nsqd.newSpan(spanPublish, m, t.name, "")
+	err = t.put(m)
 	if err != nil {
 		return err
 	}
+	t.nsqd.emitSpan(span)
 	atomic.AddUint64(&t.messageCount, 1)
-	atomic.AddUint64(&t.messageBytes, uint64(len(m.Body)))
+	atomic.AddUint64(&t.messageBytes, uint64(size))
 	return nil
 }
 
-// PutMessages writes multiple Messages to the queue
-func (t *Topic) PutMessages(msgs []*Message) error {
-	t.RLock()
+// putDeferred writes a Message, which has come due, from the deferred store
+// to the queue (it was already counted when it was published)
+func (t *Topic) putDeferred(m *Message) error {
+	t.rlockAwake()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
+	return t.put(m)
+}
 
-	messageTotalBytes := 0
+// PutMessages writes multiple Messages to the queue, either all of them
+// or (on error) none.
+//
+// As many as fit are put in memory, but only after the rest have been
+// written to the backend as one batch (which may fail).
+func (t *Topic) PutMessages(msgs []*Message) error {
+	return t.putMessages(msgs, false)
+}
+
+// putMessages is PutMessages, or with durable PutMessagesDurable
+func (t *Topic) putMessages(msgs []*Message, durable bool) error {
+	err := t.makeRoom(len(msgs))
+	if err != nil {
+		return err
+	}
+	t.lockAwake()
+	defer t.Unlock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	if _, ok := t.backend.(interface{ Sync() error }); durable && !ok {
+		return ErrNotDurable
+	}
+
+	// while holding the write lock no one else puts messages in memory
+	// (messagePump only takes them out), so this space is ours
+	memoryMsgChan := t.memoryMsgChan
+	if len(msgs) > 0 && msgs[0].Priority > PriorityNormal {
+		memoryMsgChan = t.priority.msgChan
+	}
+	inMemory := t.limits.memoryRoom(memoryMsgChan)
+	if inMemory > len(msgs) {
+		inMemory = len(msgs)
+	}
+	if durable {
+		inMemory = 0
+	}
 
+	var spans []*SpanEvent
 	for i, m := range msgs {
-		err := t.put(m)
+		spans = append(spans, t.nsqd.newSpan(spanPublish, m, t.name, ""))
+		if i >= inMemory {
+			spans = append(spans, t.nsqd.newSpan(spanEnqueueDisk, m, t.name, ""))
+		}
+	}
+
+	if inMemory < len(msgs) {
+		err := writeMessagesToBackend(msgs[inMemory:], t.backend)
+		if err == errMemoryQueueFull {
+			atomic.AddUint64(&t.overflowCount, uint64(len(msgs)-inMemory))
+			return ErrTopicFull
+		}
+		t.nsqd.SetHealth(err)
 		if err != nil {
-			atomic.AddUint64(&t.messageCount, uint64(i))
-			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
+			t.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to write messages to backend - %s",
+				t.name, err)
 			return err
 		}
+	}
+	if durable {
+		// under the lock, so that the topic can't hibernate (closing the
+		// backend) in between
+		err := backendSync(t.backend)
+		t.nsqd.SetHealth(err)
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to sync backend - %s",
+				t.name, err)
+			return err
+		}
+	}
+
+	messageTotalBytes := 0
+	for _, m := range msgs {
 		messageTotalBytes += len(m.Body)
 	}
+	for _, m := range msgs[:inMemory] {
+		memoryMsgChan <- m
+	}
+	for _, span := range spans {
+		t.nsqd.emitSpan(span)
+	}
 
 	atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
@@ -217,10 +398,31 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 }
 
 func (t *Topic) put(m *Message) error {
+	if m.deferred != 0 && t.deferred != nil && t.nsqd.getOpts().PersistDeferred {
+		err := t.deferred.Put(m, time.Now().Add(m.deferred).UnixNano())
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to write message to deferred store - %s",
+				t.name, err)
+			return err
+		}
+		m.release()
+		return nil
+	}
+
+	memoryMsgChan := t.memoryMsgChan
+	if m.Priority > PriorityNormal {
+		memoryMsgChan = t.priority.msgChan
+	}
 	select {
-	case t.memoryMsgChan <- m:
+	case t.limits.memoryQueue(memoryMsgChan) <- m:
 	default:
+		span := t.nsqd.newSpan(spanEnqueueDisk, m, t.name, "")
 		err := writeMessageToBackend(m, t.backend)
+		if err == errMemoryQueueFull {
+			atomic.AddUint64(&t.overflowCount, 1)
+			return ErrTopicFull
+		}
 		t.nsqd.SetHealth(err)
 		if err != nil {
 			t.nsqd.logf(LOG_ERROR,
@@ -228,12 +430,215 @@ func (t *Topic) put(m *Message) error {
 				t.name, err)
 			return err
 		}
+		t.nsqd.emitSpan(span)
 	}
 	return nil
 }
 
+// admitPublish checks a publish of n messages of size bytes in total
+// against the quotas of the topic's namespace (see namespace.admitPublish),
+// then its max_publish_rate and daily_byte_quota, returning ErrRateLimited
+// or ErrQuotaExceeded if it's over either. It's called after dedup, so that
+// the re-publishes the dedup window drops aren't charged for.
+func (t *Topic) admitPublish(n int, size int) error {
+	if ns := t.nsqd.namespaceOf(t.name); ns != nil {
+		if err := ns.admitPublish(t.nsqd, n); err != nil {
+			return err
+		}
+	}
+	if !t.publishLimit.allow(n) {
+		atomic.AddUint64(&t.rateLimitedCount, uint64(n))
+		return ErrRateLimited
+	}
+	quota := t.limits.quota()
+	if quota <= 0 {
+		return nil
+	}
+	day := time.Now().Unix() / 86400
+	t.quotaMtx.Lock()
+	defer t.quotaMtx.Unlock()
+	if t.quotaDay != day {
+		t.quotaDay = day
+		t.quotaBytes = 0
+	}
+	if t.quotaBytes+int64(size) > quota {
+		atomic.AddUint64(&t.quotaExceededCount, uint64(n))
+		return ErrQuotaExceeded
+	}
+	t.quotaBytes += int64(size)
+	return nil
+}
+
+// quotaUsed returns the bytes counted against today's daily_byte_quota
+func (t *Topic) quotaUsed() int64 {
+	t.quotaMtx.Lock()
+	defer t.quotaMtx.Unlock()
+	if t.quotaDay != time.Now().Unix()/86400 {
+		return 0
+	}
+	return t.quotaBytes
+}
+
+// makeRoom applies the topic's overflow policy before n messages are put,
+// returning ErrTopicFull if they must not be
+func (t *Topic) makeRoom(n int) error {
+	maxDepth, policy := t.limits.overflow(t.nsqd.getOpts())
+	if maxDepth <= 0 || t.backlog()+int64(n) <= maxDepth {
+		return nil
+	}
+
+	switch policy {
+	case overflowDropOldest:
+		t.dropOldest(maxDepth, n)
+		return nil
+	case overflowBlock:
+		deadline := time.Now().Add(t.nsqd.getOpts().OverflowTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(overflowPollInterval)
+			if t.Exiting() {
+				return errors.New("exiting")
+			}
+			if t.backlog()+int64(n) <= maxDepth {
+				return nil
+			}
+		}
+	}
+	atomic.AddUint64(&t.overflowCount, uint64(n))
+	return ErrTopicFull
+}
+
+// backlog returns the depth of the topic, or of its deepest channel
+func (t *Topic) backlog() int64 {
+	depth := t.Depth()
+	t.RLock()
+	for _, c := range t.channelMap {
+		if d := c.Depth(); d > depth {
+			depth = d
+		}
+	}
+	t.RUnlock()
+	return depth
+}
+
+// dropOldest drops, from the topic and each of its channels, as many of the
+// messages next in line as it takes to make room for n more under maxDepth
+func (t *Topic) dropOldest(maxDepth int64, n int) {
+	t.RLock()
+	// not Depth(), whose BackendDepth() would take the read lock again (and
+	// deadlock behind a waiting writer)
+	depth := int64(len(t.memoryMsgChan)) + t.priority.depth() + t.scheduler.Held() + t.backend.Depth()
+	dropped := dropMessages(depth+int64(n)-maxDepth, t.backend,
+		t.memoryMsgChan, t.priority.msgChan)
+	for _, c := range t.channelMap {
+		dropped += dropMessages(c.Depth()+int64(n)-maxDepth, c.backend,
+			c.requeueMsgChan, c.memoryMsgChan, c.priority.msgChan)
+	}
+	t.RUnlock()
+	atomic.AddUint64(&t.overflowCount, dropped)
+}
+
+// dropMessages takes up to count messages off a topic's or channel's queue,
+// from memoryMsgChans first, in turn (requeued messages have waited longest),
+// then the backend (messages only go to it once memory is full)
+func dropMessages(count int64, backend BackendQueue, memoryMsgChans ...chan *Message) uint64 {
+	var dropped uint64
+	for _, memoryMsgChan := range memoryMsgChans {
+	drain:
+		for ; count > 0; count-- {
+			select {
+			case msg := <-memoryMsgChan:
+				msg.release()
+			default:
+				break drain
+			}
+			dropped++
+		}
+	}
+	for ; count > 0; count-- {
+		select {
+		case _, ok := <-backend.ReadChan():
+			if !ok {
+				return dropped
+			}
+		default:
+			return dropped
+		}
+		dropped++
+	}
+	return dropped
+}
+
 func (t *Topic) Depth() int64 {
-	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
+	return int64(len(t.memoryMsgChan)) + t.priority.depth() + t.scheduler.Held() + t.BackendDepth()
+}
+
+// DeferredDiskCount returns the number of deferred publishes pending on disk
+func (t *Topic) DeferredDiskCount() int64 {
+	if t.deferred == nil {
+		return 0
+	}
+	return t.deferred.Count()
+}
+
+// Goroutines returns the number of goroutines (messagePump and the deferred
+// store's pump) working on the topic, not counting its channels'
+func (t *Topic) Goroutines() int64 {
+	n := t.waitGroup.Running()
+	if t.deferred != nil {
+		n += t.deferred.waitGroup.Running()
+	}
+	return n
+}
+
+func (t *Topic) BackendDepth() int64 {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backend.Depth()
+}
+
+// BackendSkippedCount returns the number of messages lost to corruption of
+// the backend since it was opened
+func (t *Topic) BackendSkippedCount() int64 {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backendSkippedCount(backend)
+}
+
+// BackendDiskBytes returns the size of the backend's files
+func (t *Topic) BackendDiskBytes() int64 {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backendDiskBytes(backend)
+}
+
+// BackendWriteThrottle returns whether a write to the backend is waiting on
+// its max write rate, and how many have had to since it was opened
+func (t *Topic) BackendWriteThrottle() (bool, int64) {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backendWriteThrottle(backend)
+}
+
+// BackendCompressionStats returns the size of the messages written to the
+// backend since it was opened, before and after compression
+func (t *Topic) BackendCompressionStats() (int64, int64) {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backendCompressionStats(backend)
+}
+
+// BackendChecksumErrorCount returns the number of records of the backend
+// that failed their checksum since it was opened
+func (t *Topic) BackendChecksumErrorCount() int64 {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	return backendChecksumErrorCount(backend)
 }
 
 // messagePump selects over the in-memory and backend queue and
@@ -241,9 +646,10 @@ func (t *Topic) Depth() int64 {
 func (t *Topic) messagePump() {
 	var msg *Message
 	var buf []byte
-	var err error
+	var ok bool
 	var chans []*Channel
 	var memoryMsgChan chan *Message
+	var priorityMsgChan chan *Message
 	var backendChan <-chan []byte
 
 	// do not pass messages before Start(), but avoid blocking Pause() or GetChannel()
@@ -253,6 +659,8 @@ func (t *Topic) messagePump() {
 			continue
 		case <-t.pauseChan:
 			continue
+		case <-t.hibernateChan:
+			return
 		case <-t.exitChan:
 			goto exit
 		case <-t.startChan:
@@ -266,19 +674,59 @@ func (t *Topic) messagePump() {
 	t.RUnlock()
 	if len(chans) > 0 && !t.IsPaused() {
 		memoryMsgChan = t.memoryMsgChan
+		priorityMsgChan = t.priority.msgChan
 		backendChan = t.backend.ReadChan()
 	}
 
 	// main message loop
 	for {
+		// high priority messages go ahead of the scheduler's, unless it's
+		// the others' turn
+		var priorityChan chan *Message
+		if priorityMsgChan != nil {
+			priorityChan = t.priority.turn(len(t.memoryMsgChan) > 0 ||
+				t.scheduler.Held() > 0 || t.backend.Depth() > 0)
+		}
+		select {
+		case msg = <-priorityChan:
+			t.priority.took(msg)
+			t.putToChannels(msg, chans)
+			continue
+		default:
+		}
+
+		if t.scheduler != nil && memoryMsgChan != nil {
+			if !t.scheduler.fill(memoryMsgChan, backendChan) {
+				// a closed ReadChan would otherwise be selected forever
+				backendChan = t.reopenBackend()
+				continue
+			}
+			if msg = t.scheduler.next(); msg != nil {
+				t.priority.took(msg)
+				t.putToChannels(msg, chans)
+				t.scheduler.done()
+				continue
+			}
+		}
+
+		fromBackend := false
 		select {
+		case msg = <-priorityChan:
+			t.priority.took(msg)
+			t.putToChannels(msg, chans)
+			continue
 		case msg = <-memoryMsgChan:
-		case buf = <-backendChan:
-			msg, err = decodeMessage(buf)
-			if err != nil {
-				t.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+		case buf, ok = <-backendChan:
+			if !ok {
+				// a closed ReadChan would otherwise be selected forever
+				backendChan = t.reopenBackend()
 				continue
 			}
+			msg = t.decodeBackendMessage(buf)
+			if msg == nil {
+				continue
+			}
+			fromBackend = true
 		case <-t.channelUpdateChan:
 			chans = chans[:0]
 			t.RLock()
@@ -288,53 +736,124 @@ func (t *Topic) messagePump() {
 			t.RUnlock()
 			if len(chans) == 0 || t.IsPaused() {
 				memoryMsgChan = nil
+				priorityMsgChan = nil
 				backendChan = nil
 			} else {
 				memoryMsgChan = t.memoryMsgChan
+				priorityMsgChan = t.priority.msgChan
 				backendChan = t.backend.ReadChan()
 			}
 			continue
 		case <-t.pauseChan:
 			if len(chans) == 0 || t.IsPaused() {
 				memoryMsgChan = nil
+				priorityMsgChan = nil
 				backendChan = nil
 			} else {
 				memoryMsgChan = t.memoryMsgChan
+				priorityMsgChan = t.priority.msgChan
 				backendChan = t.backend.ReadChan()
 			}
 			continue
+		case <-t.hibernateChan:
+			return
 		case <-t.exitChan:
 			goto exit
 		}
 
-		for i, channel := range chans {
-			chanMsg := msg
-			// copy the message because each channel
-			// needs a unique instance but...
-			// fastpath to avoid copy if its the first channel
-			// (the topic already created the first copy)
-			if i > 0 {
-				chanMsg = NewMessage(msg.ID, msg.Body)
-				chanMsg.Timestamp = msg.Timestamp
-				chanMsg.deferred = msg.deferred
-			}
-			if chanMsg.deferred != 0 {
-				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
-				continue
-			}
-			err := channel.PutMessage(chanMsg)
+		if t.scheduler != nil {
+			// the next one may be older, or due from the other queue
+			t.scheduler.hold(msg, fromBackend)
+			continue
+		}
+		t.priority.took(msg)
+		t.putToChannels(msg, chans)
+	}
+
+exit:
+	if t.scheduler != nil {
+		for _, msg := range t.scheduler.drain() {
+			err := writeMessageToBackend(msg, t.backend)
 			if err != nil {
 				t.nsqd.logf(LOG_ERROR,
-					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
-					t.name, msg.ID, channel.name, err)
+					"TOPIC(%s) ERROR: failed to write message to backend - %s", t.name, err)
 			}
 		}
 	}
-
-exit:
 	t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing ... messagePump", t.name)
 }
 
+// decodeBackendMessage decodes a message read from the backend, nil if it
+// can't be
+func (t *Topic) decodeBackendMessage(b []byte) *Message {
+	t.RLock()
+	backend := t.backend
+	t.RUnlock()
+	msg, err := decodeBackendMessage(backend, b, t.nsqd.getOpts().MessagePool)
+	if err != nil {
+		t.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+		return nil
+	}
+	return msg
+}
+
+// putToChannels puts msg to each of chans, a copy to all but the last
+func (t *Topic) putToChannels(msg *Message, chans []*Channel) {
+	// each channel gets the message in turn, without blocking: one
+	// whose memory queue is full spills it to its own backend (see
+	// Channel.put), so a slow channel doesn't hold up the others
+	shared := atomic.LoadInt32(&t.sharedFanOut) == 1
+	for i, channel := range chans {
+		chanMsg := msg
+		// copy the message because each channel
+		// needs a unique instance but...
+		// fastpath to avoid copy if its the last channel
+		// (the topic already created the last copy, and once it
+		// is handed off it may be FIN'd and released to the pool)
+		if i < len(chans)-1 {
+			if shared {
+				chanMsg = msg.copy()
+			} else {
+				chanMsg = msg.clone()
+			}
+			// non-zero for messages dead-lettered by another channel
+			chanMsg.Attempts = msg.Attempts
+		}
+		if chanMsg.deferred != 0 {
+			channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
+			continue
+		}
+		err := channel.PutMessage(chanMsg)
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
+				t.name, chanMsg.ID, channel.name, err)
+		}
+	}
+}
+
+// reopenBackend replaces a backend whose ReadChan was closed underneath
+// messagePump (i.e. it failed) with a new one on the same files, returning
+// the new ReadChan, or nil when messagePump should stop reading the backend
+func (t *Topic) reopenBackend() <-chan []byte {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ephemeral || t.Exiting() || atomic.LoadInt32(&t.migrating) == 1 {
+		t.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s): backend ReadChan closed, no longer reading from backend", t.name)
+		return nil
+	}
+
+	t.nsqd.logf(LOG_ERROR, "TOPIC(%s): backend ReadChan closed, reopening backend", t.name)
+	err := t.backend.Close()
+	if err != nil {
+		t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to close backend - %s", t.name, err)
+	}
+	t.backend = t.newBackend(t.dataPath)
+	return t.backend.ReadChan()
+}
+
 // Delete empties the topic and all its channels and closes
 func (t *Topic) Delete() error {
 	return t.exit(true)
@@ -360,11 +879,30 @@ func (t *Topic) exit(deleted bool) error {
 		t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing", t.name)
 	}
 
+	// a hibernating topic's backend has to be re-opened to be flushed or deleted
+	t.wake()
+
 	close(t.exitChan)
 
 	// synchronize the close of messagePump()
 	t.waitGroup.Wait()
 
+	if t.deferred != nil {
+		var err error
+		if deleted {
+			err = t.deferred.Delete()
+		} else {
+			err = t.deferred.Close()
+		}
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to close deferred store - %s", t.name, err)
+		}
+	}
+
+	if n := t.Goroutines(); n > 0 {
+		t.nsqd.logf(LOG_WARN, "TOPIC(%s): %d goroutines still running after close", t.name, n)
+	}
+
 	if deleted {
 		t.Lock()
 		for _, channel := range t.channelMap {
@@ -396,33 +934,46 @@ func (t *Topic) Empty() error {
 	for {
 		select {
 		case <-t.memoryMsgChan:
+		case <-t.priority.msgChan:
 		default:
 			goto finish
 		}
 	}
 
 finish:
-	return t.backend.Empty()
+	if t.deferred != nil {
+		err := t.deferred.Empty()
+		if err != nil {
+			return err
+		}
+	}
+	t.rlockAwake()
+	backend := t.backend
+	t.RUnlock()
+	return backend.Empty()
 }
 
 func (t *Topic) flush() error {
-	if len(t.memoryMsgChan) > 0 {
+	memoryDepth := len(t.memoryMsgChan) + len(t.priority.msgChan)
+	if memoryDepth > 0 {
 		t.nsqd.logf(LOG_INFO,
 			"TOPIC(%s): flushing %d memory messages to backend",
-			t.name, len(t.memoryMsgChan))
+			t.name, memoryDepth)
 	}
 
 	for {
+		var msg *Message
 		select {
-		case msg := <-t.memoryMsgChan:
-			err := writeMessageToBackend(msg, t.backend)
-			if err != nil {
-				t.nsqd.logf(LOG_ERROR,
-					"ERROR: failed to write message to backend - %s", err)
-			}
+		case msg = <-t.memoryMsgChan:
+		case msg = <-t.priority.msgChan:
 		default:
 			goto finish
 		}
+		err := writeMessageToBackend(msg, t.backend)
+		if err != nil {
+			t.nsqd.logf(LOG_ERROR,
+				"ERROR: failed to write message to backend - %s", err)
+		}
 	}
 
 finish:
@@ -460,22 +1011,355 @@ func (t *Topic) UnPause() error {
 }
 
 func (t *Topic) doPause(pause bool) error {
+	if !pause && atomic.LoadInt32(&t.migrating) == 1 {
+		return errors.New("backend migration in progress")
+	}
+
 	if pause {
 		atomic.StoreInt32(&t.paused, 1)
 	} else {
 		atomic.StoreInt32(&t.paused, 0)
 	}
 
+	t.signalPump(t.pauseChan)
+
+	return nil
+}
+
+func (t *Topic) IsPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+// MigrateBackend moves the topic's on-disk messages to a new DiskQueue rooted
+// at dataPath and swaps it in as the topic's backend.
+//
+// The topic is paused for the duration so that messagePump stops reading from
+// the old backend. Publishes are still accepted; they buffer in memory or land
+// behind the backlog in the old backend, which is drained once more (while
+// briefly holding the topic lock) right before the swap.
+func (t *Topic) MigrateBackend(dataPath string) error {
+	if t.ephemeral {
+		return errors.New("ephemeral topic has no disk backend")
+	}
+	if t.Exiting() {
+		return errors.New("exiting")
+	}
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dataPath)
+	}
+	if !atomic.CompareAndSwapInt32(&t.migrating, 0, 1) {
+		return errors.New("backend migration already in progress")
+	}
+	t.wake()
+
+	wasPaused := t.IsPaused()
+	t.Pause()
+
+	err = t.migrateBackend(dataPath)
+
+	atomic.StoreInt32(&t.migrating, 0)
+	if !wasPaused {
+		t.UnPause()
+	}
+	return err
+}
+
+func (t *Topic) migrateBackend(dataPath string) error {
+	t.Lock()
+	if filepath.Clean(dataPath) == filepath.Clean(t.dataPath) {
+		t.Unlock()
+		return fmt.Errorf("topic is already stored in %s", dataPath)
+	}
+	from := t.backend
+	m := &backendMigration{dataPath: dataPath}
+	t.migration = m
+	t.Unlock()
+	defer atomic.StoreInt32(&m.done, 1)
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): migrating backend (depth %d) to %s",
+		t.name, from.Depth(), dataPath)
+
+	moved := func(data []byte) {
+		atomic.AddInt64(&m.messageCount, 1)
+		atomic.AddInt64(&m.messageBytes, int64(len(data)))
+	}
+
+	to := t.newBackend(dataPath)
+	err := moveBackendMessages(from, to, moved)
+	if err == nil {
+		t.Lock()
+		err = moveBackendMessages(from, to, moved)
+		if err == nil {
+			t.backend = to
+			t.dataPath = dataPath
+		}
+		t.Unlock()
+	}
+	if err != nil {
+		t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to migrate backend to %s - %s",
+			t.name, dataPath, err)
+		// put back whatever already made it over
+		rerr := moveBackendMessages(to, from, func([]byte) {})
+		if rerr != nil {
+			t.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s): failed to restore messages from %s, leaving them in place - %s",
+				t.name, dataPath, rerr)
+			to.Close()
+			return err
+		}
+		to.Empty()
+		to.Delete()
+		return err
+	}
+
+	from.Empty()
+	from.Delete()
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): migrated %d messages (%d bytes) to %s",
+		t.name, atomic.LoadInt64(&m.messageCount), atomic.LoadInt64(&m.messageBytes), dataPath)
+	return nil
+}
+
+// moveBackendMessages reads from until it is empty, writing each message to.
+// The caller must make sure nothing else is reading from.
+func moveBackendMessages(from BackendQueue, to BackendQueue, moved func([]byte)) error {
+	// Depth() is updated just after a read is handed off, re-check it
+	// periodically rather than blocking on ReadChan() forever
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for from.Depth() > 0 {
+		select {
+		case data := <-from.ReadChan():
+			err := to.Put(data)
+			if err != nil {
+				// don't lose the message in hand
+				from.Put(data)
+				return err
+			}
+			moved(data)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (t *Topic) IsHibernated() bool {
+	return atomic.LoadInt32(&t.hibernated) == 1
+}
+
+// isIdle returns true if the topic and all its channels are empty
+// and there are no clients
+//
+// this expects the caller to handle locking
+func (t *Topic) isIdle() bool {
+	if len(t.memoryMsgChan) > 0 || t.priority.depth() > 0 ||
+		t.scheduler.Held() > 0 || t.backend.Depth() > 0 {
+		return false
+	}
+	if t.deferred != nil && t.deferred.Count() > 0 {
+		return false
+	}
+	for _, c := range t.channelMap {
+		if !c.isIdle() {
+			return false
+		}
+	}
+	return true
+}
+
+// hibernate stops messagePump and closes the backend (persisting its state)
+// of an idle topic, cutting its goroutines until the next publish or
+// subscribe wakes it. It returns false if the topic wasn't hibernated.
+func (t *Topic) hibernate() bool {
+	t.hibernateMtx.Lock()
+	defer t.hibernateMtx.Unlock()
+
+	// hibernated can only be set while holding the write lock, so holding
+	// the read lock (see rlockAwake) guarantees that the topic is awake
+	t.Lock()
+	if t.IsHibernated() || t.Exiting() || atomic.LoadInt32(&t.migrating) == 1 || !t.isIdle() {
+		t.Unlock()
+		return false
+	}
+	atomic.StoreInt32(&t.hibernated, 1)
+	t.Unlock()
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): hibernating", t.name)
+
+	t.hibernateChan <- 1
+	t.waitGroup.Wait()
+	if !t.ephemeral {
+		t.backend.Close()
+	}
+	return true
+}
+
+// wake re-opens the backend and restarts messagePump of a hibernating topic
+func (t *Topic) wake() {
+	if !t.IsHibernated() {
+		return
+	}
+
+	t.hibernateMtx.Lock()
+	defer t.hibernateMtx.Unlock()
+	if !t.IsHibernated() {
+		return
+	}
+
+	t.nsqd.logf(LOG_INFO, "TOPIC(%s): waking", t.name)
+
+	t.Lock()
+	if !t.ephemeral {
+		t.backend = t.newBackend(t.dataPath)
+	}
+	atomic.StoreInt32(&t.hibernated, 0)
+	t.Unlock()
+
+	// exit() takes care of an exiting topic's messagePump
+	if t.Exiting() {
+		return
+	}
+	t.waitGroup.Wrap(t.messagePump)
+	t.Start()
+}
+
+// rlockAwake read locks the topic, waking it first if it is hibernating
+func (t *Topic) rlockAwake() {
+	for {
+		t.RLock()
+		if !t.IsHibernated() {
+			return
+		}
+		t.RUnlock()
+		t.wake()
+	}
+}
+
+// lockAwake is rlockAwake for the write lock
+func (t *Topic) lockAwake() {
+	for {
+		t.Lock()
+		if !t.IsHibernated() {
+			return
+		}
+		t.Unlock()
+		t.wake()
+	}
+}
+
+// signalPump notifies messagePump of a state change on ch, a hibernating
+// topic's messagePump picks up the current state once it is woken
+func (t *Topic) signalPump(ch chan int) {
+	t.hibernateMtx.Lock()
+	defer t.hibernateMtx.Unlock()
+	if t.IsHibernated() {
+		return
+	}
 	select {
-	case t.pauseChan <- 1:
+	case ch <- 1:
 	case <-t.exitChan:
 	}
+}
+
+// SetLabels replaces the topic's labels, which are echoed in stats so that
+// topics can be grouped (by team, service, etc.). labels must not be
+// modified afterwards.
+func (t *Topic) SetLabels(labels map[string]string) {
+	t.Lock()
+	t.labels = labels
+	t.Unlock()
+}
+
+func (t *Topic) Labels() map[string]string {
+	t.RLock()
+	defer t.RUnlock()
+	return t.labels
+}
+
+// SetPartitions makes the topic partitioned, see partition
+func (t *Topic) SetPartitions(n int) {
+	atomic.StoreInt32(&t.partitions, int32(n))
+}
+
+func (t *Topic) Partitions() int {
+	return int(atomic.LoadInt32(&t.partitions))
+}
+
+// partitionName returns the name of the i-th partition of topic
+func partitionName(topic string, i int) string {
+	return topic + "." + strconv.Itoa(i)
+}
+
+// partition returns the topic a publish with key goes to: for a partitioned
+// topic the partition key hashes to (the next one round-robin without a
+// key), so that messages with the same key stay in order, otherwise t
+func (t *Topic) partition(key []byte) *Topic {
+	n := atomic.LoadInt32(&t.partitions)
+	if n == 0 {
+		return t
+	}
+	var i uint32
+	if len(key) == 0 {
+		i = uint32(atomic.AddUint64(&t.partitionSeq, 1) % uint64(n))
+	} else {
+		h := fnv.New32a()
+		h.Write(key)
+		i = h.Sum32() % uint32(n)
+	}
+	return t.nsqd.GetTopic(partitionName(t.name, int(i)))
+}
 
+// SetQueueOptions overrides the nsqd-wide options sizing the topic's queues
+// (its channels have their own), qo must be valid
+func (t *Topic) SetQueueOptions(qo QueueOptions) {
+	t.Lock()
+	t.limits.set(qo)
+	var maxPublishRate int64
+	if qo.MaxPublishRate != nil {
+		maxPublishRate = *qo.MaxPublishRate
+	}
+	t.publishLimit.setRate(maxPublishRate)
+	t.dedupWindow.reset()
+	if !t.ephemeral {
+		t.limits.applyTo(t.backend, t.nsqd.getOpts())
+	}
+	t.Unlock()
+}
+
+func (t *Topic) QueueOptions() QueueOptions {
+	return t.limits.options()
+}
+
+func isValidFanOutMode(mode string) bool {
+	return mode == "copy" || mode == "shared"
+}
+
+// SetFanOutMode sets how messages are handed to the topic's channels. With
+// "copy" each channel gets its own copy of the message body, with "shared"
+// channels share one body (saving an allocation and copy per channel), which
+// must then never be modified in place.
+func (t *Topic) SetFanOutMode(mode string) error {
+	switch mode {
+	case "copy":
+		atomic.StoreInt32(&t.sharedFanOut, 0)
+	case "shared":
+		atomic.StoreInt32(&t.sharedFanOut, 1)
+	default:
+		return fmt.Errorf("invalid fan-out mode %q", mode)
+	}
 	return nil
 }
 
-func (t *Topic) IsPaused() bool {
-	return atomic.LoadInt32(&t.paused) == 1
+func (t *Topic) FanOutMode() string {
+	if atomic.LoadInt32(&t.sharedFanOut) == 1 {
+		return "shared"
+	}
+	return "copy"
 }
 
 func (t *Topic) GenerateID() MessageID {
@@ -6,8 +6,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -195,6 +199,176 @@ func TestPause(t *testing.T) {
 	test.Equal(t, int64(1), channel.Depth())
 }
 
+func TestMigrateBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	opts.MaxBytesPerFile = 4096
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	newDataPath, err := ioutil.TempDir("", "nsq-test-migrate-")
+	test.Nil(t, err)
+	defer os.RemoveAll(newDataPath)
+
+	topicName := "test_topic_migrate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	err = topic.Pause()
+	test.Nil(t, err)
+
+	ids := make(map[MessageID]bool)
+	put := func(n int) []MessageID {
+		var msgIDs []MessageID
+		for i := 0; i < n; i++ {
+			msg := NewMessage(topic.GenerateID(), []byte("test body"))
+			err := topic.PutMessage(msg)
+			if err != nil {
+				panic(err)
+			}
+			msgIDs = append(msgIDs, msg.ID)
+		}
+		return msgIDs
+	}
+	for _, id := range put(500) {
+		ids[id] = true
+	}
+
+	// keep publishing while the backlog is moved
+	doneChan := make(chan []MessageID)
+	go func() {
+		doneChan <- put(500)
+	}()
+
+	err = topic.MigrateBackend(newDataPath)
+	test.Nil(t, err)
+	for _, id := range <-doneChan {
+		ids[id] = true
+	}
+
+	test.Equal(t, true, topic.IsPaused())
+	test.Equal(t, int64(1000), topic.Depth())
+
+	stats := NewTopicStats(topic, nil)
+	test.NotNil(t, stats.BackendMigration)
+	test.Equal(t, newDataPath, stats.BackendMigration.DataPath)
+	test.Equal(t, false, stats.BackendMigration.InProgress)
+	test.Equal(t, true, stats.BackendMigration.MessageCount >= 490)
+
+	oldFiles, _ := filepath.Glob(filepath.Join(opts.DataPath, topicName+".diskqueue.*"))
+	test.Equal(t, 0, len(oldFiles))
+	newFiles, _ := filepath.Glob(filepath.Join(newDataPath, topicName+".diskqueue.*"))
+	test.Equal(t, true, len(newFiles) > 0)
+
+	err = topic.MigrateBackend(newDataPath)
+	test.NotNil(t, err)
+
+	nsqd.Lock()
+	err = nsqd.PersistMetadata()
+	nsqd.Unlock()
+	test.Nil(t, err)
+	data, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	test.Equal(t, true, strings.Contains(string(data), newDataPath))
+
+	err = topic.UnPause()
+	test.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		var msg *Message
+		select {
+		case msg = <-channel.memoryMsgChan:
+		case buf := <-channel.backend.ReadChan():
+			msg, err = decodeMessage(buf)
+			test.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+		test.Equal(t, true, ids[msg.ID])
+		delete(ids, msg.ID)
+	}
+	test.Equal(t, 0, len(ids))
+}
+
+func TestTopicHibernate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TopicHibernateTimeout = 50 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	waitHibernated := func(topic *Topic) {
+		for i := 0; !topic.IsHibernated(); i++ {
+			if i > 500 {
+				t.Fatalf("topic did not hibernate")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	topicName := "test_topic_hibernate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	// the goroutines of topics and diskqueues, once messagePump is running
+	// (nsqd's own may still be starting up, and aren't counted)
+	queueGoroutines := func() int {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Count(stacks, "nsqd.(*Topic).messagePump(") +
+			strings.Count(stacks, "diskqueue.(*diskQueue).ioLoop(")
+	}
+	var numGoroutines int
+	for i := 0; numGoroutines < 3; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(time.Millisecond)
+		numGoroutines = queueGoroutines()
+	}
+
+	waitHibernated(topic)
+	// messagePump and the backend's goroutine exit shortly after
+	for i := 0; queueGoroutines() >= numGoroutines; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, NewTopicStats(topic, nil).Hibernated)
+
+	// publishing wakes the topic
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	err := topic.PutMessage(msg)
+	test.Nil(t, err)
+	test.Equal(t, false, topic.IsHibernated())
+	select {
+	case outputMsg := <-channel.memoryMsgChan:
+		test.Equal(t, msg.ID, outputMsg.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for message")
+	}
+
+	// so does subscribing
+	waitHibernated(topic)
+	topic.GetChannel("ch2")
+	test.Equal(t, false, topic.IsHibernated())
+
+	// a topic with messages waiting stays awake
+	waitHibernated(topic)
+	err = topic.Pause()
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	test.Nil(t, err)
+	time.Sleep(4 * opts.TopicHibernateTimeout)
+	test.Equal(t, false, topic.IsHibernated())
+	test.Equal(t, int64(1), topic.Depth())
+
+	// hibernating topics can be deleted (or closed on exit)
+	topic2 := nsqd.GetTopic(topicName + "_2")
+	waitHibernated(topic2)
+	err = nsqd.DeleteExistingTopic(topic2.name)
+	test.Nil(t, err)
+	waitHibernated(nsqd.GetTopic(topicName + "_3"))
+}
+
 func BenchmarkTopicPut(b *testing.B) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
@@ -239,3 +413,442 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+// BenchmarkTopicToChannelsFanOut publishes to a topic with a fast channel
+// and a slow one (without a memory queue, so that it spills to its backend)
+// and reports the most goroutines seen, which the fan-out doesn't add to
+func BenchmarkTopicToChannelsFanOut(b *testing.B) {
+	b.StopTimer()
+	topicName := "bench_topic_to_channels_fan_out" + strconv.Itoa(b.N)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(b)
+	opts.MemQueueSize = int64(b.N)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+	topic := nsqd.GetTopic(topicName)
+	fast := topic.GetChannel("fast")
+	slow := topic.GetChannel("slow")
+	memQueueSize := int64(0)
+	slow.SetQueueOptions(QueueOptions{MemQueueSize: &memQueueSize})
+	goroutines := runtime.NumGoroutine()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+		topic.PutMessage(msg)
+		if n := runtime.NumGoroutine(); n > goroutines {
+			goroutines = n
+		}
+	}
+
+	for fast.Depth() != int64(b.N) || slow.Depth() != int64(b.N) {
+		runtime.Gosched()
+	}
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+func TestTopicBackendReadChanClosed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	closedBackend := func(topic *Topic) *dummyBackendQueue {
+		b := &dummyBackendQueue{readChan: make(chan []byte)}
+		close(b.readChan)
+		topic.Lock()
+		topic.backend.Close()
+		topic.backend = b
+		topic.Unlock()
+		return b
+	}
+
+	// the failed backend of a disk-backed topic is reopened
+	topicName := "test_backend_closed" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	b := closedBackend(topic)
+	channel := topic.GetChannel("ch")
+
+	var backend BackendQueue
+	for i := 0; i < 100; i++ {
+		topic.RLock()
+		backend = topic.backend
+		topic.RUnlock()
+		if backend != b {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.NotEqual(t, b, backend)
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, writeMessageToBackend(msg, backend))
+
+	select {
+	case outputMsg := <-channel.memoryMsgChan:
+		test.Equal(t, msg.ID, outputMsg.ID)
+		test.Equal(t, msg.Body, outputMsg.Body)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message from reopened backend")
+	}
+
+	// an ephemeral topic stops reading from its backend but keeps
+	// delivering in-memory messages
+	topic = nsqd.GetTopic(topicName + "#ephemeral")
+	b = closedBackend(topic)
+	channel = topic.GetChannel("ch")
+
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	select {
+	case outputMsg := <-channel.memoryMsgChan:
+		test.Equal(t, msg.ID, outputMsg.ID)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for in-memory message")
+	}
+	topic.RLock()
+	backend = topic.backend
+	topic.RUnlock()
+	test.Equal(t, b, backend)
+
+	test.Nil(t, topic.Delete())
+}
+
+func TestTopicFanOut(t *testing.T) {
+	for _, mode := range []string{"copy", "shared"} {
+		t.Run(mode, func(t *testing.T) {
+			opts := NewOptions()
+			opts.Logger = test.NewTestLogger(t)
+			opts.FanOutMode = mode
+			opts.MessagePool = true
+			_, _, nsqd := mustStartNSQD(opts)
+			defer os.RemoveAll(opts.DataPath)
+			defer nsqd.Exit()
+
+			topicName := "test_fan_out" + strconv.Itoa(int(time.Now().Unix()))
+			topic := nsqd.GetTopic(topicName)
+			test.Equal(t, mode, topic.FanOutMode())
+			var chans []*Channel
+			for i := 0; i < 3; i++ {
+				chans = append(chans, topic.GetChannel("ch"+strconv.Itoa(i)))
+			}
+
+			const n = 100
+			var wg sync.WaitGroup
+			for p := 0; p < 4; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					for i := p; i < n; i += 4 {
+						body, pb := newMessageBody(10, true)
+						copy(body, fmt.Sprintf("msg %d", i))
+						topic.PutMessage(newMessage(topic.GenerateID(), body, pb, true))
+					}
+				}(p)
+			}
+
+			// consume all channels concurrently, with copy mode each channel
+			// may modify its bodies and FIN (releasing them) at will
+			bodies := make([]map[MessageID]*byte, len(chans))
+			for i, c := range chans {
+				bodies[i] = make(map[MessageID]*byte)
+				wg.Add(1)
+				go func(i int, c *Channel) {
+					defer wg.Done()
+					for j := 0; j < n; j++ {
+						msg := <-c.memoryMsgChan
+						test.Equal(t, true, strings.HasPrefix(string(msg.Body), "msg "))
+						c.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+						if mode == "shared" {
+							bodies[i][msg.ID] = &msg.Body[0]
+							continue
+						}
+						msg.Body[0] = byte('A' + i)
+						runtime.Gosched()
+						test.Equal(t, byte('A'+i), msg.Body[0])
+						test.Nil(t, c.FinishMessage(0, msg.ID))
+					}
+				}(i, c)
+			}
+			wg.Wait()
+
+			if mode == "shared" {
+				// every channel got the same body, released after the last FIN
+				for id, b := range bodies[0] {
+					test.Equal(t, true, b == bodies[1][id])
+					test.Equal(t, true, b == bodies[2][id])
+					for _, c := range chans {
+						test.Nil(t, c.FinishMessage(0, id))
+					}
+				}
+			}
+			test.Equal(t, uint64(n), topic.messageCount)
+			test.Equal(t, uint64(n*10), topic.messageBytes)
+		})
+	}
+}
+
+func TestPutMessagesAtomic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	opts.MaxMsgSize = 100
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_put_messages_atomic" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	newMessages := func(sizes ...int) []*Message {
+		var msgs []*Message
+		for _, size := range sizes {
+			msgs = append(msgs, NewMessage(topic.GenerateID(), make([]byte, size)))
+		}
+		return msgs
+	}
+
+	// the 4th message is too big for the backend, none are put (not even
+	// the first two, which fit in memory)
+	err := topic.PutMessages(newMessages(10, 10, 10, int(maxStoredMsgSize(opts)), 10))
+	test.NotNil(t, err)
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, uint64(0), atomic.LoadUint64(&topic.messageCount))
+
+	test.Nil(t, topic.PutMessages(newMessages(10, 10, 10, 10, 10)))
+	test.Equal(t, int64(5), topic.Depth())
+	test.Equal(t, int64(3), topic.BackendDepth())
+	test.Equal(t, uint64(5), atomic.LoadUint64(&topic.messageCount))
+
+	topic.Lock()
+	backend := topic.backend
+	topic.backend = &errorBackendQueue{}
+	topic.Unlock()
+
+	err = topic.PutMessages(newMessages(10, 10))
+	test.NotNil(t, err)
+	test.Equal(t, 2, len(topic.memoryMsgChan))
+	test.Equal(t, uint64(5), atomic.LoadUint64(&topic.messageCount))
+
+	topic.Lock()
+	topic.backend = backend
+	topic.Unlock()
+}
+
+func TestTopicQueueOptions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_queue_options" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	memQueueSize := int64(1)
+	topic.SetQueueOptions(QueueOptions{MemQueueSize: &memQueueSize})
+	test.Equal(t, int64(1), *topic.QueueOptions().MemQueueSize)
+	test.Nil(t, topic.QueueOptions().MaxBytesPerFile)
+
+	msgs := []*Message{
+		NewMessage(topic.GenerateID(), []byte("test")),
+		NewMessage(topic.GenerateID(), []byte("test")),
+	}
+	test.Nil(t, topic.PutMessages(msgs))
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, 1, len(topic.memoryMsgChan))
+	test.Equal(t, int64(2), topic.BackendDepth())
+
+	// the channel's memory queue is sized independently (of a topic with
+	// nothing to fan out to it)
+	channel := nsqd.GetTopic(topicName + "_ch").GetChannel("ch")
+	memQueueSize = 0
+	channel.SetQueueOptions(QueueOptions{MemQueueSize: &memQueueSize})
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, 0, len(channel.memoryMsgChan))
+	test.Equal(t, int64(1), channel.backend.Depth())
+
+	topic.SetQueueOptions(QueueOptions{})
+	test.Equal(t, true, topic.QueueOptions().isEmpty())
+
+	// read_buffer_size reaches the backend, or else --read-buffer-size
+	backend := &readBufferBackendQueue{}
+	limits := newQueueLimits()
+	readBufferSize := int64(65536)
+	limits.set(QueueOptions{ReadBufferSize: &readBufferSize})
+	limits.applyTo(backend, opts)
+	test.Equal(t, 65536, backend.readBufferSize)
+	limits.set(QueueOptions{})
+	limits.applyTo(backend, opts)
+	test.Equal(t, opts.ReadBufferSize, backend.readBufferSize)
+}
+
+type readBufferBackendQueue struct {
+	errorBackendQueue
+	readBufferSize int
+}
+
+func (d *readBufferBackendQueue) SetReadBufferSize(n int) { d.readBufferSize = n }
+
+func TestTopicOverflowPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxDepth = 2
+	opts.OverflowTimeout = 50 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_overflow_policy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	setPolicy := func(policy string) {
+		topic.SetQueueOptions(QueueOptions{OverflowPolicy: &policy})
+	}
+	put := func() error {
+		return topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	}
+
+	// error
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	test.Nil(t, put())
+	test.Equal(t, ErrTopicFull, put())
+	test.Equal(t, ErrTopicFull, topic.PutMessages([]*Message{NewMessage(topic.GenerateID(), []byte("test"))}))
+	test.Equal(t, int64(2), topic.Depth())
+
+	// block, until there's room or --overflow-timeout
+	setPolicy("block")
+	start := time.Now()
+	test.Equal(t, ErrTopicFull, put())
+	test.Equal(t, true, time.Since(start) >= opts.OverflowTimeout)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-topic.memoryMsgChan
+	}()
+	test.Nil(t, put())
+	test.Equal(t, int64(2), topic.Depth())
+
+	// drop-oldest
+	setPolicy("drop-oldest")
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+	test.Equal(t, int64(2), topic.Depth())
+	<-topic.memoryMsgChan
+	test.Equal(t, msg.ID, (<-topic.memoryMsgChan).ID)
+
+	test.Equal(t, uint64(4), atomic.LoadUint64(&topic.overflowCount))
+
+	// a max_depth of 0 lifts the limit
+	maxDepth := int64(0)
+	topic.SetQueueOptions(QueueOptions{MaxDepth: &maxDepth})
+	for i := 0; i < 3; i++ {
+		test.Nil(t, put())
+	}
+}
+
+func TestTopicOverflowDropOldestChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxDepth = 2
+	opts.OverflowPolicy = "drop-oldest"
+	opts.RequeuePolicy = "requeue-first"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_overflow_drop_oldest_channel" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	channel := topic.GetChannel("ch")
+
+	// a requeued message has waited longer than the others
+	channel.requeueMsgChan <- NewMessage(topic.GenerateID(), []byte("requeued"))
+	high := NewMessage(topic.GenerateID(), []byte("high"))
+	high.Priority = PriorityHigh
+	channel.priority.msgChan <- high
+
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, 0, len(channel.requeueMsgChan))
+	test.Equal(t, int64(1), channel.priority.depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&topic.overflowCount))
+}
+
+func TestTopicOverflowDropOldestConcurrent(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 5
+	opts.MaxDepth = 10
+	opts.OverflowPolicy = "drop-oldest"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_overflow_drop_oldest_concurrent" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	// PutMessage read locks the topic, PutMessages write locks it
+	var wg sync.WaitGroup
+	var failed int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var err error
+				if i%2 == 0 {
+					err = topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+				} else {
+					err = topic.PutMessages([]*Message{
+						NewMessage(topic.GenerateID(), []byte("test")),
+						NewMessage(topic.GenerateID(), []byte("test")),
+					})
+				}
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	test.Equal(t, int64(0), atomic.LoadInt64(&failed))
+
+	// every message was either dropped or is still queued
+	for i := 0; topic.Depth()+int64(atomic.LoadUint64(&topic.overflowCount)) != 4*50+4*100; i++ {
+		test.Equal(t, true, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTopicQueueScheduling(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.QueueScheduling = schedulingFIFO
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_queue_scheduling" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	// messagePump doesn't read the queues until there's a channel
+	for _, ts := range []int64{2, 3, 6} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Timestamp = ts
+		topic.memoryMsgChan <- msg
+	}
+	for _, ts := range []int64{1, 4, 5} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Timestamp = ts
+		test.Nil(t, writeMessageToBackend(msg, topic.backend))
+	}
+
+	channel := topic.GetChannel("ch")
+	memoryMsgChan, _, _ := channel.deliveryChans()
+	for _, ts := range []int64{1, 2, 3, 4, 5, 6} {
+		msg := <-memoryMsgChan
+		test.Equal(t, ts, msg.Timestamp)
+	}
+}
@@ -0,0 +1,183 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// traceIDHeader is the message header a publisher sets to the ID of the
+// trace a message is part of, nsqd reports the SpanEvents of such messages
+// to the Tracer option and --trace-endpoint
+const traceIDHeader = "trace-id"
+
+// traceIDHTTPHeader sets traceIDHeader for messages published with /pub
+// and /mpub
+const traceIDHTTPHeader = "X-NSQ-Trace-ID"
+
+// span events
+const (
+	spanPublish     = "publish"
+	spanEnqueueDisk = "enqueue_disk"
+	spanDeliver     = "deliver"
+	spanFinish      = "finish"
+	spanRequeue     = "requeue"
+	spanTimeout     = "timeout"
+)
+
+// SpanEvent is something that happened to a message with a trace ID: it was
+// published to a topic, written to the disk queue of a topic or channel,
+// delivered by a channel to a client, or finished, requeued or timed out
+type SpanEvent struct {
+	TraceID   string `json:"trace_id"`
+	Event     string `json:"event"`
+	Topic     string `json:"topic"`
+	Channel   string `json:"channel,omitempty"`
+	MessageID string `json:"message_id"`
+	Attempts  uint16 `json:"attempts,omitempty"`
+	ClientID  int64  `json:"client_id,omitempty"`
+	Timestamp int64  `json:"timestamp"` // unix ns
+}
+
+// Tracer receives SpanEvents, Trace must not block
+type Tracer interface {
+	Trace(SpanEvent)
+}
+
+// newSpan returns the event for msg, or nil if msg has no trace ID or there
+// is no Tracer. It must be called while msg is still the caller's, and the
+// span emitted (with emitSpan) later.
+func (n *NSQD) newSpan(event string, msg *Message, topic, channel string) *SpanEvent {
+	if len(n.tracers) == 0 {
+		return nil
+	}
+	traceID, ok := msg.Headers[traceIDHeader]
+	if !ok {
+		return nil
+	}
+	return &SpanEvent{
+		TraceID:   traceID,
+		Event:     event,
+		Topic:     topic,
+		Channel:   channel,
+		MessageID: string(msg.ID[:]),
+		Attempts:  msg.Attempts,
+		ClientID:  msg.clientID,
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+func (n *NSQD) emitSpan(span *SpanEvent) {
+	if span == nil {
+		return
+	}
+	for _, t := range n.tracers {
+		t.Trace(*span)
+	}
+}
+
+// trace emits the span of event for msg
+func (n *NSQD) trace(event string, msg *Message, topic, channel string) {
+	n.emitSpan(n.newSpan(event, msg, topic, channel))
+}
+
+const (
+	traceBufferSize = 8192
+	traceBatchSize  = 500
+	traceFlushEvery = time.Second
+)
+
+// httpTracer batches SpanEvents to POST them to --trace-endpoint as JSON,
+// one per line, dropping those that don't fit in its buffer
+type httpTracer struct {
+	droppedCount uint64
+	spanChan     chan SpanEvent
+}
+
+func newHTTPTracer() *httpTracer {
+	return &httpTracer{spanChan: make(chan SpanEvent, traceBufferSize)}
+}
+
+func (t *httpTracer) Trace(span SpanEvent) {
+	select {
+	case t.spanChan <- span:
+	default:
+		atomic.AddUint64(&t.droppedCount, 1)
+	}
+}
+
+// traceLoop POSTs the spans of n.httpTracer to --trace-endpoint every
+// second, or once there are traceBatchSize of them
+func (n *NSQD) traceLoop() {
+	opts := n.getOpts()
+	client := &http.Client{
+		Transport: http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout),
+		Timeout:   opts.HTTPClientRequestTimeout,
+	}
+	ticker := time.NewTicker(traceFlushEvery)
+	var batch []SpanEvent
+	var dropped uint64
+
+	flush := func() {
+		if d := atomic.LoadUint64(&n.httpTracer.droppedCount); d != dropped {
+			n.logf(LOG_WARN, "TRACE: dropped %d span events (buffer full)", d-dropped)
+			dropped = d
+		}
+		if len(batch) == 0 {
+			return
+		}
+		err := postSpans(client, n.getOpts().TraceEndpoint, batch)
+		if err != nil {
+			n.logf(LOG_ERROR, "TRACE: failed to post %d span events - %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-n.httpTracer.spanChan:
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	for len(n.httpTracer.spanChan) > 0 {
+		batch = append(batch, <-n.httpTracer.spanChan)
+	}
+	flush()
+	n.logf(LOG_INFO, "TRACE: closing")
+	ticker.Stop()
+}
+
+func postSpans(client *http.Client, url string, spans []SpanEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, span := range spans {
+		if err := enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	resp, err := client.Post(url, "application/x-ndjson", &buf)
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got response %s %q", resp.Status, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type chanTracer chan SpanEvent
+
+func (t chanTracer) Trace(span SpanEvent) {
+	t <- span
+}
+
+func TestTracing(t *testing.T) {
+	spans := make(chanTracer, 100)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.Tracer = spans
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_tracing" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	// only messages with a trace ID are traced
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("untraced"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString("traced"))
+	req.Header.Set(traceIDHTTPHeader, "abc123")
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	span := <-spans
+	test.Equal(t, "abc123", span.TraceID)
+	test.Equal(t, spanPublish, span.Event)
+	test.Equal(t, topicName, span.Topic)
+	test.Equal(t, "", span.Channel)
+
+	untraced := <-channel.memoryMsgChan
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, []byte("traced"), msg.Body)
+	test.Equal(t, "abc123", msg.Headers[traceIDHeader])
+	test.Equal(t, string(msg.ID[:]), span.MessageID)
+
+	test.Nil(t, channel.StartInFlightTimeout(untraced, 1, opts.MsgTimeout))
+	test.Nil(t, channel.FinishMessage(1, untraced.ID))
+
+	msg.Attempts++
+	test.Nil(t, channel.StartInFlightTimeout(msg, 1, opts.MsgTimeout))
+	test.Nil(t, channel.RequeueMessage(1, msg.ID, 0, RequeueReasonOther))
+	msg = <-channel.memoryMsgChan
+	msg.Attempts++
+	test.Nil(t, channel.StartInFlightTimeout(msg, 2, opts.MsgTimeout))
+	test.Nil(t, channel.FinishMessage(2, msg.ID))
+
+	for _, expected := range []SpanEvent{
+		{Event: spanDeliver, Attempts: 1, ClientID: 1},
+		{Event: spanRequeue, Attempts: 1, ClientID: 1},
+		{Event: spanDeliver, Attempts: 2, ClientID: 2},
+		{Event: spanFinish, Attempts: 2, ClientID: 2},
+	} {
+		span := <-spans
+		test.Equal(t, expected.Event, span.Event)
+		test.Equal(t, "abc123", span.TraceID)
+		test.Equal(t, topicName, span.Topic)
+		test.Equal(t, "ch", span.Channel)
+		test.Equal(t, expected.Attempts, span.Attempts)
+		test.Equal(t, expected.ClientID, span.ClientID)
+	}
+	select {
+	case span := <-spans:
+		t.Fatalf("unexpected span %+v", span)
+	default:
+	}
+}
+
+func TestTraceEndpoint(t *testing.T) {
+	spans := make(chan SpanEvent, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			var span SpanEvent
+			if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			spans <- span
+		}
+	}))
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TraceEndpoint = srv.URL
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_trace_endpoint" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Headers = map[string]string{traceIDHeader: "abc123"}
+	test.Nil(t, topic.PutMessage(msg))
+
+	// the topic's messagePump moves it to the channel's disk queue, perhaps
+	// before the publish is reported
+	events := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		span := <-spans
+		test.Equal(t, "abc123", span.TraceID)
+		test.Equal(t, topicName, span.Topic)
+		events[span.Event+"/"+span.Channel] = true
+	}
+	test.Equal(t, map[string]bool{
+		spanPublish + "/":       true,
+		spanEnqueueDisk + "/":   true,
+		spanEnqueueDisk + "/ch": true,
+	}, events)
+}
+
+func TestTraceIDMaxMsgSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.MaxMsgSize = 100
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_trace_id_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	pub := func(traceID string) int {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&header=a:b", httpAddr, topicName)
+		body := bytes.Repeat([]byte("x"), int(opts.MaxMsgSize))
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		req.Header.Set(traceIDHTTPHeader, traceID)
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the trace ID counts toward the headers, which the backends have room
+	// for on top of a --max-msg-size body
+	room := maxPublishedHeadersSize - headersSize(map[string]string{"a": "b", traceIDHeader: ""})
+	test.Equal(t, 400, pub(strings.Repeat("t", room+1)))
+	test.Equal(t, 200, pub(strings.Repeat("t", room)))
+	test.Equal(t, "OK", nsqd.GetHealth())
+
+	msg, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, room, len(msg.Headers[traceIDHeader]))
+	test.Equal(t, int(opts.MaxMsgSize), len(msg.Body))
+}
@@ -0,0 +1,68 @@
+package nsqd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const unixSocketScheme = "unix://"
+
+// unixSocketPath returns the path of addr if it's a unix socket address,
+// i.e. unix:///path/to.sock
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixSocketScheme), true
+}
+
+// listen listens on addr, a TCP address (of network) or a unix socket
+// address. The unix socket is created with perm, and removed when the
+// listener is closed.
+func listen(network, addr string, backlog int, perm os.FileMode) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return listenTCP(network, addr, backlog)
+	}
+
+	// replace a socket left behind by a process that didn't exit cleanly,
+	// but not one that's still in use
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, perm)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// tcpAddr returns the (first TCP) address l listens on, or an empty one if it
+// only listens on unix sockets
+func tcpAddr(l net.Listener) *net.TCPAddr {
+	if ml, ok := l.(*multiListener); ok {
+		for _, l := range ml.listeners {
+			if addr, ok := l.Addr().(*net.TCPAddr); ok {
+				return addr
+			}
+		}
+		return &net.TCPAddr{}
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,349 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/websocket"
+)
+
+// jsonMessage is a message as sent to websocket and HTTP (GET /message)
+// consumers
+type jsonMessage struct {
+	ID        string            `json:"id"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body"`
+}
+
+func newJSONMessage(msg *Message) jsonMessage {
+	return jsonMessage{
+		ID:        string(msg.ID[:]),
+		Timestamp: msg.Timestamp,
+		Attempts:  msg.Attempts,
+		Headers:   msg.Headers,
+		Body:      string(msg.Body),
+	}
+}
+
+// wsCommand is a command from a websocket client: the equivalent of RDY,
+// FIN, REQ (with a delay in ms) or TOUCH
+type wsCommand struct {
+	RDY   *int64  `json:"rdy"`
+	FIN   *string `json:"fin"`
+	REQ   *string `json:"req"`
+	Delay int64   `json:"delay"`
+	TOUCH *string `json:"touch"`
+}
+
+// wsClient is a Consumer subscribed over a websocket (see doWebSocket)
+type wsClient struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	ReadyCount    int64
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+	ackStats
+
+	ID          int64
+	conn        *websocket.Conn
+	channel     *Channel
+	connectTime time.Time
+
+	// set while wsMessagePump runs
+	pumpRunning int32
+
+	readyStateChan chan int
+	exitChan       chan int
+	closer         sync.Once
+}
+
+func (c *wsClient) tryUpdateReadyState() {
+	select {
+	case c.readyStateChan <- 1:
+	default:
+	}
+}
+
+func (c *wsClient) Pause()   { c.tryUpdateReadyState() }
+func (c *wsClient) UnPause() { c.tryUpdateReadyState() }
+
+func (c *wsClient) Close() error {
+	c.closer.Do(func() { close(c.exitChan) })
+	return c.conn.Close()
+}
+
+func (c *wsClient) TimedOutMessage() {
+	c.timedOut()
+	atomic.AddInt64(&c.InFlightCount, -1)
+	c.tryUpdateReadyState()
+}
+
+// TimeoutWarning is a no-op, there's no equivalent of IDENTIFY's
+// msg_timeout_warning for websocket clients
+func (c *wsClient) TimeoutWarning(MessageID) {}
+
+func (c *wsClient) IsForwarder() bool { return false }
+
+func (c *wsClient) IsReadyForMessages() bool {
+	if c.channel.IsPaused() || c.isEvicted() {
+		return false
+	}
+	readyCount := atomic.LoadInt64(&c.ReadyCount)
+	return readyCount > 0 && atomic.LoadInt64(&c.InFlightCount) < readyCount
+}
+
+func (c *wsClient) Empty() {
+	atomic.StoreInt64(&c.InFlightCount, 0)
+	c.tryUpdateReadyState()
+}
+
+func (c *wsClient) IsSlow() bool {
+	return c.isSlow(c.channel.nsqd.getOpts())
+}
+
+func (c *wsClient) Stats() ClientStats {
+	stats := ClientStats{
+		Version:       "WS",
+		RemoteAddress: c.conn.RemoteAddr().String(),
+		State:         stateSubscribed,
+		ReadyCount:    atomic.LoadInt64(&c.ReadyCount),
+		InFlightCount: atomic.LoadInt64(&c.InFlightCount),
+		MessageCount:  atomic.LoadUint64(&c.MessageCount),
+		FinishCount:   atomic.LoadUint64(&c.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&c.RequeueCount),
+		ConnectTime:   c.connectTime.Unix(),
+	}
+	c.fillStats(&stats, c.channel.nsqd.getOpts())
+	return stats
+}
+
+// doWebSocket subscribes a websocket client to the channel query param of
+// topic (by default an ephemeral channel of its own). Like a TCP client it
+// gets up to rdy messages in flight, which it must fin or req.
+func (s *httpServer) doWebSocket(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	query := req.URL.Query()
+	topicName := query.Get("topic")
+	if !protocol.IsValidTopicName(topicName) {
+		http.Error(w, "INVALID_TOPIC", http.StatusBadRequest)
+		return
+	}
+	clientID := atomic.AddInt64(&s.nsqd.clientIDSequence, 1)
+	channelName := query.Get("channel")
+	if channelName == "" {
+		channelName = fmt.Sprintf("ws-%d#ephemeral", clientID)
+	}
+	if !protocol.IsValidChannelName(channelName) {
+		http.Error(w, "INVALID_CHANNEL", http.StatusBadRequest)
+		return
+	}
+	if s.nsqd.IsDraining() {
+		http.Error(w, "DRAINING", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.admitTopic(req, topicName); err != nil {
+		httpErr := err.(http_api.Err)
+		http.Error(w, httpErr.Text, httpErr.Code)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to upgrade websocket request - %s", err)
+		return
+	}
+	conn.MaxMessageSize = 1024
+
+	client := &wsClient{
+		ID:             clientID,
+		conn:           conn,
+		connectTime:    time.Now(),
+		readyStateChan: make(chan int, 1),
+		exitChan:       make(chan int),
+	}
+	// the same work-around as SUB's for the last client leaving an
+	// ephemeral channel between GetChannel and AddClient
+	for {
+		topic := s.nsqd.GetTopic(topicName)
+		client.channel = topic.GetChannel(channelName)
+		if err := client.channel.AddClient(client.ID, client); err != nil {
+			s.wsError(client, "E_TOO_MANY_CHANNEL_CONSUMERS")
+			conn.Close()
+			return
+		}
+		if (client.channel.ephemeral && client.channel.Exiting()) || (topic.ephemeral && topic.Exiting()) {
+			client.channel.RemoveClient(client.ID)
+			time.Sleep(1 * time.Millisecond)
+			continue
+		}
+		break
+	}
+	s.nsqd.logf(LOG_INFO, "WEBSOCKET: client(%s) subscribed to %s:%s", conn.RemoteAddr(), topicName, channelName)
+
+	go s.wsMessagePump(client)
+	s.wsReadLoop(client)
+
+	client.Close()
+	client.channel.RemoveClient(client.ID)
+	client.channel.requeueInFlight(client.ID)
+}
+
+func (s *httpServer) wsError(client *wsClient, code string) {
+	data, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{code})
+	client.conn.WriteMessage(websocket.OpText, data)
+}
+
+// wsReadLoop handles the client's commands until it disconnects or sends an
+// invalid one
+func (s *httpServer) wsReadLoop(client *wsClient) {
+	for {
+		_, data, err := client.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd wsCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			s.wsError(client, "E_INVALID")
+			return
+		}
+		if err := s.wsExec(client, cmd); err != nil {
+			s.wsError(client, err.Error())
+			if _, ok := err.(*protocol.FatalClientErr); ok {
+				return
+			}
+		}
+	}
+}
+
+func (s *httpServer) wsExec(client *wsClient, cmd wsCommand) error {
+	opts := s.nsqd.getOpts()
+	switch {
+	case cmd.RDY != nil:
+		if *cmd.RDY < 0 || *cmd.RDY > opts.MaxRdyCount {
+			return protocol.NewFatalClientErr(nil, "E_INVALID", "invalid rdy")
+		}
+		atomic.StoreInt64(&client.ReadyCount, *cmd.RDY)
+		client.tryUpdateReadyState()
+	case cmd.FIN != nil:
+		id, err := getMessageID([]byte(*cmd.FIN))
+		if err != nil {
+			return protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+		}
+		if err := client.channel.FinishMessage(client.ID, *id); err != nil {
+			return protocol.NewClientErr(nil, "E_FIN_FAILED", err.Error())
+		}
+		atomic.AddUint64(&client.FinishCount, 1)
+		atomic.AddInt64(&client.InFlightCount, -1)
+		client.tryUpdateReadyState()
+	case cmd.REQ != nil:
+		id, err := getMessageID([]byte(*cmd.REQ))
+		if err != nil {
+			return protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+		}
+		delay := time.Duration(cmd.Delay) * time.Millisecond
+		if delay < 0 || delay > opts.MaxReqTimeout {
+			return protocol.NewFatalClientErr(nil, "E_INVALID", "invalid delay")
+		}
+		if err := client.channel.RequeueMessage(client.ID, *id, delay, RequeueReasonOther); err != nil {
+			return protocol.NewClientErr(nil, "E_REQ_FAILED", err.Error())
+		}
+		atomic.AddUint64(&client.RequeueCount, 1)
+		atomic.AddInt64(&client.InFlightCount, -1)
+		client.tryUpdateReadyState()
+	case cmd.TOUCH != nil:
+		id, err := getMessageID([]byte(*cmd.TOUCH))
+		if err != nil {
+			return protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+		}
+		if err := client.channel.TouchMessage(client.ID, *id, client.channel.msgTimeout(opts.MsgTimeout)); err != nil {
+			return protocol.NewClientErr(nil, "E_TOUCH_FAILED", err.Error())
+		}
+	default:
+		return protocol.NewFatalClientErr(nil, "E_INVALID", "invalid command")
+	}
+	return nil
+}
+
+// wsMessagePump sends the client messages from its channel, up to its rdy
+// count in flight at a time
+func (s *httpServer) wsMessagePump(client *wsClient) {
+	channel := client.channel
+	atomic.AddInt64(&channel.goroutines, 1)
+	defer atomic.AddInt64(&channel.goroutines, -1)
+	atomic.StoreInt32(&client.pumpRunning, 1)
+	defer atomic.StoreInt32(&client.pumpRunning, 0)
+
+	for {
+		var memoryMsgChan chan *Message
+		var backendMsgChan <-chan []byte
+		var requeueMsgChan chan *Message
+		var priorityMsgChan chan *Message
+		var rateLimitChan <-chan time.Time
+		if client.IsReadyForMessages() {
+			if d := channel.deliveryLimit.wait(); d > 0 {
+				rateLimitChan = time.After(d)
+			} else {
+				memoryMsgChan, backendMsgChan, requeueMsgChan = channel.deliveryChans()
+				priorityMsgChan = channel.priorityDeliveryChan()
+			}
+		}
+
+		var msg *Message
+		// high priority messages go first, unless it's the others' turn
+		select {
+		case msg = <-priorityMsgChan:
+		default:
+		}
+		if msg == nil {
+			select {
+			case <-client.readyStateChan:
+			case <-rateLimitChan:
+			case msg = <-memoryMsgChan:
+			case msg = <-requeueMsgChan:
+			case msg = <-priorityMsgChan:
+			case b := <-backendMsgChan:
+				var err error
+				msg, err = decodeBackendMessage(channel.backend, b, s.nsqd.getOpts().MessagePool)
+				if err != nil {
+					s.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				}
+			case <-client.exitChan:
+				return
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		channel.priority.took(msg)
+		if channel.expired(msg) {
+			channel.expireMessage(msg)
+			continue
+		}
+
+		channel.deliveryLimit.take(1)
+		msg.Attempts++
+		data, _ := json.Marshal(newJSONMessage(msg))
+		// msg must not be touched once it is in flight
+		channel.StartInFlightTimeout(msg, client.ID, channel.msgTimeout(s.nsqd.getOpts().MsgTimeout))
+		atomic.AddInt64(&client.InFlightCount, 1)
+		atomic.AddUint64(&client.MessageCount, 1)
+		atomic.AddUint64(&channel.localDeliveryCount, 1)
+
+		err := client.conn.WriteMessage(websocket.OpText, data)
+		if err != nil {
+			client.Close()
+			return
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"github.com/julienschmidt/httprouter"
@@ -121,10 +124,37 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 	producers := s.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	producers = producers.FilterByActive(s.nsqlookupd.opts.InactiveProducerTimeout,
 		s.nsqlookupd.opts.TombstoneLifetime)
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"channels":  channels,
 		"producers": producers.PeerInfo(),
-	}, nil
+	}
+	partitions := partitionTopics(s.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys(), topicName)
+	if len(partitions) > 0 {
+		data["partitions"] = partitions
+	}
+	return data, nil
+}
+
+// partitionTopics returns the partitions of topic in topics, those named
+// <topic>.<n> (see nsqd's /topic/create?partitions=), in order
+func partitionTopics(topics []string, topic string) []string {
+	var partitions []int
+	for _, t := range topics {
+		if !strings.HasPrefix(t, topic+".") {
+			continue
+		}
+		n, err := strconv.Atoi(t[len(topic)+1:])
+		if err != nil || n < 0 || strconv.Itoa(n) != t[len(topic)+1:] {
+			continue
+		}
+		partitions = append(partitions, n)
+	}
+	sort.Ints(partitions)
+	names := make([]string, 0, len(partitions))
+	for _, n := range partitions {
+		names = append(names, fmt.Sprintf("%s.%d", topic, n))
+	}
+	return names
 }
 
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -256,6 +286,8 @@ type node struct {
 	TCPPort          int      `json:"tcp_port"`
 	HTTPPort         int      `json:"http_port"`
 	Version          string   `json:"version"`
+	TCPAddresses     []string `json:"tcp_addresses,omitempty"`
+	HTTPAddresses    []string `json:"http_addresses,omitempty"`
 	Tombstones       []bool   `json:"tombstones"`
 	Topics           []string `json:"topics"`
 }
@@ -293,6 +325,8 @@ func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httpro
 			TCPPort:          p.peerInfo.TCPPort,
 			HTTPPort:         p.peerInfo.HTTPPort,
 			Version:          p.peerInfo.Version,
+			TCPAddresses:     p.peerInfo.TCPAddresses,
+			HTTPAddresses:    p.peerInfo.HTTPAddresses,
 			Tombstones:       tombstones,
 			Topics:           topics,
 		}
@@ -224,6 +224,13 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
 	}
 
+	// message IDs are only unique if every nsqd has its own --node-id
+	if dup := p.findNodeID(&peerInfo); dup != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_DUPLICATE_NODE_ID",
+			fmt.Sprintf("IDENTIFY node_id %d is already used by %s:%d",
+				*peerInfo.NodeID, dup.BroadcastAddress, dup.TCPPort))
+	}
+
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
 
 	p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
@@ -254,6 +261,27 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	return response, nil
 }
 
+// findNodeID returns the active producer, other than one at the same
+// address (i.e. the same nsqd reconnecting), with peerInfo's node ID
+func (p *LookupProtocolV1) findNodeID(peerInfo *PeerInfo) *PeerInfo {
+	if peerInfo.NodeID == nil {
+		return nil
+	}
+	producers := p.nsqlookupd.DB.FindProducers("client", "", "").FilterByActive(
+		p.nsqlookupd.opts.InactiveProducerTimeout, 0)
+	for _, producer := range producers {
+		pi := producer.peerInfo
+		if pi.NodeID == nil || *pi.NodeID != *peerInfo.NodeID {
+			continue
+		}
+		if pi.BroadcastAddress == peerInfo.BroadcastAddress && pi.TCPPort == peerInfo.TCPPort {
+			continue
+		}
+		return pi
+	}
+	return nil
+}
+
 func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, error) {
 	if client.peerInfo != nil {
 		// we could get a PING before other commands on the same client connection
@@ -3,6 +3,7 @@ package nsqlookupd
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,8 +31,9 @@ type TopicsDoc struct {
 }
 
 type LookupDoc struct {
-	Channels  []interface{} `json:"channels"`
-	Producers []*PeerInfo   `json:"producers"`
+	Channels   []interface{} `json:"channels"`
+	Producers  []*PeerInfo   `json:"producers"`
+	Partitions []string      `json:"partitions"`
 }
 
 func mustStartLookupd(opts *Options) (*net.TCPAddr, *net.TCPAddr, *NSQLookupd) {
@@ -357,3 +359,67 @@ func TestTombstonedNodes(t *testing.T) {
 	test.Equal(t, topicName, producers[0].Topics[0].Topic)
 	test.Equal(t, true, producers[0].Topics[0].Tombstoned)
 }
+
+func TestDuplicateNodeID(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	identifyNode := func(conn net.Conn, tcpPort int, nodeID int64) string {
+		ci := make(map[string]interface{})
+		ci["tcp_port"] = tcpPort
+		ci["http_port"] = HTTPPort
+		ci["broadcast_address"] = HostAddr
+		ci["hostname"] = HostAddr
+		ci["version"] = NSQDVersion
+		ci["node_id"] = nodeID
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		return string(resp)
+	}
+
+	conn1 := mustConnectLookupd(t, tcpAddr)
+	defer conn1.Close()
+	test.Equal(t, false, strings.HasPrefix(identifyNode(conn1, TCPPort, 7), "E_"))
+
+	// another nsqd with the same node ID is rejected
+	conn2 := mustConnectLookupd(t, tcpAddr)
+	defer conn2.Close()
+	resp := identifyNode(conn2, TCPPort+1, 7)
+	test.Equal(t, true, strings.HasPrefix(resp, "E_DUPLICATE_NODE_ID"))
+
+	// the same nsqd reconnecting isn't, nor another with a different node ID
+	conn3 := mustConnectLookupd(t, tcpAddr)
+	defer conn3.Close()
+	test.Equal(t, false, strings.HasPrefix(identifyNode(conn3, TCPPort, 7), "E_"))
+	conn4 := mustConnectLookupd(t, tcpAddr)
+	defer conn4.Close()
+	test.Equal(t, false, strings.HasPrefix(identifyNode(conn4, TCPPort+1, 8), "E_"))
+}
+
+func TestLookupPartitions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	for _, topic := range []string{"orders", "orders.1", "orders.10", "orders.0", "orders.x", "orders.01", "orders_v2.0"} {
+		nsqlookupd.DB.AddRegistration(Registration{"topic", topic, ""})
+	}
+
+	lr := LookupDoc{}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=orders", httpAddr)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, []string{"orders.0", "orders.1", "orders.10"}, lr.Partitions)
+
+	lr = LookupDoc{}
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=orders.1", httpAddr)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(lr.Partitions))
+}
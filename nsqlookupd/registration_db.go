@@ -28,6 +28,11 @@ type PeerInfo struct {
 	TCPPort          int    `json:"tcp_port"`
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+	// the nsqd's --node-id, nil for nsqds that don't send it
+	NodeID *int64 `json:"node_id,omitempty"`
+	// every address the nsqd listens on (see --tcp-address/--http-address)
+	TCPAddresses  []string `json:"tcp_addresses,omitempty"`
+	HTTPAddresses []string `json:"http_addresses,omitempty"`
 }
 
 type Producer struct {